@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strconv"
@@ -839,7 +840,43 @@ func (s *SelectStatement) HasWildcard() bool {
 	return false
 }
 
-// GroupByIterval extracts the time interval, if specified.
+// IsSinglePointQuery returns whether or not the select statement is a raw query
+// that returns only the first point (LIMIT 1) or, when ordered by time
+// descending, only the last point.
+func (s *SelectStatement) IsSinglePointQuery() bool {
+	return s.IsRawQuery && s.Limit == 1 && s.Offset == 0
+}
+
+// IsLatestPointQuery returns whether or not the select statement is a single
+// point query ordered by time descending, e.g. SELECT value FROM cpu ORDER BY DESC LIMIT 1
+func (s *SelectStatement) IsLatestPointQuery() bool {
+	return s.IsSinglePointQuery() && s.IsTimeDescending()
+}
+
+// MapperLimit returns the number of points each mapper of a raw query has to read, or 0 to read every point.
+// The outputs of several mappers are merged before the offset and limit are applied, so each mapper reads the
+// limit plus the offset. Mappers read points in ascending time order, so queries ordered by time descending,
+// which need the latest points, read every point and leave the offset and limit to the reducer.
+func (s *SelectStatement) MapperLimit() int {
+	if s.IsTimeDescending() || s.Limit == 0 {
+		return 0
+	}
+	return s.Limit + s.Offset
+}
+
+// IsTimeDescending returns whether or not the select statement orders points
+// by time descending, e.g. SELECT value FROM cpu ORDER BY DESC
+func (s *SelectStatement) IsTimeDescending() bool {
+	if len(s.SortFields) == 0 {
+		return false
+	}
+	// a sort field without a name orders by time
+	f := s.SortFields[0]
+	return f.Name == "" && !f.Ascending
+}
+
+// GroupByIterval extracts the time interval, if specified. For sliding windows, such as GROUP BY time(5m, 1m),
+// the interval is the step between windows.
 func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 	// return if we've already pulled it out
 	if s.groupByInterval != 0 {
@@ -853,23 +890,59 @@ func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 
 	for _, d := range s.Dimensions {
 		if call, ok := d.Expr.(*Call); ok && call.Name == "time" {
-			// Make sure there is exactly one argument.
-			if len(call.Args) != 1 {
-				return 0, errors.New("time dimension expected one argument")
+			_, step, err := timeDimensionArgs(call)
+			if err != nil {
+				return 0, err
 			}
+			s.groupByInterval = step
+			return step, nil
+		}
+	}
+	return 0, nil
+}
 
-			// Ensure the argument is a duration.
-			lit, ok := call.Args[0].(*DurationLiteral)
-			if !ok {
-				return 0, errors.New("time dimension must have one duration argument")
+// GroupByWindow extracts the window size of sliding windows, such as 5m in GROUP BY time(5m, 1m), where each
+// point contributes to every window that covers it. Returns 0 if the windows don't overlap.
+func (s *SelectStatement) GroupByWindow() (time.Duration, error) {
+	for _, d := range s.Dimensions {
+		if call, ok := d.Expr.(*Call); ok && call.Name == "time" {
+			window, step, err := timeDimensionArgs(call)
+			if err != nil || window == step {
+				return 0, err
 			}
-			s.groupByInterval = lit.Val
-			return lit.Val, nil
+			return window, nil
 		}
 	}
 	return 0, nil
 }
 
+// timeDimensionArgs returns the arguments of a time() dimension: the window size and, for sliding windows
+// such as time(5m, 1m), the step between windows. Without a step, windows don't overlap and the step is the
+// window size. The window size must be a multiple of the step.
+func timeDimensionArgs(call *Call) (window, step time.Duration, err error) {
+	if len(call.Args) != 1 && len(call.Args) != 2 {
+		return 0, 0, errors.New("time dimension expected one or two arguments")
+	}
+	for i, arg := range call.Args {
+		lit, ok := arg.(*DurationLiteral)
+		if !ok {
+			return 0, 0, errors.New("time dimension must have duration arguments")
+		}
+		if i == 0 {
+			window = lit.Val
+		} else {
+			step = lit.Val
+		}
+	}
+
+	if len(call.Args) == 1 {
+		return window, window, nil
+	} else if step <= 0 || step > window || window%step != 0 {
+		return 0, 0, errors.New("time dimension window must be a multiple of its step")
+	}
+	return window, step, nil
+}
+
 // SetTimeRange sets the start and end time of the select statement to [start, end). i.e. start inclusive, end exclusive.
 // This is used commonly for continuous queries so the start and end are in buckets.
 func (s *SelectStatement) SetTimeRange(start, end time.Time) error {
@@ -1003,12 +1076,15 @@ func walkNames(exp Expr) []string {
 		if len(expr.Args) == 0 {
 			return nil
 		}
-		lit, ok := expr.Args[0].(*VarRef)
-		if !ok {
-			return nil
-		}
 
-		return []string{lit.Val}
+		switch arg := expr.Args[0].(type) {
+		case *VarRef:
+			return []string{arg.Val}
+		case *Call:
+			// an aggregate of an aggregate such as max(mean(value))
+			return walkNames(arg)
+		}
+		return nil
 	case *BinaryExpr:
 		var ret []string
 		ret = append(ret, walkNames(expr.LHS)...)
@@ -1668,7 +1744,7 @@ func (a Dimensions) String() string {
 	return strings.Join(str, ", ")
 }
 
-// Normalize returns the interval and tag dimensions separately.
+// Normalize returns the interval and tag dimensions separately. For sliding windows the interval is the step.
 // Returns 0 if no time interval is specified.
 // Returns an error if multiple time dimensions exist or if non-VarRef dimensions are specified.
 func (a Dimensions) Normalize() (time.Duration, []string, error) {
@@ -1678,18 +1754,16 @@ func (a Dimensions) Normalize() (time.Duration, []string, error) {
 	for _, dim := range a {
 		switch expr := dim.Expr.(type) {
 		case *Call:
-			// Ensure the call is time() and it only has one duration argument.
+			// Ensure the call is time() with a duration and an optional step.
 			// If we already have a duration
 			if expr.Name != "time" {
 				return 0, nil, errors.New("only time() calls allowed in dimensions")
-			} else if len(expr.Args) != 1 {
-				return 0, nil, errors.New("time dimension expected one argument")
-			} else if lit, ok := expr.Args[0].(*DurationLiteral); !ok {
-				return 0, nil, errors.New("time dimension must have one duration argument")
+			} else if _, step, err := timeDimensionArgs(expr); err != nil {
+				return 0, nil, err
 			} else if dur != 0 {
 				return 0, nil, errors.New("multiple time dimensions not allowed")
 			} else {
-				dur = lit.Val
+				dur = step
 			}
 
 		case *VarRef:
@@ -2246,6 +2320,11 @@ func evalBinaryExpr(expr *BinaryExpr, m map[string]interface{}) interface{} {
 				return float64(0)
 			}
 			return lhs / rhs
+		case MOD:
+			if rhs == 0 {
+				return float64(0)
+			}
+			return math.Mod(lhs, rhs)
 		}
 	case string:
 		rhs, _ := rhs.(string)
@@ -2424,6 +2503,11 @@ func reduceBinaryExprNumberLHS(op Token, lhs *NumberLiteral, rhs Expr) Expr {
 				return &NumberLiteral{Val: 0}
 			}
 			return &NumberLiteral{Val: lhs.Val / rhs.Val}
+		case MOD:
+			if rhs.Val == 0 {
+				return &NumberLiteral{Val: 0}
+			}
+			return &NumberLiteral{Val: math.Mod(lhs.Val, rhs.Val)}
 		case EQ:
 			return &BooleanLiteral{Val: lhs.Val == rhs.Val}
 		case NEQ:
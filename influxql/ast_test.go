@@ -584,6 +584,7 @@ func TestEval(t *testing.T) {
 		// Number literals.
 		{in: `1 + 2`, out: float64(3)},
 		{in: `(foo*2) + ( (4/2) + (3 * 5) - 0.5 )`, out: float64(26.5), data: map[string]interface{}{"foo": float64(5)}},
+		{in: `foo % 3`, out: float64(2), data: map[string]interface{}{"foo": float64(8)}},
 		{in: `foo / 2`, out: float64(2), data: map[string]interface{}{"foo": float64(4)}},
 		{in: `4 = 4`, out: true},
 		{in: `4 <> 4`, out: false},
@@ -630,6 +631,7 @@ func TestReduce(t *testing.T) {
 		// Number literals.
 		{in: `1 + 2`, out: `3.000`},
 		{in: `(foo*2) + ( (4/2) + (3 * 5) - 0.5 )`, out: `(foo * 2.000) + 16.500`},
+		{in: `7 % 4 + foo % 2`, out: `3.000 + foo % 2.000`},
 		{in: `foo(bar(2 + 3), 4)`, out: `foo(bar(5.000), 4.000)`},
 		{in: `4 / 0`, out: `0.000`},
 		{in: `4 = 4`, out: `true`},
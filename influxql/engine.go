@@ -41,6 +41,7 @@ type MapReduceJob struct {
 	TMax            int64            // maximum time specified in the query
 	key             []byte           // a key that identifies the MRJob so it can be sorted
 	interval        int64            // the group by interval of the query
+	windowSteps     int              // the number of intervals each sliding window covers, if more than one
 	stmt            *SelectStatement // the select statement this job was created for
 	chunkSize       int              // the number of points to buffer in raw queries before returning a chunked response
 }
@@ -84,9 +85,21 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 
 	// get the aggregates and the associated reduce functions
 	aggregates := m.stmt.FunctionCalls()
+	secondary, err := m.secondaryAggregates(aggregates)
+	if err != nil {
+		out <- &Row{Err: err}
+		return
+	}
 	reduceFuncs := make([]ReduceFunc, len(aggregates))
 	for i, c := range aggregates {
-		reduceFunc, err := InitializeReduceFunc(c)
+		var reduceFunc ReduceFunc
+		var err error
+		if secondary {
+			// aggregates of aggregates reduce the results of their inner aggregate, so they aren't mapped
+			reduceFunc, err = InitializeReduceFunc(c)
+		} else {
+			_, reduceFunc, _, err = MapReduceFuncs(c)
+		}
 		if err != nil {
 			out <- &Row{Err: err}
 			return
@@ -106,6 +119,14 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 		intervalTop := m.TMax/m.interval*m.interval + m.interval
 		intervalBottom := m.TMin / m.interval * m.interval
 		pointCountInResult = int((intervalTop - intervalBottom) / m.interval)
+
+		// sliding windows combine the outputs of several consecutive intervals
+		if w, err := m.stmt.GroupByWindow(); err != nil {
+			out <- &Row{Err: err}
+			return
+		} else if w > 0 {
+			m.windowSteps = int(w.Nanoseconds() / m.interval)
+		}
 	}
 
 	// For group by time queries, limit the number of data points returned by the limit and offset
@@ -162,9 +183,15 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 		m.TMin = resultValues[0][0].(time.Time).UnixNano()
 	}
 
-	// now loop through the aggregate functions and populate everything
+	// now loop through the aggregate functions and populate everything. Identical aggregates that
+	// appear more than once in the query are only mapped and reduced once.
+	cache := newReduceCache()
 	for i, c := range aggregates {
-		if err := m.processAggregate(c, reduceFuncs[i], resultValues); err != nil {
+		process := m.processAggregate
+		if secondary {
+			process = m.processSecondaryAggregate
+		}
+		if err := process(c, reduceFuncs[i], resultValues, cache); err != nil {
 			out <- &Row{
 				Name: m.MeasurementName,
 				Tags: m.TagSet.Tags,
@@ -175,6 +202,11 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 		}
 	}
 
+	// aggregates of aggregates reduce the results of every interval to a single point
+	if secondary && len(resultValues) > 0 {
+		resultValues = resultValues[:1]
+	}
+
 	// filter out empty results
 	if filterEmptyResults && m.resultsEmpty(resultValues) {
 		return
@@ -193,6 +225,9 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 	// handle any fill options
 	resultValues = m.processFill(resultValues)
 
+	// report the result of an empty interval, such as a count of 0, for intervals fill() left empty
+	m.processEmptyResults(resultValues)
+
 	row := &Row{
 		Name:    m.MeasurementName,
 		Tags:    m.TagSet.Tags,
@@ -215,6 +250,18 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 		}
 	}
 
+	// a query for only the latest point needs to see the last point from every mapper
+	if m.stmt.IsLatestPointQuery() {
+		m.processLatestPoint(out, filterEmptyResults)
+		return
+	}
+
+	// points ordered by time descending can only be sent once every mapper has been read
+	if m.stmt.IsTimeDescending() {
+		m.processRawQueryDesc(out, filterEmptyResults)
+		return
+	}
+
 	mapperOutputs := make([][]*rawQueryMapOutput, len(m.Mappers))
 	// markers for which mappers have been completely emptied
 	mapperComplete := make([]bool, len(m.Mappers))
@@ -291,7 +338,7 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 		}
 
 		// sort the values by time first so we can then handle offset and limit
-		sort.Sort(rawOutputs(values))
+		sortRawOutputs(values, false)
 
 		// get rid of any points that need to be offset
 		if valuesOffset < m.stmt.Offset {
@@ -346,6 +393,94 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 	}
 }
 
+// processRawQueryDesc sends out the points of every mapper ordered by time descending. Mappers read points
+// forward in time, so all of them are buffered before the reducer applies the offset and limit.
+func (m *MapReduceJob) processRawQueryDesc(out chan *Row, filterEmptyResults bool) {
+	var outputs []interface{}
+	for _, mm := range m.Mappers {
+		for {
+			res, err := mm.NextInterval()
+			if err != nil {
+				out <- &Row{Err: err}
+				return
+			}
+			// an empty output means the mapper has no more data in the time range
+			values, _ := res.([]*rawQueryMapOutput)
+			if len(values) == 0 {
+				break
+			}
+			outputs = append(outputs, values)
+		}
+	}
+
+	reduceFunc, err := InitializeRawReduceFunc(m.stmt)
+	if err != nil {
+		out <- &Row{Err: err}
+		return
+	}
+	v := reduceFunc(outputs)
+	if err, ok := v.(error); ok {
+		out <- &Row{Err: err}
+		return
+	}
+	values, _ := v.([]*rawQueryMapOutput)
+	if len(values) == 0 {
+		if !filterEmptyResults {
+			out <- m.processRawResults(nil)
+		}
+		return
+	}
+
+	// send out the values in chunks
+	for len(values) > 0 {
+		n := len(values)
+		if m.chunkSize > 0 && n > m.chunkSize {
+			n = m.chunkSize
+		}
+		row := m.processRawResults(values[:n])
+		// perform post-processing, such as math.
+		row.Values = m.processResults(row.Values)
+		out <- row
+		values = values[n:]
+	}
+}
+
+// processLatestPoint sends out the single latest point across all mappers. Each mapper
+// only outputs the latest point it has read so nothing else is buffered.
+func (m *MapReduceJob) processLatestPoint(out chan *Row, filterEmptyResults bool) {
+	var latest *rawQueryMapOutput
+	for _, mm := range m.Mappers {
+		for {
+			res, err := mm.NextInterval()
+			if err != nil {
+				out <- &Row{Err: err}
+				return
+			}
+			// an empty output means the mapper has no more data in the time range
+			values, _ := res.([]*rawQueryMapOutput)
+			if len(values) == 0 {
+				break
+			}
+			for _, o := range values {
+				if latest == nil || o.Timestamp > latest.Timestamp {
+					latest = o
+				}
+			}
+		}
+	}
+
+	if latest == nil {
+		if !filterEmptyResults {
+			out <- m.processRawResults(nil)
+		}
+		return
+	}
+
+	row := m.processRawResults([]*rawQueryMapOutput{latest})
+	row.Values = m.processResults(row.Values)
+	out <- row
+}
+
 // processsResults will apply any math that was specified in the select statement against the passed in results
 func (m *MapReduceJob) processResults(results [][]interface{}) [][]interface{} {
 	hasMath := false
@@ -426,6 +561,25 @@ func (m *MapReduceJob) processFill(results [][]interface{}) [][]interface{} {
 	return results
 }
 
+// processEmptyResults replaces the nil values of the fields with a result for empty intervals, see EmptyResult.
+func (m *MapReduceJob) processEmptyResults(results [][]interface{}) {
+	for i, f := range m.stmt.Fields {
+		c, ok := f.Expr.(*Call)
+		if !ok {
+			continue
+		}
+		empty := EmptyResult(c)
+		if empty == nil {
+			continue
+		}
+		for _, vals := range results {
+			if i+1 < len(vals) && vals[i+1] == nil {
+				vals[i+1] = empty
+			}
+		}
+	}
+}
+
 func getProcessor(expr Expr, startIndex int) (processor, int) {
 	switch expr := expr.(type) {
 	case *VarRef:
@@ -477,8 +631,8 @@ func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
 		return func(values []interface{}) interface{} {
 			l := lhs(values)
 			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
+			if lv, ok := binaryOperand(l); ok {
+				if rv, ok := binaryOperand(r); ok {
 					if rv != 0 {
 						return lv + rv
 					}
@@ -490,8 +644,8 @@ func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
 		return func(values []interface{}) interface{} {
 			l := lhs(values)
 			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
+			if lv, ok := binaryOperand(l); ok {
+				if rv, ok := binaryOperand(r); ok {
 					if rv != 0 {
 						return lv - rv
 					}
@@ -503,8 +657,8 @@ func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
 		return func(values []interface{}) interface{} {
 			l := lhs(values)
 			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
+			if lv, ok := binaryOperand(l); ok {
+				if rv, ok := binaryOperand(r); ok {
 					if rv != 0 {
 						return lv * rv
 					}
@@ -516,8 +670,8 @@ func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
 		return func(values []interface{}) interface{} {
 			l := lhs(values)
 			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
+			if lv, ok := binaryOperand(l); ok {
+				if rv, ok := binaryOperand(r); ok {
 					if rv != 0 {
 						return lv / rv
 					}
@@ -525,6 +679,19 @@ func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
 			}
 			return nil
 		}
+	case MOD:
+		return func(values []interface{}) interface{} {
+			l := lhs(values)
+			r := rhs(values)
+			if lv, ok := binaryOperand(l); ok {
+				if rv, ok := binaryOperand(r); ok {
+					if rv != 0 {
+						return math.Mod(lv, rv)
+					}
+				}
+			}
+			return nil
+		}
 	default:
 		// we shouldn't get here, but give them back nils if it goes this way
 		return func(values []interface{}) interface{} {
@@ -533,6 +700,18 @@ func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
 	}
 }
 
+// binaryOperand returns the value of an operand of a binary expression as a float64. Integer results, such as
+// the counts returned by count(), are converted.
+func binaryOperand(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
 // resultsEmpty will return true if the all the result values are empty or contain only nulls
 func (m *MapReduceJob) resultsEmpty(resultValues [][]interface{}) bool {
 	for _, vals := range resultValues {
@@ -607,34 +786,181 @@ func (m *MapReduceJob) processRawResults(values []*rawQueryMapOutput) *Row {
 	return row
 }
 
-func (m *MapReduceJob) processAggregate(c *Call, reduceFunc ReduceFunc, resultValues [][]interface{}) error {
-	mapperOutputs := make([]interface{}, len(m.Mappers))
+func (m *MapReduceJob) processAggregate(c *Call, reduceFunc ReduceFunc, resultValues [][]interface{}, cache *reduceCache) error {
+	// if this aggregate has already been computed, reuse its reduced values. Stateful reducers are always run,
+	// since each call keeps its own state.
+	key := c.String()
+	cacheable := !IsStateful(c)
+	if cacheable && cache.has(key) {
+		for i, vals := range resultValues {
+			resultValues[i] = append(vals, cache.get(key, vals[0].(time.Time).UnixNano()))
+		}
+		return nil
+	}
+
+	// a sliding window reduces the mapper outputs of every interval it covers, so the outputs of the last
+	// windowSteps intervals are kept
+	steps := 1
+	if m.windowSteps > 1 {
+		steps = m.windowSteps
+	}
+	intervalOutputs := make([][]interface{}, 0, steps)
+
+	// reducers such as mean_over_time() also need the bounds of each interval
+	bounded := InitializeBoundedReduceFunc(c)
 
 	// intialize the mappers
 	for _, mm := range m.Mappers {
 		// for aggregate queries, we use the chunk size to determine how many times NextInterval should be called.
 		// This is the number of buckets that we need to fill.
-		if err := mm.Begin(c, m.TMin, len(resultValues)); err != nil {
+		if err := mm.Begin(c, m.TMin, len(resultValues)+steps-1); err != nil {
 			return err
 		}
 	}
 
 	// populate the result values for each interval of time
-	for i, _ := range resultValues {
-		// collect the results from each mapper
+	for i := -(steps - 1); i < len(resultValues); i++ {
+		// collect the results from each mapper, for the last interval covered by the window starting at i
+		outputs := make([]interface{}, len(m.Mappers))
 		for j, mm := range m.Mappers {
 			res, err := mm.NextInterval()
 			if err != nil {
 				return err
 			}
-			mapperOutputs[j] = res
+			outputs[j] = res
+		}
+		if len(intervalOutputs) == steps {
+			intervalOutputs = intervalOutputs[1:]
+		}
+		intervalOutputs = append(intervalOutputs, outputs)
+		if i < 0 {
+			continue
+		}
+
+		mapperOutputs := outputs
+		if steps > 1 {
+			mapperOutputs = make([]interface{}, 0, steps*len(m.Mappers))
+			for _, o := range intervalOutputs {
+				mapperOutputs = append(mapperOutputs, o...)
+			}
+		}
+
+		// reducers that can fail, such as strict mode aggregates, return their error as the result
+		var v interface{}
+		if bounded != nil {
+			// the outputs are those of the steps intervals from the start of the window
+			start := resultValues[i][0].(time.Time).UnixNano()
+			end := start + int64(steps)*m.interval
+			// the last intervals end with the query
+			if end > m.TMax {
+				end = m.TMax
+			}
+			v = bounded(mapperOutputs, start, end)
+		} else {
+			v = reduceFunc(mapperOutputs)
+		}
+		if err, ok := v.(error); ok {
+			return err
+		}
+		// points of series transforms keep the tags of the series they were computed from
+		if KeepsTags(c) {
+			v = TaggedPoints(v, m.TagSet.Tags)
+		}
+		resultValues[i] = append(resultValues[i], v)
+		if cacheable {
+			cache.set(key, resultValues[i][0].(time.Time).UnixNano(), v)
+		}
+	}
+
+	return nil
+}
+
+// secondaryAggregates returns true if the aggregates are aggregates of aggregates such as max(mean(value)),
+// which reduce the results of every group by interval to a single point. Secondary aggregates can't be mixed
+// with other aggregates and need a group by interval with a lower time bound.
+func (m *MapReduceJob) secondaryAggregates(aggregates []*Call) (bool, error) {
+	var n int
+	for _, c := range aggregates {
+		if len(c.Args) > 0 {
+			// aggregates of a transform, such as max(derivative(value)), are computed per interval
+			if _, ok := c.Args[0].(*Call); ok && Transform(c) == nil {
+				n++
+			}
 		}
-		resultValues[i] = append(resultValues[i], reduceFunc(mapperOutputs))
 	}
 
+	if n == 0 {
+		return false, nil
+	} else if n != len(aggregates) {
+		return false, errors.New("aggregates of aggregates can't be mixed with other aggregates")
+	}
+
+	if d, err := m.stmt.GroupByInterval(); err != nil {
+		return false, err
+	} else if d == 0 || m.TMin == 0 {
+		return false, errors.New("aggregates of aggregates need a group by time interval and a lower time bound")
+	}
+	return true, nil
+}
+
+// processSecondaryAggregate computes the inner aggregate of c, such as mean(value) in max(mean(value)), for
+// every interval and then reduces the interval results with c into the first row of resultValues.
+func (m *MapReduceJob) processSecondaryAggregate(c *Call, reduceFunc ReduceFunc, resultValues [][]interface{}, cache *reduceCache) error {
+	if len(resultValues) == 0 {
+		return nil
+	}
+
+	inner := c.Args[0].(*Call)
+	_, innerReduceFunc, _, err := MapReduceFuncs(inner)
+	if err != nil {
+		return err
+	}
+
+	intervals := make([][]interface{}, len(resultValues))
+	for i, vals := range resultValues {
+		intervals[i] = []interface{}{vals[0]}
+	}
+	if err := m.processAggregate(inner, innerReduceFunc, intervals, cache); err != nil {
+		return err
+	}
+
+	v, err := ReduceIntervals(c, reduceFunc, intervals)
+	if err != nil {
+		return err
+	}
+	resultValues[0] = append(resultValues[0], v)
 	return nil
 }
 
+// reduceCache memoizes reduced values by aggregate call and interval start time so that the
+// same aggregate over the same field isn't recomputed within a single query.
+type reduceCache struct {
+	values map[string]map[int64]interface{}
+}
+
+func newReduceCache() *reduceCache {
+	return &reduceCache{values: make(map[string]map[int64]interface{})}
+}
+
+// has returns true if values have been cached for the call.
+func (c *reduceCache) has(call string) bool {
+	_, ok := c.values[call]
+	return ok
+}
+
+// get returns the cached value of the call for the interval starting at t.
+func (c *reduceCache) get(call string, t int64) interface{} {
+	return c.values[call][t]
+}
+
+// set caches the value of the call for the interval starting at t.
+func (c *reduceCache) set(call string, t int64, v interface{}) {
+	if c.values[call] == nil {
+		c.values[call] = make(map[int64]interface{})
+	}
+	c.values[call][t] = v
+}
+
 type MapReduceJobs []*MapReduceJob
 
 func (a MapReduceJobs) Len() int           { return len(a) }
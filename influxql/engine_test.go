@@ -0,0 +1,438 @@
+package influxql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMapper is a Mapper that returns a fixed output for each interval and counts how often it's run.
+type testMapper struct {
+	outputs []interface{}
+	begins  map[string]int
+	i       int
+}
+
+func (m *testMapper) Open() error { return nil }
+func (m *testMapper) Close()      {}
+
+func (m *testMapper) Begin(c *Call, startingTime int64, limit int) error {
+	if m.begins == nil {
+		m.begins = make(map[string]int)
+	}
+	// raw queries begin without a call
+	if c != nil {
+		m.begins[c.String()]++
+	}
+	m.i = 0
+	return nil
+}
+
+func (m *testMapper) NextInterval() (interface{}, error) {
+	if m.i >= len(m.outputs) {
+		return nil, nil
+	}
+	m.i++
+	return m.outputs[m.i-1], nil
+}
+
+// executeTestJob runs a MapReduceJob for the query over the mappers and returns its single row.
+func executeTestJob(t *testing.T, q string, tmin, tmax int64, mappers ...Mapper) *Row {
+	stmt, err := NewParser(strings.NewReader(q)).ParseStatement()
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+
+	job := &MapReduceJob{
+		MeasurementName: "cpu",
+		TagSet:          &TagSet{},
+		Mappers:         mappers,
+		TMin:            tmin,
+		TMax:            tmax,
+		stmt:            stmt.(*SelectStatement),
+	}
+	if d, err := job.stmt.GroupByInterval(); err == nil {
+		job.interval = d.Nanoseconds()
+	}
+
+	out := make(chan *Row, 1)
+	job.Execute(out, false)
+	close(out)
+
+	row := <-out
+	if row == nil {
+		t.Fatalf("no row returned for %s", q)
+	}
+	if row.Err != nil {
+		t.Fatalf("unexpected error for %s: %s", q, row.Err)
+	}
+	return row
+}
+
+// Ensure identical aggregates in a query are only computed once.
+func TestMapReduceJob_ReduceCache(t *testing.T) {
+	mapper := &testMapper{outputs: []interface{}{float64(3)}}
+	row := executeTestJob(t, `SELECT sum(value), sum(value), sum(other) FROM cpu`, 0, 10, mapper)
+
+	if n := mapper.begins["sum(value)"]; n != 1 {
+		t.Errorf("expected sum(value) to be computed once. got %d", n)
+	}
+	if n := mapper.begins["sum(other)"]; n != 1 {
+		t.Errorf("expected sum(other) to be computed once. got %d", n)
+	}
+	if vals := row.Values[0]; vals[1] != float64(3) || vals[2] != float64(3) || vals[3] != float64(3) {
+		t.Errorf("unexpected values: %v", vals)
+	}
+}
+
+// Ensure stateful aggregates are computed for every call even once the cache holds their results.
+func TestMapReduceJob_ReduceCacheStateful(t *testing.T) {
+	mapper := &testMapper{outputs: []interface{}{
+		[]interface{}{"a", "b"},
+		[]interface{}{"b", "a"},
+		[]interface{}{"c"},
+	}}
+	tmin, tmax := int64(time.Minute), int64(4*time.Minute-1)
+	row := executeTestJob(t, `SELECT distinct_changes(value), distinct_changes(value) FROM cpu GROUP BY time(1m)`, tmin, tmax, mapper)
+
+	if n := mapper.begins["distinct_changes(value)"]; n != 2 {
+		t.Errorf("expected distinct_changes(value) to be computed twice. got %d", n)
+	}
+	exp := []interface{}{2.0, nil, 1.0}
+	if len(row.Values) != len(exp) {
+		t.Fatalf("unexpected values: %v", row.Values)
+	}
+	for i, vals := range row.Values {
+		if vals[1] != exp[i] || vals[2] != exp[i] {
+			t.Errorf("interval %d: exp %v, got %v", i, exp[i], vals[1:])
+		}
+	}
+}
+
+// Ensure aggregates of aggregates reduce the per interval results to a single point.
+func TestMapReduceJob_SecondaryAggregates(t *testing.T) {
+	mapper := &testMapper{outputs: []interface{}{
+		&MeanMapOutput{Count: 2, Mean: 10},
+		&MeanMapOutput{Count: 2, Mean: 30},
+		nil,
+		&MeanMapOutput{Count: 1, Mean: 20},
+	}}
+	tmin, tmax := int64(time.Minute), int64(5*time.Minute-1)
+	row := executeTestJob(t, `SELECT max(mean(value)), count(mean(value)), mean(mean(value)) FROM cpu GROUP BY time(1m)`, tmin, tmax, mapper)
+
+	if len(row.Values) != 1 {
+		t.Fatalf("expected a single point. got %v", row.Values)
+	}
+	if vals := row.Values[0]; vals[0] != time.Unix(0, tmin).UTC() || vals[1] != 30.0 || vals[2] != int64(3) || vals[3] != 20.0 {
+		t.Errorf("unexpected values: %v", vals)
+	}
+	if n := mapper.begins["mean(value)"]; n != 1 {
+		t.Errorf("expected mean(value) to be computed once. got %d", n)
+	}
+}
+
+// Ensure aggregates of aggregates can't be mixed with other aggregates.
+func TestMapReduceJob_SecondaryAggregates_Mixed(t *testing.T) {
+	stmt, err := NewParser(strings.NewReader(`SELECT max(mean(value)), sum(value) FROM cpu GROUP BY time(1m)`)).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &MapReduceJob{TagSet: &TagSet{}, TMin: int64(time.Minute), TMax: int64(5 * time.Minute), interval: int64(time.Minute), stmt: stmt.(*SelectStatement)}
+
+	out := make(chan *Row, 1)
+	job.Execute(out, false)
+	if row := <-out; row.Err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// Ensure derivative points of a grouped query carry the tags of their series.
+func TestMapReduceJob_DerivativeTags(t *testing.T) {
+	for _, host := range []string{"serverA", "serverB"} {
+		mapper := &testMapper{outputs: []interface{}{[]*rawQueryMapOutput{
+			{Timestamp: int64(time.Second), Values: 1.0},
+			{Timestamp: int64(2 * time.Second), Values: 3.0},
+		}}}
+		stmt, err := NewParser(strings.NewReader(`SELECT derivative(value) FROM cpu GROUP BY host`)).ParseStatement()
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := &MapReduceJob{
+			MeasurementName: "cpu",
+			TagSet:          &TagSet{Tags: map[string]string{"host": host}},
+			Mappers:         []Mapper{mapper},
+			TMax:            int64(time.Minute),
+			stmt:            stmt.(*SelectStatement),
+		}
+
+		out := make(chan *Row, 1)
+		job.Execute(out, false)
+		row := <-out
+		if row.Err != nil {
+			t.Fatal(row.Err)
+		}
+
+		points, ok := row.Values[0][1].([]*Point)
+		if !ok || len(points) != 1 {
+			t.Fatalf("%s: unexpected derivative: %v", host, row.Values[0][1])
+		}
+		if p := points[0]; p.Values != 2.0 || p.Tags["host"] != host {
+			t.Errorf("%s: unexpected point: %+v", host, p)
+		}
+	}
+}
+
+// Ensure the points of every series transform of a grouped query carry the tags of their series.
+func TestMapReduceJob_SeriesTransformTags(t *testing.T) {
+	for _, expr := range []string{
+		`derivative(value)`, `difference(value)`, `cumulative_sum(value)`, `elapsed(value)`,
+		`moving_average(value, 2)`, `moving_stddev(value, 2)`, `moving_min(value, 2)`, `moving_max(value, 2)`,
+		`holt_winters(value, 1, 1)`, `lttb(value, 3)`,
+	} {
+		mapper := &testMapper{outputs: []interface{}{[]*rawQueryMapOutput{
+			{Timestamp: int64(time.Second), Values: 1.0},
+			{Timestamp: int64(2 * time.Second), Values: 3.0},
+			{Timestamp: int64(3 * time.Second), Values: 4.0},
+		}}}
+		stmt, err := NewParser(strings.NewReader(`SELECT ` + expr + ` FROM cpu GROUP BY host`)).ParseStatement()
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := &MapReduceJob{
+			MeasurementName: "cpu",
+			TagSet:          &TagSet{Tags: map[string]string{"host": "serverA"}},
+			Mappers:         []Mapper{mapper},
+			TMax:            int64(time.Minute),
+			stmt:            stmt.(*SelectStatement),
+		}
+
+		out := make(chan *Row, 1)
+		job.Execute(out, false)
+		row := <-out
+		if row.Err != nil {
+			t.Fatalf("%s: %s", expr, row.Err)
+		}
+
+		points, ok := row.Values[0][1].([]*Point)
+		if !ok || len(points) == 0 {
+			t.Fatalf("%s: unexpected output: %v", expr, row.Values[0][1])
+		}
+		for _, p := range points {
+			if p.Tags["host"] != "serverA" {
+				t.Errorf("%s: unexpected point: %+v", expr, p)
+			}
+		}
+	}
+}
+
+// Ensure each point of a sliding window query contributes to every window that covers it.
+func TestMapReduceJob_SlidingWindows(t *testing.T) {
+	// the count of points in each minute
+	mapper := &testMapper{outputs: []interface{}{1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0}}
+	tmin, tmax := int64(10*time.Minute), int64(20*time.Minute-1)
+	row := executeTestJob(t, `SELECT count(value) FROM cpu GROUP BY time(5m, 1m)`, tmin, tmax, mapper)
+
+	exp := []int64{15, 20, 25, 30, 35, 40, 34, 27, 19, 10}
+	if len(row.Values) != len(exp) {
+		t.Fatalf("expected %d windows. got %v", len(exp), row.Values)
+	}
+	for i, vals := range row.Values {
+		if ts := time.Unix(0, tmin).Add(time.Duration(i) * time.Minute).UTC(); vals[0] != ts {
+			t.Errorf("window %d: exp start %s got %v", i, ts, vals[0])
+		}
+		if vals[1] != exp[i] {
+			t.Errorf("window %d: exp count %v got %v", i, exp[i], vals[1])
+		}
+	}
+}
+
+// Ensure the window of a sliding window query must be a multiple of its step.
+func TestSelectStatement_GroupByWindow(t *testing.T) {
+	tests := []struct {
+		q        string
+		interval time.Duration
+		window   time.Duration
+		err      bool
+	}{
+		{q: `SELECT count(value) FROM cpu GROUP BY time(5m)`, interval: 5 * time.Minute},
+		{q: `SELECT count(value) FROM cpu GROUP BY time(5m, 1m)`, interval: time.Minute, window: 5 * time.Minute},
+		{q: `SELECT count(value) FROM cpu GROUP BY time(5m, 2m)`, err: true},
+		{q: `SELECT count(value) FROM cpu GROUP BY time(1m, 5m)`, err: true},
+	}
+
+	for _, test := range tests {
+		stmt, err := NewParser(strings.NewReader(test.q)).ParseStatement()
+		if err != nil {
+			if !test.err {
+				t.Errorf("%s: unexpected error: %s", test.q, err)
+			}
+			continue
+		}
+		s := stmt.(*SelectStatement)
+		interval, err := s.GroupByInterval()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.q)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		window, _ := s.GroupByWindow()
+		if interval != test.interval || window != test.window {
+			t.Errorf("%s: exp interval %s window %s, got %s and %s", test.q, test.interval, test.window, interval, window)
+		}
+	}
+}
+
+// Ensure raw queries ordered by time descending return the points of every mapper latest first.
+func TestMapReduceJob_RawQueryDesc(t *testing.T) {
+	a := &testMapper{outputs: []interface{}{
+		[]*rawQueryMapOutput{{1, 1.0}, {3, 3.0}},
+		[]*rawQueryMapOutput{{5, 5.0}},
+	}}
+	b := &testMapper{outputs: []interface{}{
+		[]*rawQueryMapOutput{{2, 2.0}, {4, 4.0}},
+	}}
+
+	row := executeTestJob(t, `SELECT value FROM cpu ORDER BY DESC LIMIT 3 OFFSET 1`, 0, 10, a, b)
+	var got []int64
+	for _, v := range row.Values {
+		got = append(got, v[0].(time.Time).UnixNano())
+	}
+	if exp := []int64{4, 3, 2}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("wrong times. exp %v got %v", exp, got)
+	}
+}
+
+// limitMapper emits up to limit of its points, in ascending time order, the way the local mapper honors the
+// limit it's created with.
+type limitMapper struct {
+	points []*rawQueryMapOutput
+	limit  int
+	done   bool
+}
+
+func (m *limitMapper) Open() error                                    { return nil }
+func (m *limitMapper) Close()                                         {}
+func (m *limitMapper) Begin(c *Call, startingTime int64, n int) error { m.done = false; return nil }
+
+func (m *limitMapper) NextInterval() (interface{}, error) {
+	if m.done {
+		return nil, nil
+	}
+	m.done = true
+	if m.limit > 0 && len(m.points) > m.limit {
+		return m.points[:m.limit], nil
+	}
+	return m.points, nil
+}
+
+// Ensure queries ordered by time descending return the latest points when mappers honor their limit.
+func TestMapReduceJob_RawQueryDescLimit(t *testing.T) {
+	q := `SELECT value FROM cpu ORDER BY DESC LIMIT 2 OFFSET 1`
+	stmt, err := NewParser(strings.NewReader(q)).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := stmt.(*SelectStatement).MapperLimit()
+	a := &limitMapper{points: []*rawQueryMapOutput{{1, 1.0}, {3, 3.0}, {5, 5.0}, {7, 7.0}}, limit: limit}
+	b := &limitMapper{points: []*rawQueryMapOutput{{2, 2.0}, {4, 4.0}, {6, 6.0}}, limit: limit}
+
+	row := executeTestJob(t, q, 0, 10, a, b)
+	var got []int64
+	for _, v := range row.Values {
+		got = append(got, v[0].(time.Time).UnixNano())
+	}
+	if exp := []int64{6, 5}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("wrong times. exp %v got %v", exp, got)
+	}
+}
+
+// Ensure bounded reducers are passed the end of each interval, clipped to the end of the query.
+func TestMapReduceJob_BoundedReducer(t *testing.T) {
+	s := int64(time.Second)
+	mapper := &testMapper{outputs: []interface{}{[]*rawQueryMapOutput{{0, 2.0}, {10 * s, 4.0}}}}
+
+	// the series ends at 10s and the query at 25s, before the 30s boundary: (2*10 + 4*15) / 25
+	row := executeTestJob(t, `SELECT mean_over_time(value, 30s) FROM cpu`, 0, 25*s, mapper)
+	if len(row.Values) != 1 || row.Values[0][1] != 3.2 {
+		t.Errorf("unexpected values: %v", row.Values)
+	}
+}
+
+// Ensure bounded reducers of sliding windows are passed the bounds of the window their outputs come from.
+func TestMapReduceJob_BoundedReducerWindows(t *testing.T) {
+	m := int64(time.Minute)
+	mapper := &testMapper{outputs: []interface{}{
+		[]*rawQueryMapOutput{{10 * m, 2.0}},
+		[]*rawQueryMapOutput{{11 * m, 4.0}},
+	}}
+
+	// windows of 2m every minute: [10m, 12m) is (2*1 + 4*1) / 2, [11m, 13m) carries 4 to its end and
+	// [12m, 14m) has no points
+	row := executeTestJob(t, `SELECT mean_over_time(value, 10m) FROM cpu GROUP BY time(2m, 1m)`, 10*m, 13*m-1, mapper)
+	var got []interface{}
+	for _, vals := range row.Values {
+		got = append(got, vals[1])
+	}
+	if exp := []interface{}{3.0, 4.0, nil}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp %v got %v", exp, got)
+	}
+}
+
+// Ensure the integer results of count() can be used in binary expressions.
+func TestMapReduceJob_BinaryExprCount(t *testing.T) {
+	mapper := &testMapper{outputs: []interface{}{int64(3)}}
+	row := executeTestJob(t, `SELECT count(value) * 2, count(value) FROM cpu`, 0, 10, mapper)
+
+	if vals := row.Values[0]; vals[1] != 6.0 || vals[2] != int64(3) {
+		t.Errorf("unexpected values: %v", vals)
+	}
+}
+
+// Ensure empty intervals have a count of 0 unless they're filled, and tag sets without points are still
+// filtered out.
+func TestMapReduceJob_EmptyCount(t *testing.T) {
+	tmin, tmax := int64(time.Minute), int64(4*time.Minute-1)
+	for _, tt := range []struct {
+		q   string
+		exp []interface{}
+	}{
+		{`SELECT count(value) FROM cpu GROUP BY time(1m)`, []interface{}{int64(2), int64(0), int64(1)}},
+		{`SELECT count(value) FROM cpu GROUP BY time(1m) fill(1234)`, []interface{}{int64(2), 1234.0, int64(1)}},
+		{`SELECT count(value), sum(value) FROM cpu GROUP BY time(1m)`, []interface{}{int64(2), int64(0), int64(1)}},
+	} {
+		mapper := &testMapper{outputs: []interface{}{int64(2), nil, int64(1)}}
+		row := executeTestJob(t, tt.q, tmin, tmax, mapper)
+		var got []interface{}
+		for _, vals := range row.Values {
+			got = append(got, vals[1])
+		}
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: exp %v got %v", tt.q, tt.exp, got)
+		}
+	}
+
+	// a tag set without any points is filtered out of queries over several tag sets
+	stmt, err := NewParser(strings.NewReader(`SELECT count(value) FROM cpu GROUP BY time(1m)`)).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &MapReduceJob{
+		MeasurementName: "cpu",
+		TagSet:          &TagSet{},
+		Mappers:         []Mapper{&testMapper{outputs: []interface{}{nil, nil, nil}}},
+		TMin:            tmin,
+		TMax:            tmax,
+		stmt:            stmt.(*SelectStatement),
+		interval:        int64(time.Minute),
+	}
+	out := make(chan *Row, 1)
+	job.Execute(out, true)
+	close(out)
+	if row := <-out; row != nil {
+		t.Errorf("exp no row for an idle tag set. got %v", row.Values)
+	}
+}
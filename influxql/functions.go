@@ -4,20 +4,96 @@ package influxql
 // Query functions are represented as two discreet functions: Map and Reduce. These roughly follow the MapReduce
 // paradigm popularized by Google and Hadoop.
 //
-// When adding an aggregate function, define a mapper, a reducer, and add them in the switch statement in the MapReduceFuncs function
+// When adding an aggregate function, define a mapper, a reducer, and add them in the switch statements of InitializeMapFunc,
+// InitializeReduceFunc and InitializeUnmarshaller, which MapReduceFuncs calls together. Aggregates defined outside this
+// package are added with RegisterAggregate.
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"math/big"
 	"math/rand"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Iterator represents a forward-only iterator over a set of points.
-// These are used by the MapFunctions in this file
+// These are used by the MapFunctions in this file. Next returns false once there are no more points, since
+// a timestamp of 0 is a valid point at the Unix epoch.
 type Iterator interface {
-	Next() (seriesID uint64, timestamp int64, value interface{})
+	Next() (seriesID uint64, timestamp int64, value interface{}, ok bool)
+}
+
+// ErrIterator is an Iterator that can fail partway through, such as on a storage error. Like bufio.Scanner,
+// Next stops returning points after an error and Err returns the error, or nil if the iterator was simply
+// exhausted. Every map function checks Err after iterating, so a failed read is returned as an error rather
+// than mistaken for the end of the data. The reducers of raw points pass the error of a mapper on.
+type ErrIterator interface {
+	Iterator
+	Err() error
+}
+
+// OrderedIterator is an Iterator that can report whether it yields points in time order, which lets
+// selectors such as MapFirst and MapLast skip comparing timestamps.
+type OrderedIterator interface {
+	Iterator
+	Ordered() bool
+}
+
+// isOrdered returns true if itr is known to yield points in time order.
+func isOrdered(itr Iterator) bool {
+	o, ok := itr.(OrderedIterator)
+	return ok && o.Ordered()
+}
+
+// SortedIterator is an Iterator that can report whether it yields values in ascending order, as some storage
+// encodings do, which lets MapMin, MapMax and MapSpread skip comparing values. Values that aren't numeric are
+// skipped and may appear anywhere.
+type SortedIterator interface {
+	Iterator
+	Sorted() bool
+}
+
+// isSorted returns true if itr is known to yield values in ascending order.
+func isSorted(itr Iterator) bool {
+	s, ok := itr.(SortedIterator)
+	return ok && s.Sorted()
+}
+
+// sortedExtremes returns the first and the last values converted by conv of an iterator yielding values in
+// ascending order, its min and max. If last is false it stops after the first value and max is unset.
+func sortedExtremes(itr Iterator, last bool, conv func(interface{}) (float64, bool)) (min, max float64, ok bool) {
+	for _, _, v, more := itr.Next(); more; _, _, v, more = itr.Next() {
+		val, isNum := conv(v)
+		if !isNum {
+			continue
+		}
+		if !ok {
+			min, ok = val, true
+			if !last {
+				break
+			}
+		}
+		max = val
+	}
+	return min, max, ok
+}
+
+// iteratorErr returns the error that stopped itr, if it's an ErrIterator.
+func iteratorErr(itr Iterator) error {
+	if e, ok := itr.(ErrIterator); ok {
+		return e.Err()
+	}
+	return nil
 }
 
 // MapFunc represents a function used for mapping over a sequential series of data.
@@ -31,6 +107,87 @@ type ReduceFunc func([]interface{}) interface{}
 // server and marshal it into an interface the reduer can use
 type UnmarshalFunc func([]byte) (interface{}, error)
 
+// aggregate is a user-defined aggregate added with RegisterAggregate.
+type aggregate struct {
+	mapFunc       MapFunc
+	reduceFunc    ReduceFunc
+	unmarshalFunc UnmarshalFunc
+}
+
+var (
+	aggregatesMu sync.RWMutex
+	aggregates   = make(map[string]*aggregate)
+)
+
+// RegisterAggregate adds the aggregate function name, computed by the mapper m and the reducer r, so queries can
+// call it like the built-in functions with a single field argument. The unmarshaller u decodes the map outputs
+// sent by other nodes into the values r expects. If it's nil they're decoded as generic JSON values. It returns
+// an error if name is already registered or is a built-in function.
+func RegisterAggregate(name string, m MapFunc, r ReduceFunc, u UnmarshalFunc) error {
+	if name == "" || m == nil || r == nil {
+		return fmt.Errorf("expected name, mapper and reducer to register aggregate")
+	}
+	if u == nil {
+		u = unmarshalJSON
+	}
+
+	if builtinFunctions[name] {
+		return fmt.Errorf("can't register built-in function: %q", name)
+	}
+
+	aggregatesMu.Lock()
+	defer aggregatesMu.Unlock()
+	if _, ok := aggregates[name]; ok {
+		return fmt.Errorf("aggregate already registered: %q", name)
+	}
+	aggregates[name] = &aggregate{mapFunc: m, reduceFunc: r, unmarshalFunc: u}
+	return nil
+}
+
+// registeredAggregate returns the aggregate registered as name, or nil if there's none.
+func registeredAggregate(name string) *aggregate {
+	aggregatesMu.RLock()
+	defer aggregatesMu.RUnlock()
+	return aggregates[name]
+}
+
+// builtinFunctions are the names of the functions of this package, which can't be registered as aggregates.
+// A function added to InitializeMapFunc must be added here too.
+var builtinFunctions = map[string]bool{
+	"all_max": true, "all_min": true, "bottom": true, "count": true, "count_distinct": true,
+	"count_distinct_approx": true, "count_gaps": true, "cumulative_sum": true, "derivative": true,
+	"difference": true, "distinct": true, "distinct_changes": true, "elapsed": true, "first": true,
+	"geometric_mean": true, "harmonic_mean": true, "histogram": true, "holt_winters": true, "integral": true,
+	"kurtosis": true, "last": true, "log_mean": true, "log_stddev": true, "lttb": true, "max": true, "mean": true,
+	"mean_over_time": true, "mean_weighted": true, "median": true, "min": true, "missing_count": true,
+	"mode": true, "moving_average": true, "moving_max": true, "moving_min": true, "moving_stddev": true,
+	"nth": true, "percentage": true, "percentile": true, "percentile_approx": true, "percentile_rank": true,
+	"percentiles": true, "range": true, "ratio": true, "rms": true, "sample": true, "series_count": true,
+	"skewness": true, "spread": true, "stddev": true, "stddev_pop": true, "sum": true, "sum_of_squares": true,
+	"time_weighted_mean": true, "top": true, "top_frequent": true, "variance": true, "variance_pop": true,
+}
+
+// MapReduceFuncs takes an aggregate call from the query and returns its MapFunc, ReduceFunc and UnmarshalFunc
+// together, or the first error initializing them. A nil call is a raw data query.
+func MapReduceFuncs(c *Call) (MapFunc, ReduceFunc, UnmarshalFunc, error) {
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var reduceFunc ReduceFunc
+	if c != nil {
+		// raw data queries aren't reduced
+		if reduceFunc, err = InitializeReduceFunc(c); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return mapFunc, reduceFunc, unmarshal, nil
+}
+
 // InitializeMapFunc takes an aggregate call from the query and returns the MapFunc
 func InitializeMapFunc(c *Call) (MapFunc, error) {
 	// see if it's a query for raw data
@@ -38,13 +195,149 @@ func InitializeMapFunc(c *Call) (MapFunc, error) {
 		return MapRawQuery, nil
 	}
 
+	// aggregates of a transform map the points the transform needs
+	if t := Transform(c); t != nil {
+		if _, err := transformedAggregate(c, t); err != nil {
+			return nil, err
+		}
+		return InitializeMapFunc(t)
+	}
+	if d := CountDistinct(c); d != nil {
+		return InitializeMapFunc(d)
+	}
+
 	// Ensure that there is either a single argument or if for percentile, two
-	if c.Name == "percentile" {
-		if len(c.Args) != 2 {
+	switch c.Name {
+	case "percentile":
+		// percentile takes either an optional trim fraction or 'linear' or 'dedupe' flag, and the 'coverage' flag
+		if len(c.Args) < 2 {
 			return nil, fmt.Errorf("expected two arguments for percentile()")
+		} else if len(c.Args) > 4 {
+			return nil, fmt.Errorf("expected two to four arguments for percentile()")
+		}
+		if _, err := percentileArgs(c); err != nil {
+			return nil, err
+		}
+	case "percentile_approx":
+		if _, err := percentileApproxArg(c); err != nil {
+			return nil, err
+		}
+	case "percentiles":
+		if _, err := percentilesArgs(c); err != nil {
+			return nil, err
+		}
+	case "percentile_rank":
+		if _, err := percentileRankArg(c); err != nil {
+			return nil, err
+		}
+	case "median":
+		if _, _, err := medianArgs(c); err != nil {
+			return nil, err
+		}
+	case "sum", "mean", "min", "max":
+		if _, err := numericAggregateArgs(c); err != nil {
+			return nil, err
+		}
+	case "top", "bottom":
+		if _, err := topBottomArgs(c); err != nil {
+			return nil, err
+		}
+	case "derivative":
+		if _, err := derivativeArgs(c); err != nil {
+			return nil, err
+		}
+	case "count_distinct":
+		if _, err := countDistinctArgs(c); err != nil {
+			return nil, err
+		}
+	case "moving_average", "moving_stddev", "moving_min", "moving_max":
+		if _, err := movingWindowArg(c); err != nil {
+			return nil, err
+		}
+	case "nth":
+		if _, err := nthArg(c); err != nil {
+			return nil, err
+		}
+	case "holt_winters":
+		if _, _, err := holtWintersArgs(c); err != nil {
+			return nil, err
 		}
-	} else if len(c.Args) != 1 {
-		return nil, fmt.Errorf("expected one argument for %s()", c.Name)
+	case "lttb":
+		if _, err := lttbArg(c); err != nil {
+			return nil, err
+		}
+	case "sample":
+		if _, err := sampleArg(c); err != nil {
+			return nil, err
+		}
+	case "mode":
+		if _, err := modeArgs(c); err != nil {
+			return nil, err
+		}
+	case "top_frequent":
+		if _, err := topFrequentArg(c); err != nil {
+			return nil, err
+		}
+	case "missing_count":
+		if _, err := expectedIntervalArg(c); err != nil {
+			return nil, err
+		}
+	case "count_gaps":
+		if _, err := gapIntervalArg(c); err != nil {
+			return nil, err
+		}
+	case "mean_over_time":
+		if _, err := meanOverTimeArg(c); err != nil {
+			return nil, err
+		}
+	case "integral":
+		if _, err := unitArg(c, time.Second); err != nil {
+			return nil, err
+		}
+	case "elapsed":
+		if _, err := unitArg(c, time.Nanosecond); err != nil {
+			return nil, err
+		}
+	case "stddev":
+		if _, err := stddevArgs(c); err != nil {
+			return nil, err
+		}
+	case "histogram":
+		if _, err := histogramArgs(c); err != nil {
+			return nil, err
+		}
+	case "count":
+		if _, err := countArgs(c); err != nil {
+			return nil, err
+		}
+	case "first", "last":
+		if _, err := pointArg(c); err != nil {
+			return nil, err
+		}
+	case "distinct":
+		if _, err := distinctArgs(c); err != nil {
+			return nil, err
+		}
+	case "mean_weighted":
+		if _, _, err := weightedMeanArgs(c); err != nil {
+			return nil, err
+		}
+	case "ratio", "percentage":
+		if _, _, err := ratioArgs(c); err != nil {
+			return nil, err
+		}
+	default:
+		if len(c.Args) != 1 {
+			return nil, fmt.Errorf("expected one argument for %s()", c.Name)
+		}
+	}
+
+	// count(*) counts every point whatever fields it has
+	if CountsAll(c) {
+		if len(c.Args) != 1 {
+			return nil, fmt.Errorf("expected no other arguments with a wildcard in count()")
+		}
+		return MapCount, nil
 	}
 
 	// Ensure the argument is a variable reference.
@@ -53,719 +346,7396 @@ func InitializeMapFunc(c *Call) (MapFunc, error) {
 		return nil, fmt.Errorf("expected field argument in %s()", c.Name)
 	}
 
+	if a := registeredAggregate(c.Name); a != nil {
+		return a.mapFunc, nil
+	}
+
 	// Retrieve map function by name.
 	switch c.Name {
 	case "count":
+		if opt, _ := countArgs(c); opt.tc != 0 {
+			return MapByTimeComponent(MapCount, opt.tc), nil
+		} else if opt.bucket != nil {
+			return MapByBucket(MapCount, c.Args[0].(*VarRef).Val, opt.bucket), nil
+		}
 		return MapCount, nil
 	case "sum":
-		return MapSum, nil
+		opt, _ := numericAggregateArgs(c)
+		if opt.halfLife > 0 {
+			// decay weights depend on the timestamp of each point
+			return opt.mapFunc(MapRawQuery), nil
+		} else if opt.strict {
+			return opt.mapFunc(MapSumStrict), nil
+		} else if opt.exact {
+			return opt.mapFunc(MapExactSum), nil
+		} else if opt.compensated {
+			return opt.mapFunc(MapCompensatedSum), nil
+		}
+		return opt.mapFunc(MapSum), nil
 	case "mean":
-		return MapMean, nil
+		opt, _ := numericAggregateArgs(c)
+		if opt.halfLife > 0 {
+			return opt.mapFunc(MapRawQuery), nil
+		} else if opt.strict {
+			return opt.mapFunc(MapMeanStrict), nil
+		} else if opt.exact {
+			return opt.mapFunc(MapExactSum), nil
+		}
+		return opt.mapFunc(MapMean), nil
 	case "median":
+		// the median depends on every value, so unlike stddev() it can't be mapped to a fixed size partial
+		if _, timestamp, _ := medianArgs(c); timestamp {
+			return MapMedianWithTime, nil
+		}
 		return MapStddev, nil
 	case "min":
-		return MapMin, nil
+		opt, _ := numericAggregateArgs(c)
+		if opt.point {
+			return MapSelectPoint(c.Name, opt.field), nil
+		} else if opt.timestamp {
+			return opt.mapFunc(MapMinWithTime), nil
+		}
+		return opt.mapFunc(MapMin), nil
 	case "max":
-		return MapMax, nil
-	case "spread":
+		opt, _ := numericAggregateArgs(c)
+		if opt.point {
+			return MapSelectPoint(c.Name, opt.field), nil
+		} else if opt.timestamp {
+			return opt.mapFunc(MapMaxWithTime), nil
+		}
+		return opt.mapFunc(MapMax), nil
+	case "spread", "range":
 		return MapSpread, nil
+	case "variance", "stddev_pop", "variance_pop":
+		return MapStddev, nil
 	case "stddev":
+		if onePass, _ := stddevArgs(c); onePass {
+			return MapStddevOnePass, nil
+		}
 		return MapStddev, nil
+	case "all_min":
+		return MapAllMin, nil
+	case "all_max":
+		return MapAllMax, nil
+	case "mean_weighted":
+		value, weight, _ := weightedMeanArgs(c)
+		return MapWeightedMean(value, weight), nil
+	case "ratio", "percentage":
+		num, den, _ := ratioArgs(c)
+		return MapRatio(num, den), nil
+	case "log_mean":
+		return MapLogMean, nil
+	case "sum_of_squares":
+		return MapSumOfSquares, nil
+	case "rms":
+		return MapRMS, nil
+	case "geometric_mean":
+		return MapGeometricMean, nil
+	case "skewness", "kurtosis":
+		return MapMoments, nil
+	case "harmonic_mean":
+		return MapHarmonicMean, nil
+	case "log_stddev":
+		return MapLogStddev, nil
 	case "first":
+		if point, _ := pointArg(c); point {
+			return MapSelectPoint(c.Name, c.Args[0].(*VarRef).Val), nil
+		}
 		return MapFirst, nil
 	case "last":
+		if point, _ := pointArg(c); point {
+			return MapSelectPoint(c.Name, c.Args[0].(*VarRef).Val), nil
+		}
 		return MapLast, nil
 	case "percentile":
 		_, ok := c.Args[1].(*NumberLiteral)
 		if !ok {
 			return nil, fmt.Errorf("expected float argument in percentile()")
 		}
+		opt, _ := percentileArgs(c)
+		mapFunc := MapEcho
+		if opt.halfLife > 0 || opt.dedupe {
+			mapFunc = MapRawQuery
+		} else if opt.timestamp {
+			mapFunc = MapMedianWithTime
+		}
+		if opt.coverage {
+			return MapWithCoverage(mapFunc), nil
+		}
+		return mapFunc, nil
+	case "percentile_approx":
+		return MapTDigest, nil
+	case "percentiles", "percentile_rank":
 		return MapEcho, nil
-	default:
-		return nil, fmt.Errorf("function not found: %q", c.Name)
-	}
-}
-
-// InitializeReduceFunc takes an aggregate call from the query and returns the ReduceFunc
-func InitializeReduceFunc(c *Call) (ReduceFunc, error) {
-	// Retrieve reduce function by name.
-	switch c.Name {
-	case "count":
-		return ReduceSum, nil
-	case "sum":
-		return ReduceSum, nil
-	case "mean":
-		return ReduceMean, nil
-	case "median":
-		return ReduceMedian, nil
-	case "min":
-		return ReduceMin, nil
-	case "max":
-		return ReduceMax, nil
-	case "spread":
-		return ReduceSpread, nil
-	case "stddev":
-		return ReduceStddev, nil
-	case "first":
-		return ReduceFirst, nil
-	case "last":
-		return ReduceLast, nil
-	case "percentile":
-		if len(c.Args) != 2 {
-			return nil, fmt.Errorf("expected float argument in percentile()")
+	case "top", "bottom":
+		if opt, _ := topBottomArgs(c); opt.tieBreak != "" {
+			return MapTopBottomPairs(opt.field, opt.tieBreak), nil
 		}
-
-		lit, ok := c.Args[1].(*NumberLiteral)
-		if !ok {
-			return nil, fmt.Errorf("expected float argument in percentile()")
+		return MapStddev, nil
+	case "mode":
+		if opt, _ := modeArgs(c); opt.nulls {
+			return MapModeWithNulls, nil
+		}
+		return MapStddev, nil
+	case "top_frequent":
+		return MapFrequencies, nil
+	case "series_count":
+		return MapSeriesCount, nil
+	case "distinct":
+		if nulls, _ := distinctArgs(c); nulls {
+			return MapDistinct, nil
+		}
+		return MapExcludeNulls(MapDistinct), nil
+	case "distinct_changes":
+		return MapExcludeNulls(MapDistinct), nil
+	case "derivative", "difference", "cumulative_sum", "integral", "elapsed", "moving_average", "moving_stddev", "nth",
+		"missing_count", "holt_winters", "count_gaps", "moving_min", "moving_max",
+		"time_weighted_mean", "mean_over_time", "lttb":
+		return MapRawQuery, nil
+	case "count_distinct":
+		opt, _ := countDistinctArgs(c)
+		mapFunc := MapDistinct
+		if opt.gap > 0 {
+			// counting per session depends on the order of points
+			mapFunc = MapRawQuery
+		} else if opt.approx {
+			mapFunc = MapHyperLogLog
+		}
+		if !opt.nulls {
+			mapFunc = MapExcludeNulls(mapFunc)
 		}
-		return ReducePercentile(lit.Val), nil
+		if opt.ignoreCase {
+			return MapIgnoreCase(mapFunc), nil
+		}
+		return mapFunc, nil
+	case "histogram":
+		h, _ := histogramArgs(c)
+		return MapHistogram(h), nil
+	case "sample":
+		n, _ := sampleArg(c)
+		return MapSample(n, rand.Intn), nil
 	default:
 		return nil, fmt.Errorf("function not found: %q", c.Name)
 	}
 }
 
-func InitializeUnmarshaller(c *Call) (UnmarshalFunc, error) {
-	// if c is nil it's a raw data query
-	if c == nil {
-		return func(b []byte) (interface{}, error) {
-			a := make([]*rawQueryMapOutput, 0)
-			err := json.Unmarshal(b, &a)
-			return a, err
-		}, nil
+// ReduceIntervals applies the outer aggregate of an aggregate of aggregates, such as max in max(mean(value)), to
+// the results of the inner aggregate for each group by interval. Each row of intervals holds the start time of
+// the interval followed by the inner result. Every interval with a result is treated as a point, so for example
+// count(mean(value)) counts the intervals that have a mean.
+func ReduceIntervals(c *Call, reduceFunc ReduceFunc, intervals [][]interface{}) (interface{}, error) {
+	// the outer aggregate maps the interval results as if they were the values of a field
+	outer := &Call{Name: c.Name, Args: append([]Expr{&VarRef{Val: c.Args[0].String()}}, c.Args[1:]...)}
+	mapFunc, err := InitializeMapFunc(outer)
+	if err != nil {
+		return nil, err
 	}
 
-	// Retrieve marshal function by name
-	switch c.Name {
-	case "mean":
-		return func(b []byte) (interface{}, error) {
-			var o meanMapOutput
-			err := json.Unmarshal(b, &o)
-			return &o, err
-		}, nil
-	case "spread":
-		return func(b []byte) (interface{}, error) {
-			var o spreadMapOutput
-			err := json.Unmarshal(b, &o)
-			return &o, err
-		}, nil
-	case "first":
-		return func(b []byte) (interface{}, error) {
-			var o firstLastMapOutput
-			err := json.Unmarshal(b, &o)
-			return &o, err
-		}, nil
-	case "last":
-		return func(b []byte) (interface{}, error) {
-			var o firstLastMapOutput
-			err := json.Unmarshal(b, &o)
-			return &o, err
-		}, nil
-	case "stddev":
-		return func(b []byte) (interface{}, error) {
-			val := make([]float64, 0)
-			err := json.Unmarshal(b, &val)
-			return val, err
-		}, nil
-	case "median":
-		return func(b []byte) (interface{}, error) {
-			a := make([]float64, 0)
-			err := json.Unmarshal(b, &a)
-			return a, err
-		}, nil
-	default:
-		return func(b []byte) (interface{}, error) {
-			var val interface{}
-			err := json.Unmarshal(b, &val)
-			return val, err
-		}, nil
+	var points rawOutputs
+	for _, vals := range intervals {
+		if vals[1] == nil {
+			continue
+		}
+		points = append(points, &rawQueryMapOutput{vals[0].(time.Time).UnixNano(), vals[1]})
 	}
-}
 
-// MapCount computes the number of values in an iterator.
-func MapCount(itr Iterator) interface{} {
-	n := float64(0)
-	for _, k, _ := itr.Next(); k != 0; _, k, _ = itr.Next() {
-		n++
+	mapped := mapFunc(&rawOutputsIterator{points: points})
+	if err, ok := mapped.(error); ok {
+		return nil, err
 	}
-	if n > 0 {
-		return n
+	v := reduceFunc([]interface{}{mapped})
+	if err, ok := v.(error); ok {
+		return nil, err
 	}
-	return nil
+	return v, nil
 }
 
-// MapSum computes the summation of values in an iterator.
-func MapSum(itr Iterator) interface{} {
-	n := float64(0)
-	count := 0
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		count++
-		n += v.(float64)
+// Transform returns the transform, such as derivative(value) in max(derivative(value)), whose points an
+// aggregate is applied to, or nil if the aggregate is applied directly to a field.
+func Transform(c *Call) *Call {
+	if c == nil || len(c.Args) == 0 {
+		return nil
 	}
-	if count > 0 {
-		return n
+	if t, ok := c.Args[0].(*Call); ok && t.Name == "derivative" {
+		return t
 	}
 	return nil
 }
 
-// ReduceSum computes the sum of values for each key.
-func ReduceSum(values []interface{}) interface{} {
-	var n float64
-	count := 0
-	for _, v := range values {
-		if v == nil {
-			continue
-		}
-		count++
-		n += v.(float64)
+// CountDistinct returns the count_distinct() call that c is written in place of, or nil if c is not one of
+// them. count(distinct(field)) counts the values distinct(field) would return, and count_distinct_approx(field)
+// estimates the count like count_distinct(field, 'approx'). Any options of distinct() or
+// count_distinct_approx() are passed on.
+func CountDistinct(c *Call) *Call {
+	if c == nil || len(c.Args) == 0 {
+		return nil
 	}
-	if count > 0 {
-		return n
+	switch c.Name {
+	case "count":
+		if d, ok := c.Args[0].(*Call); ok && d.Name == "distinct" && len(c.Args) == 1 {
+			return &Call{Name: "count_distinct", Args: d.Args}
+		}
+	case "count_distinct_approx":
+		args := append(c.Args[:len(c.Args):len(c.Args)], &StringLiteral{Val: "approx"})
+		return &Call{Name: "count_distinct", Args: args}
 	}
 	return nil
 }
 
-// MapMean computes the count and sum of values in an iterator to be combined by the reducer.
-func MapMean(itr Iterator) interface{} {
-	out := &meanMapOutput{}
-
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		out.Count++
-		out.Mean += (v.(float64) - out.Mean) / float64(out.Count)
+// transformedAggregate returns the aggregate c of the transform t as a call over the points of the transform,
+// which are treated as the values of a field.
+func transformedAggregate(c, t *Call) (*Call, error) {
+	switch c.Name {
+	case "min", "max", "mean", "spread":
+	default:
+		return nil, fmt.Errorf("%s() can't be applied to %s()", c.Name, t.Name)
 	}
-
-	if out.Count > 0 {
-		return out
+	if len(c.Args) != 1 {
+		return nil, fmt.Errorf("expected one argument for %s() of %s()", c.Name, t.Name)
 	}
-
-	return nil
+	return &Call{Name: c.Name, Args: []Expr{&VarRef{Val: t.String()}}}, nil
 }
 
-type meanMapOutput struct {
-	Count int
-	Mean  float64
+// ReduceTransformed applies an aggregate to the points computed by a transform for each interval, e.g. the
+// max of the rates computed by ReduceDerivative is the peak rate of change.
+func ReduceTransformed(transform ReduceFunc, mapFunc MapFunc, reduceFunc ReduceFunc) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		v := transform(values)
+		points, ok := v.([]*rawQueryMapOutput)
+		if !ok {
+			// no points or an error
+			return v
+		}
+		return reduceFunc([]interface{}{mapFunc(&rawOutputsIterator{points: points})})
+	}
 }
 
-// ReduceMean computes the mean of values for each key.
-func ReduceMean(values []interface{}) interface{} {
-	out := &meanMapOutput{}
-	var countSum int
-	for _, v := range values {
-		if v == nil {
-			continue
+// InitializeReduceFunc takes an aggregate call from the query and returns the ReduceFunc
+func InitializeReduceFunc(c *Call) (ReduceFunc, error) {
+	if t := Transform(c); t != nil {
+		outer, err := transformedAggregate(c, t)
+		if err != nil {
+			return nil, err
 		}
-		val := v.(*meanMapOutput)
-		countSum = out.Count + val.Count
-		out.Mean = val.Mean*(float64(val.Count)/float64(countSum)) + out.Mean*(float64(out.Count)/float64(countSum))
-		out.Count = countSum
+		transform, err := InitializeReduceFunc(t)
+		if err != nil {
+			return nil, err
+		}
+		mapFunc, err := InitializeMapFunc(outer)
+		if err != nil {
+			return nil, err
+		}
+		reduceFunc, err := InitializeReduceFunc(outer)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceTransformed(transform, mapFunc, reduceFunc), nil
 	}
-	if out.Count > 0 {
-		return out.Mean
+	if d := CountDistinct(c); d != nil {
+		return InitializeReduceFunc(d)
 	}
-	return nil
-}
 
-// ReduceMedian computes the median of values
-func ReduceMedian(values []interface{}) interface{} {
-	var data []float64
-	// Collect all the data points
-	for _, value := range values {
-		if value == nil {
-			continue
-		}
-		data = append(data, value.([]float64)...)
+	if a := registeredAggregate(c.Name); a != nil {
+		return a.reduceFunc, nil
 	}
 
-	length := len(data)
-	if length < 2 {
-		if length == 0 {
-			return nil
+	// Retrieve reduce function by name.
+	switch c.Name {
+	case "count":
+		opt, err := countArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		reduceFunc := ReduceCount
+		if opt.float {
+			reduceFunc = ReduceFloatCount
+		}
+		if opt.tc != 0 || opt.bucket != nil {
+			return ReduceByBucket(reduceFunc), nil
+		}
+		return reduceFunc, nil
+	case "sum":
+		opt, err := numericAggregateArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.halfLife > 0 {
+			return opt.reduceFunc(ReduceDecayedSum(opt.halfLife)), nil
+		} else if opt.strict {
+			return opt.reduceFunc(ReduceSumStrict), nil
+		} else if opt.exact {
+			return opt.reduceFunc(ReduceExactSum), nil
+		} else if opt.compensated {
+			return opt.reduceFunc(ReduceCompensatedSum), nil
+		}
+		return opt.reduceFunc(ReduceSum), nil
+	case "mean":
+		opt, err := numericAggregateArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.halfLife > 0 {
+			return opt.reduceFunc(ReduceDecayedMean(opt.halfLife)), nil
+		} else if opt.exact {
+			return opt.reduceFunc(ReduceExactMean), nil
+		}
+		return opt.reduceFunc(ReduceMean), nil
+	case "median":
+		fraction, timestamp, err := medianArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if timestamp {
+			return ReduceMedianWithTime, nil
+		} else if fraction > 0 {
+			return ReduceTrimmedMedian(fraction), nil
+		}
+		return ReduceMedianWithOptions(MedianOptions{EvenMode: medianEvenModeArg(c)}), nil
+	case "min":
+		opt, err := numericAggregateArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.point {
+			return ReduceSelectPoint(c.Name, opt.field), nil
+		} else if opt.timestamp {
+			return opt.reduceFunc(ReduceMinWithTime), nil
+		}
+		return opt.reduceFunc(ReduceMin), nil
+	case "max":
+		opt, err := numericAggregateArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.point {
+			return ReduceSelectPoint(c.Name, opt.field), nil
+		} else if opt.timestamp {
+			return opt.reduceFunc(ReduceMaxWithTime), nil
+		}
+		return opt.reduceFunc(ReduceMax), nil
+	case "spread":
+		return ReduceSpread, nil
+	case "range":
+		return ReduceRange, nil
+	case "variance":
+		return ReduceVariance, nil
+	case "stddev_pop":
+		return ReducePopulationStddev, nil
+	case "variance_pop":
+		return ReducePopulationVariance, nil
+	case "stddev":
+		onePass, err := stddevArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if onePass {
+			return ReduceStddevOnePass, nil
+		}
+		return ReduceStddev, nil
+	case "all_min":
+		return ReduceAllMin, nil
+	case "all_max":
+		return ReduceAllMax, nil
+	case "mean_weighted":
+		return ReduceWeightedMean, nil
+	case "ratio":
+		return ReduceRatio(1), nil
+	case "percentage":
+		return ReduceRatio(100), nil
+	case "log_mean":
+		return ReduceLogMean, nil
+	case "sum_of_squares":
+		// the sums of squares of each mapper add up like sums
+		return ReduceSum, nil
+	case "rms":
+		return ReduceRMS, nil
+	case "geometric_mean":
+		return ReduceGeometricMean, nil
+	case "skewness":
+		return ReduceSkewness, nil
+	case "kurtosis":
+		return ReduceKurtosis, nil
+	case "harmonic_mean":
+		return ReduceHarmonicMean, nil
+	case "log_stddev":
+		return ReduceLogStddev, nil
+	case "first", "last":
+		point, err := pointArg(c)
+		if err != nil {
+			return nil, err
+		} else if point {
+			return ReduceSelectPoint(c.Name, c.Args[0].(*VarRef).Val), nil
+		} else if c.Name == "first" {
+			return ReduceFirst, nil
+		}
+		return ReduceLast, nil
+	case "percentile":
+		opt, err := percentileArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		reduceFunc := ReducePercentile(opt.percentile)
+		if opt.halfLife > 0 {
+			reduceFunc = ReduceDecayedPercentile(opt.percentile, opt.halfLife)
+		} else if opt.fraction > 0 {
+			reduceFunc = ReduceTrimmedPercentile(opt.percentile, opt.fraction)
+		} else if opt.verbose {
+			reduceFunc = ReducePercentileVerbose(opt.percentile)
+		} else if opt.interpolate {
+			reduceFunc = ReducePercentileInterpolated(opt.percentile)
+		} else if opt.dedupe {
+			reduceFunc = ReduceDeduplicated(reduceFunc)
+		} else if opt.timestamp {
+			reduceFunc = ReducePercentileWithTime(opt.percentile)
+		}
+		if opt.coverage {
+			return ReduceWithCoverage(reduceFunc), nil
+		}
+		return reduceFunc, nil
+	case "percentiles":
+		percentiles, err := percentilesArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReducePercentiles(percentiles), nil
+	case "percentile_rank":
+		threshold, err := percentileRankArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReducePercentileRank(threshold), nil
+	case "percentile_approx":
+		p, err := percentileApproxArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReducePercentileApprox(p), nil
+	case "top":
+		opt, err := topBottomArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.tieBreak != "" {
+			return ReduceTopPairs(opt.n, opt.distinct), nil
+		}
+		return ReduceTop(opt.n, opt.distinct), nil
+	case "bottom":
+		opt, err := topBottomArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.tieBreak != "" {
+			return ReduceBottomPairs(opt.n, opt.distinct), nil
+		}
+		return ReduceBottom(opt.n, opt.distinct), nil
+	case "derivative":
+		opt, err := derivativeArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.zero {
+			return ReduceDerivativeOrZero(opt.policy, opt.smoothing), nil
+		}
+		return ReduceDerivative(opt.policy, opt.smoothing), nil
+	case "difference":
+		return ReduceDifference, nil
+	case "cumulative_sum":
+		return ReduceCumulativeSum, nil
+	case "integral":
+		unit, err := unitArg(c, time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceIntegral(unit), nil
+	case "elapsed":
+		unit, err := unitArg(c, time.Nanosecond)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceElapsed(unit), nil
+	case "series_count":
+		return ReduceSeriesCount, nil
+	case "distinct":
+		return ReduceDistinct, nil
+	case "distinct_changes":
+		return NewDistinctChangesReducer().Reduce, nil
+	case "count_distinct":
+		opt, err := countDistinctArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		if opt.gap > 0 {
+			return ReduceCountDistinctSessions(opt.gap), nil
+		} else if opt.approx {
+			return ReduceCountDistinctApprox, nil
+		}
+		return ReduceCountDistinct(opt.withValues), nil
+	case "moving_average":
+		window, err := movingWindowArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceMovingAverage(window), nil
+	case "moving_stddev":
+		window, err := movingWindowArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceMovingStddev(window), nil
+	case "moving_min", "moving_max":
+		window, err := movingWindowArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceMovingExtreme(window, c.Name == "moving_max"), nil
+	case "time_weighted_mean":
+		return ReduceTimeWeightedMean, nil
+	case "mean_over_time":
+		interval, err := meanOverTimeArg(c)
+		if err != nil {
+			return nil, err
+		}
+		// without the bounds of the interval, the last value is only extended to the next boundary
+		fn := ReduceMeanOverTime(interval)
+		return func(values []interface{}) interface{} {
+			return fn(values, math.MinInt64, math.MaxInt64)
+		}, nil
+	case "holt_winters":
+		n, season, err := holtWintersArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceHoltWinters(n, season), nil
+	case "lttb":
+		n, err := lttbArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceLTTB(n), nil
+	case "nth":
+		n, err := nthArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceNth(n), nil
+	case "mode":
+		opt, err := modeArgs(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceMode(opt.count), nil
+	case "top_frequent":
+		n, err := topFrequentArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceTopFrequent(n), nil
+	case "missing_count":
+		interval, err := expectedIntervalArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceMissingCount(interval), nil
+	case "count_gaps":
+		interval, err := gapIntervalArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceCountGaps(interval), nil
+	case "histogram":
+		return ReduceHistogram, nil
+	case "sample":
+		n, err := sampleArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return ReduceSample(n, rand.Intn), nil
+	default:
+		return nil, fmt.Errorf("function not found: %q", c.Name)
+	}
+}
+
+// BoundedReduceFunc is a ReduceFunc that also depends on the bounds of the interval it reduces, such as to extend
+// the last value to the end of the interval. Start is inclusive and end exclusive.
+type BoundedReduceFunc func(values []interface{}, start, end int64) interface{}
+
+// InitializeBoundedReduceFunc takes an aggregate call from the query and returns its BoundedReduceFunc, or nil
+// if its reducer doesn't depend on the bounds of the interval. Only mean_over_time() does. Calls are validated
+// by InitializeReduceFunc.
+func InitializeBoundedReduceFunc(c *Call) BoundedReduceFunc {
+	if c == nil || c.Name != "mean_over_time" {
+		return nil
+	}
+	interval, err := meanOverTimeArg(c)
+	if err != nil {
+		return nil
+	}
+	return ReduceMeanOverTime(interval)
+}
+
+// StatefulReducer reduces the mapper outputs of each interval in time order, keeping state from one interval to
+// the next, such as the distinct values of the previous interval for distinct_changes(). Since its results depend
+// on every interval reduced before, a StatefulReducer must be instantiated per query and never shared between
+// queries or series. InitializeReduceFunc returns the Reduce method of a new one each time it's called.
+type StatefulReducer interface {
+	Reduce(values []interface{}) interface{}
+}
+
+// statefulReducers are the functions reduced by a StatefulReducer.
+var statefulReducers = map[string]bool{"distinct_changes": true}
+
+// IsStateful returns true if c is reduced by a StatefulReducer. Its results depend on the intervals reduced
+// before, so they mustn't be cached and reused for another call.
+func IsStateful(c *Call) bool {
+	return c != nil && statefulReducers[c.Name]
+}
+
+// StreamingReducer reduces mapper outputs pushed one at a time rather than all at once, so the outputs of every
+// mapper needn't be collected before reducing. Its result is the same as the ReduceFunc of the same call.
+type StreamingReducer interface {
+	Push(v interface{})
+	Result() interface{}
+}
+
+// InitializeStreamingReducer takes an aggregate call from the query and returns a function creating a
+// StreamingReducer for each interval, or nil if the call can only be reduced by its ReduceFunc. Only sum(),
+// count(), mean(), min(), max() and spread() of a field, without options, reduce incrementally.
+func InitializeStreamingReducer(c *Call) func() StreamingReducer {
+	if c == nil || len(c.Args) != 1 {
+		return nil
+	}
+	if _, ok := c.Args[0].(*VarRef); !ok {
+		return nil
+	}
+
+	switch c.Name {
+	case "sum":
+		return func() StreamingReducer { return &sumReducer{} }
+	case "count":
+		return func() StreamingReducer { return &countReducer{} }
+	case "mean":
+		return func() StreamingReducer { return &meanReducer{} }
+	case "min":
+		return func() StreamingReducer { return &extremeReducer{} }
+	case "max":
+		return func() StreamingReducer { return &extremeReducer{max: true} }
+	case "spread":
+		return func() StreamingReducer { return &spreadReducer{max: extremeReducer{max: true}} }
+	}
+	return nil
+}
+
+// sumReducer reduces sums like ReduceSum. It keeps the sum of each mapper rather than a running total
+// so that they are added pairwise, with the same rounding as ReduceSum.
+type sumReducer struct {
+	sums []float64
+}
+
+func (r *sumReducer) Push(v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		r.sums = append(r.sums, v)
+	case *Partial:
+		if v.Count > 0 {
+			r.sums = append(r.sums, v.Sum)
+		}
+	}
+}
+
+func (r *sumReducer) Result() interface{} {
+	if sum, ok := MergeSumPartials(r.sums); ok {
+		return sum
+	}
+	return nil
+}
+
+// countReducer reduces counts like ReduceCount.
+type countReducer struct {
+	n int64
+}
+
+func (r *countReducer) Push(v interface{}) {
+	r.n += countOf(v)
+}
+
+func (r *countReducer) Result() interface{} {
+	if r.n == 0 {
+		return nil
+	}
+	return r.n
+}
+
+// meanReducer reduces means like ReduceMean, keeping the count and mean of each mapper so that they are merged
+// pairwise like ReduceMean does.
+type meanReducer struct {
+	partials []*MeanMapOutput
+}
+
+func (r *meanReducer) Push(v interface{}) {
+	if p := meanPartial(v); p != nil {
+		r.partials = append(r.partials, p)
+	}
+}
+
+func (r *meanReducer) Result() interface{} {
+	if len(r.partials) == 0 {
+		return nil
+	}
+	return mergeMeans(r.partials).Mean
+}
+
+// extremeReducer reduces the min, or the max if max is set, like ReduceMin and ReduceMax.
+type extremeReducer struct {
+	max   bool
+	value float64
+	ok    bool
+}
+
+func (r *extremeReducer) Push(v interface{}) {
+	val, ok := v.(float64)
+	if !ok {
+		return
+	}
+	switch {
+	case !r.ok:
+		r.value, r.ok = val, true
+	case r.max:
+		r.value = math.Max(r.value, val)
+	default:
+		r.value = math.Min(r.value, val)
+	}
+}
+
+func (r *extremeReducer) Result() interface{} {
+	if !r.ok {
+		return nil
+	}
+	return r.value
+}
+
+// spreadReducer reduces the spread like ReduceSpread. Its max must have max set.
+type spreadReducer struct {
+	min, max extremeReducer
+}
+
+func (r *spreadReducer) Push(v interface{}) {
+	var o spreadMapOutput
+	switch v := v.(type) {
+	case spreadMapOutput:
+		o = v
+	case *spreadMapOutput:
+		o = *v
+	default:
+		return
+	}
+	r.min.Push(o.Min)
+	r.max.Push(o.Max)
+}
+
+func (r *spreadReducer) Result() interface{} {
+	if !r.min.ok {
+		return nil
+	}
+	return r.max.value - r.min.value
+}
+
+func InitializeUnmarshaller(c *Call) (UnmarshalFunc, error) {
+	// if c is nil it's a raw data query
+	if c == nil {
+		return unmarshalRawQuery, nil
+	}
+
+	// aggregates of a transform receive the points the transform needs
+	if t := Transform(c); t != nil {
+		return InitializeUnmarshaller(t)
+	}
+	if d := CountDistinct(c); d != nil {
+		return InitializeUnmarshaller(d)
+	}
+
+	if a := registeredAggregate(c.Name); a != nil {
+		return a.unmarshalFunc, nil
+	}
+
+	// selectors returning the whole point
+	if SelectsPoint(c) {
+		return unmarshalPoint, nil
+	}
+
+	// aggregates with options that change or wrap the output of their mapper
+	if c.Name == "sum" || c.Name == "mean" || c.Name == "min" || c.Name == "max" {
+		if opt, err := numericAggregateArgs(c); err == nil && (opt.series || opt.debug || opt.coverage || opt.timestamp || opt.group != 0 || opt.bucket != nil || opt.exact || opt.compensated || opt.halfLife > 0) {
+			fn, err := InitializeUnmarshaller(&Call{Name: c.Name, Args: c.Args[:1]})
+			if err != nil {
+				return nil, err
+			}
+			if opt.exact {
+				fn = unmarshalExactSum
+			} else if opt.compensated {
+				fn = unmarshalCompensatedSum
+			} else if opt.halfLife > 0 {
+				fn = unmarshalRawQuery
+			} else if opt.timestamp {
+				fn = unmarshalMinMax
+			}
+			if opt.group != 0 || opt.bucket != nil {
+				fn = unmarshalByBucket(fn)
+			}
+			if opt.debug {
+				fn = unmarshalWithNaNOrigin(fn)
+			}
+			if opt.coverage {
+				fn = unmarshalWithCoverage(fn)
+			}
+			if opt.series {
+				fn = unmarshalWithSeries(fn)
+			}
+			return fn, nil
+		}
+	}
+
+	// Retrieve marshal function by name
+	switch c.Name {
+	case "count":
+		if opt, _ := countArgs(c); opt.tc != 0 || opt.bucket != nil {
+			return unmarshalByBucket(unmarshalCount), nil
+		}
+		return unmarshalCount, nil
+	case "derivative", "difference", "cumulative_sum", "integral", "elapsed", "moving_average", "moving_stddev", "nth",
+		"missing_count", "holt_winters", "count_gaps", "moving_min", "moving_max",
+		"time_weighted_mean", "mean_over_time", "lttb":
+		// functions that depend on the order of points are mapped by MapRawQuery
+		return unmarshalRawQuery, nil
+	case "all_min", "all_max":
+		return unmarshalRawQuery, nil
+	case "mean", "log_mean":
+		return func(b []byte) (interface{}, error) {
+			var o MeanMapOutput
+			if err := json.Unmarshal(b, &o); err != nil {
+				return nil, err
+			}
+			return &o, checkPartialVersion(c.Name, o.Version)
+		}, nil
+	case "spread", "range":
+		return func(b []byte) (interface{}, error) {
+			var o spreadMapOutput
+			if err := json.Unmarshal(b, &o); err != nil {
+				return nil, err
+			}
+			return &o, checkPartialVersion(c.Name, o.Version)
+		}, nil
+	case "mean_weighted":
+		return func(b []byte) (interface{}, error) {
+			var o weightedMeanMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "ratio", "percentage":
+		return func(b []byte) (interface{}, error) {
+			var o ratioMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "skewness", "kurtosis":
+		return func(b []byte) (interface{}, error) {
+			var o momentsMapOutput
+			if err := json.Unmarshal(b, &o); err != nil {
+				return nil, err
+			}
+			return &o, checkPartialVersion(c.Name, o.Version)
+		}, nil
+	case "geometric_mean":
+		return func(b []byte) (interface{}, error) {
+			var o geometricMeanMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "harmonic_mean":
+		return func(b []byte) (interface{}, error) {
+			var o harmonicMeanMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "rms":
+		return func(b []byte) (interface{}, error) {
+			var o rmsMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "first", "last":
+		// the reducers expect the firstLastMapOutput value emitted by MapFirst and MapLast. Values decode as
+		// float64, string or bool, so integer values come back as float64
+		return func(b []byte) (interface{}, error) {
+			var o firstLastMapOutput
+			err := json.Unmarshal(b, &o)
+			return o, err
+		}, nil
+	case "stddev", "log_stddev", "variance", "stddev_pop", "variance_pop":
+		if onePass, _ := stddevArgs(c); onePass {
+			return func(b []byte) (interface{}, error) {
+				// nodes that predate one pass partials by default send the values of the two pass algorithm
+				if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+					var values []float64
+					if err := json.Unmarshal(b, &values); err != nil {
+						return nil, err
+					}
+					o := &stddevOnePassMapOutput{Version: PartialVersion}
+					for _, v := range values {
+						o.add(v)
+					}
+					if o.Count == 0 {
+						return nil, nil
+					}
+					return o, nil
+				}
+
+				var o stddevOnePassMapOutput
+				if err := json.Unmarshal(b, &o); err != nil {
+					return nil, err
+				}
+				return &o, checkPartialVersion(c.Name, o.Version)
+			}, nil
+		}
+		return func(b []byte) (interface{}, error) {
+			val := make([]float64, 0)
+			err := json.Unmarshal(b, &val)
+			return val, err
+		}, nil
+	case "percentile_approx":
+		return func(b []byte) (interface{}, error) {
+			d := &TDigest{}
+			err := json.Unmarshal(b, d)
+			return d, err
+		}, nil
+	case "percentile":
+		// the reducers expect the []interface{} emitted by MapEcho
+		var fn UnmarshalFunc = func(b []byte) (interface{}, error) {
+			a := make([]interface{}, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}
+		opt, _ := percentileArgs(c)
+		if opt.halfLife > 0 || opt.dedupe {
+			fn = unmarshalRawQuery
+		} else if opt.timestamp {
+			fn = unmarshalMedianWithTime
+		}
+		if opt.coverage {
+			return unmarshalWithCoverage(fn), nil
+		}
+		return fn, nil
+	case "top", "bottom":
+		if opt, _ := topBottomArgs(c); opt.tieBreak != "" {
+			return func(b []byte) (interface{}, error) {
+				a := make([]topBottomPair, 0)
+				err := json.Unmarshal(b, &a)
+				return a, err
+			}, nil
+		}
+		return func(b []byte) (interface{}, error) {
+			a := make([]float64, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}, nil
+	case "median", "mode":
+		if _, timestamp, _ := medianArgs(c); timestamp && c.Name == "median" {
+			return unmarshalMedianWithTime, nil
+		}
+		if c.Name == "mode" {
+			if opt, _ := modeArgs(c); opt.nulls {
+				return func(b []byte) (interface{}, error) {
+					var o modeMapOutput
+					err := json.Unmarshal(b, &o)
+					return &o, err
+				}, nil
+			}
+		}
+		return func(b []byte) (interface{}, error) {
+			a := make([]float64, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}, nil
+	case "top_frequent":
+		return unmarshalFrequencies, nil
+	case "sample":
+		return func(b []byte) (interface{}, error) {
+			var o sampleMapOutput
+			if err := json.Unmarshal(b, &o); err != nil {
+				return nil, err
+			}
+			return &o, nil
+		}, nil
+	case "histogram":
+		return func(b []byte) (interface{}, error) {
+			a := make([]histogramBucket, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}, nil
+	case "series_count":
+		return func(b []byte) (interface{}, error) {
+			a := make([]uint64, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}, nil
+	case "distinct", "distinct_changes", "percentiles", "percentile_rank":
+		return func(b []byte) (interface{}, error) {
+			a := make([]interface{}, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}, nil
+	case "count_distinct":
+		if opt, _ := countDistinctArgs(c); opt.gap > 0 {
+			return unmarshalRawQuery, nil
+		} else if opt.approx {
+			return func(b []byte) (interface{}, error) {
+				h := &HyperLogLog{}
+				err := json.Unmarshal(b, h)
+				return h, err
+			}, nil
+		}
+		return func(b []byte) (interface{}, error) {
+			a := make([]interface{}, 0)
+			err := json.Unmarshal(b, &a)
+			return a, err
+		}, nil
+	default:
+		return unmarshalJSON, nil
+	}
+}
+
+// unmarshalJSON decodes a map output as a generic JSON value.
+func unmarshalJSON(b []byte) (interface{}, error) {
+	var val interface{}
+	err := json.Unmarshal(b, &val)
+	return val, err
+}
+
+// PartialVersion is the version of the partial map outputs, such as MeanMapOutput, that are serialized between
+// nodes. Bump it whenever a partial changes in a way that nodes running the previous version can't merge.
+const PartialVersion = 1
+
+// partialVersionWindow is how many versions older or newer than PartialVersion a node still merges during a
+// rolling upgrade. Partials from nodes that predate versioning unmarshal as version 0.
+const partialVersionWindow = 1
+
+// checkPartialVersion returns an error if a partial of the given version can't be merged by this node.
+func checkPartialVersion(name string, version int) error {
+	if version < PartialVersion-partialVersionWindow || version > PartialVersion+partialVersionWindow {
+		return fmt.Errorf("unsupported partial version %d for %s(), expected %d to %d", version, name,
+			PartialVersion-partialVersionWindow, PartialVersion+partialVersionWindow)
+	}
+	return nil
+}
+
+// numericOptions are the optional arguments of sum(), mean(), min() and max().
+type numericOptions struct {
+	factor      float64       // scaling factor applied to the reduced result, e.g. sum(bytes, 0.001)
+	strict      bool          // sum() and mean() only: reject values that lose precision as a float
+	exact       bool          // sum() and mean() only: use exact decimal arithmetic
+	compensated bool          // sum() only: accumulate with compensated summation
+	series      bool          // also report how many series contributed to the result
+	debug       bool          // sum() and mean() only: report the series that produced a NaN result or overflow
+	coverage    bool          // sum() and mean() only: report the time range of the points the result covers
+	group       TimeComponent // sum() and mean() only: aggregate per hour of day or day of week
+	bucket      Expr          // sum() and mean() only: aggregate per bucket computed from each value, e.g. value % 10
+	field       string        // the field being aggregated
+	flag        string        // sum() and mean() only: exclude points whose boolean flag field is true
+	halfLife    time.Duration // sum() and mean() only: weight points by time decay with this half-life
+	point       bool          // min() and max() only: return all the fields of the selected point
+	timestamp   bool          // min() and max() only: return the timestamp of the selected value along with it
+}
+
+// numericAggregateArgs returns the optional arguments of sum(), mean(), min() and max(): a numeric scaling
+// factor, the 'series' flag and, for sum() and mean(), the 'strict', 'exact', 'debug', 'coverage' and time
+// component grouping flags. Sum() also takes the 'compensated' flag. Sum() and mean() also take the name of a
+// boolean field flagging bad points to exclude, e.g. sum(value, bad), a half-life duration to weight points by
+// time decay, e.g. mean(value, 7d), and an expression computing an integer bucket from each value to aggregate
+// per bucket, e.g. sum(value, value % 10). Min() and max() take the 'point' flag to return all the fields of
+// the selected point, or the 'time' flag to return the timestamp of the selected value along with it. The
+// factor defaults to 1.
+func numericAggregateArgs(c *Call) (numericOptions, error) {
+	opt := numericOptions{factor: 1}
+	if len(c.Args) < 1 || len(c.Args) > 5 {
+		return opt, fmt.Errorf("expected one to five arguments for %s()", c.Name)
+	}
+	if field, ok := c.Args[0].(*VarRef); ok {
+		opt.field = field.Val
+	}
+
+	hasFactor := false
+	for _, arg := range c.Args[1:] {
+		switch arg := arg.(type) {
+		case *NumberLiteral:
+			if hasFactor {
+				return opt, fmt.Errorf("expected a single scaling factor in %s()", c.Name)
+			}
+			opt.factor, hasFactor = arg.Val, true
+		case *StringLiteral:
+			if arg.Val == "series" && !opt.series {
+				opt.series = true
+			} else if arg.Val == "strict" && !opt.strict && !opt.exact && !opt.compensated && (c.Name == "sum" || c.Name == "mean") {
+				opt.strict = true
+			} else if arg.Val == "exact" && !opt.exact && !opt.strict && !opt.compensated && (c.Name == "sum" || c.Name == "mean") {
+				opt.exact = true
+			} else if arg.Val == "compensated" && !opt.compensated && !opt.strict && !opt.exact && c.Name == "sum" {
+				opt.compensated = true
+			} else if arg.Val == "point" && !opt.point && (c.Name == "min" || c.Name == "max") {
+				opt.point = true
+			} else if arg.Val == "time" && !opt.timestamp && (c.Name == "min" || c.Name == "max") {
+				opt.timestamp = true
+			} else if arg.Val == "debug" && !opt.debug && (c.Name == "sum" || c.Name == "mean") {
+				opt.debug = true
+			} else if arg.Val == "coverage" && !opt.coverage && (c.Name == "sum" || c.Name == "mean") {
+				opt.coverage = true
+			} else if tc, ok := timeComponentFlag(arg.Val); ok && opt.group == 0 && (c.Name == "sum" || c.Name == "mean") {
+				opt.group = tc
+			} else {
+				return opt, fmt.Errorf("unexpected argument %s in %s()", arg.String(), c.Name)
+			}
+		case *VarRef:
+			if opt.field == "" || opt.flag != "" || (c.Name != "sum" && c.Name != "mean") {
+				return opt, fmt.Errorf("unexpected argument %s in %s()", arg.String(), c.Name)
+			}
+			opt.flag = arg.Val
+		case *BinaryExpr:
+			if opt.field == "" || opt.bucket != nil || (c.Name != "sum" && c.Name != "mean") {
+				return opt, fmt.Errorf("unexpected argument %s in %s()", arg.String(), c.Name)
+			}
+			opt.bucket = arg
+		case *DurationLiteral:
+			if arg.Val <= 0 || opt.halfLife != 0 || (c.Name != "sum" && c.Name != "mean") {
+				return opt, fmt.Errorf("expected a single positive half-life duration in %s()", c.Name)
+			}
+			opt.halfLife = arg.Val
+		default:
+			return opt, fmt.Errorf("expected numeric scaling factor in %s()", c.Name)
+		}
+	}
+
+	if opt.halfLife > 0 && (opt.strict || opt.exact || opt.compensated || opt.debug || opt.group != 0 || opt.bucket != nil) {
+		return opt, fmt.Errorf("a half-life can't be combined with 'strict', 'exact', 'compensated', 'debug' or grouping in %s()", c.Name)
+	} else if opt.group != 0 && opt.bucket != nil {
+		return opt, fmt.Errorf("can't group by both a time component and a bucket expression in %s()", c.Name)
+	} else if opt.point && (hasFactor || opt.series || opt.timestamp || opt.field == "") {
+		return opt, fmt.Errorf("'point' can't be combined with other arguments in %s()", c.Name)
+	} else if opt.timestamp && hasFactor {
+		return opt, fmt.Errorf("'time' can't be combined with a scaling factor in %s()", c.Name)
+	}
+	return opt, nil
+}
+
+// mapFunc applies the options to a map function.
+func (opt numericOptions) mapFunc(fn MapFunc) MapFunc {
+	if opt.group != 0 {
+		fn = MapByTimeComponent(fn, opt.group)
+	} else if opt.bucket != nil {
+		fn = MapByBucket(fn, opt.field, opt.bucket)
+	}
+	if opt.debug {
+		fn = MapWithNaNOrigin(fn)
+	}
+	if opt.coverage {
+		fn = MapWithCoverage(fn)
+	}
+	if opt.series {
+		fn = MapWithSeries(fn)
+	}
+	if opt.flag != "" {
+		fn = MapExcludeFlagged(fn, opt.field, opt.flag)
+	}
+	return fn
+}
+
+// reduceFunc applies the options to a reduce function.
+func (opt numericOptions) reduceFunc(fn ReduceFunc) ReduceFunc {
+	if opt.debug {
+		fn = ReduceFinite(fn)
+	}
+	fn = ReduceScaled(fn, opt.factor)
+	if opt.group != 0 || opt.bucket != nil {
+		fn = ReduceByBucket(fn)
+	}
+	if opt.debug {
+		fn = ReduceWithNaNOrigin(fn)
+	}
+	if opt.coverage {
+		fn = ReduceWithCoverage(fn)
+	}
+	if opt.series {
+		return ReduceWithSeries(fn)
+	}
+	return fn
+}
+
+// seriesIterator records the IDs of the series yielded by an iterator.
+type seriesIterator struct {
+	itr Iterator
+	ids map[uint64]struct{}
+}
+
+// Next returns the next value from the underlying iterator.
+func (s *seriesIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	seriesID, timestamp, value, ok = s.itr.Next()
+	if ok {
+		s.ids[seriesID] = struct{}{}
+	}
+	return
+}
+
+// Err returns the error that stopped the underlying iterator, if any.
+func (s *seriesIterator) Err() error { return iteratorErr(s.itr) }
+
+type seriesMapOutput struct {
+	Value     interface{}
+	SeriesIDs []uint64
+}
+
+type seriesOutput struct {
+	Value       interface{}
+	SeriesCount int
+}
+
+// MapWithSeries wraps a map function so that its output also carries the IDs of the series it read.
+func MapWithSeries(fn MapFunc) MapFunc {
+	return func(itr Iterator) interface{} {
+		s := &seriesIterator{itr: itr, ids: make(map[uint64]struct{})}
+		v := fn(s)
+		if v == nil {
+			return nil
+		} else if err, ok := v.(error); ok {
+			return err
+		}
+
+		out := &seriesMapOutput{Value: v}
+		for id := range s.ids {
+			out.SeriesIDs = append(out.SeriesIDs, id)
+		}
+		return out
+	}
+}
+
+// ReduceWithSeries wraps a reduce function over the output of MapWithSeries so that its result also reports
+// how many distinct series contributed to it.
+func ReduceWithSeries(fn ReduceFunc) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		inner := make([]interface{}, len(values))
+		ids := make(map[uint64]struct{})
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			val := v.(*seriesMapOutput)
+			inner[i] = val.Value
+			for _, id := range val.SeriesIDs {
+				ids[id] = struct{}{}
+			}
+		}
+
+		v := fn(inner)
+		if v == nil {
+			return nil
+		} else if err, ok := v.(error); ok {
+			return err
+		}
+		return &seriesOutput{Value: v, SeriesCount: len(ids)}
+	}
+}
+
+// unmarshalWithSeries unmarshals the output of MapWithSeries, using fn to unmarshal the wrapped output.
+func unmarshalWithSeries(fn UnmarshalFunc) UnmarshalFunc {
+	return func(b []byte) (interface{}, error) {
+		var o struct {
+			Value     json.RawMessage
+			SeriesIDs []uint64
+		}
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+		v, err := fn(o.Value)
+		return &seriesMapOutput{Value: v, SeriesIDs: o.SeriesIDs}, err
+	}
+}
+
+// coverageIterator records the earliest and latest timestamps yielded by an iterator.
+type coverageIterator struct {
+	itr      Iterator
+	min, max int64
+	found    bool
+}
+
+// Next returns the next value from the underlying iterator.
+func (c *coverageIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	seriesID, timestamp, value, ok = c.itr.Next()
+	if !ok {
+		return
+	}
+	if !c.found || timestamp < c.min {
+		c.min = timestamp
+	}
+	if !c.found || timestamp > c.max {
+		c.max = timestamp
+	}
+	c.found = true
+	return
+}
+
+// Err returns the error that stopped the underlying iterator, if any.
+func (c *coverageIterator) Err() error { return iteratorErr(c.itr) }
+
+// coverageOutput is the output of an aggregate, or of its mapper, along with the earliest and latest timestamps
+// of the points it was computed from, so consumers know how much of a nominal interval the data covers.
+type coverageOutput struct {
+	Value   interface{}
+	MinTime int64
+	MaxTime int64
+}
+
+// MapWithCoverage wraps a map function so that its output also carries the time range of the points it read.
+func MapWithCoverage(fn MapFunc) MapFunc {
+	return func(itr Iterator) interface{} {
+		c := &coverageIterator{itr: itr}
+		v := fn(c)
+		if v == nil || !c.found {
+			return nil
+		} else if err, ok := v.(error); ok {
+			return err
+		}
+		return &coverageOutput{Value: v, MinTime: c.min, MaxTime: c.max}
+	}
+}
+
+// ReduceWithCoverage wraps a reduce function over the output of MapWithCoverage so that its result also reports
+// the earliest and latest timestamps of the points that contributed to it.
+func ReduceWithCoverage(fn ReduceFunc) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		inner := make([]interface{}, len(values))
+		var out *coverageOutput
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			val := v.(*coverageOutput)
+			inner[i] = val.Value
+			if out == nil {
+				out = &coverageOutput{MinTime: val.MinTime, MaxTime: val.MaxTime}
+			}
+			if val.MinTime < out.MinTime {
+				out.MinTime = val.MinTime
+			}
+			if val.MaxTime > out.MaxTime {
+				out.MaxTime = val.MaxTime
+			}
+		}
+
+		v := fn(inner)
+		if v == nil || out == nil {
+			return nil
+		} else if err, ok := v.(error); ok {
+			return err
+		}
+		out.Value = v
+		return out
+	}
+}
+
+// unmarshalWithCoverage unmarshals the output of MapWithCoverage, using fn to unmarshal the wrapped output.
+func unmarshalWithCoverage(fn UnmarshalFunc) UnmarshalFunc {
+	return func(b []byte) (interface{}, error) {
+		var o struct {
+			Value   json.RawMessage
+			MinTime int64
+			MaxTime int64
+		}
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+		v, err := fn(o.Value)
+		return &coverageOutput{Value: v, MinTime: o.MinTime, MaxTime: o.MaxTime}, err
+	}
+}
+
+// FlagField returns the name of the boolean field flagging points to exclude from an aggregate, such as bad in
+// sum(value, bad), or an empty string if there's none. For calls with a flag field, mappers must yield all the
+// fields of each point as a map keyed by field name rather than the value of a single field.
+func FlagField(c *Call) string {
+	if c == nil || (c.Name != "sum" && c.Name != "mean") {
+		return ""
+	}
+	opt, err := numericAggregateArgs(c)
+	if err != nil {
+		return ""
+	}
+	return opt.flag
+}
+
+// MultiFieldCall returns true if the map function of c reads more than one field of each point, such as sum()
+// with a flag field, top() with a tie-breaking field or a selector returning the whole point. Mappers must then
+// yield all the fields of each point as a map keyed by field name rather than the value of a single field.
+func MultiFieldCall(c *Call) bool {
+	if FlagField(c) != "" || SelectsPoint(c) || CountsAll(c) {
+		return true
+	}
+	if c != nil && (c.Name == "mean_weighted" || c.Name == "ratio" || c.Name == "percentage") {
+		return true
+	}
+	if c != nil && (c.Name == "top" || c.Name == "bottom") {
+		opt, err := topBottomArgs(c)
+		return err == nil && opt.tieBreak != ""
+	}
+	return false
+}
+
+// CountsAll returns true if c is count(*), which counts every point rather than the points with a field. Mappers
+// of count(*) yield the fields of each point, so a point is counted whichever fields it has and whatever their
+// types.
+func CountsAll(c *Call) bool {
+	if c == nil || c.Name != "count" || len(c.Args) == 0 {
+		return false
+	}
+	_, ok := c.Args[0].(*Wildcard)
+	return ok
+}
+
+// numericAggregates are the functions that compute over the numeric values of a field and skip any other value.
+var numericAggregates = map[string]bool{
+	"sum": true, "mean": true, "min": true, "max": true, "spread": true, "range": true, "all_min": true, "all_max": true,
+	"stddev": true, "variance": true, "stddev_pop": true, "variance_pop": true, "log_mean": true, "log_stddev": true,
+	"sum_of_squares": true, "rms": true, "geometric_mean": true, "harmonic_mean": true, "mean_weighted": true,
+	"ratio": true, "percentage": true, "skewness": true, "kurtosis": true, "median": true, "percentile": true,
+	"percentiles": true, "percentile_rank": true, "percentile_approx": true, "histogram": true, "top_frequent": true,
+	"derivative": true, "difference": true, "cumulative_sum": true, "integral": true, "moving_average": true,
+	"moving_stddev": true, "moving_min": true, "moving_max": true, "holt_winters": true, "time_weighted_mean": true,
+	"mean_over_time": true, "lttb": true,
+}
+
+// CheckFieldType returns an error if c computes over numeric values but its field has the type typ of a string
+// or boolean field. The mappers skip values that aren't numeric, so the result would otherwise silently be
+// empty.
+func CheckFieldType(c *Call, field string, typ DataType) error {
+	if c == nil || !numericAggregates[c.Name] {
+		return nil
+	}
+	if typ == String || typ == Boolean {
+		return fmt.Errorf("%s() can't be applied to %s field %s", c.Name, typ, field)
+	}
+	return nil
+}
+
+// flaggedIterator yields the value of a field from an iterator over all the fields of each point, skipping
+// points where the flag field is true or that don't have the field.
+type flaggedIterator struct {
+	itr   Iterator
+	field string
+	flag  string
+}
+
+// Next returns the next unflagged value from the underlying iterator.
+func (f *flaggedIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	for {
+		seriesID, timestamp, value, ok = f.itr.Next()
+		if !ok {
+			return 0, 0, nil, false
+		}
+
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if flagged, _ := fields[f.flag].(bool); flagged {
+			continue
+		}
+		if v, ok := fields[f.field]; ok {
+			return seriesID, timestamp, v, true
+		}
+	}
+}
+
+// Err returns the error that stopped the underlying iterator, if any.
+func (f *flaggedIterator) Err() error { return iteratorErr(f.itr) }
+
+// MapExcludeFlagged wraps a map function over the values of field so that points where the boolean flag field
+// is true are excluded. The iterator must yield all the fields of each point, see FlagField.
+func MapExcludeFlagged(fn MapFunc, field, flag string) MapFunc {
+	return func(itr Iterator) interface{} {
+		return fn(&flaggedIterator{itr: itr, field: field, flag: flag})
+	}
+}
+
+// nanIterator records the ID of the first series to yield a NaN value.
+type nanIterator struct {
+	itr      Iterator
+	seriesID uint64
+	found    bool
+}
+
+// Next returns the next value from the underlying iterator.
+func (n *nanIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	seriesID, timestamp, value, ok = n.itr.Next()
+	if f, isFloat := value.(float64); isFloat && ok && !n.found && math.IsNaN(f) {
+		n.seriesID, n.found = seriesID, true
+	}
+	return
+}
+
+// Err returns the error that stopped the underlying iterator, if any.
+func (n *nanIterator) Err() error { return iteratorErr(n.itr) }
+
+type nanOriginMapOutput struct {
+	Value       interface{}
+	HasNaN      bool
+	NaNSeriesID uint64
+}
+
+// MapWithNaNOrigin wraps a map function so that its output also carries the ID of the first series that
+// yielded a NaN value, if any.
+func MapWithNaNOrigin(fn MapFunc) MapFunc {
+	return func(itr Iterator) interface{} {
+		n := &nanIterator{itr: itr}
+		v := fn(n)
+		if v == nil {
+			return nil
+		} else if err, ok := v.(error); ok {
+			return err
+		}
+		return &nanOriginMapOutput{Value: v, HasNaN: n.found, NaNSeriesID: n.seriesID}
+	}
+}
+
+// ReduceWithNaNOrigin wraps a reduce function over the output of MapWithNaNOrigin. If the result is NaN, or the
+// result of any bucket of a grouped or bucketed aggregate is, an error naming the first series that yielded a
+// NaN value is returned instead. Other structured results aren't inspected; 'debug' is only accepted by sum()
+// and mean(), whose results are float64s or buckets of them.
+func ReduceWithNaNOrigin(fn ReduceFunc) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		inner := make([]interface{}, len(values))
+		var origin *nanOriginMapOutput
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			val := v.(*nanOriginMapOutput)
+			inner[i] = val.Value
+			if origin == nil && val.HasNaN {
+				origin = val
+			}
+		}
+
+		v := fn(inner)
+		if !nanResult(v) {
+			return v
+		} else if origin == nil {
+			return fmt.Errorf("result is NaN")
+		}
+		return fmt.Errorf("result is NaN: first NaN value from series %d", origin.NaNSeriesID)
+	}
+}
+
+// nanResult returns true if v is NaN, or a bucket of v is.
+func nanResult(v interface{}) bool {
+	switch v := v.(type) {
+	case float64:
+		return math.IsNaN(v)
+	case []*bucketOutput:
+		for _, o := range v {
+			if nanResult(o.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReduceFinite wraps a reduce function to check the result of combining each mapper's partial. If the result
+// overflows to infinity, an error naming the partial that caused it is returned instead of the result. NaN
+// results are left for ReduceWithNaNOrigin to report. The partials are reduced once, and only a result that
+// isn't finite is traced back to its partial. Once a running result is infinite or NaN it stays so, so the
+// partial is found by a binary search over the prefixes of the partials.
+func ReduceFinite(fn ReduceFunc) ReduceFunc {
+	nonFinite := func(v interface{}) bool {
+		f, ok := v.(float64)
+		return ok && (math.IsInf(f, 0) || math.IsNaN(f))
+	}
+	return func(values []interface{}) interface{} {
+		v := fn(values)
+		if !nonFinite(v) {
+			return v
+		}
+
+		// find the first partial after which the result isn't finite
+		i := sort.Search(len(values), func(i int) bool { return nonFinite(fn(values[:i+1])) })
+		if i < len(values) {
+			if f := fn(values[:i+1]).(float64); math.IsInf(f, 0) {
+				return fmt.Errorf("result overflowed to %v after combining partial %d of %d", f, i+1, len(values))
+			}
+		}
+		return v
+	}
+}
+
+// unmarshalWithNaNOrigin unmarshals the output of MapWithNaNOrigin, using fn to unmarshal the wrapped output.
+func unmarshalWithNaNOrigin(fn UnmarshalFunc) UnmarshalFunc {
+	return func(b []byte) (interface{}, error) {
+		var o struct {
+			Value       json.RawMessage
+			HasNaN      bool
+			NaNSeriesID uint64
+		}
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+		v, err := fn(o.Value)
+		return &nanOriginMapOutput{Value: v, HasNaN: o.HasNaN, NaNSeriesID: o.NaNSeriesID}, err
+	}
+}
+
+// TimeComponent is a part of a timestamp that points can be grouped by regardless of their date.
+type TimeComponent int
+
+const (
+	// HourOfDay groups points by the hour of the day, 0-23, in UTC.
+	HourOfDay TimeComponent = iota + 1
+	// DayOfWeek groups points by the day of the week, 0-6 starting on Sunday, in UTC.
+	DayOfWeek
+)
+
+// timeComponentFlag returns the time component for the 'group_hour_of_day' and 'group_day_of_week' flags.
+func timeComponentFlag(s string) (TimeComponent, bool) {
+	switch s {
+	case "group_hour_of_day":
+		return HourOfDay, true
+	case "group_day_of_week":
+		return DayOfWeek, true
+	default:
+		return 0, false
+	}
+}
+
+// of returns the time component of a timestamp.
+func (tc TimeComponent) of(timestamp int64) int {
+	t := time.Unix(0, timestamp).UTC()
+	if tc == DayOfWeek {
+		return int(t.Weekday())
+	}
+	return t.Hour()
+}
+
+// countArgs returns the time component to group by if count() was passed a grouping flag, or the bucketing
+// expression if it was passed one, e.g. count(value, value % 10).
+func countArgs(c *Call) (countOptions, error) {
+	var opt countOptions
+	if n := len(c.Args); n > 1 {
+		if lit, ok := c.Args[n-1].(*StringLiteral); ok && lit.Val == "float" {
+			opt.float = true
+			c = &Call{Name: c.Name, Args: c.Args[:n-1]}
+		}
+	}
+	if len(c.Args) < 1 || len(c.Args) > 2 {
+		return opt, fmt.Errorf("expected one or two arguments for count()")
+	}
+	if len(c.Args) == 1 {
+		return opt, nil
+	}
+	switch arg := c.Args[1].(type) {
+	case *StringLiteral:
+		if tc, ok := timeComponentFlag(arg.Val); ok {
+			opt.tc = tc
+			return opt, nil
+		}
+	case *BinaryExpr:
+		if _, ok := c.Args[0].(*VarRef); ok {
+			opt.bucket = arg
+			return opt, nil
+		}
+	}
+	return opt, fmt.Errorf("expected 'group_hour_of_day', 'group_day_of_week' or a bucket expression as second argument in count()")
+}
+
+// countOptions are the optional arguments of count().
+type countOptions struct {
+	tc     TimeComponent // count per hour of the day or day of the week
+	bucket Expr          // count per bucket computed by the expression
+	float  bool          // return float64 counts rather than int64s
+}
+
+// bufferedPoint is a point read from an iterator to be replayed.
+type bufferedPoint struct {
+	seriesID  uint64
+	timestamp int64
+	value     interface{}
+}
+
+// replayIterator iterates over the points buffered from another iterator, reporting the same order and error.
+type replayIterator struct {
+	points  []bufferedPoint
+	ordered bool
+	err     error
+}
+
+// Next returns the next buffered point.
+func (r *replayIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	if len(r.points) == 0 {
+		return 0, 0, nil, false
+	}
+	p := r.points[0]
+	r.points = r.points[1:]
+	return p.seriesID, p.timestamp, p.value, true
+}
+
+// Ordered returns true if the buffered iterator yielded points in time order.
+func (r *replayIterator) Ordered() bool { return r.ordered }
+
+// Err returns the error that stopped the buffered iterator, if any.
+func (r *replayIterator) Err() error { return r.err }
+
+// CombineMapFuncs returns a map function running each of fns over the points of a single pass over the iterator,
+// so that several aggregates of the same field, such as min(), max() and mean(), read it only once. Points are
+// buffered and replayed to each map function in turn, and the outputs are returned in the order of fns. If the
+// iterator or any map function fails, the first error is returned instead.
+func CombineMapFuncs(fns []MapFunc) MapFunc {
+	return func(itr Iterator) interface{} {
+		var points []bufferedPoint
+		for seriesID, k, v, ok := itr.Next(); ok; seriesID, k, v, ok = itr.Next() {
+			points = append(points, bufferedPoint{seriesID: seriesID, timestamp: k, value: v})
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+
+		outputs := make([]interface{}, len(fns))
+		for i, fn := range fns {
+			outputs[i] = fn(&replayIterator{points: points, ordered: isOrdered(itr)})
+			if err, ok := outputs[i].(error); ok {
+				return err
+			}
+		}
+		return outputs
+	}
+}
+
+// rawOutputsIterator iterates over buffered points.
+type rawOutputsIterator struct {
+	points rawOutputs
+}
+
+// Next returns the next buffered point.
+func (r *rawOutputsIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	if len(r.points) == 0 {
+		return 0, 0, nil, false
+	}
+	p := r.points[0]
+	r.points = r.points[1:]
+	return 0, p.Timestamp, p.Values, true
+}
+
+type bucketOutput struct {
+	Bucket int
+	Value  interface{}
+}
+
+// MapByTimeComponent wraps a map function so that it's run separately over the points of each hour of day
+// or day of week. Buckets without any output are left out.
+func MapByTimeComponent(fn MapFunc, tc TimeComponent) MapFunc {
+	return mapByBucket(fn, func(timestamp int64, value interface{}) (int, bool) {
+		return tc.of(timestamp), true
+	})
+}
+
+// MapByBucket wraps a map function so that it's run separately over the points of each bucket computed by
+// evaluating expr, such as value % 10, for the value of field. Results are keyed by the integer part of the
+// bucket. Points where expr doesn't evaluate to a number are left out, as are buckets without any output.
+func MapByBucket(fn MapFunc, field string, expr Expr) MapFunc {
+	return mapByBucket(fn, func(timestamp int64, value interface{}) (int, bool) {
+		if i, ok := value.(int64); ok {
+			value = float64(i)
+		}
+		f, ok := Eval(expr, map[string]interface{}{field: value}).(float64)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false
+		}
+		return int(math.Floor(f)), true
+	})
+}
+
+// mapByBucket runs a map function separately over the points of each bucket returned by key.
+func mapByBucket(fn MapFunc, key func(timestamp int64, value interface{}) (int, bool)) MapFunc {
+	return func(itr Iterator) interface{} {
+		buckets := make(map[int]rawOutputs)
+		for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+			b, ok := key(k, v)
+			if !ok {
+				continue
+			}
+			buckets[b] = append(buckets[b], &rawQueryMapOutput{k, v})
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+
+		var out []*bucketOutput
+		for b, points := range buckets {
+			v := fn(&rawOutputsIterator{points: points})
+			if v == nil {
+				continue
+			} else if err, ok := v.(error); ok {
+				return err
+			}
+			out = append(out, &bucketOutput{Bucket: b, Value: v})
+		}
+
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	}
+}
+
+// ReduceByTimeComponent wraps a reduce function over the output of MapByTimeComponent so that it reduces
+// each bucket separately. The results are sorted by bucket.
+func ReduceByTimeComponent(fn ReduceFunc) ReduceFunc {
+	return ReduceByBucket(fn)
+}
+
+// ReduceByBucket wraps a reduce function over the output of MapByBucket or MapByTimeComponent so that it
+// reduces each bucket separately. The results are sorted by bucket.
+func ReduceByBucket(fn ReduceFunc) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		buckets := make(map[int][]interface{})
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+			for _, o := range v.([]*bucketOutput) {
+				buckets[o.Bucket] = append(buckets[o.Bucket], o.Value)
+			}
+		}
+
+		var results []*bucketOutput
+		for b, bucketValues := range buckets {
+			v := fn(bucketValues)
+			if v == nil {
+				continue
+			} else if err, ok := v.(error); ok {
+				return err
+			}
+			results = append(results, &bucketOutput{Bucket: b, Value: v})
+		}
+
+		if len(results) == 0 {
+			return nil
+		}
+		sort.Sort(bucketOutputs(results))
+		return results
+	}
+}
+
+type bucketOutputs []*bucketOutput
+
+func (a bucketOutputs) Len() int           { return len(a) }
+func (a bucketOutputs) Less(i, j int) bool { return a[i].Bucket < a[j].Bucket }
+func (a bucketOutputs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// unmarshalByBucket unmarshals the output of MapByBucket or MapByTimeComponent, using fn to unmarshal the
+// output of each bucket.
+func unmarshalByBucket(fn UnmarshalFunc) UnmarshalFunc {
+	return func(b []byte) (interface{}, error) {
+		var o []struct {
+			Bucket int
+			Value  json.RawMessage
+		}
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+
+		out := make([]*bucketOutput, 0, len(o))
+		for _, bucket := range o {
+			v, err := fn(bucket.Value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, &bucketOutput{Bucket: bucket.Bucket, Value: v})
+		}
+		return out, nil
+	}
+}
+
+// ReduceScaled wraps a reducer, multiplying its result by factor. Scaled results are always floats, so an
+// integral factor such as 1000 still yields a float rather than an integer.
+func ReduceScaled(fn ReduceFunc, factor float64) ReduceFunc {
+	if factor == 1 {
+		return fn
+	}
+	return func(values []interface{}) interface{} {
+		v := fn(values)
+		if f, ok := v.(float64); ok {
+			return f * factor
+		}
+		return v
+	}
+}
+
+// WithFill wraps a reducer so that intervals it returns nil for, such as intervals without points, return fill
+// instead. A nil fill leaves them null. PreviousFill returns the last non-nil result of an earlier interval
+// instead, or nil before the first one.
+//
+// With PreviousFill the returned reducer keeps the last result between calls, so it must only reduce the
+// intervals of a single series, in time order, and isn't safe for concurrent use. Create one per series.
+func WithFill(fn ReduceFunc, fill interface{}) ReduceFunc {
+	if fill == nil {
+		return fn
+	}
+	if fill == PreviousFill {
+		var previous interface{}
+		return func(values []interface{}) interface{} {
+			v := fn(values)
+			if v == nil {
+				return previous
+			} else if _, ok := v.(error); !ok {
+				previous = v
+			}
+			return v
+		}
+	}
+	return func(values []interface{}) interface{} {
+		if v := fn(values); v != nil {
+			return v
+		}
+		return fill
+	}
+}
+
+// MaxExactFloat64 is the largest magnitude at which a float64 can still represent every integer exactly (2^53).
+const MaxExactFloat64 = 1 << 53
+
+// SkipNonFinite makes numeric aggregates skip NaN and infinite values as if the points were absent. By default
+// they're included, so a single NaN makes sum() or mean() of an interval NaN.
+var SkipNonFinite = false
+
+// skipped returns true if v is a value numeric aggregates skip because of SkipNonFinite.
+func skipped(v interface{}) bool {
+	f, ok := v.(float64)
+	return ok && SkipNonFinite && (math.IsNaN(f) || math.IsInf(f, 0))
+}
+
+// toFloat64 converts a numeric value, which is a float64 or an int64 for integer fields, to a float64. It
+// returns false for values that aren't numeric, such as strings and booleans, which aggregates skip, and for
+// NaN and infinite values if SkipNonFinite is set.
+func toFloat64(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		if skipped(v) {
+			return 0, false
+		}
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// finiteFloat64 converts a numeric value to a float64 like toFloat64, but returns false for NaN and infinite
+// values regardless of SkipNonFinite. min() and max() always skip them since NaN never compares as an
+// extreme and would make the result depend on the order of the points.
+func finiteFloat64(v interface{}) (float64, bool) {
+	f, ok := toFloat64(v)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// exactFloat64 converts a numeric value to a float64 like toFloat64, returning false for values aggregates skip,
+// and an error if v is an integer that can't be represented exactly as a float64.
+func exactFloat64(v interface{}) (float64, bool, error) {
+	var i int64
+	switch v := v.(type) {
+	case int64:
+		i = v
+	case int:
+		i = int64(v)
+	}
+	if i > MaxExactFloat64 || i < -MaxExactFloat64 {
+		return 0, false, fmt.Errorf("integer value %d exceeds 2^53 and would lose precision as a float", i)
+	}
+	f, ok := toFloat64(v)
+	return f, ok, nil
+}
+
+// topBottomOptions are the arguments of top() and bottom().
+type topBottomOptions struct {
+	n        int
+	distinct bool   // every value is returned at most once
+	field    string // the field values are ordered by
+	tieBreak string // the field that orders values tied on field, if any
+}
+
+// topBottomArgs returns the arguments of top(field, N) or bottom(field, N), optionally followed by the
+// 'distinct' flag. A second field before N, as in top(a, b, N), breaks ties between equal values of the first.
+func topBottomArgs(c *Call) (topBottomOptions, error) {
+	var opt topBottomOptions
+	args := c.Args
+	if len(args) > 1 {
+		if ref, ok := args[1].(*VarRef); ok {
+			opt.tieBreak = ref.Val
+			args = append(args[:1:1], args[2:]...)
+		}
+	}
+
+	if len(args) < 2 || len(args) > 3 {
+		return opt, fmt.Errorf("expected field and integer for %s()", c.Name)
+	}
+	if ref, ok := args[0].(*VarRef); ok {
+		opt.field = ref.Val
+	}
+	lit, ok := args[1].(*NumberLiteral)
+	if !ok || lit.Val <= 0 || lit.Val != math.Trunc(lit.Val) {
+		return opt, fmt.Errorf("expected field and integer for %s()", c.Name)
+	}
+	opt.n = int(lit.Val)
+	if len(args) == 3 {
+		if flag, ok := args[2].(*StringLiteral); !ok || flag.Val != "distinct" {
+			return opt, fmt.Errorf("expected 'distinct' after the integer in %s()", c.Name)
+		}
+		opt.distinct = true
+	}
+	return opt, nil
+}
+
+// TimestampPolicy determines which timestamp is assigned to a result computed from a pair of points.
+type TimestampPolicy int
+
+const (
+	// LaterTimestamp stamps the result with the time of the later point. This is the default.
+	LaterTimestamp TimestampPolicy = iota
+
+	// EarlierTimestamp stamps the result with the time of the earlier point.
+	EarlierTimestamp
+
+	// MidpointTimestamp stamps the result halfway between the two points.
+	MidpointTimestamp
+)
+
+// timestamp returns the time a result computed from points at t0 and t1 is stamped with.
+func (p TimestampPolicy) timestamp(t0, t1 int64) int64 {
+	switch p {
+	case EarlierTimestamp:
+		return t0
+	case MidpointTimestamp:
+		return t0 + (t1-t0)/2
+	default:
+		return t1
+	}
+}
+
+// derivativeOptions are the optional arguments of derivative().
+type derivativeOptions struct {
+	policy    TimestampPolicy
+	smoothing int
+	zero      bool // emit a rate of 0 for intervals where no rate can be computed
+}
+
+// derivativeArgs returns the optional arguments of derivative(): a timestamp policy of 'earlier', 'later' or
+// 'midpoint', an integer smoothing window and the 'zero' flag. All default to no change from the plain
+// derivative.
+func derivativeArgs(c *Call) (derivativeOptions, error) {
+	var opt derivativeOptions
+	if len(c.Args) < 1 || len(c.Args) > 4 {
+		return opt, fmt.Errorf("expected one to four arguments for %s()", c.Name)
+	}
+
+	hasPolicy := false
+	for _, arg := range c.Args[1:] {
+		switch arg := arg.(type) {
+		case *StringLiteral:
+			if arg.Val == "zero" {
+				if opt.zero {
+					return opt, fmt.Errorf("unexpected argument %s in %s()", arg.String(), c.Name)
+				}
+				opt.zero = true
+				continue
+			}
+			if hasPolicy {
+				return opt, fmt.Errorf("expected a single timestamp policy in %s()", c.Name)
+			}
+			switch arg.Val {
+			case "later":
+				opt.policy = LaterTimestamp
+			case "earlier":
+				opt.policy = EarlierTimestamp
+			case "midpoint":
+				opt.policy = MidpointTimestamp
+			default:
+				return opt, fmt.Errorf("expected 'earlier', 'later' or 'midpoint' as timestamp policy in %s()", c.Name)
+			}
+			hasPolicy = true
+		case *NumberLiteral:
+			if opt.smoothing > 0 || arg.Val <= 0 || arg.Val != math.Trunc(arg.Val) {
+				return opt, fmt.Errorf("expected a single positive integer smoothing window in %s()", c.Name)
+			}
+			opt.smoothing = int(arg.Val)
+		default:
+			return opt, fmt.Errorf("unexpected argument %s in %s()", arg.String(), c.Name)
+		}
+	}
+	return opt, nil
+}
+
+// unmarshalRawQuery unmarshals the output of MapRawQuery.
+func unmarshalRawQuery(b []byte) (interface{}, error) {
+	a := make([]*rawQueryMapOutput, 0)
+	err := json.Unmarshal(b, &a)
+	return a, err
+}
+
+// MapCount computes the number of values in an iterator as an int64.
+func MapCount(itr Iterator) interface{} {
+	var n int64
+	for _, _, _, ok := itr.Next(); ok; _, _, _, ok = itr.Next() {
+		n++
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if n > 0 {
+		return n
+	}
+	return nil
+}
+
+// MapSeriesCount collects the IDs of the distinct series with points in an iterator, in ascending order.
+func MapSeriesCount(itr Iterator) interface{} {
+	seen := make(map[uint64]struct{})
+	for id, _, _, ok := itr.Next(); ok; id, _, _, ok = itr.Next() {
+		seen[id] = struct{}{}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+
+	ids := make([]uint64, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids
+}
+
+// ReduceSeriesCount computes the number of distinct series with points for each key, i.e. the series
+// cardinality of the interval. A series read by more than one mapper is counted once.
+func ReduceSeriesCount(values []interface{}) interface{} {
+	seen := make(map[uint64]struct{})
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, id := range v.([]uint64) {
+			seen[id] = struct{}{}
+		}
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	return float64(len(seen))
+}
+
+// uint64Slice sorts series IDs in ascending order.
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// MapSum computes the summation of values in an iterator.
+func MapSum(itr Iterator) interface{} {
+	n := float64(0)
+	count := 0
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		count++
+		n += val
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if count > 0 {
+		return n
+	}
+	return nil
+}
+
+// MapSumOfSquares computes the summation of the squares of values in an iterator.
+func MapSumOfSquares(itr Iterator) interface{} {
+	n := float64(0)
+	count := 0
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		count++
+		n += val * val
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if count > 0 {
+		return n
+	}
+	return nil
+}
+
+type rmsMapOutput struct {
+	Count int
+	SumSq float64 // sum of the squares of the values
+}
+
+// MapRMS computes the count and the sum of the squares of the values in an iterator.
+func MapRMS(itr Iterator) interface{} {
+	out := &rmsMapOutput{}
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		out.Count++
+		out.SumSq += val * val
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if out.Count == 0 {
+		return nil
+	}
+	return out
+}
+
+// ReduceRMS computes the root mean square of the values, sqrt(sum(value^2)/count), such as the magnitude of an
+// alternating signal.
+func ReduceRMS(values []interface{}) interface{} {
+	var out rmsMapOutput
+	for _, v := range values {
+		if v, ok := v.(*rmsMapOutput); ok {
+			out.Count += v.Count
+			out.SumSq += v.SumSq
+		}
+	}
+	if out.Count == 0 {
+		return nil
+	}
+	return math.Sqrt(out.SumSq / float64(out.Count))
+}
+
+// MapSumStrict computes the summation of values in an iterator. Unlike MapSum it returns an error instead
+// of silently losing precision when a value or the running sum exceeds the exact integer range of a float64.
+func MapSumStrict(itr Iterator) interface{} {
+	n := float64(0)
+	count := 0
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		f, ok, err := exactFloat64(v)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		count++
+		n += f
+		if math.Abs(n) > MaxExactFloat64 {
+			return fmt.Errorf("sum exceeds 2^53 and would lose precision as a float")
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if count > 0 {
+		return n
+	}
+	return nil
+}
+
+// ReduceSum computes the sum of values for each key. Each value is either the float64 sum of a mapper's points
+// or a *Partial summarizing any number of points.
+func ReduceSum(values []interface{}) interface{} {
+	// the sum of a single mapper, the common case for a single shard, needs no combining
+	if len(values) == 1 {
+		switch v := values[0].(type) {
+		case float64:
+			return v
+		case *Partial:
+			if v.Count > 0 {
+				return v.Sum
+			}
+			return nil
+		case nil:
+			return nil
+		}
+	}
+
+	var sums []float64
+	for _, v := range values {
+		switch v := v.(type) {
+		case float64:
+			sums = append(sums, v)
+		case *Partial:
+			if v.Count == 0 {
+				continue
+			}
+			sums = append(sums, v.Sum)
+		}
+	}
+	if sum, ok := MergeSumPartials(sums); ok {
+		return sum
+	}
+	return nil
+}
+
+// MergeSumPartials returns the total of the sums of each mapper like ReduceSum. It returns false if there are
+// no sums.
+func MergeSumPartials(sums []float64) (float64, bool) {
+	if len(sums) == 0 {
+		return 0, false
+	}
+	return pairwiseSum(sums), true
+}
+
+// ReduceCount computes the total of the counts of each mapper. Counts are int64s, so unlike float64s they're
+// exact beyond 2^53 points. An interval without points reduces to nil like other aggregates, so that the engine
+// can tell it apart and fill it; it's reported as a count of 0, see EmptyResult.
+func ReduceCount(values []interface{}) interface{} {
+	var counts []int64
+	for _, v := range values {
+		if n := countOf(v); n > 0 {
+			counts = append(counts, n)
+		}
+	}
+	if n, ok := MergeCountPartials(counts); ok && n > 0 {
+		return n
+	}
+	return nil
+}
+
+// ReduceFloatCount computes the total of the counts of each mapper like ReduceCount, but returns a float64 as
+// count() did before counts were int64s. It's used by count(field, 'float') for clients relying on float
+// counts. Counts beyond 2^53 points lose precision.
+func ReduceFloatCount(values []interface{}) interface{} {
+	if n, ok := ReduceCount(values).(int64); ok {
+		return float64(n)
+	}
+	return nil
+}
+
+// EmptyResult returns the result of c for an interval without points that fill() left empty, or nil if it has
+// none. The count of no points is 0, while their sum or mean is undefined. Reducers return nil for empty
+// intervals regardless, so that empty intervals can be filled and tag sets without any points filtered out.
+func EmptyResult(c *Call) interface{} {
+	if c == nil || c.Name != "count" || len(c.Args) == 0 {
+		return nil
+	}
+	if _, ok := c.Args[0].(*Call); ok {
+		return nil
+	}
+	opt, err := countArgs(c)
+	if err != nil || opt.tc != 0 || opt.bucket != nil {
+		return nil
+	} else if opt.float {
+		return float64(0)
+	}
+	return int64(0)
+}
+
+// countOf returns the count output by a mapper: the int64 of MapCount, the float64 count of a server predating
+// int64 counts, or the count of a *Partial.
+func countOf(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case *Partial:
+		return v.Count
+	}
+	return 0
+}
+
+// unmarshalCount unmarshals the output of MapCount. Servers predating int64 counts send float64s, which may be
+// encoded with an exponent, so they're decoded as float64s for ReduceCount to convert.
+func unmarshalCount(b []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return v, nil
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	return n.Float64()
+}
+
+// MergeCountPartials returns the total of the counts of each mapper. It returns false if there are no counts.
+func MergeCountPartials(counts []int64) (int64, bool) {
+	if len(counts) == 0 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range counts {
+		n += c
+	}
+	return n, true
+}
+
+// pairwiseBlockSize is the number of values pairwise combines add linearly rather than splitting further.
+const pairwiseBlockSize = 8
+
+// pairwiseSum adds values by recursively summing each half, so the rounding error grows with the log of the
+// number of values rather than linearly, at about the cost of a linear sum.
+func pairwiseSum(values []float64) float64 {
+	if len(values) <= pairwiseBlockSize {
+		var n float64
+		for _, v := range values {
+			n += v
+		}
+		return n
+	}
+	mid := len(values) / 2
+	return pairwiseSum(values[:mid]) + pairwiseSum(values[mid:])
+}
+
+// compensatedSumMapOutput is a sum accumulated with Neumaier's variant of Kahan summation. Compensation holds
+// the low order bits lost from Sum by each addition, so Sum+Compensation is accurate to about one rounding of
+// the result however many values are added, while a plain float64 sum accumulates the rounding of every
+// addition. It's used by sum() with the 'compensated' flag, e.g. for long runs of large integer counters.
+type compensatedSumMapOutput struct {
+	Count        int
+	Sum          float64
+	Compensation float64
+}
+
+// add adds a value to the sum, accumulating the bits lost to rounding in the compensation.
+func (o *compensatedSumMapOutput) add(val float64) {
+	t := o.Sum + val
+	if math.Abs(o.Sum) >= math.Abs(val) {
+		o.Compensation += (o.Sum - t) + val
+	} else {
+		o.Compensation += (val - t) + o.Sum
+	}
+	o.Sum = t
+}
+
+// MapCompensatedSum computes the compensated sum of values in an iterator.
+func MapCompensatedSum(itr Iterator) interface{} {
+	out := &compensatedSumMapOutput{}
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok {
+			out.Count++
+			out.add(val)
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if out.Count > 0 {
+		return out
+	}
+	return nil
+}
+
+// ReduceCompensatedSum combines the compensated sums of each mapper, adding both the sum and the compensation
+// of each so that neither loses precision.
+func ReduceCompensatedSum(values []interface{}) interface{} {
+	out := &compensatedSumMapOutput{}
+	for _, v := range values {
+		if v, ok := v.(*compensatedSumMapOutput); ok && v.Count > 0 {
+			out.Count += v.Count
+			out.add(v.Sum)
+			out.add(v.Compensation)
+		}
+	}
+	if out.Count == 0 {
+		return nil
+	}
+	return out.Sum + out.Compensation
+}
+
+// unmarshalCompensatedSum unmarshals the output of MapCompensatedSum.
+func unmarshalCompensatedSum(b []byte) (interface{}, error) {
+	var o compensatedSumMapOutput
+	err := json.Unmarshal(b, &o)
+	return &o, err
+}
+
+type exactSumMapOutput struct {
+	Count int
+	Sum   *big.Rat
+}
+
+// MapExactSum computes the exact sum of values in an iterator for sum() and mean() with the 'exact' flag, such
+// as for billing metrics. Floats are summed as the decimal they're written as, so summing 0.1 ten times is
+// exactly 1 rather than accumulating binary rounding error. It's considerably slower than MapSum.
+func MapExactSum(itr Iterator) interface{} {
+	out := &exactSumMapOutput{Sum: new(big.Rat)}
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		r, err := exactDecimal(v)
+		if err != nil {
+			return err
+		}
+		out.Count++
+		out.Sum.Add(out.Sum, r)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if out.Count > 0 {
+		return out
+	}
+	return nil
+}
+
+// exactDecimal returns a value as an exact rational. A float64 is converted from the shortest decimal that
+// represents it rather than its binary value, e.g. 0.1 is exactly 1/10.
+func exactDecimal(v interface{}) (*big.Rat, error) {
+	switch v := v.(type) {
+	case float64:
+		r, ok := new(big.Rat).SetString(strconv.FormatFloat(v, 'g', -1, 64))
+		if !ok {
+			return nil, fmt.Errorf("can't sum %v exactly", v)
+		}
+		return r, nil
+	case int64:
+		return new(big.Rat).SetInt64(v), nil
+	}
+	return nil, fmt.Errorf("can't sum %v exactly", v)
+}
+
+// reduceExactSum adds the exact sums from each mapper.
+func reduceExactSum(values []interface{}) *exactSumMapOutput {
+	out := &exactSumMapOutput{Sum: new(big.Rat)}
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		val := v.(*exactSumMapOutput)
+		out.Count += val.Count
+		out.Sum.Add(out.Sum, val.Sum)
+	}
+	return out
+}
+
+// ReduceExactSum computes the exact sum of values for each key. Only the final result is rounded to a float.
+func ReduceExactSum(values []interface{}) interface{} {
+	out := reduceExactSum(values)
+	if out.Count == 0 {
+		return nil
+	}
+	f, _ := out.Sum.Float64()
+	return f
+}
+
+// ReduceExactMean computes the exact mean of values for each key. Only the final result is rounded to a float.
+func ReduceExactMean(values []interface{}) interface{} {
+	out := reduceExactSum(values)
+	if out.Count == 0 {
+		return nil
+	}
+	f, _ := out.Sum.Quo(out.Sum, new(big.Rat).SetInt64(int64(out.Count))).Float64()
+	return f
+}
+
+// unmarshalExactSum unmarshals the output of MapExactSum.
+func unmarshalExactSum(b []byte) (interface{}, error) {
+	var o exactSumMapOutput
+	err := json.Unmarshal(b, &o)
+	return &o, err
+}
+
+// ReduceSumStrict computes the sum of values for each key, returning an error if the sum exceeds the exact
+// integer range of a float64.
+func ReduceSumStrict(values []interface{}) interface{} {
+	sum := ReduceSum(values)
+	if n, ok := sum.(float64); ok && math.Abs(n) > MaxExactFloat64 {
+		return fmt.Errorf("sum exceeds 2^53 and would lose precision as a float")
+	}
+	return sum
+}
+
+// MapMean computes the count and sum of values in an iterator to be combined by the reducer.
+func MapMean(itr Iterator) interface{} {
+	out := &MeanMapOutput{Version: PartialVersion}
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		out.Count++
+		out.Mean += (val - out.Mean) / float64(out.Count)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if out.Count > 0 {
+		return out
+	}
+
+	return nil
+}
+
+// MapMeanStrict computes the count and mean of values in an iterator like MapMean but returns an error
+// if an integer value can't be represented exactly as a float64.
+func MapMeanStrict(itr Iterator) interface{} {
+	out := &MeanMapOutput{Version: PartialVersion}
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		f, ok, err := exactFloat64(v)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		out.Count++
+		out.Mean += (f - out.Mean) / float64(out.Count)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if out.Count > 0 {
+		return out
+	}
+
+	return nil
+}
+
+// MeanMapOutput is the count and mean of the points a mapper contributes to a mean.
+type MeanMapOutput struct {
+	Count   int
+	Mean    float64
+	Version int
+}
+
+// ReduceMean computes the mean of values for each key. Partials such as the output of MapMean or a *Partial
+// are weighted by the number of points they summarize, while a raw float64 value counts as a single point.
+func ReduceMean(values []interface{}) interface{} {
+	if len(values) == 1 {
+		if val := meanPartial(values[0]); val != nil {
+			return val.Mean
+		}
+		return nil
+	}
+
+	var partials []*MeanMapOutput
+	for _, v := range values {
+		if val := meanPartial(v); val != nil {
+			partials = append(partials, val)
+		}
+	}
+	if len(partials) > 0 {
+		return mergeMeans(partials).Mean
+	}
+	return nil
+}
+
+// MergeMeanPartials returns the mean of the points summarized by the partials, weighting each by its count
+// like ReduceMean. It returns false if the partials summarize no points.
+func MergeMeanPartials(partials []MeanMapOutput) (float64, bool) {
+	var nonEmpty []*MeanMapOutput
+	for i := range partials {
+		if partials[i].Count > 0 {
+			nonEmpty = append(nonEmpty, &partials[i])
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return 0, false
+	}
+	return mergeMeans(nonEmpty).Mean, true
+}
+
+// mergeMeans combines the count and mean of each partial pairwise, see pairwiseSum. Partials must be non-empty.
+func mergeMeans(partials []*MeanMapOutput) *MeanMapOutput {
+	if len(partials) == 1 {
+		return partials[0]
+	}
+	mid := len(partials) / 2
+	a, b := mergeMeans(partials[:mid]), mergeMeans(partials[mid:])
+	count := a.Count + b.Count
+	return &MeanMapOutput{
+		Count: count,
+		Mean:  b.Mean*(float64(b.Count)/float64(count)) + a.Mean*(float64(a.Count)/float64(count)),
+	}
+}
+
+// meanPartial returns the count and mean of the points a mapper output contributes to a mean, or nil if it
+// contributes none.
+func meanPartial(v interface{}) *MeanMapOutput {
+	switch v := v.(type) {
+	case *MeanMapOutput:
+		if v.Count > 0 {
+			return v
+		}
+	case *Partial:
+		if v.Count > 0 {
+			return &MeanMapOutput{Count: int(v.Count), Mean: v.Sum / float64(v.Count)}
+		}
+	case float64:
+		return &MeanMapOutput{Count: 1, Mean: v}
+	}
+	return nil
+}
+
+// Partial is the intermediate state of count(), sum(), mean(), min(), max(), stddev() and variance() over a set
+// of points. Continuous queries can store a partial and later merge the partial of newly arrived points into it
+// with MergePartial rather than recomputing the aggregate from scratch, and downsampled partials can be
+// re-aggregated into coarser ones the same way. The JSON encoding of a Partial is stable; partials stored
+// before M2 was added decode with an M2 of 0 and shouldn't be used for stddev() or variance().
+type Partial struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	M2    float64 `json:"m2"` // sum of squared differences from the mean
+}
+
+// MapPartial computes the partial of the values in an iterator.
+func MapPartial(itr Iterator) interface{} {
+	var p *Partial
+	var mean float64
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		if p == nil {
+			p = &Partial{Min: val, Max: val}
+		}
+		p.Count++
+		p.Sum += val
+		p.Min = math.Min(p.Min, val)
+		p.Max = math.Max(p.Max, val)
+
+		// Welford's method
+		delta := val - mean
+		mean += delta / float64(p.Count)
+		p.M2 += delta * (val - mean)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	return p
+}
+
+// MergePartial combines two partials into the partial of all their points. Either may be nil. The sums of
+// squared differences are pooled around the combined mean, weighted by the count of each partial, so the
+// variance of the merged partial is that of all the points rather than of the partial means.
+func MergePartial(a, b *Partial) *Partial {
+	if a == nil || a.Count == 0 {
+		return b
+	} else if b == nil || b.Count == 0 {
+		return a
+	}
+	count := a.Count + b.Count
+	delta := b.Sum/float64(b.Count) - a.Sum/float64(a.Count)
+	return &Partial{
+		Count: count,
+		Sum:   a.Sum + b.Sum,
+		Min:   math.Min(a.Min, b.Min),
+		Max:   math.Max(a.Max, b.Max),
+		M2:    a.M2 + b.M2 + delta*delta*float64(a.Count)*float64(b.Count)/float64(count),
+	}
+}
+
+// ReducePartial merges the partials emitted by MapPartial.
+func ReducePartial(values []interface{}) interface{} {
+	var out *Partial
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		out = MergePartial(out, v.(*Partial))
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// Result returns the value of the named aggregate (count, sum, mean, min, max, stddev or variance) for the
+// partial. Like stddev() and variance(), the sample variance is returned, which needs at least two points.
+func (p *Partial) Result(name string) (interface{}, error) {
+	if p == nil || p.Count == 0 {
+		return nil, nil
+	}
+	switch name {
+	case "count":
+		return p.Count, nil
+	case "sum":
+		return p.Sum, nil
+	case "mean":
+		return p.Sum / float64(p.Count), nil
+	case "min":
+		return p.Min, nil
+	case "max":
+		return p.Max, nil
+	case "stddev", "variance":
+		if p.Count < 2 {
+			return nil, nil
+		}
+		variance := snapVariance(p.M2/float64(p.Count-1), p.Sum/float64(p.Count))
+		if name == "stddev" {
+			return math.Sqrt(variance), nil
+		}
+		return variance, nil
+	}
+	return nil, fmt.Errorf("no partial result for %s()", name)
+}
+
+// trimArg returns the fraction of extreme values to trim passed as argument i of the call, or 0 if there's no
+// such argument. Twice the fraction of values is trimmed in all, so it must be at least 0 and less than 0.5.
+func trimArg(c *Call, i int) (float64, error) {
+	if len(c.Args) <= i {
+		return 0, nil
+	}
+	lit, ok := c.Args[i].(*NumberLiteral)
+	if !ok || lit.Val < 0 || lit.Val >= 0.5 {
+		return 0, fmt.Errorf("expected trim fraction between 0 and 0.5 in %s()", c.Name)
+	}
+	return lit.Val, nil
+}
+
+// percentileOptions are the arguments of percentile().
+type percentileOptions struct {
+	percentile  float64
+	fraction    float64       // fraction of extreme values trimmed from each end first
+	interpolate bool          // interpolate linearly between ranks rather than use the nearest rank
+	verbose     bool          // interpolate and also return the bracketing values and interpolation weight
+	halfLife    time.Duration // weight points by time decay with this half-life
+	coverage    bool          // report the time range of the points the result covers
+	dedupe      bool          // count points with the same time and value only once
+	timestamp   bool          // return the timestamp of the point at the percentile along with its value
+}
+
+// percentileArgs returns the arguments of percentile(field, p), followed by an optional trim fraction, the
+// 'linear' flag to interpolate between ranks, the 'verbose' flag to also return the values interpolated
+// between, the 'dedupe' flag to count points with the same time and value only once, the 'time' flag to return
+// the timestamp of the point at the percentile, or a half-life duration to weight points by time decay. The
+// 'coverage' flag may follow last.
+func percentileArgs(c *Call) (percentileOptions, error) {
+	var opt percentileOptions
+	if n := len(c.Args); n > 2 {
+		if lit, ok := c.Args[n-1].(*StringLiteral); ok && lit.Val == "coverage" {
+			opt.coverage = true
+			c = &Call{Name: c.Name, Args: c.Args[:n-1]}
+		}
+	}
+	if len(c.Args) < 2 || len(c.Args) > 3 {
+		return opt, fmt.Errorf("expected float argument in percentile()")
+	}
+	lit, ok := c.Args[1].(*NumberLiteral)
+	if !ok {
+		return opt, fmt.Errorf("expected float argument in percentile()")
+	}
+	opt.percentile = lit.Val
+
+	if len(c.Args) == 3 {
+		if lit, ok := c.Args[2].(*StringLiteral); ok {
+			switch lit.Val {
+			case "linear", "verbose":
+				opt.interpolate, opt.verbose = true, lit.Val == "verbose"
+			case "dedupe":
+				opt.dedupe = true
+			case "time":
+				opt.timestamp = true
+			default:
+				return opt, fmt.Errorf("unexpected argument %s in percentile()", lit.String())
+			}
+			return opt, nil
+		} else if lit, ok := c.Args[2].(*DurationLiteral); ok {
+			if lit.Val <= 0 {
+				return opt, fmt.Errorf("expected positive half-life duration in percentile()")
+			}
+			opt.halfLife = lit.Val
+			return opt, nil
+		}
+	}
+
+	fraction, err := trimArg(c, 2)
+	if err != nil {
+		return opt, err
+	}
+	opt.fraction = fraction
+	return opt, nil
+}
+
+// percentilesArgs returns the percentiles of percentiles(field, p1, p2, ...), each between 0 and 100.
+func percentilesArgs(c *Call) ([]float64, error) {
+	if len(c.Args) < 2 {
+		return nil, fmt.Errorf("expected field and percentiles for percentiles()")
+	}
+	percentiles := make([]float64, 0, len(c.Args)-1)
+	for _, arg := range c.Args[1:] {
+		lit, ok := arg.(*NumberLiteral)
+		if !ok || lit.Val < 0 || lit.Val > 100 {
+			return nil, fmt.Errorf("expected percentile between 0 and 100 in percentiles()")
+		}
+		percentiles = append(percentiles, lit.Val)
+	}
+	return percentiles, nil
+}
+
+// trimExtremes discards twice the fraction of values in data, picking the values farthest from the median one
+// at a time. Outliers on one side are trimmed before values on the other side, so unlike discarding as many
+// values from each end, trimming moves the median away from the outliers. NaN values are discarded too.
+func trimExtremes(data []float64, fraction float64) []float64 {
+	k := int(float64(len(data)) * fraction)
+	if k == 0 {
+		return data
+	}
+	sorted := getSortedRange(data, 0, len(data))
+	for len(sorted) > 0 && math.IsNaN(sorted[0]) {
+		sorted = sorted[1:]
+	}
+	if len(sorted) <= 2*k {
+		return nil
+	}
+
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	lo, hi := 0, len(sorted)-1
+	for i := 0; i < 2*k; i++ {
+		if median-sorted[lo] > sorted[hi]-median {
+			lo++
+		} else {
+			hi--
+		}
+	}
+	return sorted[lo : hi+1]
+}
+
+// ReduceTrimmedMedian computes the median of values after discarding twice the given fraction of values,
+// those farthest from the median, see trimExtremes. Outliers on one side of the median shift it less once
+// they're trimmed.
+func ReduceTrimmedMedian(fraction float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var data []float64
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+			data = append(data, value.([]float64)...)
+		}
+		return ReduceMedian([]interface{}{trimExtremes(data, fraction)})
+	}
+}
+
+// ReduceMedian computes the median of values, ignoring NaN values. The median of an even number of values is
+// the mean of the two middle values.
+func ReduceMedian(values []interface{}) interface{} {
+	return ReduceMedianWithOptions(MedianOptions{EvenMode: MedianAverage})(values)
+}
+
+// MedianEvenMode is how the median of an even number of values is picked from the two middle values.
+type MedianEvenMode int
+
+const (
+	// MedianAverage returns the mean of the two middle values.
+	MedianAverage MedianEvenMode = iota
+	// MedianLower returns the lower of the two middle values.
+	MedianLower
+	// MedianUpper returns the higher of the two middle values.
+	MedianUpper
+)
+
+// MedianOptions are the options of ReduceMedianWithOptions.
+type MedianOptions struct {
+	EvenMode MedianEvenMode
+}
+
+// ReduceMedianWithOptions returns a ReduceFunc computing the median of values, ignoring NaN values, with the
+// median of an even number of values picked according to opt.EvenMode. The middle values are selected by
+// getSortedRange in O(N) time on average rather than by sorting all the values.
+func ReduceMedianWithOptions(opt MedianOptions) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var n int
+		for _, value := range values {
+			if value != nil {
+				n += len(value.([]float64))
+			}
+		}
+
+		// Collect all the data points
+		data := make([]float64, 0, n)
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+			data = append(data, value.([]float64)...)
+		}
+		data = dropNaN(data)
+
+		length := len(data)
+		if length < 2 {
+			if length == 0 {
+				return nil
+			}
+			return data[0]
+		}
+		middle := length / 2
+		if length%2 != 0 {
+			return getSortedRange(data, middle, 1)[0]
+		}
+
+		sortedRange := getSortedRange(data, middle-1, 2)
+		var low, high = sortedRange[0], sortedRange[1]
+		switch opt.EvenMode {
+		case MedianLower:
+			return low
+		case MedianUpper:
+			return high
+		default:
+			return low + (high-low)/2
+		}
+	}
+}
+
+// medianArgs returns the optional argument of median(): either a trim fraction, the 'time' flag to return the
+// timestamp of the median point along with the median, or the 'lower' or 'upper' flag, see medianEvenModeArg.
+func medianArgs(c *Call) (fraction float64, timestamp bool, err error) {
+	if len(c.Args) < 1 || len(c.Args) > 2 {
+		return 0, false, fmt.Errorf("expected one or two arguments for median()")
+	}
+	if len(c.Args) == 2 {
+		if lit, ok := c.Args[1].(*StringLiteral); ok {
+			switch lit.Val {
+			case "time":
+				return 0, true, nil
+			case "lower", "upper":
+				return 0, false, nil
+			}
+			return 0, false, fmt.Errorf("unexpected argument %s in median()", lit.String())
+		}
+	}
+	fraction, err = trimArg(c, 1)
+	return fraction, false, err
+}
+
+// medianEvenModeArg returns how median() picks the median of an even number of values: the mean of the two
+// middle values unless the 'lower' or 'upper' flag is given. Calls are validated by medianArgs.
+func medianEvenModeArg(c *Call) MedianEvenMode {
+	if len(c.Args) == 2 {
+		if lit, ok := c.Args[1].(*StringLiteral); ok {
+			switch lit.Val {
+			case "lower":
+				return MedianLower
+			case "upper":
+				return MedianUpper
+			}
+		}
+	}
+	return MedianAverage
+}
+
+// medianMapOutput is a value along with the timestamp of its point.
+type medianMapOutput struct {
+	Time int64
+	Val  float64
+}
+
+// medianOutputs sorts points by value, and points with the same value by time.
+type medianOutputs []medianMapOutput
+
+func (a medianOutputs) Len() int      { return len(a) }
+func (a medianOutputs) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a medianOutputs) Less(i, j int) bool {
+	if a[i].Val != a[j].Val {
+		return a[i].Val < a[j].Val
+	}
+	return a[i].Time < a[j].Time
+}
+
+// MapMedianWithTime collects the values and the timestamps of their points to pass to the reducer, for
+// median(field, 'time') and percentile(field, p, 'time'). NaN values are skipped.
+func MapMedianWithTime(itr Iterator) interface{} {
+	var values []medianMapOutput
+	for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok && !math.IsNaN(val) {
+			values = append(values, medianMapOutput{Time: k, Val: val})
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	return values
+}
+
+// ReduceMedianWithTime computes the median of values along with the timestamp of the median point. With an even
+// number of values the median is the mean of the two central values, and the timestamp is that of the later of
+// the two central points.
+func ReduceMedianWithTime(values []interface{}) interface{} {
+	var data medianOutputs
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		data = append(data, value.([]medianMapOutput)...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	sort.Sort(data)
+
+	middle := len(data) / 2
+	if len(data)%2 == 1 {
+		out := data[middle]
+		return &out
+	}
+	low, high := data[middle-1], data[middle]
+	out := &medianMapOutput{Time: high.Time, Val: low.Val + (high.Val-low.Val)/2}
+	if low.Time > high.Time {
+		out.Time = low.Time
+	}
+	return out
+}
+
+// unmarshalMedianWithTime unmarshals the output of MapMedianWithTime.
+func unmarshalMedianWithTime(b []byte) (interface{}, error) {
+	var a []medianMapOutput
+	err := json.Unmarshal(b, &a)
+	return a, err
+}
+
+// ReducePercentileWithTime computes the percentile of values like ReducePercentile, along with the timestamp of
+// the point at the nearest rank. If several points have the percentile value, the earliest one is returned.
+func ReducePercentileWithTime(percentile float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var data medianOutputs
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+			data = append(data, value.([]medianMapOutput)...)
+		}
+		sort.Sort(data)
+
+		// negative percentiles count from the highest value down
+		index := nearestRankIndex(len(data), math.Abs(percentile))
+		if index < 0 {
+			return nil
+		} else if percentile < 0 {
+			index = len(data) - 1 - index
+		}
+		// points with the same value are sorted by time
+		first := sort.Search(index, func(i int) bool { return data[i].Val >= data[index].Val })
+		out := data[first]
+		return &out
+	}
+}
+
+// reduceBatchSize is the number of values the percentile(), median() and stddev() reducers process between
+// yielding the processor, so that reducing a very large interval doesn't keep other queries from running.
+var reduceBatchSize = 1 << 16
+
+// reduceYield is called by the reducers after each batch of reduceBatchSize values.
+var reduceYield = runtime.Gosched
+
+// batchSize returns reduceBatchSize, or 1 if it isn't positive.
+func batchSize() int {
+	if reduceBatchSize < 1 {
+		return 1
+	}
+	return reduceBatchSize
+}
+
+// reduceBatch counts down the values left in the current batch, yielding the processor when the batch is done.
+type reduceBatch int
+
+// newReduceBatch returns a count down of a batch of reduceBatchSize values.
+func newReduceBatch() reduceBatch {
+	return reduceBatch(batchSize())
+}
+
+// step counts a value, yielding and starting the next batch after the last value of the batch.
+func (b *reduceBatch) step() {
+	if *b--; *b > 0 {
+		return
+	}
+	reduceYield()
+	*b = newReduceBatch()
+}
+
+// batchedSort sorts data in ascending order, yielding after every batch of reduceBatchSize values sorted or
+// merged. Batches are sorted separately and then merged pairwise, so no step works on more than a batch
+// without yielding. Data must not contain NaN values.
+func batchedSort(data []float64) {
+	n := batchSize()
+	if len(data) <= n {
+		sort.Float64s(data)
+		return
+	}
+
+	for lo := 0; lo < len(data); lo += n {
+		hi := lo + n
+		if hi > len(data) {
+			hi = len(data)
+		}
+		sort.Float64s(data[lo:hi])
+		reduceYield()
+	}
+
+	src, dst := data, make([]float64, len(data))
+	batch := newReduceBatch()
+	for width := n; width < len(data); width *= 2 {
+		for lo := 0; lo < len(data); lo += 2 * width {
+			mid, hi := lo+width, lo+2*width
+			if mid > len(data) {
+				mid = len(data)
+			}
+			if hi > len(data) {
+				hi = len(data)
+			}
+
+			i, j := lo, mid
+			for k := lo; k < hi; k++ {
+				if j >= hi || (i < mid && src[i] <= src[j]) {
+					dst[k], i = src[i], i+1
+				} else {
+					dst[k], j = src[j], j+1
+				}
+				batch.step()
+			}
+		}
+		src, dst = dst, src
+	}
+	if &src[0] != &data[0] {
+		copy(data, src)
+	}
+}
+
+// RunningMedian maintains the exact median of a growing set of values with two heaps: a max heap holding the
+// lower half of the values and a min heap holding the upper half. Each value is added in O(log n) time and the
+// median is available in O(1) time, so continuous queries don't need to sort every value on each update.
+type RunningMedian struct {
+	lower maxHeap
+	upper minHeap
+}
+
+// NewRunningMedian returns an empty RunningMedian.
+func NewRunningMedian() *RunningMedian {
+	return &RunningMedian{}
+}
+
+// Push adds a value.
+func (m *RunningMedian) Push(v float64) {
+	if len(m.lower) == 0 || v <= m.lower[0] {
+		heap.Push(&m.lower, v)
+	} else {
+		heap.Push(&m.upper, v)
+	}
+
+	// keep the lower half the same size as, or one larger than, the upper half
+	if len(m.lower) > len(m.upper)+1 {
+		heap.Push(&m.upper, heap.Pop(&m.lower))
+	} else if len(m.upper) > len(m.lower) {
+		heap.Push(&m.lower, heap.Pop(&m.upper))
+	}
+}
+
+// Median returns the median of the values added so far, or nil if there are none. The median of an even number
+// of values is the mean of the two middle values, as with ReduceMedian.
+func (m *RunningMedian) Median() interface{} {
+	if len(m.lower) == 0 {
+		return nil
+	} else if len(m.lower) > len(m.upper) {
+		return m.lower[0]
+	}
+	low, high := m.lower[0], m.upper[0]
+	return low + (high-low)/2
+}
+
+// Reduce adds the values emitted by the median mapper and returns the median of every value added so far. It
+// can be used as the ReduceFunc of a continuous query that is fed new mapper outputs on each run.
+func (m *RunningMedian) Reduce(values []interface{}) interface{} {
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, val := range v.([]float64) {
+			m.Push(val)
+		}
+	}
+	return m.Median()
+}
+
+type minHeap []float64
+
+func (h minHeap) Len() int            { return len(h) }
+func (h minHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h minHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *minHeap) Push(x interface{}) { *h = append(*h, x.(float64)) }
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	v := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return v
+}
+
+type maxHeap []float64
+
+func (h maxHeap) Len() int            { return len(h) }
+func (h maxHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h maxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x interface{}) { *h = append(*h, x.(float64)) }
+func (h *maxHeap) Pop() interface{} {
+	old := *h
+	v := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return v
+}
+
+// ReduceTop computes the n largest values for each key, in descending order. Duplicate values each count
+// towards n unless distinct is set, in which case every value is returned at most once.
+func ReduceTop(n int, distinct bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		data := topBottomData(values, distinct)
+		if len(data) == 0 {
+			return nil
+		}
+
+		start := len(data) - n
+		if start < 0 {
+			start = 0
+		}
+		top := getSortedRange(data, start, n)
+
+		// getSortedRange returns ascending values, but the top values are listed largest first
+		for i, j := 0, len(top)-1; i < j; i, j = i+1, j-1 {
+			top[i], top[j] = top[j], top[i]
+		}
+		return top
+	}
+}
+
+// ReduceBottom computes the n smallest values for each key, in ascending order. Duplicate values each count
+// towards n unless distinct is set, in which case every value is returned at most once.
+func ReduceBottom(n int, distinct bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		data := topBottomData(values, distinct)
+		if len(data) == 0 {
+			return nil
+		}
+		return getSortedRange(data, 0, n)
+	}
+}
+
+// topBottomPair is a value of the field top() or bottom() orders by along with the value of its tie-breaking field.
+type topBottomPair struct {
+	Value    float64
+	TieBreak float64
+}
+
+// topBottomPairs sorts pairs by value and then by tie-breaking value.
+type topBottomPairs []topBottomPair
+
+func (a topBottomPairs) Len() int      { return len(a) }
+func (a topBottomPairs) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a topBottomPairs) Less(i, j int) bool {
+	if a[i].Value != a[j].Value {
+		return a[i].Value < a[j].Value
+	}
+	return a[i].TieBreak < a[j].TieBreak
+}
+
+// MapTopBottomPairs collects the values of field along with the values of the tieBreak field for top(a, b, N)
+// and bottom(a, b, N). Points missing either field are skipped. The iterator must yield all the fields of each
+// point, see MultiFieldCall.
+func MapTopBottomPairs(field, tieBreak string) MapFunc {
+	return func(itr Iterator) interface{} {
+		var pairs []topBottomPair
+		for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			value, ok := fields[field].(float64)
+			if !ok {
+				continue
+			}
+			tb, ok := fields[tieBreak].(float64)
+			if !ok {
+				continue
+			}
+			pairs = append(pairs, topBottomPair{Value: value, TieBreak: tb})
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+
+		if len(pairs) == 0 {
+			return nil
+		}
+		return pairs
+	}
+}
+
+// ReduceTopPairs computes the n largest pairs for each key, ordered by value and then by tie-breaking value,
+// largest first. If distinct is set, identical pairs are returned at most once.
+func ReduceTopPairs(n int, distinct bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		pairs := topBottomPairData(values, distinct)
+		if len(pairs) == 0 {
+			return nil
+		}
+		sort.Sort(sort.Reverse(pairs))
+		if len(pairs) > n {
+			pairs = pairs[:n]
+		}
+		return []topBottomPair(pairs)
+	}
+}
+
+// ReduceBottomPairs computes the n smallest pairs for each key, ordered by value and then by tie-breaking
+// value, smallest first. If distinct is set, identical pairs are returned at most once.
+func ReduceBottomPairs(n int, distinct bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		pairs := topBottomPairData(values, distinct)
+		if len(pairs) == 0 {
+			return nil
+		}
+		sort.Sort(pairs)
+		if len(pairs) > n {
+			pairs = pairs[:n]
+		}
+		return []topBottomPair(pairs)
+	}
+}
+
+// topBottomPairData collects the output of MapTopBottomPairs, dropping duplicate pairs if distinct is set.
+func topBottomPairData(values []interface{}, distinct bool) topBottomPairs {
+	var pairs topBottomPairs
+	var seen map[topBottomPair]struct{}
+	if distinct {
+		seen = make(map[topBottomPair]struct{})
+	}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		for _, p := range value.([]topBottomPair) {
+			if distinct {
+				if _, ok := seen[p]; ok {
+					continue
+				}
+				seen[p] = struct{}{}
+			}
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+// topBottomData collects the mapper outputs for top() and bottom(), dropping duplicate values if distinct is set.
+func topBottomData(values []interface{}, distinct bool) []float64 {
+	var data []float64
+	var seen map[float64]struct{}
+	if distinct {
+		seen = make(map[float64]struct{})
+	}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		for _, v := range value.([]float64) {
+			if distinct {
+				if _, ok := seen[v]; ok {
+					continue
+				}
+				seen[v] = struct{}{}
+			}
+			data = append(data, v)
+		}
+	}
+	return data
+}
+
+// getSortedRange returns a sorted subset of data. By using discardLowerRange and discardUpperRange to get the target
+// subset (unsorted) and then just sorting that subset, the work can be reduced from O(N lg N), where N is len(data), to
+// O(N + count lg count) for the average case
+// - O(N) to discard the unwanted items
+// - O(count lg count) to sort the count number of extracted items
+// This can be useful for:
+// - finding the median: getSortedRange(data, middle, 1)
+// - finding the top N: getSortedRange(data, len(data) - N, N)
+// - finding the bottom N: getSortedRange(data, 0, N)
+func getSortedRange(data []float64, start int, count int) []float64 {
+	return getSortedRangeWith(data, start, count, defaultPivot)
+}
+
+// getSortedRangeWith returns a sorted subset of data like getSortedRange, partitioning around the pivots chosen
+// by pivot.
+func getSortedRangeWith(data []float64, start int, count int, pivot pivotFunc) []float64 {
+	out := discardLowerRange(data, start, pivot)
+	k := len(out) - count
+	if k > 0 {
+		out = discardUpperRange(out, k, pivot)
+	}
+	sort.Float64s(out)
+
+	return out
+}
+
+// discardLowerRange discards the lower k elements of the sorted data set without sorting all the data. Sorting all of
+// the data would take O(NlgN), where N is len(data), but partitioning to find the kth largest number is O(N) in the
+// average case. The remaining N-k unsorted elements are returned - no kind of ordering is guaranteed on these elements.
+func discardLowerRange(data []float64, k int, pivot pivotFunc) []float64 {
+	out := make([]float64, len(data)-k)
+	i := 0
+
+	// discard values lower than the desired range
+	for k > 0 {
+		lows, pivotValue, pivots, highs := partition(data, pivot)
+
+		lowLength := len(lows)
+		if lowLength > k {
+			// keep all the highs and the pivots
+			for ; pivots > 0; pivots-- {
+				out[i] = pivotValue
+				i++
+			}
+			copy(out[i:], highs)
+			i += len(highs)
+			// iterate over the lows again
+			data = lows
+		} else {
+			// discard all the lows
+			data = highs
+			k -= lowLength
+			if k < pivots {
+				// if discarded enough lows, keep the remaining pivots
+				for ; pivots > k; pivots-- {
+					out[i] = pivotValue
+					i++
+				}
+				k = 0
+			} else {
+				// able to discard the pivots too
+				k -= pivots
+			}
+		}
+	}
+	copy(out[i:], data)
+	return out
+}
+
+// discardUpperRange discards the upper k elements of the sorted data set without sorting all the data. Sorting all of
+// the data would take O(NlgN), where N is len(data), but partitioning to find the kth largest number is O(N) in the
+// average case. The remaining N-k unsorted elements are returned - no kind of ordering is guaranteed on these elements.
+func discardUpperRange(data []float64, k int, pivot pivotFunc) []float64 {
+	out := make([]float64, len(data)-k)
+	i := 0
+
+	// discard values higher than the desired range
+	for k > 0 {
+		lows, pivotValue, pivots, highs := partition(data, pivot)
+
+		highLength := len(highs)
+		if highLength > k {
+			// keep all the lows and the pivots
+			for ; pivots > 0; pivots-- {
+				out[i] = pivotValue
+				i++
+			}
+			copy(out[i:], lows)
+			i += len(lows)
+			// iterate over the highs again
+			data = highs
+		} else {
+			// discard all the highs
+			data = lows
+			k -= highLength
+			if k < pivots {
+				// if discarded enough highs, keep the remaining pivots
+				for ; pivots > k; pivots-- {
+					out[i] = pivotValue
+					i++
+				}
+				k = 0
+			} else {
+				// able to discard the pivots too
+				k -= pivots
+			}
+		}
+	}
+	copy(out[i:], data)
+	return out
+}
+
+// pivotFunc returns the index of the element of data that partition splits data around. Data is never empty.
+type pivotFunc func(data []float64) int
+
+// defaultPivot chooses pivots at random from the global random source. Random pivots are fast on typical data,
+// but don't bound the worst case; use medianOfMediansPivot when that matters.
+var defaultPivot pivotFunc = func(data []float64) int {
+	return rand.Intn(len(data))
+}
+
+// randomPivot returns a pivotFunc choosing pivots at random from rng, so that a fixed seed partitions data the
+// same way on every run. A *rand.Rand isn't safe for concurrent use, so neither is the pivotFunc.
+func randomPivot(rng *rand.Rand) pivotFunc {
+	return func(data []float64) int {
+		return rng.Intn(len(data))
+	}
+}
+
+// medianOfMediansPivot chooses the median of the medians of groups of 5 elements as the pivot. The pivot is
+// guaranteed to be greater and less than about 30% of the elements each, which bounds getSortedRangeWith to O(N)
+// in the worst case at the cost of a larger constant factor than a random pivot. Data isn't modified.
+func medianOfMediansPivot(data []float64) int {
+	if len(data) <= 5 {
+		return len(data) / 2
+	}
+
+	medians := make([]float64, 0, (len(data)+4)/5)
+	var group [5]float64
+	for lo := 0; lo < len(data); lo += 5 {
+		hi := lo + 5
+		if hi > len(data) {
+			hi = len(data)
+		}
+		g := group[:copy(group[:], data[lo:hi])]
+		// insertion sort the group
+		for i := 1; i < len(g); i++ {
+			for j := i; j > 0 && g[j] < g[j-1]; j-- {
+				g[j], g[j-1] = g[j-1], g[j]
+			}
+		}
+		medians = append(medians, g[len(g)/2])
+	}
+
+	median := getSortedRangeWith(medians, len(medians)/2, 1, medianOfMediansPivot)[0]
+	for i, v := range data {
+		if v == median {
+			return i
+		}
+	}
+	return 0
+}
+
+// partition takes a list of data, chooses a pivot index with pivot and returns a list of elements lower than the
+// pivotValue, the pivotValue along with how many elements equal it, and a list of elements higher than the
+// pivotValue. Setting the elements equal to the pivot aside keeps data with many duplicate values from
+// degrading to quadratic time. partition mutates data, and yields after every reduceBatchSize elements.
+func partition(data []float64, pivot pivotFunc) (lows []float64, pivotValue float64, pivots int, highs []float64) {
+	length := len(data)
+	pivotValue = data[pivot(data)]
+
+	// partition the data into lows, values equal to the pivot and highs
+	low, mid, high := 0, 0, length-1
+	batch := newReduceBatch()
+	for ; mid <= high; batch.step() {
+		switch {
+		case data[mid] < pivotValue:
+			data[low], data[mid] = data[mid], data[low]
+			low++
+			mid++
+		case data[mid] > pivotValue:
+			data[mid], data[high] = data[high], data[mid]
+			high--
+		default:
+			mid++
+		}
+	}
+
+	return data[:low], pivotValue, mid - low, data[high+1:]
+}
+
+// MapMin collects the values to pass to the reducer
+func MapMin(itr Iterator) interface{} {
+	if isSorted(itr) {
+		min, _, ok := sortedExtremes(itr, false, finiteFloat64)
+		if err := iteratorErr(itr); err != nil {
+			return err
+		} else if ok {
+			return min
+		}
+		return nil
+	}
+
+	var min float64
+	pointsYielded := false
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := finiteFloat64(v)
+		if !ok {
+			continue
+		}
+		// Initialize min
+		if !pointsYielded {
+			min = val
+			pointsYielded = true
+		}
+		min = math.Min(min, val)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if pointsYielded {
+		return min
+	}
+	return nil
+}
+
+// ReduceMin computes the min of value.
+func ReduceMin(values []interface{}) interface{} {
+	var mins []float64
+	for _, v := range values {
+		if f, ok := finiteFloat64(v); ok {
+			mins = append(mins, f)
+		}
+	}
+	if min, ok := MergeMinPartials(mins); ok {
+		return min
+	}
+	return nil
+}
+
+// MergeMinPartials returns the lowest of the mins of each mapper like ReduceMin. It returns false if there are
+// no mins.
+func MergeMinPartials(mins []float64) (float64, bool) {
+	if len(mins) == 0 {
+		return 0, false
+	}
+	min := mins[0]
+	for _, v := range mins[1:] {
+		min = math.Min(min, v)
+	}
+	return min, true
+}
+
+// MapMax collects the values to pass to the reducer
+func MapMax(itr Iterator) interface{} {
+	if isSorted(itr) {
+		_, max, ok := sortedExtremes(itr, true, finiteFloat64)
+		if err := iteratorErr(itr); err != nil {
+			return err
+		} else if ok {
+			return max
+		}
+		return nil
+	}
+
+	var max float64
+	pointsYielded := false
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := finiteFloat64(v)
+		if !ok {
+			continue
+		}
+		// Initialize max
+		if !pointsYielded {
+			max = val
+			pointsYielded = true
+		}
+		max = math.Max(max, val)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if pointsYielded {
+		return max
+	}
+	return nil
+}
+
+// ReduceMax computes the max of value.
+func ReduceMax(values []interface{}) interface{} {
+	var maxes []float64
+	for _, v := range values {
+		if f, ok := finiteFloat64(v); ok {
+			maxes = append(maxes, f)
+		}
+	}
+	if max, ok := MergeMaxPartials(maxes); ok {
+		return max
+	}
+	return nil
+}
+
+// MergeMaxPartials returns the highest of the maxes of each mapper like ReduceMax. It returns false if there
+// are no maxes.
+func MergeMaxPartials(maxes []float64) (float64, bool) {
+	if len(maxes) == 0 {
+		return 0, false
+	}
+	max := maxes[0]
+	for _, v := range maxes[1:] {
+		max = math.Max(max, v)
+	}
+	return max, true
+}
+
+// minMaxMapOutput is the min or max value along with the timestamp of the point it was selected from.
+type minMaxMapOutput struct {
+	Time int64
+	Val  float64
+}
+
+// MapMinWithTime collects the min value and its timestamp to pass to the reducer.
+func MapMinWithTime(itr Iterator) interface{} {
+	return extremeWithTime(itr, false)
+}
+
+// ReduceMinWithTime computes the min of value along with the timestamp of the point it occurred at. Ties go
+// to the earliest point.
+func ReduceMinWithTime(values []interface{}) interface{} {
+	return reduceExtremeWithTime(values, false)
+}
+
+// MapMaxWithTime collects the max value and its timestamp to pass to the reducer.
+func MapMaxWithTime(itr Iterator) interface{} {
+	return extremeWithTime(itr, true)
+}
+
+// ReduceMaxWithTime computes the max of value along with the timestamp of the point it occurred at. Ties go
+// to the earliest point.
+func ReduceMaxWithTime(values []interface{}) interface{} {
+	return reduceExtremeWithTime(values, true)
+}
+
+// extremeWithTime returns the max value in an iterator, or the min value if max is false, along with its
+// timestamp. Ties go to the earliest point. NaN and infinite values are skipped, see finiteFloat64. It returns
+// nil if there are no such values.
+func extremeWithTime(itr Iterator, max bool) interface{} {
+	var out *minMaxMapOutput
+	for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+		val, ok := finiteFloat64(v)
+		if !ok {
+			continue
+		}
+		out = selectExtreme(out, &minMaxMapOutput{Time: k, Val: val}, max)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// reduceExtremeWithTime selects the extreme among the outputs of extremeWithTime.
+func reduceExtremeWithTime(values []interface{}, max bool) interface{} {
+	var out *minMaxMapOutput
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		out = selectExtreme(out, v.(*minMaxMapOutput), max)
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// selectExtreme returns whichever of out and o has the max value, or the min value if max is false, and on a
+// tie the earlier timestamp. Out may be nil.
+func selectExtreme(out, o *minMaxMapOutput, max bool) *minMaxMapOutput {
+	if out == nil {
+		return o
+	}
+	if o.Val == out.Val {
+		if o.Time < out.Time {
+			return o
+		}
+		return out
+	}
+	if (max && o.Val > out.Val) || (!max && o.Val < out.Val) {
+		return o
+	}
+	return out
+}
+
+// unmarshalMinMax unmarshals the output of MapMinWithTime or MapMaxWithTime.
+func unmarshalMinMax(b []byte) (interface{}, error) {
+	var o *minMaxMapOutput
+	if err := json.Unmarshal(b, &o); err != nil || o == nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// MapAllMin collects every point tied at the min value to pass to the reducer.
+func MapAllMin(itr Iterator) interface{} {
+	points, err := rawOutputsOf(itr)
+	if err != nil {
+		return err
+	}
+	return extremePoints(points, false)
+}
+
+// ReduceAllMin computes every point tied at the min value for each key, in time order.
+func ReduceAllMin(values []interface{}) interface{} {
+	points, err := sortedRawOutputs(values)
+	if err != nil {
+		return err
+	}
+	return extremePoints(points, false)
+}
+
+// MapAllMax collects every point tied at the max value to pass to the reducer.
+func MapAllMax(itr Iterator) interface{} {
+	points, err := rawOutputsOf(itr)
+	if err != nil {
+		return err
+	}
+	return extremePoints(points, true)
+}
+
+// ReduceAllMax computes every point tied at the max value for each key, in time order.
+func ReduceAllMax(values []interface{}) interface{} {
+	points, err := sortedRawOutputs(values)
+	if err != nil {
+		return err
+	}
+	return extremePoints(points, true)
+}
+
+// rawOutputsOf collects the points in an iterator, or returns the error that stopped it.
+func rawOutputsOf(itr Iterator) (rawOutputs, error) {
+	var points rawOutputs
+	for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+		points = append(points, &rawQueryMapOutput{k, v})
+	}
+	if err := iteratorErr(itr); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// extremePoints returns the points whose value equals the max value, or the min value if max is false. NaN and
+// infinite values are skipped, see finiteFloat64. It returns nil if there are no such values.
+func extremePoints(points rawOutputs, max bool) interface{} {
+	var extremes []*rawQueryMapOutput
+	var extreme float64
+	for _, p := range points {
+		val, ok := finiteFloat64(p.Values)
+		if !ok {
+			continue
+		}
+		if len(extremes) == 0 {
+			extremes, extreme = append(extremes, p), val
+			continue
+		}
+
+		if val == extreme {
+			extremes = append(extremes, p)
+		} else if (max && val > extreme) || (!max && val < extreme) {
+			extremes, extreme = append(extremes[:0], p), val
+		}
+	}
+
+	if len(extremes) == 0 {
+		return nil
+	}
+	return extremes
+}
+
+type spreadMapOutput struct {
+	Min, Max float64
+	Version  int
+}
+
+// MapSpread collects the values to pass to the reducer
+func MapSpread(itr Iterator) interface{} {
+	out := spreadMapOutput{Version: PartialVersion}
+	if isSorted(itr) {
+		var ok bool
+		out.Min, out.Max, ok = sortedExtremes(itr, true, toFloat64)
+		if err := iteratorErr(itr); err != nil {
+			return err
+		} else if ok {
+			return out
+		}
+		return nil
+	}
+
+	pointsYielded := false
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		// Initialize
+		if !pointsYielded {
+			out.Max = val
+			out.Min = val
+			pointsYielded = true
+		}
+		out.Max = math.Max(out.Max, val)
+		out.Min = math.Min(out.Min, val)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if pointsYielded {
+		return out
+	}
+	return nil
+}
+
+// ReduceSpread computes the spread of values.
+func ReduceSpread(values []interface{}) interface{} {
+	if result, ok := mergeSpreads(values); ok {
+		return result.Max - result.Min
+	}
+	return nil
+}
+
+// rangeOutput is the result of range(), the min and max of an interval.
+type rangeOutput struct {
+	Min, Max float64
+}
+
+// ReduceRange computes the min and max of values together, the endpoints of their spread.
+func ReduceRange(values []interface{}) interface{} {
+	if result, ok := mergeSpreads(values); ok {
+		return &rangeOutput{Min: result.Min, Max: result.Max}
+	}
+	return nil
+}
+
+// mergeSpreads combines the outputs of MapSpread, which are unmarshalled as pointers when they come from other
+// nodes. It returns false if there are none.
+func mergeSpreads(values []interface{}) (spreadMapOutput, bool) {
+	var result spreadMapOutput
+	pointsYielded := false
+
+	for _, v := range values {
+		var val spreadMapOutput
+		switch v := v.(type) {
+		case spreadMapOutput:
+			val = v
+		case *spreadMapOutput:
+			val = *v
+		default:
+			continue
+		}
+		// Initialize
+		if !pointsYielded {
+			result.Max = val.Max
+			result.Min = val.Min
+			pointsYielded = true
+		}
+		result.Max = math.Max(result.Max, val.Max)
+		result.Min = math.Min(result.Min, val.Min)
+	}
+	return result, pointsYielded
+}
+
+// MapStddev collects the values to pass to the reducer
+func MapStddev(itr Iterator) interface{} {
+	var values []float64
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok {
+			values = append(values, val)
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	return values
+}
+
+// ReduceStddev computes the sample stddev of values. It's nil for fewer than two values, for which the sample
+// stddev is undefined.
+func ReduceStddev(values []interface{}) interface{} {
+	m := squaredDeviationsOf(values)
+	variance, ok := m.sampleVariance()
+	if !ok {
+		return nil
+	}
+	return math.Sqrt(variance)
+}
+
+// ReduceVariance computes the sample variance of values. It's nil for fewer than two values.
+func ReduceVariance(values []interface{}) interface{} {
+	m := squaredDeviationsOf(values)
+	variance, ok := m.sampleVariance()
+	if !ok {
+		return nil
+	}
+	return variance
+}
+
+// ReducePopulationStddev computes the population standard deviation of values, dividing by the number of values
+// rather than one less. A single value has a standard deviation of 0 and no values have none.
+func ReducePopulationStddev(values []interface{}) interface{} {
+	m := squaredDeviationsOf(values)
+	variance, ok := m.populationVariance()
+	if !ok {
+		return nil
+	}
+	return math.Sqrt(variance)
+}
+
+// ReducePopulationVariance computes the population variance of values. A single value has a variance of 0 and no
+// values have none.
+func ReducePopulationVariance(values []interface{}) interface{} {
+	m := squaredDeviationsOf(values)
+	variance, ok := m.populationVariance()
+	if !ok {
+		return nil
+	}
+	return variance
+}
+
+// squaredDeviationsOf computes the count, mean and sum of squared differences from the mean of the values
+// collected by MapStddev in two passes, computing the mean before summing the squared differences from it.
+func squaredDeviationsOf(values []interface{}) momentsMapOutput {
+	var data []float64
+	// Collect all the data points
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		data = append(data, value.([]float64)...)
+	}
+
+	// Get the mean
+	var mean float64
+	var count int
+	batch := newReduceBatch()
+	for _, v := range data {
+		count++
+		mean += (v - mean) / float64(count)
+		batch.step()
+	}
+	// Get the sum of squared differences
+	var m2 float64
+	for _, v := range data {
+		dif := v - mean
+		sq := math.Pow(dif, 2)
+		m2 += sq
+		batch.step()
+	}
+	return momentsMapOutput{Count: count, Mean: mean, M2: m2}
+}
+
+// snapVariance returns 0 for a variance no larger than the rounding error of computing it around mean, so that
+// identical values have a variance of exactly 0 rather than a tiny residual.
+func snapVariance(variance, mean float64) float64 {
+	residual := 2 * (math.Nextafter(1, 2) - 1) * mean
+	if variance <= residual*residual {
+		return 0
+	}
+	return variance
+}
+
+// MapLogMean computes the count and mean of the natural log of values in an iterator. Non-positive values have
+// no logarithm and are skipped.
+func MapLogMean(itr Iterator) interface{} {
+	out := &MeanMapOutput{Version: PartialVersion}
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		if val <= 0 {
+			continue
+		}
+		out.Count++
+		out.Mean += (math.Log(val) - out.Mean) / float64(out.Count)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if out.Count > 0 {
+		return out
+	}
+
+	return nil
+}
+
+// geometricMeanMapOutput is the number of values of a mapper and the sum of their natural logs, which unlike
+// their product doesn't overflow. NonPositive is set if any value is zero or negative and so has no logarithm.
+type geometricMeanMapOutput struct {
+	Count       int
+	LogSum      float64
+	NonPositive bool `json:",omitempty"`
+}
+
+// MapGeometricMean computes the count and sum of the natural logs of the values in an iterator.
+func MapGeometricMean(itr Iterator) interface{} {
+	out := &geometricMeanMapOutput{}
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		out.Count++
+		if val <= 0 {
+			out.NonPositive = true
+			continue
+		}
+		out.LogSum += math.Log(val)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if out.Count == 0 {
+		return nil
+	}
+	return out
+}
+
+// ReduceGeometricMean computes the geometric mean of the values, exp(mean(log(value))). Unlike log_mean(),
+// which skips values without a logarithm, the geometric mean of values including zero or a negative value is nil.
+func ReduceGeometricMean(values []interface{}) interface{} {
+	var out geometricMeanMapOutput
+	for _, v := range values {
+		if v, ok := v.(*geometricMeanMapOutput); ok {
+			out.Count += v.Count
+			out.LogSum += v.LogSum
+			out.NonPositive = out.NonPositive || v.NonPositive
+		}
+	}
+	if out.Count == 0 || out.NonPositive {
+		return nil
+	}
+	return math.Exp(out.LogSum / float64(out.Count))
+}
+
+// harmonicMeanMapOutput is the number of values of a mapper and the sum of their reciprocals. Zero is set if any
+// value is zero and so has no reciprocal.
+type harmonicMeanMapOutput struct {
+	Count         int
+	ReciprocalSum float64
+	Zero          bool `json:",omitempty"`
+}
+
+// MapHarmonicMean computes the count and sum of the reciprocals of the values in an iterator.
+func MapHarmonicMean(itr Iterator) interface{} {
+	out := &harmonicMeanMapOutput{}
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		val, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		out.Count++
+		if val == 0 {
+			out.Zero = true
+			continue
+		}
+		out.ReciprocalSum += 1 / val
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if out.Count == 0 {
+		return nil
+	}
+	return out
+}
+
+// ReduceHarmonicMean computes the harmonic mean of the values, count/sum(1/value). The harmonic mean of values
+// including zero, or whose reciprocals sum to zero, is nil.
+func ReduceHarmonicMean(values []interface{}) interface{} {
+	var out harmonicMeanMapOutput
+	for _, v := range values {
+		if v, ok := v.(*harmonicMeanMapOutput); ok {
+			out.Count += v.Count
+			out.ReciprocalSum += v.ReciprocalSum
+			out.Zero = out.Zero || v.Zero
+		}
+	}
+	if out.Count == 0 || out.Zero || out.ReciprocalSum == 0 {
+		return nil
+	}
+	return float64(out.Count) / out.ReciprocalSum
+}
+
+// ReduceLogMean computes the mean of values in log space for each key, which is their geometric mean.
+func ReduceLogMean(values []interface{}) interface{} {
+	if mean, ok := ReduceMean(values).(float64); ok {
+		return math.Exp(mean)
+	}
+	return nil
+}
+
+// MapLogStddev collects the natural log of values to pass to the reducer. Non-positive values have no
+// logarithm and are skipped.
+func MapLogStddev(itr Iterator) interface{} {
+	var values []float64
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok && val > 0 {
+			values = append(values, math.Log(val))
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	return values
+}
+
+// ReduceLogStddev computes the standard deviation of values in log space for each key, exponentiated. This is
+// their geometric standard deviation.
+func ReduceLogStddev(values []interface{}) interface{} {
+	if stddev, ok := ReduceStddev(values).(float64); ok {
+		return math.Exp(stddev)
+	}
+	return nil
+}
+
+// stddevArgs returns true if stddev() should use the one pass algorithm. The optional second argument selects
+// either 'one_pass', the default, or 'two_pass'. The other functions mapped by MapStddev always use two passes.
+//
+// The one pass algorithm uses Welford's method in each mapper and sends only a fixed size partial, which is
+// combined in the reducer. Partials keep the mean rather than the sum of squares, so values with a large mean
+// don't lose precision. The two pass algorithm sends every value to the reducer, which computes the mean before
+// summing the squared differences from it. It can be slightly more accurate but its memory and network use grow
+// with the number of points.
+func stddevArgs(c *Call) (bool, error) {
+	if len(c.Args) < 1 || len(c.Args) > 2 {
+		return false, fmt.Errorf("expected one or two arguments for stddev()")
+	}
+	if len(c.Args) == 1 {
+		return c.Name == "stddev", nil
+	}
+	if lit, ok := c.Args[1].(*StringLiteral); ok {
+		switch lit.Val {
+		case "two_pass":
+			return false, nil
+		case "one_pass":
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("expected 'one_pass' or 'two_pass' as second argument in stddev()")
+}
+
+type stddevOnePassMapOutput struct {
+	Count   int
+	Mean    float64
+	M2      float64 // sum of squared differences from the mean
+	Version int
+}
+
+// add adds a value to the partial using Welford's method.
+func (o *stddevOnePassMapOutput) add(val float64) {
+	m := momentsMapOutput{Count: o.Count, Mean: o.Mean, M2: o.M2}
+	m.add(val)
+	o.Count, o.Mean, o.M2 = m.Count, m.Mean, m.M2
+}
+
+// MapStddevOnePass computes the count, mean and sum of squared differences from the mean of values in an
+// iterator in a single pass using Welford's method.
+func MapStddevOnePass(itr Iterator) interface{} {
+	out := &stddevOnePassMapOutput{Version: PartialVersion}
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok {
+			out.add(val)
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if out.Count > 0 {
+		return out
+	}
+	return nil
+}
+
+// ReduceStddevOnePass computes the stddev of values by combining the partials of MapStddevOnePass.
+func ReduceStddevOnePass(values []interface{}) interface{} {
+	var partials []*stddevOnePassMapOutput
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if val := v.(*stddevOnePassMapOutput); val.Count > 0 {
+			partials = append(partials, val)
+		}
+	}
+
+	// If no data or we only have one point, it's nil or undefined
+	if len(partials) == 0 {
+		return nil
+	}
+	out := mergeVariances(partials)
+	m := momentsMapOutput{Count: out.Count, Mean: out.Mean, M2: out.M2}
+	variance, ok := m.sampleVariance()
+	if !ok {
+		return nil
+	}
+	return math.Sqrt(variance)
+}
+
+// mergeVariances combines the count, mean and sum of squared differences of each partial pairwise using Chan's
+// method, see pairwiseSum. Partials must be non-empty.
+func mergeVariances(partials []*stddevOnePassMapOutput) *stddevOnePassMapOutput {
+	moments := make([]*momentsMapOutput, len(partials))
+	for i, p := range partials {
+		moments[i] = &momentsMapOutput{Count: p.Count, Mean: p.Mean, M2: p.M2}
+	}
+	m := mergeMoments(moments)
+	return &stddevOnePassMapOutput{Count: m.Count, Mean: m.Mean, M2: m.M2}
+}
+
+// momentsMapOutput is the count, mean and the sums of the second, third and fourth powers of the differences from
+// the mean of a mapper's values. Like the partials of stddev() they keep the mean rather than the sums of powers
+// of the values, so values with a large mean don't lose precision.
+type momentsMapOutput struct {
+	Count   int
+	Mean    float64
+	M2      float64
+	M3      float64
+	M4      float64
+	Version int
+}
+
+// add adds a value to the partial, extending Welford's method to the third and fourth moments. Each moment is
+// updated from the lower moments before they change, so the count, mean and M2 are the same as those of
+// stddevOnePassMapOutput whatever M3 and M4 hold.
+func (o *momentsMapOutput) add(val float64) {
+	n1 := float64(o.Count)
+	o.Count++
+	n := float64(o.Count)
+	delta := val - o.Mean
+	deltaN := delta / n
+	term := delta * deltaN * n1
+	o.Mean += deltaN
+	o.M4 += term*deltaN*deltaN*(n*n-3*n+3) + 6*deltaN*deltaN*o.M2 - 4*deltaN*o.M3
+	o.M3 += term*deltaN*(n-2) - 3*deltaN*o.M2
+	o.M2 += term
+}
+
+// sampleVariance returns the sample variance of the partial, dividing the sum of squared differences from the
+// mean by one less than the count. It returns false for fewer than two values, for which it's undefined.
+func (o *momentsMapOutput) sampleVariance() (float64, bool) {
+	if o.Count < 2 {
+		return 0, false
+	}
+	return snapVariance(o.M2/float64(o.Count-1), o.Mean), true
+}
+
+// populationVariance returns the population variance of the partial, dividing the sum of squared differences
+// from the mean by the count. It's 0 for a single value and returns false for no values.
+func (o *momentsMapOutput) populationVariance() (float64, bool) {
+	if o.Count == 0 {
+		return 0, false
+	}
+	return snapVariance(o.M2/float64(o.Count), o.Mean), true
+}
+
+// mergeMoments combines partials pairwise using Pébay's generalization of Chan's method, see pairwiseSum.
+// Partials must be non-empty.
+func mergeMoments(partials []*momentsMapOutput) *momentsMapOutput {
+	if len(partials) == 1 {
+		return partials[0]
+	}
+	mid := len(partials) / 2
+	a, b := mergeMoments(partials[:mid]), mergeMoments(partials[mid:])
+	na, nb := float64(a.Count), float64(b.Count)
+	n := na + nb
+	delta := b.Mean - a.Mean
+	delta2 := delta * delta
+	return &momentsMapOutput{
+		Count: a.Count + b.Count,
+		Mean:  a.Mean + delta*nb/n,
+		M2:    a.M2 + b.M2 + delta2*na*nb/n,
+		M3: a.M3 + b.M3 + delta2*delta*na*nb*(na-nb)/(n*n) +
+			3*delta*(na*b.M2-nb*a.M2)/n,
+		M4: a.M4 + b.M4 + delta2*delta2*na*nb*(na*na-na*nb+nb*nb)/(n*n*n) +
+			6*delta2*(na*na*b.M2+nb*nb*a.M2)/(n*n) + 4*delta*(na*b.M3-nb*a.M3)/n,
+	}
+}
+
+// MapMoments computes the count, mean and central moment sums of values in an iterator in a single pass.
+func MapMoments(itr Iterator) interface{} {
+	out := &momentsMapOutput{Version: PartialVersion}
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok {
+			out.add(val)
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if out.Count > 0 {
+		return out
+	}
+	return nil
+}
+
+// momentsOf merges the partials of MapMoments. It returns false if there are fewer than min values or their
+// variance is zero, for which the standardized moments are undefined.
+func momentsOf(values []interface{}, min int) (*momentsMapOutput, bool) {
+	var partials []*momentsMapOutput
+	for _, v := range values {
+		if v, ok := v.(*momentsMapOutput); ok && v.Count > 0 {
+			partials = append(partials, v)
+		}
+	}
+	if len(partials) == 0 {
+		return nil, false
+	}
+	m := mergeMoments(partials)
+	if m.Count < min || snapVariance(m.M2/float64(m.Count), m.Mean) == 0 {
+		return nil, false
+	}
+	return m, true
+}
+
+// ReduceSkewness computes the population skewness of values, their third central moment divided by the cube of
+// their standard deviation. It's nil for fewer than two values or values that are all equal.
+func ReduceSkewness(values []interface{}) interface{} {
+	m, ok := momentsOf(values, 2)
+	if !ok {
+		return nil
+	}
+	return math.Sqrt(float64(m.Count)) * m.M3 / math.Pow(m.M2, 1.5)
+}
+
+// ReduceKurtosis computes the population excess kurtosis of values, their fourth central moment divided by the
+// square of their variance, less the 3 of a normal distribution. It's nil for fewer than three values or values
+// that are all equal.
+func ReduceKurtosis(values []interface{}) interface{} {
+	m, ok := momentsOf(values, 3)
+	if !ok {
+		return nil
+	}
+	return float64(m.Count)*m.M4/(m.M2*m.M2) - 3
+}
+
+// SelectsPoint returns true if c is a selector returning all the fields of the selected point rather than the
+// value of a single field, such as first(value, 'point') or max(value, 'point').
+func SelectsPoint(c *Call) bool {
+	if c == nil {
+		return false
+	}
+	switch c.Name {
+	case "first", "last":
+		point, err := pointArg(c)
+		return err == nil && point
+	case "min", "max":
+		opt, err := numericAggregateArgs(c)
+		return err == nil && opt.point
+	}
+	return false
+}
+
+// pointArg returns true if first() or last() is passed the 'point' flag to return all the fields of the
+// selected point.
+func pointArg(c *Call) (bool, error) {
+	if len(c.Args) == 1 {
+		return false, nil
+	} else if len(c.Args) != 2 {
+		return false, fmt.Errorf("expected one or two arguments for %s()", c.Name)
+	}
+	if arg, ok := c.Args[1].(*StringLiteral); !ok || arg.Val != "point" {
+		return false, fmt.Errorf("unexpected argument %s in %s()", c.Args[1].String(), c.Name)
+	}
+	return true, nil
+}
+
+// selectPoint returns true if the selector name, one of first, last, min or max, prefers point a over point b.
+// Min and max compare the values of field, ties going to the earliest point.
+func selectPoint(name, field string, a, b *Point) bool {
+	switch name {
+	case "first", "last":
+		av := a.Values.(map[string]interface{})[field]
+		bv := b.Values.(map[string]interface{})[field]
+		return prefersFirstLast(name == "last", a.Timestamp, av, b.Timestamp, bv)
+	}
+	av, _ := finiteFloat64(a.Values.(map[string]interface{})[field])
+	bv, _ := finiteFloat64(b.Values.(map[string]interface{})[field])
+	if av == bv {
+		return a.Timestamp < b.Timestamp
+	}
+	return (name == "min" && av < bv) || (name == "max" && av > bv)
+}
+
+// MapSelectPoint collects the point selected by first(), last(), min() or max() of field along with all its
+// other fields. Points that don't have a value for field, or for min() and max() a finite numeric one, are
+// skipped.
+// The iterator must yield all the fields of each point, see MultiFieldCall.
+func MapSelectPoint(name, field string) MapFunc {
+	return func(itr Iterator) interface{} {
+		var out *Point
+		for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			val, ok := fields[field]
+			if !ok || val == nil {
+				continue
+			} else if _, ok := finiteFloat64(val); !ok && (name == "min" || name == "max") {
+				continue
+			}
+			p := &Point{Timestamp: k, Values: fields}
+			if out == nil || selectPoint(name, field, p, out) {
+				out = p
+			}
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+
+		if out == nil {
+			return nil
+		}
+		return out
+	}
+}
+
+// ReduceSelectPoint computes the point selected by first(), last(), min() or max() of field. The result is a
+// *Point whose Values holds all the fields of the point keyed by field name.
+func ReduceSelectPoint(name, field string) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var out *Point
+		for _, v := range values {
+			p, ok := v.(*Point)
+			if !ok || p == nil {
+				continue
+			}
+			if out == nil || selectPoint(name, field, p, out) {
+				out = p
+			}
+		}
+		if out == nil {
+			return nil
+		}
+		return out
+	}
+}
+
+// unmarshalPoint decodes the output of MapSelectPoint.
+func unmarshalPoint(b []byte) (interface{}, error) {
+	var p *Point
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, nil
+	}
+	if _, ok := p.Values.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("expected the fields of a point, got %v", p.Values)
+	}
+	return p, nil
+}
+
+type firstLastMapOutput struct {
+	Time int64
+	Val  interface{}
+}
+
+// prefersFirstLast returns true if first(), or last() if last is set, selects the value a at time at over the
+// value b at time bt. Points with the same time are common after downsampling or from shards that overlap, so
+// rather than depend on the order points are read and merged in, first() selects the smaller value and last()
+// the larger, in the order of interfaceValues.
+func prefersFirstLast(last bool, at int64, a interface{}, bt int64, b interface{}) bool {
+	if at != bt {
+		return (at < bt) != last
+	}
+	if last {
+		return interfaceValues{b, a}.Less(0, 1)
+	}
+	return interfaceValues{a, b}.Less(0, 1)
+}
+
+// mapFirstLast selects the first or last value of an iterator, skipping points with a nil value.
+func mapFirstLast(itr Iterator, last bool) interface{} {
+	var out *firstLastMapOutput
+	ordered := isOrdered(itr)
+	for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+		if v == nil {
+			continue
+		}
+		// points of time ordered input after the earliest time with a value can't be first
+		if ordered && !last && out != nil && k > out.Time {
+			break
+		}
+		if out == nil || prefersFirstLast(last, k, v, out.Time, out.Val) {
+			out = &firstLastMapOutput{Time: k, Val: v}
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return *out
+}
+
+// reduceFirstLast selects the first or last of the values selected by mapFirstLast.
+func reduceFirstLast(values []interface{}, last bool) interface{} {
+	var out *firstLastMapOutput
+	for _, v := range values {
+		val, ok := v.(firstLastMapOutput)
+		if !ok {
+			continue
+		}
+		if out == nil || prefersFirstLast(last, val.Time, val.Val, out.Time, out.Val) {
+			out = &val
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return out.Val
+}
+
+// MapFirst collects the values to pass to the reducer. Points with a nil value are skipped, so an interval whose
+// points all have nil values has no first value, just like an interval without points. Of points with the same
+// time, the smallest value is first, see prefersFirstLast.
+func MapFirst(itr Iterator) interface{} {
+	return mapFirstLast(itr, false)
+}
+
+// ReduceFirst computes the first of value.
+func ReduceFirst(values []interface{}) interface{} {
+	return reduceFirstLast(values, false)
+}
+
+// MapLast collects the values to pass to the reducer. Like MapFirst, points with a nil value are skipped. Of
+// points with the same time, the largest value is last.
+func MapLast(itr Iterator) interface{} {
+	return mapFirstLast(itr, true)
+}
+
+// ReduceLast computes the last of value.
+func ReduceLast(values []interface{}) interface{} {
+	return reduceFirstLast(values, true)
+}
+
+// MapEcho emits the data points for each group by interval
+func MapEcho(itr Iterator) interface{} {
+	var values []interface{}
+
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		values = append(values, v)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	return values
+}
+
+// ReducePercentile computes the percentile of values for each key. A negative percentile counts from the top
+// of the distribution instead of the bottom, so percentile(field, -95) is the value that 95% of values are
+// greater than or equal to. It is the percentile of the negated values, negated.
+func ReducePercentile(percentile float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return percentileOf(echoValues(values), percentile)
+	}
+}
+
+// ReducePercentiles computes several percentiles of values for each key, sorting the values only once. It
+// returns a map from each percentile, formatted like 50 or 99.9, to its value as ReducePercentile computes it.
+func ReducePercentiles(percentiles []float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		allValues := echoValues(values)
+		if len(allValues) == 0 {
+			return nil
+		}
+		batchedSort(allValues)
+		out := make(map[string]interface{}, len(percentiles))
+		for _, p := range percentiles {
+			out[strconv.FormatFloat(p, 'f', -1, 64)] = nearestRank(allValues, p)
+		}
+		return out
+	}
+}
+
+// percentileRankArg returns the threshold value passed as the second argument of percentile_rank().
+func percentileRankArg(c *Call) (float64, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and value for percentile_rank()")
+	}
+	lit, ok := c.Args[1].(*NumberLiteral)
+	if !ok {
+		return 0, fmt.Errorf("expected numeric value in percentile_rank()")
+	}
+	return lit.Val, nil
+}
+
+// ReducePercentileRank computes the percentile rank of threshold among values for each key, the percentage of
+// values less than or equal to it. It is the inverse of percentile().
+func ReducePercentileRank(threshold float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		allValues := echoValues(values)
+		if len(allValues) == 0 {
+			return nil
+		}
+		batchedSort(allValues)
+		n := sort.Search(len(allValues), func(i int) bool { return allValues[i] > threshold })
+		return 100 * float64(n) / float64(len(allValues))
+	}
+}
+
+// ReduceDeduplicated merges the raw points emitted by MapRawQuery for each mapper, keeping only the first of the
+// points with the same time and value, and reduces their values with fn as if they had been emitted by MapEcho.
+// Shards with overlapping ranges, such as replicas, emit the same points, which would otherwise be counted once
+// for each shard.
+func ReduceDeduplicated(fn ReduceFunc) ReduceFunc {
+	type key struct {
+		timestamp int64
+		value     interface{}
+	}
+	return func(values []interface{}) interface{} {
+		seen := make(map[key]bool)
+		var deduped []interface{}
+		for _, v := range values {
+			points, _ := v.([]*rawQueryMapOutput)
+			for _, p := range points {
+				// a remote mapper's values decode as float64, so compare numeric values as float64
+				k := key{timestamp: p.Timestamp, value: p.Values}
+				if f, ok := toFloat64(p.Values); ok {
+					k.value = f
+				}
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+				deduped = append(deduped, p.Values)
+			}
+		}
+		return fn([]interface{}{deduped})
+	}
+}
+
+// ReduceTrimmedPercentile computes the percentile of values for each key after discarding twice the given
+// fraction of values, those farthest from the median, see trimExtremes.
+func ReduceTrimmedPercentile(percentile, fraction float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return percentileOf(trimExtremes(echoValues(values), fraction), percentile)
+	}
+}
+
+// echoValues collects the float64 values emitted by MapEcho, leaving out NaN values.
+func echoValues(values []interface{}) []float64 {
+	var allValues []float64
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+
+		vals := v.([]interface{})
+		for _, v := range vals {
+			if val, ok := toFloat64(v); ok {
+				allValues = append(allValues, val)
+			}
+		}
+	}
+	return dropNaN(allValues)
+}
+
+// dropNaN removes NaN values from data in place. Sorting places NaN values unpredictably, so they're dropped
+// before selecting a value by its rank.
+func dropNaN(data []float64) []float64 {
+	finite := data[:0]
+	for _, v := range data {
+		if !math.IsNaN(v) {
+			finite = append(finite, v)
+		}
+	}
+	return finite
+}
+
+// ReducePercentileInterpolated computes the percentile of values for each key, interpolating linearly
+// between the two values bracketing the fractional rank p/100*(n-1). Unlike the nearest rank method used by
+// ReducePercentile, the 50th percentile always equals the median, for even as well as odd numbers of values.
+func ReducePercentileInterpolated(percentile float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		if p := interpolatePercentile(values, percentile); p != nil {
+			return p.Value
+		}
+		return nil
+	}
+}
+
+// percentileInterpolation is an interpolated percentile along with the two values bracketing its rank and the
+// interpolation weight, so that Value equals Lower + Weight*(Upper-Lower).
+type percentileInterpolation struct {
+	Value  float64
+	Lower  float64
+	Upper  float64
+	Weight float64
+}
+
+// ReducePercentileVerbose computes the percentile of values for each key like ReducePercentileInterpolated,
+// but returns the bracketing values and interpolation weight along with the result so it can be audited.
+func ReducePercentileVerbose(percentile float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		if p := interpolatePercentile(values, percentile); p != nil {
+			return p
+		}
+		return nil
+	}
+}
+
+// interpolatePercentile interpolates the percentile of the echoed values linearly between the two values
+// bracketing the fractional rank p/100*(n-1). It returns nil if there are no values.
+func interpolatePercentile(values []interface{}, percentile float64) *percentileInterpolation {
+	allValues := echoValues(values)
+	if len(allValues) == 0 || math.Abs(percentile) > 100 {
+		return nil
+	}
+	if percentile < 0 {
+		sort.Sort(sort.Reverse(sort.Float64Slice(allValues)))
+	} else {
+		sort.Float64s(allValues)
+	}
+
+	rank := math.Abs(percentile) / 100 * float64(len(allValues)-1)
+	lower := int(math.Floor(rank))
+	if lower == len(allValues)-1 {
+		v := allValues[lower]
+		return &percentileInterpolation{Value: v, Lower: v, Upper: v}
+	}
+	p := &percentileInterpolation{Lower: allValues[lower], Upper: allValues[lower+1], Weight: rank - float64(lower)}
+	p.Value = p.Lower + p.Weight*(p.Upper-p.Lower)
+	return p
+}
+
+// percentileOf returns the nearest rank percentile of allValues, sorting them in place.
+func percentileOf(allValues []float64, percentile float64) interface{} {
+	batchedSort(allValues)
+	if percentile < 0 {
+		for i, j := 0, len(allValues)-1; i < j; i, j = i+1, j-1 {
+			allValues[i], allValues[j] = allValues[j], allValues[i]
+		}
+	}
+	return nearestRank(allValues, math.Abs(percentile))
+}
+
+// nearestRank returns the value of sorted data at the rank of the percentile, or nil if there's no such rank.
+func nearestRank(sorted []float64, percentile float64) interface{} {
+	index := nearestRankIndex(len(sorted), percentile)
+	if index < 0 {
+		return nil
+	}
+	return sorted[index]
+}
+
+// nearestRankIndex returns the index of the nearest rank of the percentile among n sorted values, or -1 if
+// there's no such rank.
+func nearestRankIndex(n int, percentile float64) int {
+	index := int(math.Floor(float64(n)*percentile/100.0+0.5)) - 1
+	if index < 0 || index >= n {
+		return -1
+	}
+	return index
+}
+
+// ReduceDerivative computes the per second rate of change between each pair of consecutive points. Each
+// result is stamped with a timestamp chosen by policy. If smoothing is greater than one, the points are first
+// replaced by their moving average over that many points to reduce noise. Points are sorted by time first, so
+// timestamps that go backwards within or across mappers, e.g. from clock skew, never produce negative time
+// deltas, and points sharing a timestamp are skipped rather than divided by zero.
+func ReduceDerivative(policy TimestampPolicy, smoothing int) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+			return derivativeOf(points, policy, smoothing)
+		})
+	}
+}
+
+// ReduceDerivativeOrZero computes the derivative like ReduceDerivative, but emits a rate of 0 stamped with
+// the time of the latest point when an interval has points but no rate can be computed, e.g. when it only has
+// a single point. This keeps graphs from showing gaps.
+func ReduceDerivativeOrZero(policy TimestampPolicy, smoothing int) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+			if rates := derivativeOf(points, policy, smoothing); len(rates) > 0 || len(points) == 0 {
+				return rates
+			}
+			return []*rawQueryMapOutput{{points[len(points)-1].Timestamp, float64(0)}}
+		})
+	}
+}
+
+// derivativeOf returns the per second rate of change between each pair of consecutive time ordered points,
+// see ReduceDerivative.
+func derivativeOf(points []*rawQueryMapOutput, policy TimestampPolicy, smoothing int) []*rawQueryMapOutput {
+	points = numericPoints(points)
+	if smoothing > 1 {
+		points = movingAverageOf(points, MovingWindow{Points: smoothing})
+	}
+
+	var results []*rawQueryMapOutput
+	for i := 1; i < len(points); i++ {
+		prev, cur := points[i-1], points[i]
+		elapsed := cur.Timestamp - prev.Timestamp
+		if elapsed == 0 {
+			continue
+		}
+		curVal, _ := toFloat64(cur.Values)
+		prevVal, _ := toFloat64(prev.Values)
+		rate := (curVal - prevVal) / (float64(elapsed) / float64(time.Second))
+		results = append(results, &rawQueryMapOutput{policy.timestamp(prev.Timestamp, cur.Timestamp), rate})
+	}
+	return results
+}
+
+// ReduceDifference computes the difference between the values of each pair of consecutive points, stamped
+// with the time of the later point. Points are sorted by time first, since mappers on different shards return
+// them out of order. An interval with fewer than two points has no difference.
+func ReduceDifference(values []interface{}) interface{} {
+	return orderedReduce(values, func(sorted []*rawQueryMapOutput) interface{} {
+		var points []*rawQueryMapOutput
+		for _, p := range sorted {
+			if _, ok := toFloat64(p.Values); ok {
+				points = append(points, p)
+			}
+		}
+
+		var results []*rawQueryMapOutput
+		for i := 1; i < len(points); i++ {
+			prev, _ := toFloat64(points[i-1].Values)
+			cur, _ := toFloat64(points[i].Values)
+			results = append(results, &rawQueryMapOutput{points[i].Timestamp, cur - prev})
+		}
+		return results
+	})
+}
+
+// ReduceCumulativeSum computes the running total of the values of the time ordered points, with one result per
+// point holding the sum of every value up to and including it. Points from all mappers are sorted before
+// accumulating, so points from different shards are added in time order.
+func ReduceCumulativeSum(values []interface{}) interface{} {
+	return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+		var results []*rawQueryMapOutput
+		var sum float64
+		for _, p := range points {
+			if val, ok := toFloat64(p.Values); ok {
+				sum += val
+				results = append(results, &rawQueryMapOutput{p.Timestamp, sum})
+			}
+		}
+		return results
+	})
+}
+
+// unitArg returns the time unit of integral() or elapsed(), passed as an optional duration literal after the
+// field, or defaultUnit if there is none.
+func unitArg(c *Call, defaultUnit time.Duration) (time.Duration, error) {
+	if len(c.Args) < 1 || len(c.Args) > 2 {
+		return 0, fmt.Errorf("expected one or two arguments for %s()", c.Name)
+	} else if len(c.Args) == 1 {
+		return defaultUnit, nil
+	}
+	lit, ok := c.Args[1].(*DurationLiteral)
+	if !ok || lit.Val <= 0 {
+		return 0, fmt.Errorf("expected duration unit in %s()", c.Name)
+	}
+	return lit.Val, nil
+}
+
+// ReduceIntegral computes the area under the time ordered points with the trapezoidal rule, with time measured
+// in units of unit. Points sharing a timestamp add no area, and an interval with fewer than two points has no
+// integral.
+func ReduceIntegral(unit time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(sorted []*rawQueryMapOutput) interface{} {
+			var prev *rawQueryMapOutput
+			var area float64
+			var n int
+			for _, p := range sorted {
+				if _, ok := toFloat64(p.Values); !ok {
+					continue
+				}
+				if n++; prev != nil {
+					a, _ := toFloat64(prev.Values)
+					b, _ := toFloat64(p.Values)
+					area += 0.5 * (a + b) * (float64(p.Timestamp-prev.Timestamp) / float64(unit))
+				}
+				prev = p
+			}
+			if n < 2 {
+				return nil
+			}
+			return area
+		})
+	}
+}
+
+// ReduceTimeWeightedMean computes the mean of the time ordered points for each key with each value weighted by the
+// time until the next point, as if the value held until then. It's the area under the step function through the
+// points divided by the time they span, so densely sampled periods don't outweigh sparsely sampled ones. The
+// last value has no weight. A single point returns its value, and points that all share a timestamp span no
+// time and return nil.
+func ReduceTimeWeightedMean(values []interface{}) interface{} {
+	return orderedReduce(values, func(sorted []*rawQueryMapOutput) interface{} {
+		var first, prev *rawQueryMapOutput
+		var area float64
+		var n int
+		for _, p := range sorted {
+			if _, ok := toFloat64(p.Values); !ok {
+				continue
+			}
+			if n++; prev != nil {
+				v, _ := toFloat64(prev.Values)
+				area += v * float64(p.Timestamp-prev.Timestamp)
+			} else {
+				first = p
+			}
+			prev = p
+		}
+		if n == 0 {
+			return nil
+		} else if n == 1 {
+			v, _ := toFloat64(first.Values)
+			return v
+		}
+		duration := prev.Timestamp - first.Timestamp
+		if duration == 0 {
+			return nil
+		}
+		return area / float64(duration)
+	})
+}
+
+// lttbArg returns the number of points lttb() downsamples to, which must be at least 3 so that a point is
+// selected between the first and the last.
+func lttbArg(c *Call) (int, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and number of points for lttb()")
+	}
+	lit, ok := c.Args[1].(*NumberLiteral)
+	if !ok || lit.Val < 3 || lit.Val != math.Trunc(lit.Val) {
+		return 0, fmt.Errorf("expected integer number of points of at least 3 in lttb()")
+	}
+	return int(lit.Val), nil
+}
+
+// ReduceLTTB downsamples the time ordered numeric points for each key to n points with the Largest-Triangle-
+// Three-Buckets algorithm, which keeps the points that matter most to the shape of a plot, such as peaks and
+// troughs. The first and the last points are always kept and the points in between are split into n-2 buckets.
+// From each bucket the point forming the largest triangle with the point kept from the previous bucket and the
+// average of the next bucket is kept. With n or fewer points, every point is returned.
+func ReduceLTTB(n int) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(sorted []*rawQueryMapOutput) interface{} {
+			var points []*rawQueryMapOutput
+			var ys []float64
+			for _, p := range sorted {
+				if v, ok := toFloat64(p.Values); ok {
+					points = append(points, p)
+					ys = append(ys, v)
+				}
+			}
+			if len(points) <= n {
+				return points
+			}
+
+			// bucket i covers the points from bucket(i) up to bucket(i+1), leaving out the first and the last
+			bucket := func(i int) int {
+				return 1 + i*(len(points)-2)/(n-2)
+			}
+
+			results := make([]*rawQueryMapOutput, 0, n)
+			results = append(results, points[0])
+			a := 0
+			for i := 0; i < n-2; i++ {
+				// times are relative to the point kept from the previous bucket to keep their precision
+				x := func(j int) float64 {
+					return float64(points[j].Timestamp - points[a].Timestamp)
+				}
+
+				// the third vertex is the average of the next bucket, which is the last point for the last bucket
+				start, end := bucket(i+1), bucket(i+2)
+				if end > len(points) {
+					end = len(points)
+				}
+				var avgX, avgY float64
+				for j := start; j < end; j++ {
+					avgX += x(j)
+					avgY += ys[j]
+				}
+				avgX /= float64(end - start)
+				avgY /= float64(end - start)
+
+				best, maxArea := bucket(i), -1.0
+				for j := bucket(i); j < bucket(i+1); j++ {
+					area := math.Abs(x(j)*(avgY-ys[a]) - avgX*(ys[j]-ys[a]))
+					if area > maxArea {
+						best, maxArea = j, area
+					}
+				}
+				results = append(results, points[best])
+				a = best
+			}
+			return append(results, points[len(points)-1])
+		})
+	}
+}
+
+// meanOverTimeArg returns the interval passed as the second argument of mean_over_time().
+func meanOverTimeArg(c *Call) (time.Duration, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and interval for mean_over_time()")
+	}
+	lit, ok := c.Args[1].(*DurationLiteral)
+	if !ok || lit.Val <= 0 {
+		return 0, fmt.Errorf("expected positive duration interval in mean_over_time()")
+	}
+	return lit.Val, nil
+}
+
+// ReduceMeanOverTime computes the mean of the step function through the time ordered points for each key, where
+// each value holds until the next point and the last value is carried forward to the next boundary of interval,
+// aligned to the epoch. The last value is only carried up to end, the end of the group by interval, so it doesn't
+// fill time beyond the query. Points that span no time return nil.
+func ReduceMeanOverTime(interval time.Duration) BoundedReduceFunc {
+	return func(values []interface{}, start, end int64) interface{} {
+		return orderedReduce(values, func(sorted []*rawQueryMapOutput) interface{} {
+			var first, prev *rawQueryMapOutput
+			var area float64
+			for _, p := range sorted {
+				if _, ok := toFloat64(p.Values); !ok {
+					continue
+				}
+				if prev != nil {
+					v, _ := toFloat64(prev.Values)
+					area += v * float64(p.Timestamp-prev.Timestamp)
+				} else {
+					first = p
+				}
+				prev = p
+			}
+			if prev == nil {
+				return nil
+			}
+
+			// carry the last value forward to the boundary after it, or the end of the group by interval
+			boundary := (prev.Timestamp/int64(interval) + 1) * int64(interval)
+			if boundary > end {
+				boundary = end
+			}
+			if boundary > prev.Timestamp {
+				v, _ := toFloat64(prev.Values)
+				area += v * float64(boundary-prev.Timestamp)
+			} else {
+				boundary = prev.Timestamp
+			}
+			if boundary == first.Timestamp {
+				return nil
+			}
+			return area / float64(boundary-first.Timestamp)
+		})
+	}
+}
+
+// ReduceElapsed computes the time between each pair of consecutive time ordered points as a whole number of
+// units, stamped with the time of the later point. An interval with fewer than two points has no result.
+func ReduceElapsed(unit time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+			var results []*rawQueryMapOutput
+			for i := 1; i < len(points); i++ {
+				elapsed := (points[i].Timestamp - points[i-1].Timestamp) / int64(unit)
+				results = append(results, &rawQueryMapOutput{points[i].Timestamp, elapsed})
+			}
+			return results
+		})
+	}
+}
+
+// weightedMeanArgs returns the value and weight fields of mean_weighted(value, weight).
+func weightedMeanArgs(c *Call) (value, weight string, err error) {
+	if len(c.Args) == 2 {
+		v, ok1 := c.Args[0].(*VarRef)
+		w, ok2 := c.Args[1].(*VarRef)
+		if ok1 && ok2 {
+			return v.Val, w.Val, nil
+		}
+	}
+	return "", "", fmt.Errorf("expected value and weight fields for mean_weighted()")
+}
+
+// weightedMeanMapOutput is the sum of the values of a mapper each multiplied by its weight, and the sum of
+// the weights.
+type weightedMeanMapOutput struct {
+	WeightedSum float64
+	WeightSum   float64
+}
+
+// MapWeightedMean sums the values of the value field weighted by the weight field over an iterator yielding all
+// the fields of each point. Points without a numeric value and weight are skipped.
+func MapWeightedMean(value, weight string) MapFunc {
+	return func(itr Iterator) interface{} {
+		var out weightedMeanMapOutput
+		var n int
+		for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			val, ok1 := toFloat64(fields[value])
+			w, ok2 := toFloat64(fields[weight])
+			if !ok1 || !ok2 {
+				continue
+			}
+			out.WeightedSum += val * w
+			out.WeightSum += w
+			n++
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		return &out
+	}
+}
+
+// ReduceWeightedMean combines the weighted sums of each mapper into the weighted mean. It returns nil if the
+// weights total zero.
+func ReduceWeightedMean(values []interface{}) interface{} {
+	var out weightedMeanMapOutput
+	for _, v := range values {
+		if v, ok := v.(*weightedMeanMapOutput); ok {
+			out.WeightedSum += v.WeightedSum
+			out.WeightSum += v.WeightSum
+		}
+	}
+	if out.WeightSum == 0 {
+		return nil
+	}
+	return out.WeightedSum / out.WeightSum
+}
+
+// ratioArgs returns the numerator and denominator fields of ratio(numerator, denominator) and percentage().
+func ratioArgs(c *Call) (num, den string, err error) {
+	if len(c.Args) == 2 {
+		n, ok1 := c.Args[0].(*VarRef)
+		d, ok2 := c.Args[1].(*VarRef)
+		if ok1 && ok2 {
+			return n.Val, d.Val, nil
+		}
+	}
+	return "", "", fmt.Errorf("expected numerator and denominator fields for %s()", c.Name)
+}
+
+// ratioMapOutput is the sum of the numerator field and the sum of the denominator field of a mapper's points.
+type ratioMapOutput struct {
+	NumSum float64
+	DenSum float64
+}
+
+// MapRatio sums the num and den fields over an iterator yielding all the fields of each point. Points without a
+// numeric value for both fields are skipped, so each sum covers the same points.
+func MapRatio(num, den string) MapFunc {
+	return func(itr Iterator) interface{} {
+		var out ratioMapOutput
+		var n int
+		for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			nv, ok1 := toFloat64(fields[num])
+			dv, ok2 := toFloat64(fields[den])
+			if !ok1 || !ok2 {
+				continue
+			}
+			out.NumSum += nv
+			out.DenSum += dv
+			n++
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		return &out
+	}
+}
+
+// ReduceRatio combines the sums of each mapper into the ratio of the numerator to the denominator, multiplied by
+// factor, such as 100 for a percentage. It returns nil if the denominator totals zero.
+func ReduceRatio(factor float64) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var out ratioMapOutput
+		for _, v := range values {
+			if v, ok := v.(*ratioMapOutput); ok {
+				out.NumSum += v.NumSum
+				out.DenSum += v.DenSum
+			}
+		}
+		if out.DenSum == 0 {
+			return nil
+		}
+		return factor * out.NumSum / out.DenSum
+	}
+}
+
+// countDistinctOptions are the optional arguments of count_distinct().
+type countDistinctOptions struct {
+	withValues bool          // return the distinct values along with the count
+	gap        time.Duration // count distinct values per session
+	ignoreCase bool          // strings differing only in case count as the same value
+	approx     bool          // estimate the count with a HyperLogLog sketch
+	nulls      bool          // null values count as a value rather than being excluded
+}
+
+// countDistinctArgs returns the optional arguments of count_distinct(). The 'values' flag returns the distinct
+// values along with the count, a duration counts distinct values per session, where a session ends when the
+// time between consecutive points exceeds the duration, and the 'approx' flag estimates the count with a
+// HyperLogLog sketch. Any of them may be combined with the 'ignore_case' flag, which counts strings such as
+// "Host1" and "host1" as the same value.
+func countDistinctArgs(c *Call) (countDistinctOptions, error) {
+	var opt countDistinctOptions
+	if len(c.Args) < 1 || len(c.Args) > 4 {
+		return opt, fmt.Errorf("expected one to four arguments for %s()", c.Name)
+	}
+
+	for _, arg := range c.Args[1:] {
+		switch lit := arg.(type) {
+		case *StringLiteral:
+			if lit.Val == "ignore_case" && !opt.ignoreCase {
+				opt.ignoreCase = true
+				continue
+			} else if lit.Val == "nulls" && !opt.nulls {
+				opt.nulls = true
+				continue
+			} else if lit.Val == "values" && !opt.withValues && opt.gap == 0 && !opt.approx {
+				opt.withValues = true
+				continue
+			} else if lit.Val == "approx" && !opt.withValues && opt.gap == 0 && !opt.approx {
+				opt.approx = true
+				continue
+			}
+		case *DurationLiteral:
+			if lit.Val > 0 && !opt.withValues && opt.gap == 0 && !opt.approx {
+				opt.gap = lit.Val
+				continue
+			}
+		}
+		return opt, fmt.Errorf("expected 'values', 'approx' or session gap duration, and optionally 'ignore_case' and 'nulls', as arguments in %s()", c.Name)
+	}
+	return opt, nil
+}
+
+// DefaultHyperLogLogPrecision is the precision of the sketches used by count_distinct(field, 'approx'). A
+// sketch has 2^precision one byte registers and a standard error of about 1.04/sqrt(2^precision), 0.8% here.
+const DefaultHyperLogLogPrecision = 14
+
+// HyperLogLog is a sketch that estimates the number of distinct values added to it in a fixed amount of memory.
+// Sketches of the same precision can be merged, so the sketch of an interval can be persisted and later updated
+// with newly arrived points rather than recounting the whole interval.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty sketch with 2^precision registers. The precision must be between 4 and 16.
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < 4 || precision > 16 {
+		return nil, fmt.Errorf("HyperLogLog precision must be between 4 and 16, got %d", precision)
+	}
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}, nil
+}
+
+// Add adds a value to the sketch.
+func (h *HyperLogLog) Add(v interface{}) {
+	x := hashValue(v)
+	i := x >> (64 - h.precision)
+	w := x<<h.precision | 1<<(h.precision-1) // the guard bit bounds the rank
+	var rank uint8 = 1
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// Merge adds the values of another sketch of the same precision to this one.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if other.precision != h.precision {
+		return fmt.Errorf("can't merge HyperLogLog sketches of precision %d and %d", h.precision, other.precision)
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Count returns the estimated number of distinct values added to the sketch.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// use linear counting for small cardinalities where the raw estimate is biased
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary encodes the sketch as its precision followed by its registers.
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	return append([]byte{h.precision}, h.registers...), nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary.
+func (h *HyperLogLog) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 || b[0] < 4 || b[0] > 16 || len(b) != 1+1<<b[0] {
+		return fmt.Errorf("invalid HyperLogLog sketch")
+	}
+	h.precision = b[0]
+	h.registers = append([]uint8(nil), b[1:]...)
+	return nil
+}
+
+// MarshalJSON encodes the sketch for sending between nodes.
+func (h *HyperLogLog) MarshalJSON() ([]byte, error) {
+	b, _ := h.MarshalBinary()
+	return json.Marshal(b)
+}
+
+// UnmarshalJSON decodes a sketch encoded by MarshalJSON.
+func (h *HyperLogLog) UnmarshalJSON(data []byte) error {
+	var b []byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	return h.UnmarshalBinary(b)
+}
+
+// hashValue returns a well mixed 64 bit hash of a point value.
+func hashValue(v interface{}) uint64 {
+	var buf [9]byte
+	var b []byte
+	switch v := v.(type) {
+	case float64:
+		buf[0] = 1
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v))
+		b = buf[:]
+	case int64:
+		buf[0] = 2
+		binary.BigEndian.PutUint64(buf[1:], uint64(v))
+		b = buf[:]
+	case bool:
+		buf[0] = 3
+		if v {
+			buf[1] = 1
+		}
+		b = buf[:2]
+	default:
+		b = []byte(fmt.Sprintf("\x04%v", v))
+	}
+
+	f := fnv.New64a()
+	f.Write(b)
+	x := f.Sum64()
+
+	// finalize with the murmur3 mixer since FNV alone spreads similar inputs poorly across the high bits
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// IntervalSketch is the HyperLogLog sketch of the distinct values in the group by interval starting at Start.
+// A continuous rollup of count_distinct() persists the sketch of each interval and updates it as new points
+// arrive instead of recounting the interval from scratch.
+type IntervalSketch struct {
+	Start  int64
+	Sketch *HyperLogLog
+}
+
+// MarshalBinary encodes the interval start time followed by the sketch.
+func (s *IntervalSketch) MarshalBinary() ([]byte, error) {
+	b, err := s.Sketch.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8, 8+len(b))
+	binary.BigEndian.PutUint64(buf, uint64(s.Start))
+	return append(buf, b...), nil
+}
+
+// UnmarshalBinary decodes an interval sketch encoded by MarshalBinary.
+func (s *IntervalSketch) UnmarshalBinary(b []byte) error {
+	if len(b) < 8 {
+		return fmt.Errorf("invalid interval sketch")
+	}
+	s.Start = int64(binary.BigEndian.Uint64(b))
+	s.Sketch = &HyperLogLog{}
+	return s.Sketch.UnmarshalBinary(b[8:])
+}
+
+// Update merges the output of MapHyperLogLog for newly arrived points into the sketch and returns the updated
+// estimate of distinct values in the interval.
+func (s *IntervalSketch) Update(values []interface{}) (uint64, error) {
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if err := s.Sketch.Merge(v.(*HyperLogLog)); err != nil {
+			return 0, err
+		}
+	}
+	return s.Sketch.Count(), nil
+}
+
+// MapHyperLogLog adds the values in an iterator to a sketch.
+func MapHyperLogLog(itr Iterator) interface{} {
+	h, _ := NewHyperLogLog(DefaultHyperLogLogPrecision)
+	n := 0
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		h.Add(v)
+		n++
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return nil
+	}
+	return h
+}
+
+// ReduceCountDistinctApprox merges the sketches from each mapper and estimates the number of distinct values.
+func ReduceCountDistinctApprox(values []interface{}) interface{} {
+	h, _ := NewHyperLogLog(DefaultHyperLogLogPrecision)
+	n := 0
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if err := h.Merge(v.(*HyperLogLog)); err != nil {
+			return err
+		}
+		n++
+	}
+
+	if n == 0 {
+		return nil
+	}
+	return float64(h.Count())
+}
+
+// foldCaseIterator lower cases the string values of an iterator.
+type foldCaseIterator struct {
+	itr Iterator
+}
+
+// Next returns the next value from the underlying iterator.
+func (f *foldCaseIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	seriesID, timestamp, value, ok = f.itr.Next()
+	if s, ok := value.(string); ok {
+		value = strings.ToLower(s)
+	}
+	return
+}
+
+// Err returns the error that stopped the underlying iterator, if any.
+func (f *foldCaseIterator) Err() error { return iteratorErr(f.itr) }
+
+// MapIgnoreCase wraps a map function so that it sees string values lower cased.
+func MapIgnoreCase(fn MapFunc) MapFunc {
+	return func(itr Iterator) interface{} {
+		return fn(&foldCaseIterator{itr: itr})
+	}
+}
+
+// distinctArgs returns true if distinct() was passed the optional 'nulls' flag to count null as a value.
+func distinctArgs(c *Call) (bool, error) {
+	if len(c.Args) < 1 || len(c.Args) > 2 {
+		return false, fmt.Errorf("expected one or two arguments for distinct()")
+	}
+	if len(c.Args) == 1 {
+		return false, nil
+	}
+	if lit, ok := c.Args[1].(*StringLiteral); !ok || lit.Val != "nulls" {
+		return false, fmt.Errorf("expected 'nulls' as second argument in distinct()")
+	}
+	return true, nil
+}
+
+// nonNullIterator skips the null values of an iterator.
+type nonNullIterator struct {
+	itr Iterator
+}
+
+// Next returns the next non-null value from the underlying iterator.
+func (n *nonNullIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	for {
+		seriesID, timestamp, value, ok = n.itr.Next()
+		if !ok || value != nil {
+			return
+		}
+	}
+}
+
+// Err returns the error that stopped the underlying iterator, if any.
+func (n *nonNullIterator) Err() error { return iteratorErr(n.itr) }
+
+// MapExcludeNulls wraps a map function so that points with a null value are excluded. Distinct(),
+// count_distinct() and mode() exclude nulls by default and only count null as a value when passed 'nulls'.
+func MapExcludeNulls(fn MapFunc) MapFunc {
+	return func(itr Iterator) interface{} {
+		return fn(&nonNullIterator{itr: itr})
+	}
+}
+
+// MapDistinct computes the unique values in an iterator. A null value is kept as nil, which sorts last.
+func MapDistinct(itr Iterator) interface{} {
+	index := make(map[interface{}]struct{})
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		index[v] = struct{}{}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+
+	if len(index) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, 0, len(index))
+	for v := range index {
+		values = append(values, v)
+	}
+	return values
+}
+
+// ReduceDistinct computes the unique values for each key, in ascending order.
+func ReduceDistinct(values []interface{}) interface{} {
+	index := make(map[interface{}]struct{})
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, val := range v.([]interface{}) {
+			index[val] = struct{}{}
+		}
+	}
+
+	if len(index) == 0 {
+		return nil
+	}
+
+	out := make([]interface{}, 0, len(index))
+	for v := range index {
+		out = append(out, v)
+	}
+	sort.Sort(interfaceValues(out))
+	return out
+}
+
+// DistinctChangesReducer is the StatefulReducer of distinct_changes(). It returns the number of distinct values
+// of an interval only if they differ from the distinct values of the previous interval, and nil otherwise.
+// Intervals without values have no distinct values, so going from some values to none is a change to 0.
+type DistinctChangesReducer struct {
+	prev map[interface{}]struct{}
+}
+
+// NewDistinctChangesReducer returns a DistinctChangesReducer for a new query.
+func NewDistinctChangesReducer() *DistinctChangesReducer {
+	return &DistinctChangesReducer{prev: make(map[interface{}]struct{})}
+}
+
+// Reduce computes the distinct values of the outputs of MapDistinct for the next interval and compares them
+// with the previous interval's.
+func (r *DistinctChangesReducer) Reduce(values []interface{}) interface{} {
+	index := make(map[interface{}]struct{})
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, val := range v.([]interface{}) {
+			index[val] = struct{}{}
+		}
+	}
+
+	changed := len(index) != len(r.prev)
+	for v := range index {
+		if changed {
+			break
+		}
+		_, seen := r.prev[v]
+		changed = !seen
+	}
+	r.prev = index
+
+	if !changed {
+		return nil
+	}
+	return float64(len(index))
+}
+
+type countDistinctOutput struct {
+	Count  float64
+	Values []interface{}
+}
+
+// ReduceCountDistinct computes the number of unique values for each key. If withValues is set the sorted unique
+// values are returned along with the count.
+func ReduceCountDistinct(withValues bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		index := make(map[interface{}]struct{})
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+			for _, val := range v.([]interface{}) {
+				index[val] = struct{}{}
+			}
+		}
+
+		if len(index) == 0 {
+			return nil
+		}
+		if !withValues {
+			return float64(len(index))
+		}
+
+		out := &countDistinctOutput{Count: float64(len(index))}
+		for v := range index {
+			out.Values = append(out.Values, v)
+		}
+		sort.Sort(interfaceValues(out.Values))
+		return out
+	}
+}
+
+// ReduceCountDistinctSessions splits the time ordered points for each key into sessions wherever consecutive
+// points are more than gap apart, and computes the number of unique values in each session. Each count is
+// stamped with the time of the first point in its session.
+func ReduceCountDistinctSessions(gap time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var results []*rawQueryMapOutput
+		var index map[interface{}]struct{}
+		points, err := sortedRawOutputs(values)
+		if err != nil {
+			return err
+		}
+		for i, p := range points {
+			if i == 0 || p.Timestamp-points[i-1].Timestamp > int64(gap) {
+				index = make(map[interface{}]struct{})
+				results = append(results, &rawQueryMapOutput{Timestamp: p.Timestamp})
+			}
+			index[p.Values] = struct{}{}
+			results[len(results)-1].Values = float64(len(index))
+		}
+
+		if len(results) == 0 {
+			return nil
+		}
+		return results
+	}
+}
+
+// interfaceValues sorts values of mixed types. Booleans sort before numbers, numbers before strings, and
+// strings before nil.
+type interfaceValues []interface{}
+
+func (a interfaceValues) Len() int      { return len(a) }
+func (a interfaceValues) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a interfaceValues) Less(i, j int) bool {
+	ri, rj := typeRank(a[i]), typeRank(a[j])
+	if ri != rj {
+		return ri < rj
+	}
+
+	switch v := a[i].(type) {
+	case bool:
+		return !v && a[j].(bool)
+	case float64:
+		return v < a[j].(float64)
+	case int64:
+		return v < a[j].(int64)
+	case string:
+		return v < a[j].(string)
+	}
+	return false
+}
+
+// typeRank returns the position of the value's type in the sort order of interfaceValues.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case bool:
+		return 0
+	case int64:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+// nthArg returns the position passed as the second argument of nth().
+func nthArg(c *Call) (int, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and position for nth()")
+	}
+	lit, ok := c.Args[1].(*NumberLiteral)
+	if !ok || lit.Val == 0 || lit.Val != math.Trunc(lit.Val) {
+		return 0, fmt.Errorf("expected non-zero integer position in nth()")
+	}
+	return int(lit.Val), nil
+}
+
+// ReduceNth returns the value of the nth point by time for each key. Positions start at 1 and negative
+// positions count back from the last point, so -1 is the last point. Positions out of range return nil.
+func ReduceNth(n int) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		points, err := sortedRawOutputs(values)
+		if err != nil {
+			return err
+		}
+
+		i := n - 1
+		if n < 0 {
+			i = len(points) + n
+		}
+		if i < 0 || i >= len(points) {
+			return nil
+		}
+		return points[i].Values
+	}
+}
+
+// expectedIntervalArg returns the expected sampling interval passed as the second argument of the call.
+func expectedIntervalArg(c *Call) (time.Duration, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and sampling interval for %s()", c.Name)
+	}
+	lit, ok := c.Args[1].(*DurationLiteral)
+	if !ok || lit.Val <= 0 {
+		return 0, fmt.Errorf("expected duration sampling interval in %s()", c.Name)
+	}
+	return lit.Val, nil
+}
+
+// ReduceMissingCount computes how many points are missing for each key given that a point is expected every
+// interval. A gap of d between consecutive points is missing (d-1)/interval points, so a gap of exactly one
+// interval is missing none.
+func ReduceMissingCount(interval time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		points, err := sortedRawOutputs(values)
+		if err != nil {
+			return err
+		}
+		if len(points) == 0 {
+			return nil
+		}
+
+		var missing int64
+		for i := 1; i < len(points); i++ {
+			if gap := points[i].Timestamp - points[i-1].Timestamp; gap > 0 {
+				missing += (gap - 1) / int64(interval)
+			}
+		}
+		return float64(missing)
+	}
+}
+
+// holtWintersArgs returns the number of predictions and the season length passed to holt_winters().
+func holtWintersArgs(c *Call) (n, season int, err error) {
+	if len(c.Args) != 3 {
+		return 0, 0, fmt.Errorf("expected field, number of predictions and season length for holt_winters()")
+	}
+	if lit, ok := c.Args[1].(*NumberLiteral); !ok || lit.Val <= 0 || lit.Val != math.Trunc(lit.Val) {
+		return 0, 0, fmt.Errorf("expected positive integer number of predictions in holt_winters()")
+	} else {
+		n = int(lit.Val)
+	}
+	if lit, ok := c.Args[2].(*NumberLiteral); !ok || lit.Val <= 0 || lit.Val != math.Trunc(lit.Val) {
+		return 0, 0, fmt.Errorf("expected positive integer season length in holt_winters()")
+	} else {
+		season = int(lit.Val)
+	}
+	return n, season, nil
+}
+
+// ReduceHoltWinters fits an additive triple exponential smoothing model to the time ordered points for each key
+// and returns the points followed by n forecast points. The model needs two full seasons of points to initialize,
+// so fewer points return nil. Forecast points are spaced at the median interval between the points, which treats
+// irregular sampling as if it were regular.
+func ReduceHoltWinters(n, season int) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+			var ys []float64
+			var times []int64
+			for _, p := range points {
+				if v, ok := toFloat64(p.Values); ok {
+					ys = append(ys, v)
+					times = append(times, p.Timestamp)
+				}
+			}
+			if len(ys) < 2*season || len(ys) < 2 {
+				return nil
+			}
+
+			m := holtWintersModel{season: season}
+			params := nelderMead(func(x []float64) float64 {
+				return m.fit(ys, x[0], x[1], x[2])
+			}, []float64{0.3, 0.1, 0.1}, 200)
+			m.fit(ys, params[0], params[1], params[2])
+
+			step := medianDelta(times)
+			results := make([]*rawQueryMapOutput, 0, len(points)+n)
+			results = append(results, points...)
+			last := times[len(times)-1]
+			for h := 1; h <= n; h++ {
+				results = append(results, &rawQueryMapOutput{last + int64(h)*step, m.forecast(len(ys), h)})
+			}
+			return results
+		})
+	}
+}
+
+// holtWintersModel holds the state of an additive triple exponential smoothing model after a fit.
+type holtWintersModel struct {
+	season    int
+	level     float64
+	trend     float64
+	seasonals []float64 // seasonal component of the latest point at each position in the season
+}
+
+// fit runs the model over ys with the smoothing parameters alpha, beta and gamma and returns the sum of the
+// squared one step ahead errors. Parameters outside of [0, 1] are clamped. The trend starts at the change in mean
+// between the first two seasons, the level at the trend line through the mean of the first season and the
+// seasonals at the deviations of the first season from that line.
+func (m *holtWintersModel) fit(ys []float64, alpha, beta, gamma float64) float64 {
+	alpha, beta, gamma = clamp01(alpha), clamp01(beta), clamp01(gamma)
+
+	var first, second float64
+	for i := 0; i < m.season; i++ {
+		first += ys[i]
+		second += ys[m.season+i]
+	}
+	first /= float64(m.season)
+	second /= float64(m.season)
+
+	m.trend = (second - first) / float64(m.season)
+	mid := float64(m.season-1) / 2
+	m.level = first + mid*m.trend
+	m.seasonals = make([]float64, m.season)
+	for i := range m.seasonals {
+		m.seasonals[i] = ys[i] - (first + (float64(i)-mid)*m.trend)
+	}
+
+	var sse float64
+	for t := m.season; t < len(ys); t++ {
+		s := m.seasonals[t%m.season]
+		e := ys[t] - (m.level + m.trend + s)
+		sse += e * e
+		level := alpha*(ys[t]-s) + (1-alpha)*(m.level+m.trend)
+		m.trend = beta*(level-m.level) + (1-beta)*m.trend
+		m.level = level
+		m.seasonals[t%m.season] = gamma*(ys[t]-level) + (1-gamma)*s
+	}
+	return sse
+}
+
+// forecast returns the prediction h steps after the last of the n points the model was fit to.
+func (m *holtWintersModel) forecast(n, h int) float64 {
+	return m.level + float64(h)*m.trend + m.seasonals[(n+h-1)%m.season]
+}
+
+// clamp01 returns v limited to [0, 1].
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// medianDelta returns the median interval between consecutive time ordered timestamps.
+func medianDelta(times []int64) int64 {
+	deltas := make([]int64, 0, len(times)-1)
+	for i := 1; i < len(times); i++ {
+		deltas = append(deltas, times[i]-times[i-1])
+	}
+	sort.Sort(int64Slice(deltas))
+	return deltas[len(deltas)/2]
+}
+
+// int64Slice sorts int64 values in ascending order.
+type int64Slice []int64
+
+func (a int64Slice) Len() int           { return len(a) }
+func (a int64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// nelderMead minimizes f with the Nelder-Mead simplex method starting from start and returns the best point
+// found after at most iterations steps.
+func nelderMead(f func(x []float64) float64, start []float64, iterations int) []float64 {
+	dim := len(start)
+	simplex := make([][]float64, dim+1)
+	scores := make([]float64, dim+1)
+	for i := range simplex {
+		simplex[i] = append([]float64(nil), start...)
+		if i > 0 {
+			simplex[i][i-1] += 0.1
+		}
+		scores[i] = f(simplex[i])
+	}
+
+	// along returns the point from the centroid c in the direction away from the worst point w scaled by k.
+	along := func(c, w []float64, k float64) []float64 {
+		x := make([]float64, dim)
+		for i := range x {
+			x[i] = c[i] + k*(c[i]-w[i])
+		}
+		return x
+	}
+
+	for iter := 0; iter < iterations; iter++ {
+		// Order the simplex from the best point to the worst.
+		for i := 1; i < len(simplex); i++ {
+			for j := i; j > 0 && scores[j] < scores[j-1]; j-- {
+				simplex[j], simplex[j-1] = simplex[j-1], simplex[j]
+				scores[j], scores[j-1] = scores[j-1], scores[j]
+			}
+		}
+		if scores[dim]-scores[0] <= 1e-12*math.Abs(scores[0]) {
+			break
+		}
+
+		centroid := make([]float64, dim)
+		for _, x := range simplex[:dim] {
+			for i := range centroid {
+				centroid[i] += x[i] / float64(dim)
+			}
+		}
+		worst := simplex[dim]
+
+		reflected := along(centroid, worst, 1)
+		r := f(reflected)
+		switch {
+		case r < scores[0]:
+			if expanded := along(centroid, worst, 2); f(expanded) < r {
+				simplex[dim], scores[dim] = expanded, f(expanded)
+			} else {
+				simplex[dim], scores[dim] = reflected, r
+			}
+		case r < scores[dim-1]:
+			simplex[dim], scores[dim] = reflected, r
+		default:
+			if contracted := along(centroid, worst, -0.5); f(contracted) < scores[dim] {
+				simplex[dim], scores[dim] = contracted, f(contracted)
+				continue
+			}
+			// Shrink every point towards the best one.
+			for i := 1; i < len(simplex); i++ {
+				for j := range simplex[i] {
+					simplex[i][j] = simplex[0][j] + 0.5*(simplex[i][j]-simplex[0][j])
+				}
+				scores[i] = f(simplex[i])
+			}
+		}
+	}
+
+	best := 0
+	for i := range scores {
+		if scores[i] < scores[best] {
+			best = i
+		}
+	}
+	return simplex[best]
+}
+
+// gapIntervalArg returns the interval passed as the second argument of count_gaps(), either a duration or a
+// number of nanoseconds.
+func gapIntervalArg(c *Call) (time.Duration, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and interval for count_gaps()")
+	}
+	switch lit := c.Args[1].(type) {
+	case *DurationLiteral:
+		if lit.Val > 0 {
+			return lit.Val, nil
+		}
+	case *NumberLiteral:
+		if lit.Val > 0 && lit.Val == math.Trunc(lit.Val) {
+			return time.Duration(lit.Val), nil
+		}
+	}
+	return 0, fmt.Errorf("expected positive duration interval in count_gaps()")
+}
+
+// ReduceCountGaps counts the gaps between consecutive points longer than interval for each key. A gap of
+// exactly interval isn't counted, and fewer than two points have no gaps.
+func ReduceCountGaps(interval time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		points, err := sortedRawOutputs(values)
+		if err != nil {
+			return err
+		}
+		var gaps int64
+		for i := 1; i < len(points); i++ {
+			if points[i].Timestamp-points[i-1].Timestamp > int64(interval) {
+				gaps++
+			}
+		}
+		return float64(gaps)
+	}
+}
+
+// MovingWindow is the window of a moving aggregate. It spans either a fixed number of points or a duration.
+type MovingWindow struct {
+	Points   int
+	Duration time.Duration
+}
+
+// movingWindowArg returns the window passed as the second argument of a moving aggregate. An integer
+// literal sets a point count window and a duration literal sets a time window.
+func movingWindowArg(c *Call) (MovingWindow, error) {
+	if len(c.Args) != 2 {
+		return MovingWindow{}, fmt.Errorf("expected field and window size for %s()", c.Name)
+	}
+	switch lit := c.Args[1].(type) {
+	case *NumberLiteral:
+		if lit.Val > 0 && lit.Val == math.Trunc(lit.Val) {
+			return MovingWindow{Points: int(lit.Val)}, nil
+		}
+	case *DurationLiteral:
+		if lit.Val > 0 {
+			return MovingWindow{Duration: lit.Val}, nil
+		}
+	}
+	return MovingWindow{}, fmt.Errorf("expected field and window size for %s()", c.Name)
+}
+
+// each calls fn with the values of every full window over the time ordered points, along with the timestamp of
+// the last point in the window. A point count window is full once it holds that many points. A time window
+// ending at a point holds the points within the duration before it, and is full once the duration since the
+// first point has elapsed.
+func (w MovingWindow) each(points rawOutputs, fn func(timestamp int64, window []float64)) {
+	points = numericPoints(points)
+	window := make([]float64, 0, w.Points)
+	start := 0
+	for i, p := range points {
+		if w.Points > 0 {
+			if i < w.Points-1 {
+				continue
+			}
+			start = i - w.Points + 1
+		} else {
+			if p.Timestamp-points[0].Timestamp < int64(w.Duration) {
+				continue
+			}
+			for p.Timestamp-points[start].Timestamp >= int64(w.Duration) {
+				start++
+			}
+		}
+
+		window = window[:0]
+		for _, wp := range points[start : i+1] {
+			v, _ := toFloat64(wp.Values)
+			window = append(window, v)
+		}
+		fn(p.Timestamp, window)
+	}
+}
+
+// numericPoints returns the points with numeric values, leaving out the points of string and boolean values
+// that moving aggregates and derivatives can't compute over.
+func numericPoints(points []*rawQueryMapOutput) []*rawQueryMapOutput {
+	numeric := make([]*rawQueryMapOutput, 0, len(points))
+	for _, p := range points {
+		if _, ok := toFloat64(p.Values); ok {
+			numeric = append(numeric, p)
+		}
+	}
+	return numeric
+}
+
+// ReduceMovingAverage computes the mean of each full window over the time ordered points for each key.
+func ReduceMovingAverage(w MovingWindow) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+			return movingAverageOf(points, w)
+		})
+	}
+}
+
+// movingAverageOf returns the mean of each full window over the time ordered points.
+func movingAverageOf(points []*rawQueryMapOutput, w MovingWindow) []*rawQueryMapOutput {
+	var results []*rawQueryMapOutput
+	w.each(points, func(timestamp int64, window []float64) {
+		var sum float64
+		for _, v := range window {
+			sum += v
+		}
+		results = append(results, &rawQueryMapOutput{timestamp, sum / float64(len(window))})
+	})
+	return results
+}
+
+// ReduceMovingStddev computes the sample standard deviation of each full window over the time ordered points for
+// each key. Windows holding fewer than two points are skipped.
+func ReduceMovingStddev(w MovingWindow) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+			var results []*rawQueryMapOutput
+			w.each(points, func(timestamp int64, window []float64) {
+				if len(window) < 2 {
+					return
+				}
+				var mean float64
+				for i, v := range window {
+					mean += (v - mean) / float64(i+1)
+				}
+				var variance float64
+				for _, v := range window {
+					variance += (v - mean) * (v - mean)
+				}
+				stddev := math.Sqrt(snapVariance(variance/float64(len(window)-1), mean))
+				results = append(results, &rawQueryMapOutput{timestamp, stddev})
+			})
+			return results
+		})
+	}
+}
+
+// ReduceMovingExtreme computes the min of each full window over the time ordered points for each key, or the max
+// if max is set. Rather than scan each window, it keeps the positions of the values that can still be the
+// extreme of a later window in a monotonic deque, so each point is added and removed once whatever the size of
+// the window.
+func ReduceMovingExtreme(w MovingWindow, max bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		return orderedReduce(values, func(points []*rawQueryMapOutput) interface{} {
+			return movingExtremeOf(points, w, max)
+		})
+	}
+}
+
+// movingExtremeOf returns the min, or max if max is set, of each full window over the time ordered points. Windows
+// are full under the same conditions as in MovingWindow.each, over the points with numeric values. The extreme
+// value is returned as it was mapped, so the extremes of an integer field are integers.
+func movingExtremeOf(points []*rawQueryMapOutput, w MovingWindow, max bool) []*rawQueryMapOutput {
+	points = numericPoints(points)
+	vals := make([]float64, len(points))
+	for i, p := range points {
+		vals[i], _ = toFloat64(p.Values)
+	}
+
+	var results []*rawQueryMapOutput
+	var deque []int // positions of points with values in increasing order, or decreasing if max is set
+	start := 0
+	for i, p := range points {
+		// a value is never the extreme of a window again once a later value is at least as extreme
+		val := vals[i]
+		for len(deque) > 0 {
+			last := vals[deque[len(deque)-1]]
+			if (max && last > val) || (!max && last < val) {
+				break
+			}
+			deque = deque[:len(deque)-1]
+		}
+		deque = append(deque, i)
+
+		if w.Points > 0 {
+			if i < w.Points-1 {
+				continue
+			}
+			start = i - w.Points + 1
+		} else {
+			if p.Timestamp-points[0].Timestamp < int64(w.Duration) {
+				continue
+			}
+			for p.Timestamp-points[start].Timestamp >= int64(w.Duration) {
+				start++
+			}
+		}
+
+		for deque[0] < start {
+			deque = deque[1:]
 		}
-		return data[0]
+		results = append(results, &rawQueryMapOutput{p.Timestamp, points[deque[0]].Values})
 	}
-	middle := length / 2
-	var sortedRange []float64
-	if length%2 == 0 {
-		sortedRange = getSortedRange(data, middle-1, 2)
-		var low, high = sortedRange[0], sortedRange[1]
-		return low + (high-low)/2
-	} else {
-		sortedRange = getSortedRange(data, middle, 1)
-		return sortedRange[0]
+	return results
+}
+
+// decayWeights returns the weight of each time ordered point when points decay with the given half-life. Weights
+// are relative to the latest point, which has a weight of 1, and halve for every half-life a point is older.
+func decayWeights(points rawOutputs, halfLife time.Duration) []float64 {
+	if len(points) == 0 {
+		return nil
+	}
+	latest := points[len(points)-1].Timestamp
+	weights := make([]float64, len(points))
+	for i, p := range points {
+		weights[i] = math.Exp2(-float64(latest-p.Timestamp) / float64(halfLife))
 	}
+	return weights
 }
 
-// getSortedRange returns a sorted subset of data. By using discardLowerRange and discardUpperRange to get the target
-// subset (unsorted) and then just sorting that subset, the work can be reduced from O(N lg N), where N is len(data), to
-// O(N + count lg count) for the average case
-// - O(N) to discard the unwanted items
-// - O(count lg count) to sort the count number of extracted items
-// This can be useful for:
-// - finding the median: getSortedRange(data, middle, 1)
-// - finding the top N: getSortedRange(data, len(data) - N, N)
-// - finding the bottom N: getSortedRange(data, 0, N)
-func getSortedRange(data []float64, start int, count int) []float64 {
-	out := discardLowerRange(data, start)
-	k := len(out) - count
-	if k > 0 {
-		out = discardUpperRange(out, k)
+// ReduceDecayedSum computes the sum of the values for each key with each point weighted by time decay, so that
+// recent points dominate the result.
+func ReduceDecayedSum(halfLife time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		points, err := sortedRawOutputs(values)
+		if err != nil {
+			return err
+		}
+		if len(points) == 0 {
+			return nil
+		}
+		var sum float64
+		for i, w := range decayWeights(points, halfLife) {
+			if val, ok := toFloat64(points[i].Values); ok {
+				sum += w * val
+			}
+		}
+		return sum
 	}
-	sort.Float64s(out)
+}
 
-	return out
+// ReduceDecayedMean computes the weighted mean of the values for each key with each point weighted by time decay.
+func ReduceDecayedMean(halfLife time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		points, err := sortedRawOutputs(values)
+		if err != nil {
+			return err
+		}
+		if len(points) == 0 {
+			return nil
+		}
+		var sum, total float64
+		for i, w := range decayWeights(points, halfLife) {
+			if val, ok := toFloat64(points[i].Values); ok {
+				sum += w * val
+				total += w
+			}
+		}
+		if total == 0 {
+			return nil
+		}
+		return sum / total
+	}
 }
 
-// discardLowerRange discards the lower k elements of the sorted data set without sorting all the data. Sorting all of
-// the data would take O(NlgN), where N is len(data), but partitioning to find the kth largest number is O(N) in the
-// average case. The remaining N-k unsorted elements are returned - no kind of ordering is guaranteed on these elements.
-func discardLowerRange(data []float64, k int) []float64 {
-	out := make([]float64, len(data)-k)
-	i := 0
+// ReduceDecayedPercentile computes the weighted percentile of the values for each key with each point weighted
+// by time decay: the smallest value whose cumulative weight reaches the percentile of the total weight.
+func ReduceDecayedPercentile(percentile float64, halfLife time.Duration) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		points, err := sortedRawOutputs(values)
+		if err != nil {
+			return err
+		}
+		if len(points) == 0 || percentile <= 0 || percentile > 100 {
+			return nil
+		}
 
-	// discard values lower than the desired range
-	for k > 0 {
-		lows, pivotValue, highs := partition(data)
+		weights := decayWeights(points, halfLife)
+		weighted := make(weightedValues, 0, len(points))
+		var total float64
+		for i, p := range points {
+			if val, ok := toFloat64(p.Values); ok {
+				weighted = append(weighted, weightedValue{val, weights[i]})
+				total += weights[i]
+			}
+		}
+		if len(weighted) == 0 {
+			return nil
+		}
+		sort.Sort(weighted)
 
-		lowLength := len(lows)
-		if lowLength > k {
-			// keep all the highs and the pivot
-			out[i] = pivotValue
-			i++
-			copy(out[i:], highs)
-			i += len(highs)
-			// iterate over the lows again
-			data = lows
+		target := total * percentile / 100
+		var cumulative float64
+		for _, wv := range weighted {
+			cumulative += wv.weight
+			if cumulative >= target {
+				return wv.value
+			}
+		}
+		return weighted[len(weighted)-1].value
+	}
+}
+
+type weightedValue struct {
+	value  float64
+	weight float64
+}
+
+// weightedValues sorts weighted values by value.
+type weightedValues []weightedValue
+
+func (a weightedValues) Len() int           { return len(a) }
+func (a weightedValues) Less(i, j int) bool { return a[i].value < a[j].value }
+func (a weightedValues) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// orderedReduce is the reducer of functions that depend on the order of points. It merges the raw points
+// emitted by each mapper, sorts them by time once and passes them to fn. A result of fn with no points is nil.
+func orderedReduce(values []interface{}, fn func(sorted []*rawQueryMapOutput) interface{}) interface{} {
+	sorted, err := sortedRawOutputs(values)
+	if err != nil {
+		return err
+	}
+	v := fn(sorted)
+	if points, ok := v.([]*rawQueryMapOutput); ok && len(points) == 0 {
+		return nil
+	}
+	return v
+}
+
+// sortedRawOutputs merges the raw points emitted by each mapper and sorts them by time. It returns the error of
+// a mapper that failed instead.
+func sortedRawOutputs(values []interface{}) (rawOutputs, error) {
+	var points rawOutputs
+	for _, v := range values {
+		switch v := v.(type) {
+		case []*rawQueryMapOutput:
+			points = append(points, v...)
+		case error:
+			return nil, v
+		}
+	}
+	sort.Sort(points)
+	return points, nil
+}
+
+// modeOptions are the optional arguments of mode().
+type modeOptions struct {
+	count bool // return the number of occurrences along with the value
+	nulls bool // null values are a category that can be the mode rather than being excluded
+}
+
+// modeArgs returns the optional 'count' and 'nulls' flags of mode().
+func modeArgs(c *Call) (modeOptions, error) {
+	var opt modeOptions
+	if len(c.Args) < 1 || len(c.Args) > 3 {
+		return opt, fmt.Errorf("expected one to three arguments for mode()")
+	}
+	for _, arg := range c.Args[1:] {
+		lit, ok := arg.(*StringLiteral)
+		if ok && lit.Val == "count" && !opt.count {
+			opt.count = true
+		} else if ok && lit.Val == "nulls" && !opt.nulls {
+			opt.nulls = true
 		} else {
-			// discard all the lows
-			data = highs
-			k -= lowLength
-			if k == 0 {
-				// if discarded enough lows, keep the pivot
-				out[i] = pivotValue
-				i++
-			} else {
-				// able to discard the pivot too
-				k--
+			return opt, fmt.Errorf("expected 'count' or 'nulls' as arguments in mode()")
+		}
+	}
+	return opt, nil
+}
+
+type modeOutput struct {
+	Value float64
+	Count int
+	Null  bool `json:",omitempty"` // the most frequent value is null
+}
+
+// modeMapOutput is the output of MapModeWithNulls: the numeric values of the points and the number of points
+// with a null value.
+type modeMapOutput struct {
+	Values []float64
+	Nulls  int
+}
+
+// MapModeWithNulls collects the numeric values to pass to the reducer along with the number of null values.
+func MapModeWithNulls(itr Iterator) interface{} {
+	out := &modeMapOutput{}
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if v == nil {
+			out.Nulls++
+		} else if val, ok := toFloat64(v); ok {
+			out.Values = append(out.Values, val)
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if len(out.Values) == 0 && out.Nulls == 0 {
+		return nil
+	}
+	return out
+}
+
+// ReduceMode computes the most frequent value for each key. Ties go to the smallest value. If withCount
+// is set, the number of times the value occurred is returned along with it. Null values are only counted
+// when collected by MapModeWithNulls, and lose ties with other values; when null is the most frequent
+// value the result is nil, or has Null set if withCount is set.
+func ReduceMode(withCount bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		counts := make(map[float64]int)
+		var nulls int
+		for _, v := range values {
+			switch v := v.(type) {
+			case []float64:
+				for _, val := range v {
+					counts[val]++
+				}
+			case *modeMapOutput:
+				for _, val := range v.Values {
+					counts[val]++
+				}
+				nulls += v.Nulls
+			}
+		}
+
+		if len(counts) == 0 && nulls == 0 {
+			return nil
+		}
+
+		var out modeOutput
+		for val, n := range counts {
+			if n > out.Count || (n == out.Count && val < out.Value) {
+				out = modeOutput{Value: val, Count: n}
 			}
 		}
+		if nulls > out.Count {
+			out = modeOutput{Count: nulls, Null: true}
+		}
+
+		if withCount {
+			return &out
+		} else if out.Null {
+			return nil
+		}
+		return out.Value
+	}
+}
+
+// topFrequentArg returns the number of values passed as the second argument of top_frequent().
+func topFrequentArg(c *Call) (int, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and number of values for top_frequent()")
+	}
+	lit, ok := c.Args[1].(*NumberLiteral)
+	if !ok || lit.Val <= 0 || lit.Val != math.Trunc(lit.Val) {
+		return 0, fmt.Errorf("expected positive integer number of values in top_frequent()")
+	}
+	return int(lit.Val), nil
+}
+
+// frequencyMapOutput is the number of times each numeric value occurred, keyed by the value formatted so that it
+// parses back exactly. JSON objects can only have string keys.
+type frequencyMapOutput map[string]int
+
+// MapFrequencies counts the occurrences of each numeric value other than NaN to pass to the reducer. Sending
+// the counts rather than every value cuts the size of the output when values repeat.
+func MapFrequencies(itr Iterator) interface{} {
+	out := make(frequencyMapOutput)
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok && !math.IsNaN(val) {
+			out[strconv.FormatFloat(val, 'g', -1, 64)]++
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return nil
 	}
-	copy(out[i:], data)
 	return out
 }
 
-// discardUpperRange discards the upper k elements of the sorted data set without sorting all the data. Sorting all of
-// the data would take O(NlgN), where N is len(data), but partitioning to find the kth largest number is O(N) in the
-// average case. The remaining N-k unsorted elements are returned - no kind of ordering is guaranteed on these elements.
-func discardUpperRange(data []float64, k int) []float64 {
-	out := make([]float64, len(data)-k)
-	i := 0
+// frequentValue is a value along with the number of times it occurred.
+type frequentValue struct {
+	Value float64
+	Count int
+}
 
-	// discard values higher than the desired range
-	for k > 0 {
-		lows, pivotValue, highs := partition(data)
+// frequentValues sorts values by descending count, and values with the same count in ascending order.
+type frequentValues []frequentValue
 
-		highLength := len(highs)
-		if highLength > k {
-			// keep all the lows and the pivot
-			out[i] = pivotValue
+func (a frequentValues) Len() int      { return len(a) }
+func (a frequentValues) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a frequentValues) Less(i, j int) bool {
+	if a[i].Count != a[j].Count {
+		return a[i].Count > a[j].Count
+	}
+	return a[i].Value < a[j].Value
+}
+
+// ReduceTopFrequent merges the counts of MapFrequencies and returns the n most frequent values for each key along
+// with their counts, most frequent first. Ties go to the smallest value, as in mode().
+func ReduceTopFrequent(n int) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		counts := make(map[float64]int)
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+			for key, count := range v.(frequencyMapOutput) {
+				val, err := strconv.ParseFloat(key, 64)
+				if err != nil {
+					continue
+				}
+				counts[val] += count
+			}
+		}
+		if len(counts) == 0 {
+			return nil
+		}
+
+		out := make(frequentValues, 0, len(counts))
+		for val, count := range counts {
+			out = append(out, frequentValue{Value: val, Count: count})
+		}
+		sort.Sort(out)
+		if len(out) > n {
+			out = out[:n]
+		}
+		return []frequentValue(out)
+	}
+}
+
+// unmarshalFrequencies unmarshals the output of MapFrequencies.
+func unmarshalFrequencies(b []byte) (interface{}, error) {
+	var o frequencyMapOutput
+	if err := json.Unmarshal(b, &o); err != nil || o == nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// histogramBuckets describes how histogram() places values into buckets. Buckets either have a fixed
+// width and are aligned to multiples of it, or if Base is set, they are log scale and start at powers of Base.
+type histogramBuckets struct {
+	Width float64
+	Base  float64
+}
+
+// histogramArgs returns the buckets for histogram(field, width), histogram(field, 'log') or
+// histogram(field, 'log', base). Log scale buckets default to powers of 2.
+func histogramArgs(c *Call) (histogramBuckets, error) {
+	if len(c.Args) < 2 || len(c.Args) > 3 {
+		return histogramBuckets{}, fmt.Errorf("expected field and bucket width for histogram()")
+	}
+
+	if lit, ok := c.Args[1].(*NumberLiteral); ok && len(c.Args) == 2 {
+		if lit.Val <= 0 {
+			return histogramBuckets{}, fmt.Errorf("bucket width must be greater than 0 in histogram()")
+		}
+		return histogramBuckets{Width: lit.Val}, nil
+	}
+
+	if lit, ok := c.Args[1].(*StringLiteral); !ok || lit.Val != "log" {
+		return histogramBuckets{}, fmt.Errorf("expected bucket width or 'log' as second argument in histogram()")
+	}
+	if len(c.Args) == 2 {
+		return histogramBuckets{Base: 2}, nil
+	}
+
+	lit, ok := c.Args[2].(*NumberLiteral)
+	if !ok || lit.Val <= 1 {
+		return histogramBuckets{}, fmt.Errorf("log base must be a number greater than 1 in histogram()")
+	}
+	return histogramBuckets{Base: lit.Val}, nil
+}
+
+// lowerBound returns the lower bound of the bucket v falls into. Values <= 0 have no logarithm,
+// so on a log scale they all fall into a single bucket with a lower bound of 0.
+func (h histogramBuckets) lowerBound(v float64) float64 {
+	if h.Base == 0 {
+		// floor(v/width) can be off by one due to rounding, putting a value on the boundary of a bucket into
+		// the bucket below, e.g. -8.71/0.01 < -871
+		i := math.Floor(v / h.Width)
+		if (i+1)*h.Width <= v {
 			i++
-			copy(out[i:], lows)
-			i += len(lows)
-			// iterate over the highs again
-			data = highs
-		} else {
-			// discard all the highs
-			data = lows
-			k -= highLength
-			if k == 0 {
-				// if discarded enough highs, keep the pivot
-				out[i] = pivotValue
-				i++
-			} else {
-				// able to discard the pivot too
-				k--
+		} else if i*h.Width > v {
+			i--
+		}
+		return i * h.Width
+	}
+	if v <= 0 {
+		return 0
+	}
+
+	// floor(log_base(v)) can be off by one due to rounding, e.g. log(1000)/log(10) < 3
+	i := math.Floor(math.Log(v) / math.Log(h.Base))
+	if math.Pow(h.Base, i+1) <= v {
+		i++
+	} else if math.Pow(h.Base, i) > v {
+		i--
+	}
+	return math.Pow(h.Base, i)
+}
+
+type histogramBucket struct {
+	LowerBound float64
+	Count      int
+}
+
+// MapHistogram tallies the number of values in each bucket. NaN values fall in no bucket and are skipped.
+func MapHistogram(h histogramBuckets) MapFunc {
+	return func(itr Iterator) interface{} {
+		counts := make(map[float64]int)
+		for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+			if val, ok := toFloat64(v); ok && !math.IsNaN(val) {
+				counts[h.lowerBound(val)]++
+			}
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+
+		if len(counts) == 0 {
+			return nil
+		}
+		return histogramBucketsOf(counts)
+	}
+}
+
+// ReduceHistogram merges the bucket counts from each mapper. Buckets are aligned the same way
+// on every mapper, so buckets with the same lower bound are simply added together.
+func ReduceHistogram(values []interface{}) interface{} {
+	counts := make(map[float64]int)
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		for _, b := range v.([]histogramBucket) {
+			counts[b.LowerBound] += b.Count
+		}
+	}
+
+	if len(counts) == 0 {
+		return nil
+	}
+	return histogramBucketsOf(counts)
+}
+
+// histogramBucketsOf returns the counts as buckets sorted by lower bound.
+func histogramBucketsOf(counts map[float64]int) []histogramBucket {
+	buckets := make([]histogramBucket, 0, len(counts))
+	for lower, n := range counts {
+		buckets = append(buckets, histogramBucket{LowerBound: lower, Count: n})
+	}
+	sort.Sort(histogramBucketsByLowerBound(buckets))
+	return buckets
+}
+
+type histogramBucketsByLowerBound []histogramBucket
+
+func (a histogramBucketsByLowerBound) Len() int           { return len(a) }
+func (a histogramBucketsByLowerBound) Less(i, j int) bool { return a[i].LowerBound < a[j].LowerBound }
+func (a histogramBucketsByLowerBound) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// MapRawQuery is for queries without aggregates
+func MapRawQuery(itr Iterator) interface{} {
+	var values []*rawQueryMapOutput
+	for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+		val := &rawQueryMapOutput{k, v}
+		values = append(values, val)
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	return values
+}
+
+// MapRawQueryFirst is for raw queries with LIMIT 1. It stops reading after the first point.
+func MapRawQueryFirst(itr Iterator) interface{} {
+	_, k, v, ok := itr.Next()
+	if !ok {
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+		return []*rawQueryMapOutput(nil)
+	}
+	return []*rawQueryMapOutput{{k, v}}
+}
+
+// MapRawQueryLast is for raw queries ordered by time descending with LIMIT 1.
+// It reads every point but only keeps the latest one.
+func MapRawQueryLast(itr Iterator) interface{} {
+	var out *rawQueryMapOutput
+	for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+		if out == nil || k >= out.Timestamp {
+			out = &rawQueryMapOutput{k, v}
+		}
+	}
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if out == nil {
+		return []*rawQueryMapOutput(nil)
+	}
+	return []*rawQueryMapOutput{out}
+}
+
+// InitializeRawMapFunc returns the MapFunc for a raw data query. Single point
+// queries don't need every point materialized, so they use MapRawQueryFirst or
+// MapRawQueryLast instead of MapRawQuery.
+func InitializeRawMapFunc(stmt *SelectStatement) MapFunc {
+	switch {
+	case stmt.IsLatestPointQuery():
+		return MapRawQueryLast
+	case stmt.IsSinglePointQuery():
+		return MapRawQueryFirst
+	default:
+		return MapRawQuery
+	}
+}
+
+type rawQueryMapOutput struct {
+	Timestamp int64
+	Values    interface{}
+}
+
+type rawOutputs []*rawQueryMapOutput
+
+// rawOutputsDesc sorts raw points by time descending.
+type rawOutputsDesc []*rawQueryMapOutput
+
+func (a rawOutputsDesc) Len() int           { return len(a) }
+func (a rawOutputsDesc) Less(i, j int) bool { return a[i].Timestamp > a[j].Timestamp }
+func (a rawOutputsDesc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// sortRawOutputs sorts points by time, or by time descending if desc is set. Points with the same time keep
+// their order.
+func sortRawOutputs(points []*rawQueryMapOutput, desc bool) {
+	if desc {
+		sort.Stable(rawOutputsDesc(points))
+	} else {
+		sort.Stable(rawOutputs(points))
+	}
+}
+
+// ReduceRawQuery merges the points emitted by each mapper of a raw query and sorts them by time, or by time
+// descending if desc is set. Points with the same time keep the order of the mappers.
+func ReduceRawQuery(desc bool) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var points []*rawQueryMapOutput
+		for _, v := range values {
+			switch v := v.(type) {
+			case []*rawQueryMapOutput:
+				points = append(points, v...)
+			case error:
+				return v
 			}
 		}
+		sortRawOutputs(points, desc)
+		return points
 	}
-	copy(out[i:], data)
-	return out
 }
 
-// partition takes a list of data, chooses a random pivot index and returns a list of elements lower than the
-// pivotValue, the pivotValue, and a list of elements higher than the pivotValue.  partition mutates data.
-func partition(data []float64) (lows []float64, pivotValue float64, highs []float64) {
-	length := len(data)
-	// there are better (more complex) ways to calculate pivotIndex (e.g. median of 3, median of 3 medians) if this
-	// proves to be inadequate.
-	pivotIndex := rand.Int() % length
-	pivotValue = data[pivotIndex]
-	low, high := 1, length-1
-
-	// put the pivot in the first position
-	data[pivotIndex], data[0] = data[0], data[pivotIndex]
-
-	// partition the data around the pivot
-	for low <= high {
-		for low <= high && data[low] <= pivotValue {
-			low++
+// LimitRawQuery returns a ReduceFunc returning at most limit of the time sorted points returned by fn, after
+// skipping the first offset of them, so that only the requested window of points is passed on. An offset beyond
+// the points or a limit of 0 returns no points.
+func LimitRawQuery(fn ReduceFunc, offset, limit int) (ReduceFunc, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d: must be >= 0", offset)
+	} else if limit < 0 {
+		return nil, fmt.Errorf("invalid limit %d: must be >= 0", limit)
+	}
+	return func(values []interface{}) interface{} {
+		v := fn(values)
+		if err, ok := v.(error); ok {
+			return err
 		}
-		for high >= low && data[high] >= pivotValue {
-			high--
+		points, _ := v.([]*rawQueryMapOutput)
+		if offset >= len(points) {
+			return []*rawQueryMapOutput{}
 		}
-		if low < high {
-			data[low], data[high] = data[high], data[low]
+		points = points[offset:]
+		if len(points) > limit {
+			points = points[:limit]
 		}
-	}
-
-	return data[1:low], pivotValue, data[high+1:]
+		return points
+	}, nil
 }
 
-// MapMin collects the values to pass to the reducer
-func MapMin(itr Iterator) interface{} {
-	var min float64
-	pointsYielded := false
-
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		val := v.(float64)
-		// Initialize min
-		if !pointsYielded {
-			min = val
-			pointsYielded = true
-		}
-		min = math.Min(min, val)
+// InitializeRawReduceFunc returns the ReduceFunc for a raw data query. Points
+// are sorted by time unless the statement orders them by time descending, and
+// only those within the statement's offset and limit are returned.
+func InitializeRawReduceFunc(stmt *SelectStatement) (ReduceFunc, error) {
+	fn := ReduceRawQuery(stmt.IsTimeDescending())
+	if stmt.Limit == 0 && stmt.Offset == 0 {
+		return fn, nil
 	}
-	if pointsYielded {
-		return min
+	// a statement without a limit returns every point after the offset
+	limit := stmt.Limit
+	if limit == 0 {
+		limit = math.MaxInt32
 	}
-	return nil
+	return LimitRawQuery(fn, stmt.Offset, limit)
 }
 
-// ReduceMin computes the min of value.
-func ReduceMin(values []interface{}) interface{} {
-	var min float64
-	pointsYielded := false
+// Point is a time ordered value computed by a function such as derivative() along with the tags of the series,
+// or group of series, it was computed from, so grouped results can be mapped back to their series. It encodes
+// like rawQueryMapOutput with the tags added.
+type Point struct {
+	Timestamp int64
+	Values    interface{}
+	Tags      map[string]string `json:",omitempty"`
+}
 
-	for _, v := range values {
-		if v == nil {
-			continue
-		}
-		val := v.(float64)
-		// Initialize min
-		if !pointsYielded {
-			min = val
-			pointsYielded = true
-		}
-		m := math.Min(min, val)
-		min = m
-	}
-	if pointsYielded {
-		return min
-	}
-	return nil
+// seriesTransforms are the functions that reduce the points of a series to a time ordered series of points
+// computed from them, such as its derivative. Their points keep the tags of the series, see KeepsTags.
+var seriesTransforms = map[string]bool{
+	"derivative": true, "difference": true, "cumulative_sum": true, "elapsed": true, "moving_average": true,
+	"moving_stddev": true, "moving_min": true, "moving_max": true, "holt_winters": true, "lttb": true,
 }
 
-// MapMax collects the values to pass to the reducer
-func MapMax(itr Iterator) interface{} {
-	var max float64
-	pointsYielded := false
+// KeepsTags returns true if c reduces to points computed from the points of a series, which should carry the
+// tags of that series so that the results of a grouped query map back to it.
+func KeepsTags(c *Call) bool {
+	return c != nil && seriesTransforms[c.Name]
+}
 
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		val := v.(float64)
-		// Initialize max
-		if !pointsYielded {
-			max = val
-			pointsYielded = true
-		}
-		max = math.Max(max, val)
+// TaggedPoints converts the time ordered output of a reducer, such as ReduceDerivative, into points carrying
+// the given tags. Any other output is returned unchanged.
+func TaggedPoints(v interface{}, tags map[string]string) interface{} {
+	outputs, ok := v.([]*rawQueryMapOutput)
+	if !ok {
+		return v
 	}
-	if pointsYielded {
-		return max
+	points := make([]*Point, len(outputs))
+	for i, o := range outputs {
+		points[i] = &Point{Timestamp: o.Timestamp, Values: o.Values, Tags: tags}
 	}
-	return nil
+	return points
 }
 
-// ReduceMax computes the max of value.
-func ReduceMax(values []interface{}) interface{} {
-	var max float64
-	pointsYielded := false
+func (a rawOutputs) Len() int           { return len(a) }
+func (a rawOutputs) Less(i, j int) bool { return a[i].Timestamp < a[j].Timestamp }
+func (a rawOutputs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
-	for _, v := range values {
-		if v == nil {
-			continue
-		}
-		val := v.(float64)
-		// Initialize max
-		if !pointsYielded {
-			max = val
-			pointsYielded = true
-		}
-		max = math.Max(max, val)
+// sampleArg returns the sample size passed as the second argument of sample().
+func sampleArg(c *Call) (int, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and sample size for sample()")
 	}
-	if pointsYielded {
-		return max
+	lit, ok := c.Args[1].(*NumberLiteral)
+	if !ok || lit.Val <= 0 || lit.Val != math.Trunc(lit.Val) {
+		return 0, fmt.Errorf("expected positive integer sample size in sample()")
 	}
-	return nil
+	return int(lit.Val), nil
 }
 
-type spreadMapOutput struct {
-	Min, Max float64
+// sampleMapOutput is a uniform random sample of the points of a mapper along with the number of points it was
+// drawn from.
+type sampleMapOutput struct {
+	Count  int
+	Points []*rawQueryMapOutput
 }
 
-// MapSpread collects the values to pass to the reducer
-func MapSpread(itr Iterator) interface{} {
-	var out spreadMapOutput
-	pointsYielded := false
-
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		val := v.(float64)
-		// Initialize
-		if !pointsYielded {
-			out.Max = val
-			out.Min = val
-			pointsYielded = true
+// MapSample draws a uniform random sample of at most n points from an iterator with reservoir sampling. The
+// intn function returns a random int in [0, n), such as rand.Intn.
+func MapSample(n int, intn func(int) int) MapFunc {
+	return func(itr Iterator) interface{} {
+		out := &sampleMapOutput{}
+		for _, k, v, ok := itr.Next(); ok; _, k, v, ok = itr.Next() {
+			p := &rawQueryMapOutput{k, v}
+			if out.Count < n {
+				out.Points = append(out.Points, p)
+			} else if i := intn(out.Count + 1); i < n {
+				out.Points[i] = p
+			}
+			out.Count++
+		}
+		if err := iteratorErr(itr); err != nil {
+			return err
+		}
+		if out.Count == 0 {
+			return nil
 		}
-		out.Max = math.Max(out.Max, val)
-		out.Min = math.Min(out.Min, val)
-	}
-	if pointsYielded {
 		return out
 	}
-	return nil
 }
 
-// ReduceSpread computes the spread of values.
-func ReduceSpread(values []interface{}) interface{} {
-	var result spreadMapOutput
-	pointsYielded := false
+// ReduceSample combines the samples of each mapper into a uniform random sample of at most n points, sorted
+// by time. Each point is drawn from a mapper with a probability proportional to the number of its points not
+// drawn yet, so the sample is uniform over the points of all mappers however they are split.
+func ReduceSample(n int, intn func(int) int) ReduceFunc {
+	return func(values []interface{}) interface{} {
+		var samples []*sampleMapOutput
+		var remaining int
+		for _, v := range values {
+			if v, ok := v.(*sampleMapOutput); ok && len(v.Points) > 0 {
+				// copy the sample since drawing from it removes points
+				samples = append(samples, &sampleMapOutput{v.Count, append([]*rawQueryMapOutput(nil), v.Points...)})
+				remaining += v.Count
+			}
+		}
 
-	for _, v := range values {
-		if v == nil {
-			continue
+		var results rawOutputs
+		for len(results) < n && remaining > 0 {
+			i := intn(remaining)
+			for _, s := range samples {
+				if i >= s.Count {
+					i -= s.Count
+					continue
+				}
+				j := intn(len(s.Points))
+				results = append(results, s.Points[j])
+				s.Points[j] = s.Points[len(s.Points)-1]
+				s.Points = s.Points[:len(s.Points)-1]
+				s.Count--
+				remaining--
+				break
+			}
 		}
-		val := v.(spreadMapOutput)
-		// Initialize
-		if !pointsYielded {
-			result.Max = val.Max
-			result.Min = val.Min
-			pointsYielded = true
+
+		if len(results) == 0 {
+			return nil
 		}
-		result.Max = math.Max(result.Max, val.Max)
-		result.Min = math.Min(result.Min, val.Min)
+		sort.Sort(results)
+		return []*rawQueryMapOutput(results)
 	}
-	if pointsYielded {
-		return result.Max - result.Min
+}
+
+// percentileApproxArg returns the percentile passed as the second argument of percentile_approx().
+func percentileApproxArg(c *Call) (float64, error) {
+	if len(c.Args) != 2 {
+		return 0, fmt.Errorf("expected field and percentile for percentile_approx()")
 	}
-	return nil
+	lit, ok := c.Args[1].(*NumberLiteral)
+	if !ok || lit.Val < 0 || lit.Val > 100 {
+		return 0, fmt.Errorf("expected percentile between 0 and 100 in percentile_approx()")
+	}
+	return lit.Val, nil
 }
 
-// MapStddev collects the values to pass to the reducer
-func MapStddev(itr Iterator) interface{} {
-	var values []float64
+// DefaultTDigestCompression is the compression of the digests used by percentile_approx(). A digest keeps at
+// most about compression centroids, and the error of a percentile shrinks with higher compression, most of all
+// near the extremes.
+const DefaultTDigestCompression = 100
 
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		values = append(values, v.(float64))
-	}
+// TDigest is a sketch that estimates percentiles of the values added to it in a fixed amount of memory. Values are
+// clustered into centroids, which are small near the extremes and larger near the median, so extreme percentiles
+// are estimated most accurately. Digests can be merged, so each mapper builds a digest of its own points.
+type TDigest struct {
+	compression float64
+	centroids   []centroid // merged centroids sorted by mean
+	buffer      []centroid // centroids added since the last merge
+	min, max    float64
+	count       float64
+}
 
-	return values
+// centroid is the mean of a cluster of values and the number of values in it.
+type centroid struct {
+	Mean, Weight float64
 }
 
-// ReduceStddev computes the stddev of values.
-func ReduceStddev(values []interface{}) interface{} {
-	var data []float64
-	// Collect all the data points
-	for _, value := range values {
-		if value == nil {
-			continue
-		}
-		data = append(data, value.([]float64)...)
+// centroidsByMean sorts centroids by mean.
+type centroidsByMean []centroid
+
+func (a centroidsByMean) Len() int           { return len(a) }
+func (a centroidsByMean) Less(i, j int) bool { return a[i].Mean < a[j].Mean }
+func (a centroidsByMean) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// NewTDigest returns an empty digest with the given compression.
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{compression: compression}
+}
+
+// Add adds a value to the digest. NaN values are ignored.
+func (d *TDigest) Add(v float64) {
+	if math.IsNaN(v) {
+		return
 	}
+	d.add(centroid{v, 1}, v, v)
+}
 
-	// If no data or we only have one point, it's nil or undefined
-	if len(data) < 2 {
-		return nil
+// Merge adds the values of another digest to this one.
+func (d *TDigest) Merge(other *TDigest) {
+	other.compress()
+	for _, c := range other.centroids {
+		d.add(c, other.min, other.max)
 	}
+}
 
-	// Get the mean
-	var mean float64
-	var count int
-	for _, v := range data {
-		count++
-		mean += (v - mean) / float64(count)
+func (d *TDigest) add(c centroid, min, max float64) {
+	if d.count == 0 || min < d.min {
+		d.min = min
 	}
-	// Get the variance
-	var variance float64
-	for _, v := range data {
-		dif := v - mean
-		sq := math.Pow(dif, 2)
-		variance += sq
+	if d.count == 0 || max > d.max {
+		d.max = max
+	}
+	d.count += c.Weight
+	d.buffer = append(d.buffer, c)
+	if float64(len(d.buffer)) >= 5*d.compression {
+		d.compress()
 	}
-	variance = variance / float64(count-1)
-	stddev := math.Sqrt(variance)
-
-	return stddev
 }
 
-type firstLastMapOutput struct {
-	Time int64
-	Val  interface{}
+// Count returns the number of values added to the digest.
+func (d *TDigest) Count() float64 {
+	return d.count
 }
 
-// MapFirst collects the values to pass to the reducer
-func MapFirst(itr Iterator) interface{} {
-	out := firstLastMapOutput{}
-	pointsYielded := false
+// compress merges the buffered centroids into the sorted centroids, combining neighboring centroids as long as
+// they stay smaller than the scale function allows for their position.
+func (d *TDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	d.buffer = d.buffer[:0]
+	sort.Sort(centroidsByMean(all))
 
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		// Initialize first
-		if !pointsYielded {
-			out.Time = k
-			out.Val = v
-			pointsYielded = true
+	// k(q) = compression/(2π)·asin(2q-1) grows fastest near q = 0 and 1, and a centroid may span at most 1 of k
+	k := func(q float64) float64 { return d.compression / (2 * math.Pi) * math.Asin(2*q-1) }
+	limit := func(q float64) float64 {
+		k := k(q) + 1
+		if k >= d.compression/4 {
+			return d.count
 		}
-		if k < out.Time {
-			out.Time = k
-			out.Val = v
-		}
-	}
-	if pointsYielded {
-		return out
+		return d.count * (math.Sin(k*2*math.Pi/d.compression) + 1) / 2
 	}
-	return nil
-}
 
-// ReduceFirst computes the first of value.
-func ReduceFirst(values []interface{}) interface{} {
-	out := firstLastMapOutput{}
-	pointsYielded := false
-
-	for _, v := range values {
-		if v == nil {
+	// merge in place, since no more centroids are written than have been read
+	n := 0
+	cur := all[0]
+	var soFar float64
+	max := limit(0)
+	for _, c := range all[1:] {
+		if soFar+cur.Weight+c.Weight <= max {
+			cur.Weight += c.Weight
+			cur.Mean += (c.Mean - cur.Mean) * c.Weight / cur.Weight
 			continue
 		}
-		val := v.(firstLastMapOutput)
-		// Initialize first
-		if !pointsYielded {
-			out.Time = val.Time
-			out.Val = val.Val
-			pointsYielded = true
-		}
-		if val.Time < out.Time {
-			out.Time = val.Time
-			out.Val = val.Val
-		}
-	}
-	if pointsYielded {
-		return out.Val
+		all[n] = cur
+		n++
+		soFar += cur.Weight
+		max = limit(soFar / d.count)
+		cur = c
 	}
-	return nil
+	all[n] = cur
+	d.centroids = all[:n+1]
 }
 
-// MapLast collects the values to pass to the reducer
-func MapLast(itr Iterator) interface{} {
-	out := firstLastMapOutput{}
-	pointsYielded := false
+// Quantile returns the estimated value at quantile q, between 0 and 1, by interpolating between the means of the
+// centroids around it. It returns NaN if no values have been added.
+func (d *TDigest) Quantile(q float64) float64 {
+	d.compress()
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
 
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		// Initialize last
-		if !pointsYielded {
-			out.Time = k
-			out.Val = v
-			pointsYielded = true
+	target := q * d.count
+	cs := d.centroids
+	// the first and last values are the min and max, so interpolate from them to the outermost centroids
+	if target <= cs[0].Weight/2 {
+		if cs[0].Weight == 1 {
+			return cs[0].Mean
 		}
-		if k > out.Time {
-			out.Time = k
-			out.Val = v
+		return d.min + (cs[0].Mean-d.min)*target/(cs[0].Weight/2)
+	}
+
+	center := cs[0].Weight / 2
+	for i := 1; i < len(cs); i++ {
+		next := center + (cs[i-1].Weight+cs[i].Weight)/2
+		if target <= next {
+			return cs[i-1].Mean + (cs[i].Mean-cs[i-1].Mean)*(target-center)/(next-center)
 		}
+		center = next
 	}
-	if pointsYielded {
-		return out
+
+	last := cs[len(cs)-1]
+	if last.Weight == 1 || d.count == center {
+		return last.Mean
 	}
-	return nil
+	return last.Mean + (d.max-last.Mean)*(target-center)/(d.count-center)
 }
 
-// ReduceLast computes the last of value.
-func ReduceLast(values []interface{}) interface{} {
-	out := firstLastMapOutput{}
-	pointsYielded := false
+// tdigestJSON is the encoding of a digest sent between nodes.
+type tdigestJSON struct {
+	Compression float64
+	Min, Max    float64
+	Centroids   []centroid
+}
 
-	for _, v := range values {
-		if v == nil {
-			continue
-		}
+// MarshalJSON encodes the digest for sending between nodes.
+func (d *TDigest) MarshalJSON() ([]byte, error) {
+	d.compress()
+	return json.Marshal(tdigestJSON{d.compression, d.min, d.max, d.centroids})
+}
 
-		val := v.(firstLastMapOutput)
-		// Initialize last
-		if !pointsYielded {
-			out.Time = val.Time
-			out.Val = val.Val
-			pointsYielded = true
-		}
-		if val.Time > out.Time {
-			out.Time = val.Time
-			out.Val = val.Val
-		}
+// UnmarshalJSON decodes a digest encoded by MarshalJSON.
+func (d *TDigest) UnmarshalJSON(data []byte) error {
+	var o tdigestJSON
+	if err := json.Unmarshal(data, &o); err != nil {
+		return err
 	}
-	if pointsYielded {
-		return out.Val
+	if o.Compression <= 0 {
+		return fmt.Errorf("invalid t-digest")
+	}
+	*d = TDigest{compression: o.Compression, centroids: o.Centroids, min: o.Min, max: o.Max}
+	for _, c := range o.Centroids {
+		d.count += c.Weight
 	}
 	return nil
 }
 
-// MapEcho emits the data points for each group by interval
-func MapEcho(itr Iterator) interface{} {
-	var values []interface{}
-
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		values = append(values, v)
+// MapTDigest adds the numeric values in an iterator to a digest.
+func MapTDigest(itr Iterator) interface{} {
+	d := NewTDigest(DefaultTDigestCompression)
+	for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+		if val, ok := toFloat64(v); ok {
+			d.Add(val)
+		}
 	}
-	return values
+	if err := iteratorErr(itr); err != nil {
+		return err
+	}
+	if d.Count() == 0 {
+		return nil
+	}
+	return d
 }
 
-// ReducePercentile computes the percentile of values for each key.
-func ReducePercentile(percentile float64) ReduceFunc {
+// ReducePercentileApprox merges the digests from each mapper and estimates the given percentile of their values.
+func ReducePercentileApprox(percentile float64) ReduceFunc {
 	return func(values []interface{}) interface{} {
-		var allValues []float64
-
+		d := NewTDigest(DefaultTDigestCompression)
 		for _, v := range values {
-			if v == nil {
-				continue
-			}
-
-			vals := v.([]interface{})
-			for _, v := range vals {
-				allValues = append(allValues, v.(float64))
+			if v, ok := v.(*TDigest); ok {
+				d.Merge(v)
 			}
 		}
-
-		sort.Float64s(allValues)
-		length := len(allValues)
-		index := int(math.Floor(float64(length)*percentile/100.0+0.5)) - 1
-
-		if index < 0 || index >= len(allValues) {
+		if d.Count() == 0 {
 			return nil
 		}
-
-		return allValues[index]
-	}
-}
-
-// MapRawQuery is for queries without aggregates
-func MapRawQuery(itr Iterator) interface{} {
-	var values []*rawQueryMapOutput
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		val := &rawQueryMapOutput{k, v}
-		values = append(values, val)
+		return d.Quantile(percentile / 100)
 	}
-	return values
-}
-
-type rawQueryMapOutput struct {
-	Timestamp int64
-	Values    interface{}
 }
-
-type rawOutputs []*rawQueryMapOutput
-
-func (a rawOutputs) Len() int           { return len(a) }
-func (a rawOutputs) Less(i, j int) bool { return a[i].Timestamp < a[j].Timestamp }
-func (a rawOutputs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -1,7 +1,18 @@
 package influxql
 
-import "testing"
-import "sort"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
 
 type point struct {
 	seriesID  uint64
@@ -13,13 +24,13 @@ type testIterator struct {
 	values []point
 }
 
-func (t *testIterator) Next() (seriesID uint64, timestamp int64, value interface{}) {
+func (t *testIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
 	if len(t.values) > 0 {
 		v := t.values[0]
 		t.values = t.values[1:]
-		return v.seriesID, v.timestamp, v.value
+		return v.seriesID, v.timestamp, v.value, true
 	}
-	return 0, 0, nil
+	return 0, 0, nil, false
 }
 
 func TestMapMeanNoValues(t *testing.T) {
@@ -33,20 +44,20 @@ func TestMapMean(t *testing.T) {
 
 	tests := []struct {
 		input  []point
-		output *meanMapOutput
+		output *MeanMapOutput
 	}{
 		{ // Single point
 			input: []point{
 				point{0, 1, 1.0},
 			},
-			output: &meanMapOutput{1, 1},
+			output: &MeanMapOutput{1, 1, PartialVersion},
 		},
 		{ // Two points
 			input: []point{
 				point{0, 1, 2.0},
 				point{0, 2, 8.0},
 			},
-			output: &meanMapOutput{2, 5.0},
+			output: &MeanMapOutput{2, 5.0, PartialVersion},
 		},
 	}
 
@@ -60,7 +71,7 @@ func TestMapMean(t *testing.T) {
 			t.Fatalf("MapMean(%v): output mismatch: exp %v got %v", test.input, test.output, got)
 		}
 
-		if got.(*meanMapOutput).Count != test.output.Count || got.(*meanMapOutput).Mean != test.output.Mean {
+		if got.(*MeanMapOutput).Count != test.output.Count || got.(*MeanMapOutput).Mean != test.output.Mean {
 			t.Errorf("output mismatch: exp %v got %v", test.output, got)
 		}
 
@@ -184,6 +195,109 @@ func TestGetSortedRange(t *testing.T) {
 
 var benchGetSortedRangeResults []float64
 
+// Ensure getSortedRange matches sorting all the data, including data with many equal values.
+func TestGetSortedRange_Reference(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	generators := map[string]func(n int) float64{
+		"random":    func(n int) float64 { return rnd.Float64() },
+		"all equal": func(n int) float64 { return 7 },
+		"mostly equal": func(n int) float64 {
+			if rnd.Intn(10) == 0 {
+				return rnd.Float64() * 14
+			}
+			return 7
+		},
+		"few distinct": func(n int) float64 { return float64(rnd.Intn(3)) },
+	}
+
+	for name, gen := range generators {
+		for iter := 0; iter < 200; iter++ {
+			n := 1 + rnd.Intn(200)
+			data := make([]float64, n)
+			for i := range data {
+				data[i] = gen(n)
+			}
+			sorted := append([]float64(nil), data...)
+			sort.Float64s(sorted)
+
+			start := rnd.Intn(n)
+			count := rnd.Intn(n-start) + 1
+			got := getSortedRange(append([]float64(nil), data...), start, count)
+			if !reflect.DeepEqual(got, sorted[start:start+count]) {
+				t.Fatalf("%s: getSortedRange(%v, %d, %d) = %v, exp %v", name, data, start, count, got, sorted[start:start+count])
+			}
+			got = getSortedRangeWith(append([]float64(nil), data...), start, count, medianOfMediansPivot)
+			if !reflect.DeepEqual(got, sorted[start:start+count]) {
+				t.Fatalf("%s: getSortedRangeWith(%v, %d, %d, medianOfMediansPivot) = %v, exp %v", name, data, start, count, got, sorted[start:start+count])
+			}
+
+			// the median and nearest rank percentiles match indexing into the sorted values
+			var median float64
+			if n%2 == 0 {
+				median = sorted[n/2-1] + (sorted[n/2]-sorted[n/2-1])/2
+			} else {
+				median = sorted[n/2]
+			}
+			if got := ReduceMedian([]interface{}{append([]float64(nil), data...)}); got != median {
+				t.Fatalf("%s: median of %v = %v, exp %v", name, data, got, median)
+			}
+
+			echo := make([]interface{}, n)
+			for i, v := range data {
+				echo[i] = v
+			}
+			for p := 1.0; p <= 100; p += 7 {
+				i := int(math.Floor(float64(n)*p/100+0.5)) - 1
+				if i < 0 {
+					continue
+				}
+				if got := ReducePercentile(p)([]interface{}{echo}); got != sorted[i] {
+					t.Fatalf("%s: percentile %v of %v = %v, exp %v", name, p, data, got, sorted[i])
+				}
+			}
+		}
+	}
+
+	// many equal values used to take quadratic time to partition
+	data := make([]float64, 200000)
+	for i := range data {
+		data[i] = 3
+	}
+	data[0], data[1] = 1, 5
+	if got := ReduceMedian([]interface{}{data}); got != 3.0 {
+		t.Fatalf("wrong median of mostly equal values. exp 3 got %v", got)
+	}
+}
+
+// Ensure a seeded pivot selects the same pivots on every run, even from adversarial already sorted data.
+func TestGetSortedRange_SeededPivot(t *testing.T) {
+	median := func(seed int64) (float64, []float64) {
+		data := make([]float64, 10001)
+		for i := range data {
+			data[i] = float64(i)
+		}
+		var pivots []float64
+		pivot := randomPivot(rand.New(rand.NewSource(seed)))
+		record := func(data []float64) int {
+			i := pivot(data)
+			pivots = append(pivots, data[i])
+			return i
+		}
+		return getSortedRangeWith(data, len(data)/2, 1, record)[0], pivots
+	}
+
+	got, pivots := median(770)
+	if got != 5000 {
+		t.Fatalf("wrong median of sorted values. exp 5000 got %v", got)
+	}
+	if len(pivots) == 0 {
+		t.Fatal("expected pivots to be chosen by the seeded source")
+	}
+	if _, again := median(770); !reflect.DeepEqual(pivots, again) {
+		t.Fatalf("pivots differ with the same seed: %v, then %v", pivots, again)
+	}
+}
+
 func BenchmarkGetSortedRangeByPivot(b *testing.B) {
 	data := make([]float64, len(getSortedRangeData))
 	var results []float64
@@ -194,6 +308,54 @@ func BenchmarkGetSortedRangeByPivot(b *testing.B) {
 	benchGetSortedRangeResults = results
 }
 
+func benchmarkMedianByPivot(b *testing.B, order string, pivot pivotFunc) {
+	src := make([]float64, 1000000)
+	rng := rand.New(rand.NewSource(771))
+	for i := range src {
+		switch order {
+		case "sorted":
+			src[i] = float64(i)
+		case "reverse":
+			src[i] = float64(len(src) - i)
+		default:
+			src[i] = rng.Float64()
+		}
+	}
+
+	data := make([]float64, len(src))
+	var results []float64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(data, src)
+		results = getSortedRangeWith(data, len(data)/2, 1, pivot)
+	}
+	benchGetSortedRangeResults = results
+}
+
+func BenchmarkMedianRandomPivotSorted(b *testing.B) {
+	benchmarkMedianByPivot(b, "sorted", defaultPivot)
+}
+
+func BenchmarkMedianRandomPivotReverse(b *testing.B) {
+	benchmarkMedianByPivot(b, "reverse", defaultPivot)
+}
+
+func BenchmarkMedianRandomPivotRandom(b *testing.B) {
+	benchmarkMedianByPivot(b, "random", defaultPivot)
+}
+
+func BenchmarkMedianOfMediansPivotSorted(b *testing.B) {
+	benchmarkMedianByPivot(b, "sorted", medianOfMediansPivot)
+}
+
+func BenchmarkMedianOfMediansPivotReverse(b *testing.B) {
+	benchmarkMedianByPivot(b, "reverse", medianOfMediansPivot)
+}
+
+func BenchmarkMedianOfMediansPivotRandom(b *testing.B) {
+	benchmarkMedianByPivot(b, "random", medianOfMediansPivot)
+}
+
 func BenchmarkGetSortedRangeBySort(b *testing.B) {
 	data := make([]float64, len(getSortedRangeData))
 	var results []float64
@@ -204,3 +366,6116 @@ func BenchmarkGetSortedRangeBySort(b *testing.B) {
 	}
 	benchGetSortedRangeResults = results
 }
+
+func TestMapSumStrict(t *testing.T) {
+	big := int64(MaxExactFloat64 + 1)
+
+	// lenient mode silently rounds the value
+	c := &Call{Name: "sum", Args: []Expr{&VarRef{Val: "field1"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mapFunc(&testIterator{values: []point{{0, 1, 1.0}, {0, 2, 2.0}}}); got != 3.0 {
+		t.Errorf("output mismatch: exp 3 got %v", got)
+	}
+
+	// strict mode rejects it
+	c.Args = append(c.Args, &StringLiteral{Val: "strict"})
+	mapFunc, err = InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mapFunc(&testIterator{values: []point{{0, 1, int64(1)}, {0, 2, big}}}).(error); !ok {
+		t.Errorf("expected error for int64 value %d", big)
+	}
+	if got := mapFunc(&testIterator{values: []point{{0, 1, int64(1)}, {0, 2, int64(2)}}}); got != 3.0 {
+		t.Errorf("output mismatch: exp 3 got %v", got)
+	}
+
+	// the reducer rejects a total beyond 2^53
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reduceFunc([]interface{}{float64(MaxExactFloat64), 2.0}).(error); !ok {
+		t.Errorf("expected error for sum exceeding 2^53")
+	}
+
+	// mean shares the flag
+	if _, ok := MapMeanStrict(&testIterator{values: []point{{0, 1, big}}}).(error); !ok {
+		t.Errorf("expected error for int64 value %d", big)
+	}
+
+	// like lenient mode, strict mode skips values that aren't numeric
+	mixed := []point{{0, 1, nil}, {0, 2, "a"}, {0, 3, 1}, {0, 4, int64(2)}, {0, 5, 3.0}, {0, 6, true}}
+	if got := mapFunc(&testIterator{values: mixed}); got != 6.0 {
+		t.Errorf("mixed sum: exp 6 got %v", got)
+	}
+	if got, ok := MapMeanStrict(&testIterator{values: mixed}).(*MeanMapOutput); !ok || got.Count != 3 || got.Mean != 2 {
+		t.Errorf("mixed mean: exp 3 values with mean 2 got %v", got)
+	}
+
+	// anything else as the second argument is invalid
+	c.Args[1] = &StringLiteral{Val: "lenient"}
+	if _, err := InitializeMapFunc(c); err == nil {
+		t.Errorf("expected error for invalid flag")
+	}
+}
+
+func TestReduceTopBottom(t *testing.T) {
+	tests := []struct {
+		name   string
+		fn     ReduceFunc
+		input  []interface{}
+		output []float64
+	}{
+		{"top with duplicates", ReduceTop(3, false), []interface{}{[]float64{9, 1}, []float64{9, 9}}, []float64{9, 9, 9}},
+		{"top distinct", ReduceTop(3, true), []interface{}{[]float64{9, 1}, []float64{9, 9, 5}}, []float64{9, 5, 1}},
+		{"bottom with duplicates", ReduceBottom(2, false), []interface{}{[]float64{1, 9}, nil, []float64{1, 1}}, []float64{1, 1}},
+		{"bottom distinct", ReduceBottom(2, true), []interface{}{[]float64{1, 9}, nil, []float64{1, 1}}, []float64{1, 9}},
+	}
+
+	for _, tt := range tests {
+		got, ok := tt.fn(tt.input).([]float64)
+		if !ok || !reflect.DeepEqual(got, tt.output) {
+			t.Errorf("%s: output mismatch: exp %v got %v", tt.name, tt.output, got)
+		}
+	}
+}
+
+// Ensure top() returns the N largest values of each interval, or every value if there are fewer than N.
+func TestTopN(t *testing.T) {
+	m1 := []point{{0, 1, 3.0}, {0, 2, 8.0}, {0, 3, 1.0}}
+	m2 := []point{{0, 4, 5.0}, {0, 5, 2.0}}
+
+	tests := []struct {
+		n   float64
+		exp []float64
+	}{
+		{n: 2, exp: []float64{8, 5}},
+		{n: 5, exp: []float64{8, 5, 3, 2, 1}},
+		{n: 10, exp: []float64{8, 5, 3, 2, 1}},
+	}
+
+	for _, test := range tests {
+		c := &Call{Name: "top", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: test.n}}}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		got := reduceFunc([]interface{}{mapFunc(&testIterator{values: m1}), mapFunc(&testIterator{values: m2})})
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: exp %v got %v", c, test.exp, got)
+		}
+	}
+
+	c := &Call{Name: "top", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: -1}}}
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected field and integer for top()" {
+		t.Errorf("%s: unexpected error: %v", c, err)
+	}
+}
+
+// Ensure bottom() returns the N smallest values of each interval in ascending order, with tied values each
+// counting towards N.
+func TestBottomN(t *testing.T) {
+	m1 := []point{{0, 1, 3.0}, {0, 2, 8.0}, {0, 3, 1.0}}
+	m2 := []point{{0, 4, 3.0}, {0, 5, 2.0}, {0, 6, 1.0}}
+
+	tests := []struct {
+		n   float64
+		exp []float64
+	}{
+		{n: 1, exp: []float64{1}},
+		{n: 3, exp: []float64{1, 1, 2}},
+		{n: 4, exp: []float64{1, 1, 2, 3}},
+		{n: 6, exp: []float64{1, 1, 2, 3, 3, 8}},
+		{n: 10, exp: []float64{1, 1, 2, 3, 3, 8}},
+	}
+
+	for _, test := range tests {
+		c := &Call{Name: "bottom", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: test.n}}}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		// the result doesn't depend on the order of the mapper outputs
+		for _, outputs := range [][]interface{}{
+			{mapFunc(&testIterator{values: m1}), mapFunc(&testIterator{values: m2})},
+			{mapFunc(&testIterator{values: m2}), mapFunc(&testIterator{values: m1})},
+		} {
+			if got := reduceFunc(outputs); !reflect.DeepEqual(got, test.exp) {
+				t.Errorf("%s: exp %v got %v", c, test.exp, got)
+			}
+		}
+	}
+
+	for _, args := range [][]Expr{
+		{&VarRef{Val: "value"}},
+		{&VarRef{Val: "value"}, &NumberLiteral{Val: 0}},
+		{&VarRef{Val: "value"}, &NumberLiteral{Val: 2.5}},
+		{&VarRef{Val: "value"}, &StringLiteral{Val: "2"}},
+	} {
+		c := &Call{Name: "bottom", Args: args}
+		if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected field and integer for bottom()" {
+			t.Errorf("%s: unexpected error: %v", c, err)
+		}
+	}
+}
+
+func TestInitializeMapFuncTopBottom(t *testing.T) {
+	for _, args := range [][]Expr{
+		{&VarRef{Val: "field1"}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 1.5}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 3}, &StringLiteral{Val: "unique"}},
+	} {
+		c := &Call{Name: "top", Args: args}
+		if _, err := InitializeMapFunc(c); err == nil {
+			t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+		}
+	}
+
+	c := &Call{Name: "bottom", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 3}, &StringLiteral{Val: "distinct"}}}
+	if _, err := InitializeReduceFunc(c); err != nil {
+		t.Errorf("InitializeReduceFunc(%v) unexpected error: %s", c, err)
+	}
+}
+
+func TestReduceDerivativeTimestampPolicy(t *testing.T) {
+	input := []interface{}{
+		[]*rawQueryMapOutput{{20 * int64(time.Second), 30.0}},
+		[]*rawQueryMapOutput{{10 * int64(time.Second), 10.0}},
+	}
+
+	tests := []struct {
+		policy    string
+		timestamp int64
+	}{
+		{"", 20 * int64(time.Second)},
+		{"later", 20 * int64(time.Second)},
+		{"earlier", 10 * int64(time.Second)},
+		{"midpoint", 15 * int64(time.Second)},
+	}
+
+	for _, tt := range tests {
+		c := &Call{Name: "derivative", Args: []Expr{&VarRef{Val: "field1"}}}
+		if tt.policy != "" {
+			c.Args = append(c.Args, &StringLiteral{Val: tt.policy})
+		}
+		fn, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("InitializeReduceFunc(%v) unexpected error: %s", c, err)
+		}
+
+		got, ok := fn(input).([]*rawQueryMapOutput)
+		if !ok || len(got) != 1 {
+			t.Fatalf("%q: expected one result. got %v", tt.policy, got)
+		}
+		if got[0].Timestamp != tt.timestamp || got[0].Values != 2.0 {
+			t.Errorf("%q: output mismatch: exp {%d 2} got %v", tt.policy, tt.timestamp, got[0])
+		}
+	}
+
+	c := &Call{Name: "derivative", Args: []Expr{&VarRef{Val: "field1"}, &StringLiteral{Val: "first"}}}
+	if _, err := InitializeMapFunc(c); err == nil {
+		t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+	}
+}
+
+func TestReduceCountDistinct(t *testing.T) {
+	input := []interface{}{
+		MapDistinct(&testIterator{values: []point{{0, 1, 3.0}, {0, 2, 1.0}, {0, 3, 3.0}}}),
+		nil,
+		MapDistinct(&testIterator{values: []point{{0, 4, 2.0}, {0, 5, 1.0}}}),
+	}
+
+	if got := ReduceCountDistinct(false)(input); got != 3.0 {
+		t.Errorf("output mismatch: exp 3 got %v", got)
+	}
+
+	got, ok := ReduceCountDistinct(true)(input).(*countDistinctOutput)
+	if !ok {
+		t.Fatalf("expected count and values. got %v", got)
+	}
+	if exp := []interface{}{1.0, 2.0, 3.0}; got.Count != 3 || !reflect.DeepEqual(got.Values, exp) {
+		t.Errorf("output mismatch: exp {3 %v} got %v", exp, got)
+	}
+
+	if got := ReduceCountDistinct(true)([]interface{}{nil}); got != nil {
+		t.Errorf("output mismatch: exp nil got %v", got)
+	}
+}
+
+func TestInitializeReduceFuncScalingFactor(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []interface{}
+		output interface{}
+	}{
+		{"sum", []interface{}{1000.0, nil, 2000.0}, 3.0},
+		{"min", []interface{}{1000.0, 2000.0}, 1.0},
+		{"max", []interface{}{1000.0, 2000.0}, 2.0},
+		{"mean", []interface{}{&MeanMapOutput{Count: 2, Mean: 1000}, &MeanMapOutput{Count: 2, Mean: 3000}}, 2.0},
+		{"sum", []interface{}{nil}, nil},
+	}
+
+	for _, tt := range tests {
+		c := &Call{Name: tt.name, Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0.001}}}
+		fn, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("InitializeReduceFunc(%v) unexpected error: %s", c, err)
+		}
+		if got := fn(tt.input); got != tt.output {
+			t.Errorf("%s: output mismatch: exp %v got %v", c, tt.output, got)
+		}
+	}
+
+	// the factor must be numeric and 'strict' only applies to sum and mean
+	for _, c := range []*Call{
+		{Name: "sum", Args: []Expr{&VarRef{Val: "field1"}, &BooleanLiteral{Val: true}}},
+		{Name: "max", Args: []Expr{&VarRef{Val: "field1"}, &StringLiteral{Val: "strict"}}},
+		{Name: "sum", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 2}, &NumberLiteral{Val: 3}}},
+	} {
+		if _, err := InitializeMapFunc(c); err == nil {
+			t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+		}
+	}
+}
+
+func TestReduceMovingWindows(t *testing.T) {
+	s := int64(time.Second)
+	input := []interface{}{
+		[]*rawQueryMapOutput{{1 * s, 2.0}, {3 * s, 6.0}},
+		[]*rawQueryMapOutput{{2 * s, 4.0}, {4 * s, 8.0}},
+	}
+
+	tests := []struct {
+		name   string
+		fn     ReduceFunc
+		output []*rawQueryMapOutput
+	}{
+		{"average over points", ReduceMovingAverage(MovingWindow{Points: 3}), []*rawQueryMapOutput{{3 * s, 4.0}, {4 * s, 6.0}}},
+		{"average over time", ReduceMovingAverage(MovingWindow{Duration: 2 * time.Second}), []*rawQueryMapOutput{{3 * s, 5.0}, {4 * s, 7.0}}},
+		{"stddev over points", ReduceMovingStddev(MovingWindow{Points: 3}), []*rawQueryMapOutput{{3 * s, 2.0}, {4 * s, 2.0}}},
+		{"stddev over time", ReduceMovingStddev(MovingWindow{Duration: 2 * time.Second}), []*rawQueryMapOutput{{3 * s, math.Sqrt2}, {4 * s, math.Sqrt2}}},
+		{"window of one point", ReduceMovingAverage(MovingWindow{Points: 1}), []*rawQueryMapOutput{{1 * s, 2.0}, {2 * s, 4.0}, {3 * s, 6.0}, {4 * s, 8.0}}},
+		{"window of every point", ReduceMovingAverage(MovingWindow{Points: 4}), []*rawQueryMapOutput{{4 * s, 5.0}}},
+		{"window larger than data", ReduceMovingAverage(MovingWindow{Points: 5}), nil},
+	}
+
+	for _, tt := range tests {
+		got, _ := tt.fn(input).([]*rawQueryMapOutput)
+		if !reflect.DeepEqual(got, tt.output) {
+			t.Errorf("%s: output mismatch: exp %v got %v", tt.name, tt.output, got)
+		}
+	}
+
+	// integer fields are averaged like floats, and non-numeric values are skipped
+	mixed := []interface{}{
+		[]*rawQueryMapOutput{{1 * s, int64(2)}, {2 * s, "a"}, {3 * s, int64(6)}},
+		[]*rawQueryMapOutput{{4 * s, int64(4)}, {5 * s, true}, {6 * s, int64(8)}},
+	}
+	exp := []*rawQueryMapOutput{{4 * s, 4.0}, {6 * s, 6.0}}
+	if got, _ := ReduceMovingAverage(MovingWindow{Points: 3})(mixed).([]*rawQueryMapOutput); !reflect.DeepEqual(got, exp) {
+		t.Errorf("integer values: output mismatch: exp %v got %v", exp, got)
+	}
+
+	for _, args := range [][]Expr{
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: -1}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 2.5}},
+		{&VarRef{Val: "field1"}, &StringLiteral{Val: "3"}},
+		{&VarRef{Val: "field1"}},
+	} {
+		c := &Call{Name: "moving_average", Args: args}
+		if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected field and window size for moving_average()" {
+			t.Errorf("InitializeMapFunc(%v) expected window size error. got %v", c, err)
+		}
+	}
+}
+
+func TestReduceNth(t *testing.T) {
+	input := []interface{}{
+		[]*rawQueryMapOutput{{30, 3.0}, {10, 1.0}},
+		nil,
+		[]*rawQueryMapOutput{{20, 2.0}, {40, 4.0}},
+	}
+
+	tests := []struct {
+		n      int
+		output interface{}
+	}{
+		{1, 1.0},
+		{2, 2.0},
+		{-1, 4.0},
+		{-4, 1.0},
+		{5, nil},
+		{-5, nil},
+	}
+
+	for _, tt := range tests {
+		if got := ReduceNth(tt.n)(input); got != tt.output {
+			t.Errorf("nth(%d): output mismatch: exp %v got %v", tt.n, tt.output, got)
+		}
+	}
+
+	c := &Call{Name: "nth", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0}}}
+	if _, err := InitializeMapFunc(c); err == nil {
+		t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+	}
+}
+
+func TestReduceMode(t *testing.T) {
+	input := []interface{}{
+		[]float64{5, 1, 5, 2},
+		nil,
+		[]float64{1, 5, 5, 3},
+	}
+
+	if got := ReduceMode(false)(input); got != 5.0 {
+		t.Errorf("output mismatch: exp 5 got %v", got)
+	}
+
+	got, ok := ReduceMode(true)(input).(*modeOutput)
+	if !ok || got.Value != 5 || got.Count != 4 {
+		t.Errorf("output mismatch: exp {5 4} got %v", got)
+	}
+}
+
+// Ensure mode() is computed across mappers, including remote ones, with ties going to the smallest value.
+func TestMode(t *testing.T) {
+	c := &Call{Name: "mode", Args: []Expr{&VarRef{Val: "status"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mappers [][]point
+		exp     interface{}
+	}{
+		{name: "clear winner", mappers: [][]point{{{0, 1, 200.0}, {0, 2, 404.0}}, {{0, 3, 200.0}, {0, 4, 500.0}}}, exp: 200.0},
+		{name: "two-way tie", mappers: [][]point{{{0, 1, 500.0}, {0, 2, 404.0}}, {{0, 3, 500.0}, {0, 4, 404.0}}}, exp: 404.0},
+		{name: "negative tie", mappers: [][]point{{{0, 1, -1.0}}, {{0, 2, -2.0}}}, exp: -2.0},
+		{name: "empty interval", mappers: [][]point{nil, nil}, exp: nil},
+	}
+
+	for _, test := range tests {
+		var outputs []interface{}
+		for _, points := range test.mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, v)
+		}
+		if got := reduceFunc(outputs); got != test.exp {
+			t.Errorf("%s: exp %v got %v", test.name, test.exp, got)
+		}
+	}
+}
+
+func TestReducePercentileDescending(t *testing.T) {
+	var values, negated []interface{}
+	for i := 1; i <= 100; i++ {
+		values = append(values, float64(i))
+		negated = append(negated, -float64(i))
+	}
+
+	for _, p := range []float64{1, 5, 50, 95, 100} {
+		got := ReducePercentile(-p)([]interface{}{values})
+		exp := -ReducePercentile(p)([]interface{}{negated}).(float64)
+		if got != exp {
+			t.Errorf("percentile(-%v): output mismatch: exp %v got %v", p, exp, got)
+		}
+	}
+
+	if got := ReducePercentile(-95)([]interface{}{values}); got != 6.0 {
+		t.Errorf("percentile(-95): output mismatch: exp 6 got %v", got)
+	}
+}
+
+func TestMergePartial(t *testing.T) {
+	old := []point{{0, 1, 4.0}, {0, 2, 2.0}}
+	recent := []point{{0, 3, 9.0}, {0, 4, 1.0}}
+
+	// the old partial survives a round trip through storage
+	b, err := json.Marshal(MapPartial(&testIterator{values: old}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Partial
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := MergePartial(&stored, MapPartial(&testIterator{values: recent}).(*Partial))
+	full := MapPartial(&testIterator{values: append(old, recent...)}).(*Partial)
+	if !reflect.DeepEqual(merged, full) {
+		t.Fatalf("output mismatch: exp %v got %v", full, merged)
+	}
+
+	for name, exp := range map[string]interface{}{"count": int64(4), "sum": 16.0, "mean": 4.0, "min": 1.0, "max": 9.0} {
+		if got, err := merged.Result(name); err != nil || got != exp {
+			t.Errorf("%s: output mismatch: exp %v got %v (%v)", name, exp, got, err)
+		}
+	}
+
+	if got := ReducePartial([]interface{}{nil, nil}); got != nil {
+		t.Errorf("output mismatch: exp nil got %v", got)
+	}
+}
+
+// Ensure stddev() re-aggregated from downsampled partials matches the stddev of the raw points rather than of
+// the bucket means.
+func TestPartialStddev(t *testing.T) {
+	buckets := [][]point{
+		{{0, 1, 2.0}, {0, 2, 4.0}, {0, 3, 4.0}},
+		{{0, 4, 4.0}, {0, 5, 5.0}},
+		{{0, 6, 5.0}, {0, 7, 7.0}, {0, 8, 9.0}},
+	}
+
+	// downsample each bucket and store its partial
+	var raw []point
+	var partials []interface{}
+	for _, points := range buckets {
+		raw = append(raw, points...)
+		b, err := json.Marshal(MapPartial(&testIterator{values: points}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Partial{}
+		if err := json.Unmarshal(b, p); err != nil {
+			t.Fatal(err)
+		}
+		partials = append(partials, p)
+	}
+
+	merged := ReducePartial(partials).(*Partial)
+	for name, exp := range map[string]interface{}{
+		"stddev":   ReduceStddev([]interface{}{MapStddev(&testIterator{values: raw})}),
+		"variance": ReduceVariance([]interface{}{MapStddev(&testIterator{values: raw})}),
+	} {
+		if got, err := merged.Result(name); err != nil || got != exp {
+			t.Errorf("%s: exp %v got %v (%v)", name, exp, got, err)
+		}
+	}
+
+	// the stddev of the bucket means alone would be wrong
+	naive := ReduceStddev([]interface{}{[]float64{10.0 / 3, 4.5, 7}})
+	if got, _ := merged.Result("stddev"); got == naive {
+		t.Errorf("stddev %v matches the stddev of the bucket means", got)
+	}
+
+	if got, _ := MapPartial(&testIterator{values: buckets[0][:1]}).(*Partial).Result("stddev"); got != nil {
+		t.Errorf("stddev of a single point: exp nil got %v", got)
+	}
+}
+
+func TestReduceLogMeanStddev(t *testing.T) {
+	input := []point{{0, 1, 1.0}, {0, 2, 100.0}, {0, 3, -5.0}, {0, 4, 0.0}, {0, 5, 10.0}}
+
+	// the geometric mean of 1, 10 and 100 is 10
+	got := ReduceLogMean([]interface{}{MapLogMean(&testIterator{values: input}), nil})
+	if v, ok := got.(float64); !ok || math.Abs(v-10) > 1e-9 {
+		t.Errorf("log_mean: output mismatch: exp 10 got %v", got)
+	}
+
+	// the geometric standard deviation of 1, 10 and 100 is e^ln(10)
+	got = ReduceLogStddev([]interface{}{MapLogStddev(&testIterator{values: input})})
+	if v, ok := got.(float64); !ok || math.Abs(v-10) > 1e-9 {
+		t.Errorf("log_stddev: output mismatch: exp 10 got %v", got)
+	}
+
+	if got := ReduceLogMean([]interface{}{MapLogMean(&testIterator{values: []point{{0, 1, -1.0}}})}); got != nil {
+		t.Errorf("log_mean: output mismatch: exp nil got %v", got)
+	}
+}
+
+func TestReduceCountDistinctSessions(t *testing.T) {
+	m := int64(time.Minute)
+	input := []interface{}{
+		[]*rawQueryMapOutput{{0 * m, "a"}, {2 * m, "b"}, {60 * m, "a"}},
+		[]*rawQueryMapOutput{{1 * m, "a"}, {61 * m, "a"}, {62 * m, "c"}},
+	}
+
+	c := &Call{Name: "count_distinct", Args: []Expr{&VarRef{Val: "field1"}, &DurationLiteral{Val: 30 * time.Minute}}}
+	fn, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatalf("InitializeReduceFunc(%v) unexpected error: %s", c, err)
+	}
+
+	exp := []*rawQueryMapOutput{{0, 2.0}, {60 * m, 2.0}}
+	if got := fn(input); !reflect.DeepEqual(got, exp) {
+		t.Errorf("output mismatch: exp %v got %v", exp, got)
+	}
+}
+
+func TestReduceAllMinMax(t *testing.T) {
+	shard1 := []point{{0, 1, 5.0}, {0, 4, 1.0}, {0, 5, 9.0}}
+	shard2 := []point{{0, 2, 9.0}, {0, 3, 1.0}, {0, 6, 9.0}}
+
+	input := []interface{}{MapAllMax(&testIterator{values: shard1}), MapAllMax(&testIterator{values: shard2}), nil}
+	exp := []*rawQueryMapOutput{{2, 9.0}, {5, 9.0}, {6, 9.0}}
+	if got := ReduceAllMax(input); !reflect.DeepEqual(got, exp) {
+		t.Errorf("all_max: output mismatch: exp %v got %v", exp, got)
+	}
+
+	input = []interface{}{MapAllMin(&testIterator{values: shard1}), MapAllMin(&testIterator{values: shard2})}
+	exp = []*rawQueryMapOutput{{3, 1.0}, {4, 1.0}}
+	if got := ReduceAllMin(input); !reflect.DeepEqual(got, exp) {
+		t.Errorf("all_min: output mismatch: exp %v got %v", exp, got)
+	}
+
+	if got := MapAllMax(&testIterator{}); got != nil {
+		t.Errorf("all_max: output mismatch: exp nil got %v", got)
+	}
+}
+
+func TestReduceSumMeanPartials(t *testing.T) {
+	// a pre-aggregated partial of a billion points is combined with two raw points
+	partial := &Partial{Count: 1e9, Sum: 2e9, Min: 1, Max: 3}
+	input := []interface{}{partial, 5.0, nil, 8.0, &Partial{}}
+
+	if got, exp := ReduceSum(input), 2e9+13; got != exp {
+		t.Errorf("sum: output mismatch: exp %v got %v", exp, got)
+	}
+
+	exp := (2e9 + 13) / (1e9 + 2)
+	if got, ok := ReduceMean(input).(float64); !ok || math.Abs(got-exp) > 1e-9 {
+		t.Errorf("mean: output mismatch: exp %v got %v", exp, got)
+	}
+
+	if got := ReduceMean([]interface{}{&MeanMapOutput{}, nil}); got != nil {
+		t.Errorf("mean: output mismatch: exp nil got %v", got)
+	}
+}
+
+func TestReduceDerivativeSmoothing(t *testing.T) {
+	// a counter rising 10 per second with alternating jitter of +/-5
+	s := int64(time.Second)
+	var points []*rawQueryMapOutput
+	for i := int64(0); i < 10; i++ {
+		jitter := 5.0
+		if i%2 == 1 {
+			jitter = -5.0
+		}
+		points = append(points, &rawQueryMapOutput{i * s, float64(i*10) + jitter})
+	}
+	input := []interface{}{points}
+
+	spread := func(results interface{}) float64 {
+		min, max := math.Inf(1), math.Inf(-1)
+		for _, r := range results.([]*rawQueryMapOutput) {
+			min, max = math.Min(min, r.Values.(float64)), math.Max(max, r.Values.(float64))
+		}
+		return max - min
+	}
+
+	if got := spread(ReduceDerivative(LaterTimestamp, 0)(input)); got != 20 {
+		t.Errorf("noisy derivative: expected spread of 20. got %v", got)
+	}
+
+	// integer values are smoothed and differentiated like floats
+	var ints []*rawQueryMapOutput
+	for i := int64(0); i < 4; i++ {
+		ints = append(ints, &rawQueryMapOutput{i * s, i * 10})
+	}
+	for _, smoothing := range []int{0, 2} {
+		for _, r := range ReduceDerivative(LaterTimestamp, smoothing)([]interface{}{ints}).([]*rawQueryMapOutput) {
+			if r.Values != 10.0 {
+				t.Errorf("integer derivative with smoothing %d: output mismatch: exp 10 got %v", smoothing, r.Values)
+			}
+		}
+	}
+
+	smoothed := ReduceDerivative(LaterTimestamp, 2)(input).([]*rawQueryMapOutput)
+	if len(smoothed) != 8 {
+		t.Fatalf("smoothed derivative: expected 8 results. got %d", len(smoothed))
+	}
+	for _, r := range smoothed {
+		if r.Values != 10.0 {
+			t.Errorf("smoothed derivative: output mismatch: exp 10 got %v", r.Values)
+		}
+	}
+}
+
+func TestReduceTrimmed(t *testing.T) {
+	// 10 points with two low and two high outliers
+	data := []float64{-1000, -900, 1, 2, 3, 4, 5, 6, 900, 1000000}
+	echoed := make([]interface{}, len(data))
+	for i, v := range data {
+		echoed[i] = v
+	}
+
+	if got := ReduceMedian([]interface{}{append([]float64{}, data...)}); got != 3.5 {
+		t.Errorf("median: output mismatch: exp 3.5 got %v", got)
+	}
+	// outliers on both sides are trimmed, leaving the median of 1 to 6
+	if got := ReduceTrimmedMedian(0.2)([]interface{}{append([]float64{}, data[:5]...), append([]float64{}, data[5:]...)}); got != 3.5 {
+		t.Errorf("trimmed median: output mismatch: exp 3.5 got %v", got)
+	}
+
+	// outliers on one side pull the median up until they're trimmed
+	skewed := []float64{1, 2, 3, 4, 5, 6, 7, 8, 900, 1000}
+	if got := ReduceMedian([]interface{}{append([]float64{}, skewed...)}); got != 5.5 {
+		t.Errorf("skewed median: output mismatch: exp 5.5 got %v", got)
+	}
+	if got := ReduceTrimmedMedian(0.1)([]interface{}{append([]float64{}, skewed...)}); got != 4.5 {
+		t.Errorf("trimmed skewed median: output mismatch: exp 4.5 got %v", got)
+	}
+
+	// trimming removes the outliers at the top so p90 falls on an inlier
+	if got := ReducePercentile(90)([]interface{}{echoed}); got != 900.0 {
+		t.Errorf("percentile: output mismatch: exp 900 got %v", got)
+	}
+	if got := ReduceTrimmedPercentile(90, 0.2)([]interface{}{echoed}); got != 5.0 {
+		t.Errorf("trimmed percentile: output mismatch: exp 5 got %v", got)
+	}
+
+	c := &Call{Name: "median", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0.5}}}
+	if _, err := InitializeMapFunc(c); err == nil {
+		t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+	}
+}
+
+func TestReduceMissingCount(t *testing.T) {
+	s := int64(time.Second)
+	fn := ReduceMissingCount(10 * time.Second)
+
+	// points every 10s with the 30s, 40s and 50s points missing
+	input := []interface{}{
+		[]*rawQueryMapOutput{{0, 1.0}, {20 * s, 1.0}, {70 * s, 1.0}},
+		[]*rawQueryMapOutput{{10 * s, 1.0}, {60 * s, 1.0}},
+	}
+	if got := fn(input); got != 3.0 {
+		t.Errorf("output mismatch: exp 3 got %v", got)
+	}
+
+	// a gap that isn't a multiple of the interval
+	if got := fn([]interface{}{[]*rawQueryMapOutput{{0, 1.0}, {25 * s, 1.0}}}); got != 2.0 {
+		t.Errorf("output mismatch: exp 2 got %v", got)
+	}
+
+	if got := fn([]interface{}{nil}); got != nil {
+		t.Errorf("output mismatch: exp nil got %v", got)
+	}
+}
+
+func TestInitializeFuncsWithSeries(t *testing.T) {
+	c := &Call{Name: "sum", Args: []Expr{&VarRef{Val: "field1"}, &StringLiteral{Val: "series"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second shard's output goes through a remote round trip
+	shard1 := mapFunc(&testIterator{values: []point{{1, 1, 1.0}, {2, 2, 2.0}, {1, 3, 3.0}}})
+	b, err := json.Marshal(mapFunc(&testIterator{values: []point{{2, 4, 4.0}, {3, 5, 5.0}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard2, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := reduceFunc([]interface{}{shard1, shard2, nil}).(*seriesOutput)
+	if !ok || got.Value != 15.0 || got.SeriesCount != 3 {
+		t.Errorf("output mismatch: exp {15 3} got %v", got)
+	}
+
+	if got := reduceFunc([]interface{}{mapFunc(&testIterator{})}); got != nil {
+		t.Errorf("output mismatch: exp nil got %v", got)
+	}
+}
+
+func TestReduceStddevOnePass(t *testing.T) {
+	shards := [][]point{
+		{{0, 1, 1e9 + 4.0}, {0, 2, 1e9 + 7.0}, {0, 3, 1e9 + 13.0}},
+		{},
+		{{0, 4, 1e9 + 16.0}, {0, 5, 1e9 + 1.0}},
+	}
+
+	var twoPass, onePass []interface{}
+	for _, shard := range shards {
+		twoPass = append(twoPass, MapStddev(&testIterator{values: append([]point{}, shard...)}))
+		onePass = append(onePass, MapStddevOnePass(&testIterator{values: append([]point{}, shard...)}))
+	}
+
+	exp := ReduceStddev(twoPass).(float64)
+	got, ok := ReduceStddevOnePass(onePass).(float64)
+	if !ok || math.Abs(got-exp) > 1e-6 {
+		t.Errorf("output mismatch: exp %v got %v", exp, got)
+	}
+
+	if got := ReduceStddevOnePass([]interface{}{MapStddevOnePass(&testIterator{values: []point{{0, 1, 1.0}}})}); got != nil {
+		t.Errorf("output mismatch: exp nil got %v", got)
+	}
+}
+
+func benchmarkStddevData() []point {
+	points := make([]point, 10000)
+	for i := range points {
+		points[i] = point{0, int64(i + 1), float64(i % 97)}
+	}
+	return points
+}
+
+func BenchmarkStddevTwoPass(b *testing.B) {
+	data := benchmarkStddevData()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ReduceStddev([]interface{}{MapStddev(&testIterator{values: data})})
+	}
+}
+
+func BenchmarkStddevOnePass(b *testing.B) {
+	data := benchmarkStddevData()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ReduceStddevOnePass([]interface{}{MapStddevOnePass(&testIterator{values: data})})
+	}
+}
+
+func TestInitializeRawMapFuncSinglePoint(t *testing.T) {
+	tests := []struct {
+		q   string
+		exp *rawQueryMapOutput
+	}{
+		{q: `SELECT value FROM cpu LIMIT 1`, exp: &rawQueryMapOutput{1, 1.0}},
+		{q: `SELECT value FROM cpu ORDER BY ASC LIMIT 1`, exp: &rawQueryMapOutput{1, 1.0}},
+		{q: `SELECT value FROM cpu ORDER BY DESC LIMIT 1`, exp: &rawQueryMapOutput{3, 3.0}},
+	}
+
+	for _, test := range tests {
+		stmt, err := NewParser(strings.NewReader(test.q)).ParseStatement()
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		itr := &testIterator{values: []point{
+			{0, 1, 1.0},
+			{0, 2, 2.0},
+			{0, 3, 3.0},
+		}}
+		got := InitializeRawMapFunc(stmt.(*SelectStatement))(itr).([]*rawQueryMapOutput)
+		if len(got) != 1 || !reflect.DeepEqual(got[0], test.exp) {
+			t.Errorf("%s: wrong output. exp %v got %v", test.q, test.exp, got)
+		}
+		// the earliest point is found without reading any further
+		if test.exp.Timestamp == 1 && len(itr.values) != 2 {
+			t.Errorf("%s: expected 2 points left unread, got %d", test.q, len(itr.values))
+		}
+	}
+}
+
+func TestReduceHistogramLogBuckets(t *testing.T) {
+	tests := []struct {
+		q   string
+		exp []histogramBucket
+	}{
+		{
+			q: `SELECT histogram(value, 'log', 10) FROM cpu`,
+			exp: []histogramBucket{
+				{LowerBound: 0, Count: 2},
+				{LowerBound: 1, Count: 2},
+				{LowerBound: 10, Count: 3},
+				{LowerBound: 100, Count: 2},
+				{LowerBound: 1000, Count: 1},
+			},
+		},
+		{
+			q: `SELECT histogram(value, 'log') FROM cpu`,
+			exp: []histogramBucket{
+				{LowerBound: 0, Count: 2},
+				{LowerBound: 1, Count: 1},
+				{LowerBound: 8, Count: 3},
+				{LowerBound: 64, Count: 2},
+				{LowerBound: 512, Count: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		stmt, err := NewParser(strings.NewReader(test.q)).ParseStatement()
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		c := stmt.(*SelectStatement).FunctionCalls()[0]
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+
+		// values spanning 1 to 1000 split across two mappers, including values with no logarithm
+		m1 := mapFunc(&testIterator{values: []point{
+			{0, 1, 1.0}, {0, 2, 9.0}, {0, 3, 10.0}, {0, 4, 0.0},
+		}})
+		m2 := mapFunc(&testIterator{values: []point{
+			{0, 5, 15.0}, {0, 6, 99.0}, {0, 7, 100.0}, {0, 8, 999.0}, {0, 9, int64(1000)}, {0, 10, -5.0},
+		}})
+
+		if got := reduceFunc([]interface{}{m1, m2}); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: wrong buckets. exp %v got %v", test.q, test.exp, got)
+		}
+	}
+}
+
+func TestReduceHistogramBoundaries(t *testing.T) {
+	c := &Call{Name: "histogram", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 10}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// buckets are [lower, lower+10), so values on a boundary start the next bucket. NaN values are skipped.
+	var outputs []interface{}
+	for _, values := range [][]point{
+		{{0, 1, 0.0}, {0, 2, 9.999}, {0, 3, 10.0}, {0, 4, -0.001}},
+		{{0, 5, -10.0}, {0, 6, 19.5}, {0, 7, int64(20)}, {0, 8, 10.0}, {0, 9, math.NaN()}},
+		{{0, 10, math.NaN()}},
+	} {
+		b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, o)
+	}
+	exp := []histogramBucket{
+		{LowerBound: -10, Count: 2},
+		{LowerBound: 0, Count: 2},
+		{LowerBound: 10, Count: 3},
+		{LowerBound: 20, Count: 1},
+	}
+	if got := reduceFunc(outputs); !reflect.DeepEqual(got, exp) {
+		t.Errorf("wrong buckets. exp %v got %v", exp, got)
+	}
+
+	// a multiple of a fractional width is the lower bound of its own bucket despite rounding
+	h := histogramBuckets{Width: 0.01}
+	for i := -1000; i <= 1000; i++ {
+		v := float64(i) * h.Width
+		if lower := h.lowerBound(v); lower != v {
+			t.Fatalf("%v: exp lower bound %v, got %v", v, v, lower)
+		}
+	}
+}
+
+func TestInitializeMapFuncHistogramArgs(t *testing.T) {
+	for _, q := range []string{
+		`SELECT histogram(value) FROM cpu`,
+		`SELECT histogram(value, 0) FROM cpu`,
+		`SELECT histogram(value, 'linear') FROM cpu`,
+		`SELECT histogram(value, 'log', 1) FROM cpu`,
+		`SELECT histogram(value, 'log', 'ten') FROM cpu`,
+	} {
+		stmt, err := NewParser(strings.NewReader(q)).ParseStatement()
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+		if _, err := InitializeMapFunc(stmt.(*SelectStatement).FunctionCalls()[0]); err == nil {
+			t.Errorf("%s: expected error", q)
+		}
+	}
+}
+
+func TestReduceWithNaNOrigin(t *testing.T) {
+	for _, q := range []string{
+		`SELECT sum(value, 'debug') FROM cpu`,
+		`SELECT mean(value, 'debug') FROM cpu`,
+		`SELECT sum(value, 'debug', 'group_hour_of_day') FROM cpu`,
+		`SELECT mean(value, 'debug', 'group_day_of_week') FROM cpu`,
+	} {
+		stmt, err := NewParser(strings.NewReader(q)).ParseStatement()
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+		c := stmt.(*SelectStatement).FunctionCalls()[0]
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+
+		m1 := mapFunc(&testIterator{values: []point{{1, 1, 1.0}, {1, 2, 2.0}}})
+		switch got := reduceFunc([]interface{}{m1}).(type) {
+		case error:
+			t.Errorf("%s: unexpected error without NaN: %v", q, got)
+		case float64:
+			if got != 3.0 && got != 1.5 {
+				t.Errorf("%s: unexpected result without NaN: %v", q, got)
+			}
+		}
+
+		m2 := mapFunc(&testIterator{values: []point{{5, 3, 4.0}, {7, 4, math.NaN()}, {9, 5, math.NaN()}}})
+		err, ok := reduceFunc([]interface{}{m1, m2}).(error)
+		if !ok {
+			t.Fatalf("%s: expected an error", q)
+		} else if !strings.Contains(err.Error(), "series 7") {
+			t.Errorf("%s: expected series 7 to be reported, got %q", q, err)
+		}
+	}
+}
+
+func TestReduceByTimeComponent(t *testing.T) {
+	// one point per hour over three days, valued by the hour it falls in
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	var points []point
+	for i := 0; i < 72; i++ {
+		ts := start.Add(time.Duration(i) * time.Hour)
+		points = append(points, point{uint64(i % 2), ts.UnixNano(), float64(ts.Hour())})
+	}
+
+	tests := []struct {
+		q   string
+		exp func(hour int) float64
+	}{
+		{q: `SELECT count(value, 'group_hour_of_day') FROM cpu`, exp: func(hour int) float64 { return 3.0 }},
+		{q: `SELECT sum(value, 'group_hour_of_day') FROM cpu`, exp: func(hour int) float64 { return float64(3 * hour) }},
+		{q: `SELECT mean(value, 'group_hour_of_day') FROM cpu`, exp: func(hour int) float64 { return float64(hour) }},
+	}
+
+	for _, test := range tests {
+		stmt, err := NewParser(strings.NewReader(test.q)).ParseStatement()
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		c := stmt.(*SelectStatement).FunctionCalls()[0]
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+
+		// the second half of the points come from a remote mapper
+		local := mapFunc(&testIterator{values: points[:36]})
+		b, err := json.Marshal(mapFunc(&testIterator{values: points[36:]}))
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+		remote, err := unmarshal(b)
+		if err != nil {
+			t.Fatalf("%s: %s", test.q, err)
+		}
+
+		got := reduceFunc([]interface{}{local, remote}).([]*bucketOutput)
+		if len(got) != 24 {
+			t.Fatalf("%s: expected 24 buckets, got %d", test.q, len(got))
+		}
+		for hour, o := range got {
+			if v, _ := toFloat64(o.Value); o.Bucket != hour || math.Abs(v-test.exp(hour)) > 1e-9 {
+				t.Errorf("%s: wrong bucket. exp %d: %v got %d: %v", test.q, hour, test.exp(hour), o.Bucket, o.Value)
+			}
+		}
+	}
+}
+
+func TestReducePercentileInterpolatedMedian(t *testing.T) {
+	c := &Call{Name: "percentile", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 50}, &StringLiteral{Val: "linear"}}}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]interface{}{
+		{3.0, 1.0, 7.0, 5.0, 9.0},
+		{3.0, 1.0, 7.0, 5.0, 9.0, 10.0},
+		{2.0, 4.0},
+		{8.0},
+	} {
+		var floats []float64
+		for _, v := range data {
+			floats = append(floats, v.(float64))
+		}
+		median := ReduceMedian([]interface{}{floats})
+
+		if got := reduceFunc([]interface{}{data}); got != median {
+			t.Errorf("%v: p50 doesn't match median. exp %v got %v", data, median, got)
+		}
+	}
+
+	// the nearest rank method picks an actual value on an even number of values
+	if got := ReducePercentile(50)([]interface{}{[]interface{}{2.0, 4.0}}); got != 2.0 {
+		t.Errorf("wrong nearest rank p50. exp 2 got %v", got)
+	}
+}
+
+func TestReducePercentileInterpolatedEdges(t *testing.T) {
+	values := []interface{}{[]interface{}{40.0, 10.0}, []interface{}{30.0, 20.0}}
+
+	tests := []struct {
+		percentile float64
+		exp        float64
+	}{
+		{percentile: 0, exp: 10},
+		{percentile: 50, exp: 25},
+		{percentile: 100, exp: 40},
+		// rank 0.9 lies between 10 and 20
+		{percentile: 30, exp: 19},
+	}
+
+	for _, test := range tests {
+		if got := ReducePercentileInterpolated(test.percentile)(values); got == nil || math.Abs(got.(float64)-test.exp) > 1e-9 {
+			t.Errorf("p%v: exp %v got %v", test.percentile, test.exp, got)
+		}
+	}
+
+	// the nearest rank method is still the default
+	c := &Call{Name: "percentile", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 50}}}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reduceFunc(values); got != 20.0 {
+		t.Errorf("%s: exp 20 got %v", c, got)
+	}
+}
+
+func TestReduceCountDistinctIgnoreCase(t *testing.T) {
+	tests := []struct {
+		args []Expr
+		exp  interface{}
+	}{
+		{args: nil, exp: 4.0},
+		{args: []Expr{&StringLiteral{Val: "ignore_case"}}, exp: 3.0},
+		{
+			args: []Expr{&StringLiteral{Val: "values"}, &StringLiteral{Val: "ignore_case"}},
+			exp:  &countDistinctOutput{Count: 3, Values: []interface{}{1.0, "host1", "host2"}},
+		},
+	}
+
+	for _, test := range tests {
+		c := &Call{Name: "count_distinct", Args: append([]Expr{&VarRef{Val: "host"}}, test.args...)}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		m1 := mapFunc(&testIterator{values: []point{{0, 1, "Host1"}, {0, 2, "host1"}}})
+		m2 := mapFunc(&testIterator{values: []point{{0, 3, "HOST1"}, {0, 4, "host2"}}})
+		values := []interface{}{m1, m2}
+		if len(test.args) > 0 {
+			values = append(values, mapFunc(&testIterator{values: []point{{0, 5, 1.0}}}))
+		}
+		if got := reduceFunc(values); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: wrong result. exp %v got %v", c, test.exp, got)
+		}
+	}
+}
+
+func TestIntervalSketchIncrementalUpdate(t *testing.T) {
+	var first, second []point
+	for i := 0; i < 5000; i++ {
+		p := point{0, int64(i + 1), fmt.Sprintf("host%d", i%3000)}
+		if i < 2500 {
+			first = append(first, p)
+		} else {
+			second = append(second, p)
+		}
+	}
+
+	c := &Call{Name: "count_distinct", Args: []Expr{&VarRef{Val: "host"}, &StringLiteral{Val: "approx"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// persist the sketch of the interval after the first batch of points
+	s := &IntervalSketch{Start: 10, Sketch: mapFunc(&testIterator{values: first}).(*HyperLogLog)}
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reload it and update it with the second batch sent from a remote mapper
+	loaded := &IntervalSketch{}
+	if err := loaded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	} else if loaded.Start != 10 {
+		t.Fatalf("wrong interval start. exp 10 got %d", loaded.Start)
+	}
+	m, err := json.Marshal(mapFunc(&testIterator{values: second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := unmarshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.Update([]interface{}{remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := reduceFunc([]interface{}{mapFunc(&testIterator{values: append(first, second...)})})
+	if float64(got) != exp {
+		t.Fatalf("incremental count differs from scratch. exp %v got %d", exp, got)
+	}
+	if math.Abs(float64(got)-3000)/3000 > 0.03 {
+		t.Fatalf("estimate too far from 3000: %d", got)
+	}
+}
+
+func TestUnmarshalPartialVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		args []Expr
+		b    string
+		exp  interface{}
+		err  bool
+	}{
+		// partials from nodes that predate versioning
+		{name: "mean", b: `{"Count":2,"Mean":3}`, exp: &MeanMapOutput{Count: 2, Mean: 3}},
+		{name: "spread", b: `{"Min":1,"Max":4}`, exp: &spreadMapOutput{Min: 1, Max: 4}},
+		{
+			name: "stddev", args: []Expr{&StringLiteral{Val: "one_pass"}},
+			b:   `{"Count":2,"Mean":3,"M2":2}`,
+			exp: &stddevOnePassMapOutput{Count: 2, Mean: 3, M2: 2},
+		},
+
+		// a newer version within the compatibility window, with a field this node doesn't know about
+		{name: "mean", b: `{"Count":2,"Mean":3,"Version":2,"Sum":6}`, exp: &MeanMapOutput{Count: 2, Mean: 3, Version: 2}},
+
+		// versions outside the window
+		{name: "mean", b: `{"Count":2,"Mean":3,"Version":3}`, err: true},
+		{name: "spread", b: `{"Min":1,"Max":4,"Version":-1}`, err: true},
+	}
+
+	for _, test := range tests {
+		c := &Call{Name: test.name, Args: append([]Expr{&VarRef{Val: "value"}}, test.args...)}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := unmarshal([]byte(test.b))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error unmarshaling %s", c, test.b)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected error unmarshaling %s: %s", c, test.b, err)
+		} else if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: wrong partial. exp %v got %v", c, test.exp, got)
+		}
+	}
+
+	// a current partial round trips with its version
+	b, err := json.Marshal(MapMean(&testIterator{values: []point{{0, 1, 2.0}, {0, 2, 4.0}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, _ := InitializeUnmarshaller(&Call{Name: "mean", Args: []Expr{&VarRef{Val: "value"}}})
+	if got, err := unmarshal(b); err != nil {
+		t.Fatal(err)
+	} else if exp := (&MeanMapOutput{Count: 2, Mean: 3, Version: PartialVersion}); !reflect.DeepEqual(got, exp) {
+		t.Errorf("wrong partial. exp %v got %v", exp, got)
+	}
+}
+
+func TestReduceDerivativeSinglePoint(t *testing.T) {
+	single := []interface{}{[]*rawQueryMapOutput{{10 * int64(time.Second), 5.0}}, nil}
+
+	tests := []struct {
+		args []Expr
+		exp  interface{}
+	}{
+		// by default no rate is emitted
+		{args: nil, exp: nil},
+		{args: []Expr{&StringLiteral{Val: "zero"}}, exp: []*rawQueryMapOutput{{10 * int64(time.Second), 0.0}}},
+		{args: []Expr{&StringLiteral{Val: "earlier"}, &StringLiteral{Val: "zero"}}, exp: []*rawQueryMapOutput{{10 * int64(time.Second), 0.0}}},
+	}
+
+	for _, test := range tests {
+		c := &Call{Name: "derivative", Args: append([]Expr{&VarRef{Val: "value"}}, test.args...)}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if got := reduceFunc(single); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: wrong result. exp %v got %v", c, test.exp, got)
+		}
+
+		// intervals without points emit nothing either way
+		if got := reduceFunc([]interface{}{nil}); got != nil {
+			t.Errorf("%s: expected nil for an empty interval, got %v", c, got)
+		}
+	}
+
+	// an interval with more than one point is unaffected
+	c := &Call{Name: "derivative", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "zero"}}}
+	reduceFunc, _ := InitializeReduceFunc(c)
+	got := reduceFunc([]interface{}{[]*rawQueryMapOutput{{int64(time.Second), 1.0}, {3 * int64(time.Second), 5.0}}})
+	if exp := []*rawQueryMapOutput{{3 * int64(time.Second), 2.0}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("wrong derivative. exp %v got %v", exp, got)
+	}
+}
+
+// Ensure timestamps going backwards, within a mapper or across mappers, don't produce negative time deltas.
+func TestReduceDerivativeBackwardTime(t *testing.T) {
+	s := int64(time.Second)
+	// a counter rising 10 per second, yielded out of order with a duplicate point
+	m1 := []point{{0, 3 * s, 30.0}, {0, 1 * s, 10.0}, {0, 5 * s, 50.0}}
+	m2 := []point{{0, 4 * s, 40.0}, {0, 2 * s, 20.0}, {0, 2 * s, 20.0}}
+
+	for _, call := range []string{"derivative(value)", "derivative(value, 'earlier')", "derivative(value, 'zero')"} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		got := reduceFunc([]interface{}{mapFunc(&testIterator{values: m1}), mapFunc(&testIterator{values: m2})})
+		results, ok := got.([]*rawQueryMapOutput)
+		if !ok || len(results) != 4 {
+			t.Fatalf("%s: expected 4 rates. got %v", c, got)
+		}
+		for i, r := range results {
+			if r.Values != 10.0 {
+				t.Errorf("%s: rate %d: exp 10 got %v", c, i, r.Values)
+			}
+			if i > 0 && r.Timestamp <= results[i-1].Timestamp {
+				t.Errorf("%s: rate %d: timestamp %d doesn't follow %d", c, i, r.Timestamp, results[i-1].Timestamp)
+			}
+		}
+	}
+
+	// aggregates of the derivative see the same rates
+	c := &Call{Name: "min", Args: []Expr{&Call{Name: "derivative", Args: []Expr{&VarRef{Val: "value"}}}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reduceFunc([]interface{}{mapFunc(&testIterator{values: m1}), mapFunc(&testIterator{values: m2})}); got != 10.0 {
+		t.Errorf("%s: exp 10 got %v", c, got)
+	}
+}
+
+func TestReduceStddevIdenticalValues(t *testing.T) {
+	var points []point
+	var floats []float64
+	for i := 0; i < 1000; i++ {
+		points = append(points, point{0, int64(i + 1), 0.1})
+		floats = append(floats, 0.1)
+	}
+
+	if got := ReduceStddev([]interface{}{floats[:500], floats[500:]}); got != 0.0 {
+		t.Errorf("two pass stddev: exp 0 got %v", got)
+	}
+	m1 := MapStddevOnePass(&testIterator{values: points[:300]})
+	m2 := MapStddevOnePass(&testIterator{values: points[300:]})
+	if got := ReduceStddevOnePass([]interface{}{m1, m2}); got != 0.0 {
+		t.Errorf("one pass stddev: exp 0 got %v", got)
+	}
+	if got := ReduceSpread([]interface{}{MapSpread(&testIterator{values: points})}); got != 0.0 {
+		t.Errorf("spread: exp 0 got %v", got)
+	}
+
+	// residuals within rounding error of the mean snap to 0, larger variances don't
+	if got := snapVariance(1e-33, 0.1); got != 0 {
+		t.Errorf("expected rounding residual to snap to 0, got %v", got)
+	}
+	if got := snapVariance(1e-20, 0.1); got != 1e-20 {
+		t.Errorf("expected variance to be kept, got %v", got)
+	}
+}
+
+func TestMapExcludeFlagged(t *testing.T) {
+	fields := func(value float64, bad interface{}) map[string]interface{} {
+		m := map[string]interface{}{"value": value}
+		if bad != nil {
+			m["bad"] = bad
+		}
+		return m
+	}
+	points := []point{
+		{0, 1, fields(1, false)},
+		{0, 2, fields(100, true)},
+		{0, 3, fields(2, nil)},
+		{0, 4, map[string]interface{}{"bad": false}},
+		{0, 5, fields(4, false)},
+	}
+
+	tests := []struct {
+		c   *Call
+		exp interface{}
+	}{
+		{c: &Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}, &VarRef{Val: "bad"}}}, exp: 7.0},
+		{c: &Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 2}, &VarRef{Val: "bad"}}}, exp: 14.0},
+		{c: &Call{Name: "mean", Args: []Expr{&VarRef{Val: "value"}, &VarRef{Val: "bad"}}}, exp: 7.0 / 3},
+	}
+
+	for _, test := range tests {
+		if f := FlagField(test.c); f != "bad" {
+			t.Errorf("%s: expected flag field bad, got %q", test.c, f)
+		}
+		mapFunc, err := InitializeMapFunc(test.c)
+		if err != nil {
+			t.Fatalf("%s: %s", test.c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(test.c)
+		if err != nil {
+			t.Fatalf("%s: %s", test.c, err)
+		}
+		if got := reduceFunc([]interface{}{mapFunc(&testIterator{values: points})}); got != test.exp {
+			t.Errorf("%s: wrong result. exp %v got %v", test.c, test.exp, got)
+		}
+	}
+
+	// only sum() and mean() take a flag field, and only one
+	for _, c := range []*Call{
+		{Name: "max", Args: []Expr{&VarRef{Val: "value"}, &VarRef{Val: "bad"}}},
+		{Name: "sum", Args: []Expr{&VarRef{Val: "value"}, &VarRef{Val: "bad"}, &VarRef{Val: "worse"}}},
+	} {
+		if _, err := InitializeMapFunc(c); err == nil {
+			t.Errorf("%s: expected error", c)
+		}
+	}
+	if f := FlagField(&Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}}}); f != "" {
+		t.Errorf("expected no flag field, got %q", f)
+	}
+}
+
+func TestRunningMedian(t *testing.T) {
+	m := NewRunningMedian()
+	if got := m.Median(); got != nil {
+		t.Errorf("expected nil median with no values, got %v", got)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var values []float64
+	for i := 0; i < 500; i++ {
+		// include duplicates and negative values
+		v := float64(rnd.Intn(200) - 100)
+		m.Push(v)
+		values = append(values, v)
+
+		// ReduceMedian partially sorts its input in place, so give it a copy
+		exp := ReduceMedian([]interface{}{append([]float64(nil), values...)})
+		if got := m.Median(); got != exp {
+			t.Fatalf("median mismatch after %d values. exp %v got %v", len(values), exp, got)
+		}
+	}
+
+	// as a reducer it keeps the values of previous calls
+	m = NewRunningMedian()
+	m.Reduce([]interface{}{[]float64{1, 9}, nil})
+	if got := m.Reduce([]interface{}{[]float64{5, 7}}); got != 6.0 {
+		t.Errorf("expected median 6, got %v", got)
+	}
+}
+
+// errIterator yields its points and then fails with err.
+type errIterator struct {
+	testIterator
+	err error
+}
+
+func (e *errIterator) Err() error {
+	if len(e.values) == 0 {
+		return e.err
+	}
+	return nil
+}
+
+func TestMapIteratorError(t *testing.T) {
+	readErr := errors.New("read failed")
+	// a call for every mapper
+	for _, expr := range []string{
+		`count(value)`, `count(value, 'group_hour_of_day')`, `count(value, value % 2)`,
+		`sum(value)`, `sum(value, 'strict')`, `sum(value, 'exact')`, `sum(value, 'compensated')`, `sum(value, 7d)`,
+		`mean(value)`, `mean(value, 'series')`, `mean(value, 'strict')`, `mean(value, 'debug')`, `mean(value, 'coverage')`,
+		`min(value)`, `max(value)`, `min(value, 'time')`, `max(value, 'time')`, `min(value, 'point')`,
+		`median(value)`, `median(value, 'time')`, `spread(value)`, `variance(value)`, `stddev(value)`,
+		`stddev(value, 'one_pass')`, `all_min(value)`, `all_max(value)`, `mean_weighted(value, weight)`,
+		`ratio(value, other)`, `log_mean(value)`, `sum_of_squares(value)`, `rms(value)`, `geometric_mean(value)`,
+		`skewness(value)`, `harmonic_mean(value)`, `log_stddev(value)`, `first(value)`, `last(value)`,
+		`first(value, 'point')`, `percentile(value, 50)`, `percentile(value, 50, 'time')`,
+		`percentile(value, 50, 'dedupe')`, `percentile(value, 50, 'coverage')`, `percentile_approx(value, 50)`,
+		`percentiles(value, 50, 90)`, `top(value, 2)`, `top(value, other, 2)`, `mode(value)`, `mode(value, 'nulls')`,
+		`top_frequent(value, 2)`, `series_count(value)`, `distinct(value)`, `distinct(value, 'nulls')`,
+		`distinct_changes(value)`, `derivative(value)`, `count_distinct(value)`, `count_distinct(value, 'approx')`,
+		`count_distinct(value, 'ignore_case')`, `histogram(value, 10)`, `sample(value, 2)`,
+	} {
+		c, err := ParseExpr(expr)
+		if err != nil {
+			t.Fatalf("%s: %s", expr, err)
+		}
+		mapFunc, err := InitializeMapFunc(c.(*Call))
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		itr := &errIterator{testIterator: testIterator{values: []point{{0, 1, 1.0}, {0, 2, 2.0}}}, err: readErr}
+		if got := mapFunc(itr); got != readErr {
+			t.Errorf("%s: expected the read error, got %v", c, got)
+		}
+
+		itr = &errIterator{testIterator: testIterator{values: []point{{0, 1, 1.0}, {0, 2, 2.0}}}}
+		if _, ok := mapFunc(itr).(error); ok {
+			t.Errorf("%s: unexpected error", c)
+		}
+	}
+
+	// partials are mapped for downsampling, and raw points for raw queries, rather than by a call
+	for name, mapFunc := range map[string]MapFunc{
+		"partial": MapPartial, "raw": MapRawQuery, "raw first": MapRawQueryFirst, "raw last": MapRawQueryLast,
+	} {
+		itr := &errIterator{testIterator: testIterator{values: []point{{0, 1, 1.0}, {0, 2, 2.0}}}, err: readErr}
+		if name == "raw first" {
+			itr.values = nil
+		}
+		if got := mapFunc(itr); got != readErr {
+			t.Errorf("%s: expected the read error, got %v", name, got)
+		}
+	}
+
+	// min() stops at the first value of a sorted iterator, so only an error before it is surfaced
+	for name, mapFunc := range map[string]MapFunc{"min": MapMin, "max": MapMax} {
+		itr := &sortedErrIterator{errIterator{testIterator: testIterator{values: []point{{0, 1, 1.0}}}, err: readErr}}
+		if name == "min" {
+			itr.values = nil
+		}
+		if got := mapFunc(itr); got != readErr {
+			t.Errorf("sorted %s: expected the read error, got %v", name, got)
+		}
+	}
+}
+
+// Ensure the reducers of raw and time ordered points pass on the error of a mapper that failed.
+func TestReduceMapperError(t *testing.T) {
+	readErr := errors.New("read failed")
+	values := []interface{}{[]*rawQueryMapOutput{{1, 1.0}, {2, 3.0}}, readErr}
+	limited, err := LimitRawQuery(ReduceRawQuery(false), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, reduceFunc := range map[string]ReduceFunc{
+		"raw": ReduceRawQuery(false), "raw desc": ReduceRawQuery(true), "limited raw": limited,
+		"derivative": ReduceDerivative(LaterTimestamp, 0), "all_min": ReduceAllMin, "all_max": ReduceAllMax,
+	} {
+		if got := reduceFunc(values); got != readErr {
+			t.Errorf("%s: expected the read error, got %v", name, got)
+		}
+	}
+}
+
+// sortedErrIterator is an errIterator known to yield values in ascending order.
+type sortedErrIterator struct {
+	errIterator
+}
+
+func (s *sortedErrIterator) Sorted() bool { return true }
+
+// orderedIterator is a testIterator known to yield points in time order. It counts calls to Next.
+type orderedIterator struct {
+	testIterator
+	nexts int
+}
+
+func (o *orderedIterator) Ordered() bool { return true }
+
+func (o *orderedIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	o.nexts++
+	return o.testIterator.Next()
+}
+
+func orderedPoints(n int) []point {
+	points := make([]point, n)
+	for i := range points {
+		points[i] = point{0, int64(i + 1), float64(i)}
+	}
+	return points
+}
+
+func TestMapFirstLastOrdered(t *testing.T) {
+	itr := &orderedIterator{testIterator: testIterator{values: orderedPoints(100)}}
+	if got, exp := MapFirst(itr), (firstLastMapOutput{Time: 1, Val: 0.0}); got != exp {
+		t.Errorf("wrong first. exp %v got %v", exp, got)
+	}
+	// the second point is read to check it doesn't share the earliest time
+	if itr.nexts != 2 {
+		t.Errorf("expected first to stop after two points, read %d", itr.nexts)
+	}
+
+	itr = &orderedIterator{testIterator: testIterator{values: orderedPoints(100)}}
+	if got, exp := MapLast(itr), (firstLastMapOutput{Time: 100, Val: 99.0}); got != exp {
+		t.Errorf("wrong last. exp %v got %v", exp, got)
+	}
+
+	for _, fn := range []MapFunc{MapFirst, MapLast} {
+		if got := fn(&orderedIterator{}); got != nil {
+			t.Errorf("expected nil for no points, got %v", got)
+		}
+	}
+}
+
+// Ensure selectors return nil for an interval whose points all have nil values, like for an empty interval,
+// and skip nil values otherwise.
+func TestSelectorsNilValues(t *testing.T) {
+	nils := []point{{0, 1, nil}, {0, 2, nil}}
+	mixed := []point{{0, 3, nil}, {0, 4, 2.0}, {0, 5, 5.0}, {0, 6, nil}}
+
+	tests := []struct {
+		name     string
+		mapFn    MapFunc
+		reduceFn ReduceFunc
+		exp      interface{}
+	}{
+		{"first", MapFirst, ReduceFirst, 2.0},
+		{"last", MapLast, ReduceLast, 5.0},
+		{"min", MapMin, ReduceMin, 2.0},
+		{"max", MapMax, ReduceMax, 5.0},
+	}
+
+	for _, test := range tests {
+		for _, ordered := range []bool{false, true} {
+			itr := func(points []point) Iterator {
+				if ordered {
+					return &orderedIterator{testIterator: testIterator{values: points}}
+				}
+				return &testIterator{values: points}
+			}
+
+			if got := test.mapFn(itr(nils)); got != nil {
+				t.Errorf("%s: ordered %v: expected nil for nil values, got %v", test.name, ordered, got)
+			}
+			if got := test.reduceFn([]interface{}{test.mapFn(itr(nils))}); got != nil {
+				t.Errorf("%s: ordered %v: expected nil result for nil values, got %v", test.name, ordered, got)
+			}
+
+			// a mapper with only nil values doesn't hide the values of another
+			got := test.reduceFn([]interface{}{test.mapFn(itr(nils)), test.mapFn(itr(mixed))})
+			if got != test.exp {
+				t.Errorf("%s: ordered %v: exp %v got %v", test.name, ordered, test.exp, got)
+			}
+		}
+	}
+}
+
+func BenchmarkMapFirst(b *testing.B) {
+	points := orderedPoints(1000)
+	for i := 0; i < b.N; i++ {
+		MapFirst(&testIterator{values: points})
+	}
+}
+
+func BenchmarkMapFirstOrdered(b *testing.B) {
+	points := orderedPoints(1000)
+	for i := 0; i < b.N; i++ {
+		MapFirst(&orderedIterator{testIterator: testIterator{values: points}})
+	}
+}
+
+func TestReduceExactSumMean(t *testing.T) {
+	var points []point
+	for i := 0; i < 10; i++ {
+		points = append(points, point{0, int64(i + 1), 0.1})
+	}
+	points = append(points, point{0, 11, int64(2)})
+
+	if got := ReduceSum([]interface{}{MapSum(&testIterator{values: points[:10]})}); got == 1.0 {
+		t.Fatalf("expected float sum to accumulate rounding error")
+	}
+
+	tests := []struct {
+		name string
+		exp  float64
+	}{
+		{name: "sum", exp: 3},
+		{name: "mean", exp: 3.0 / 11},
+	}
+	for _, test := range tests {
+		c := &Call{Name: test.name, Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "exact"}}}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		// half the points come from a remote mapper
+		b, err := json.Marshal(mapFunc(&testIterator{values: points[5:]}))
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		remote, err := unmarshal(b)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		if got := reduceFunc([]interface{}{mapFunc(&testIterator{values: points[:5]}), remote}); got != test.exp {
+			t.Errorf("%s: wrong result. exp %v got %v", c, test.exp, got)
+		}
+	}
+
+	// 'exact' and 'strict' are mutually exclusive
+	c := &Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "exact"}, &StringLiteral{Val: "strict"}}}
+	if _, err := InitializeMapFunc(c); err == nil {
+		t.Errorf("%s: expected error", c)
+	}
+}
+
+func TestReduceDecayed(t *testing.T) {
+	hour := int64(time.Hour)
+	// a spike three hours before the latest point counts for less than the same spike an hour before it
+	older := []point{{0, 1 * hour, 10.0}, {0, 3 * hour, 1.0}, {0, 4 * hour, 1.0}}
+	recent := []point{{0, 1 * hour, 1.0}, {0, 3 * hour, 10.0}, {0, 4 * hour, 1.0}}
+
+	tests := []struct {
+		call  string
+		older interface{}
+		newer interface{}
+	}{
+		{call: "sum(value, 1h)", older: 10.0*0.125 + 1.0*0.5 + 1.0, newer: 1.0*0.125 + 10.0*0.5 + 1.0},
+		{call: "mean(value, 1h)", older: (10.0*0.125 + 1.0*0.5 + 1.0) / 1.625, newer: (1.0*0.125 + 10.0*0.5 + 1.0) / 1.625},
+		{call: "percentile(value, 75, 1h)", older: 1.0, newer: 10.0},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		got := reduceFunc([]interface{}{mapFunc(&testIterator{values: older})})
+		if math.Abs(got.(float64)-test.older.(float64)) > 1e-9 {
+			t.Errorf("%s: wrong result for older spike. exp %v got %v", c, test.older, got)
+		}
+		got = reduceFunc([]interface{}{mapFunc(&testIterator{values: recent[:2]}), mapFunc(&testIterator{values: recent[2:]})})
+		if math.Abs(got.(float64)-test.newer.(float64)) > 1e-9 {
+			t.Errorf("%s: wrong result for recent spike. exp %v got %v", c, test.newer, got)
+		}
+	}
+
+	for _, call := range []string{"sum(value, 0s)", "mean(value, 1h, 2h)", "mean(value, 1h, 'strict')", "max(value, 1h)", "percentile(value, 50, 0s)"} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeReduceFunc(expr.(*Call)); err == nil {
+			t.Errorf("%s: expected error", call)
+		}
+	}
+}
+
+// benchmarkFloats returns n points with float64 values.
+func benchmarkFloats(n int) []point {
+	points := make([]point, n)
+	for i := range points {
+		points[i] = point{0, int64(i + 1), float64(i%1013) * 1.5}
+	}
+	return points
+}
+
+// benchmarkInts returns n points with int64 values.
+func benchmarkInts(n int) []point {
+	points := make([]point, n)
+	for i := range points {
+		points[i] = point{0, int64(i + 1), int64(i % 1013)}
+	}
+	return points
+}
+
+func benchmarkMap(b *testing.B, fn MapFunc, points []point) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn(&testIterator{values: points})
+	}
+}
+
+// benchmarkReduce reduces the outputs of mapping the points in chunks of 1000, as if from that many intervals
+// or mappers.
+func benchmarkReduce(b *testing.B, mapFn MapFunc, reduceFn ReduceFunc, points []point) {
+	var outputs []interface{}
+	for i := 0; i < len(points); i += 1000 {
+		j := i + 1000
+		if j > len(points) {
+			j = len(points)
+		}
+		outputs = append(outputs, mapFn(&testIterator{values: points[i:j]}))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reduceFn(outputs)
+	}
+}
+
+func BenchmarkMapCount1000(b *testing.B)   { benchmarkMap(b, MapCount, benchmarkFloats(1000)) }
+func BenchmarkMapCount100000(b *testing.B) { benchmarkMap(b, MapCount, benchmarkFloats(100000)) }
+
+func BenchmarkMapSum1000(b *testing.B)   { benchmarkMap(b, MapSum, benchmarkFloats(1000)) }
+func BenchmarkMapSum100000(b *testing.B) { benchmarkMap(b, MapSum, benchmarkFloats(100000)) }
+
+func BenchmarkMapSumInt1000(b *testing.B)   { benchmarkMap(b, MapSumStrict, benchmarkInts(1000)) }
+func BenchmarkMapSumInt100000(b *testing.B) { benchmarkMap(b, MapSumStrict, benchmarkInts(100000)) }
+
+func BenchmarkMapMean1000(b *testing.B)   { benchmarkMap(b, MapMean, benchmarkFloats(1000)) }
+func BenchmarkMapMean100000(b *testing.B) { benchmarkMap(b, MapMean, benchmarkFloats(100000)) }
+
+func BenchmarkMapMeanInt1000(b *testing.B)   { benchmarkMap(b, MapMeanStrict, benchmarkInts(1000)) }
+func BenchmarkMapMeanInt100000(b *testing.B) { benchmarkMap(b, MapMeanStrict, benchmarkInts(100000)) }
+
+// the reduce benchmarks over 1000 points reduce the output of a single mapper, as for a single shard
+func BenchmarkReduceSum1000(b *testing.B) {
+	benchmarkReduce(b, MapSum, ReduceSum, benchmarkFloats(1000))
+}
+
+func BenchmarkReduceSum100000(b *testing.B) {
+	benchmarkReduce(b, MapSum, ReduceSum, benchmarkFloats(100000))
+}
+
+func BenchmarkReduceMin1000(b *testing.B) {
+	benchmarkReduce(b, MapMin, ReduceMin, benchmarkFloats(1000))
+}
+
+func BenchmarkReduceMax1000(b *testing.B) {
+	benchmarkReduce(b, MapMax, ReduceMax, benchmarkFloats(1000))
+}
+
+func BenchmarkReduceMean1000(b *testing.B) {
+	benchmarkReduce(b, MapMean, ReduceMean, benchmarkFloats(1000))
+}
+
+func BenchmarkReduceMean100000(b *testing.B) {
+	benchmarkReduce(b, MapMean, ReduceMean, benchmarkFloats(100000))
+}
+
+func BenchmarkReduceMedian1000(b *testing.B) {
+	benchmarkReduce(b, MapStddev, ReduceMedian, benchmarkFloats(1000))
+}
+
+func BenchmarkReduceMedian100000(b *testing.B) {
+	benchmarkReduce(b, MapStddev, ReduceMedian, benchmarkFloats(100000))
+}
+
+func BenchmarkReducePercentile1000(b *testing.B) {
+	benchmarkReduce(b, MapEcho, ReducePercentile(90), benchmarkFloats(1000))
+}
+
+func BenchmarkReducePercentile100000(b *testing.B) {
+	benchmarkReduce(b, MapEcho, ReducePercentile(90), benchmarkFloats(100000))
+}
+
+// Ensure the core map functions don't allocate per point, so regressions show up as test failures rather than
+// only in benchmark results.
+func TestMapAllocs(t *testing.T) {
+	tests := []struct {
+		name   string
+		fn     MapFunc
+		points []point
+		max    float64
+	}{
+		{name: "MapCount", fn: MapCount, points: benchmarkFloats(1000), max: 1},
+		{name: "MapSum", fn: MapSum, points: benchmarkFloats(1000), max: 1},
+		{name: "MapSumStrict", fn: MapSumStrict, points: benchmarkInts(1000), max: 1},
+		{name: "MapMean", fn: MapMean, points: benchmarkFloats(1000), max: 1},
+		{name: "MapMeanStrict", fn: MapMeanStrict, points: benchmarkInts(1000), max: 1},
+	}
+
+	for _, test := range tests {
+		itr := &testIterator{}
+		allocs := testing.AllocsPerRun(10, func() {
+			itr.values = test.points
+			test.fn(itr)
+		})
+		if allocs > test.max {
+			t.Errorf("%s: expected at most %v allocations, got %v", test.name, test.max, allocs)
+		}
+	}
+}
+
+func TestReduceTransformedDerivative(t *testing.T) {
+	// an accelerating counter at t^2 has a rate of 2t+1 between consecutive seconds
+	interval := func(start int) []point {
+		var points []point
+		for i := start; i < start+10; i++ {
+			points = append(points, point{0, int64(i+1) * int64(time.Second), float64(i * i)})
+		}
+		return points
+	}
+
+	tests := []struct {
+		call string
+		exp  []float64
+	}{
+		{call: "max(derivative(value))", exp: []float64{17, 37}},
+		{call: "min(derivative(value))", exp: []float64{1, 21}},
+		{call: "mean(derivative(value))", exp: []float64{9, 29}},
+		{call: "spread(derivative(value))", exp: []float64{16, 16}},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		for i, exp := range test.exp {
+			points := interval(i * 10)
+			got := reduceFunc([]interface{}{
+				mapFunc(&testIterator{values: points[:5]}),
+				mapFunc(&testIterator{values: points[5:]}),
+			})
+			if got != exp {
+				t.Errorf("%s: interval %d: exp %v got %v", c, i, exp, got)
+			}
+		}
+	}
+
+	for _, call := range []string{"sum(derivative(value))", "max(derivative(value), 2)"} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeMapFunc(expr.(*Call)); err == nil {
+			t.Errorf("%s: expected error", call)
+		}
+	}
+}
+
+func TestReducePercentileMedianNaN(t *testing.T) {
+	nan := math.NaN()
+	echo := []interface{}{[]interface{}{nan, 5.0, 1.0, nan}, []interface{}{4.0, nan, 2.0, 3.0}}
+
+	if got := ReducePercentile(50)(echo); got != 3.0 {
+		t.Errorf("wrong percentile. exp 3 got %v", got)
+	}
+	if got := ReducePercentile(100)(echo); got != 5.0 {
+		t.Errorf("wrong percentile. exp 5 got %v", got)
+	}
+	if got := ReducePercentileInterpolated(25)(echo); got != 2.0 {
+		t.Errorf("wrong interpolated percentile. exp 2 got %v", got)
+	}
+	if got := ReduceMedian([]interface{}{[]float64{nan, 4, 1}, []float64{3, nan, 2}}); got != 2.5 {
+		t.Errorf("wrong median. exp 2.5 got %v", got)
+	}
+	if got := ReduceMedian([]interface{}{[]float64{nan, nan}}); got != nil {
+		t.Errorf("expected nil median for only NaN values. got %v", got)
+	}
+}
+
+func TestReduceFiniteOverflow(t *testing.T) {
+	c := &Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "debug"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []interface{}{
+		mapFunc(&testIterator{values: []point{{1, 1, 1e308}}}),
+		nil,
+		mapFunc(&testIterator{values: []point{{2, 2, 1e308}}}),
+		mapFunc(&testIterator{values: []point{{3, 3, -1e308}}}),
+	}
+	got := reduceFunc(values)
+	err, ok := got.(error)
+	if !ok {
+		t.Fatalf("expected an error. got %v", got)
+	}
+	if exp := "result overflowed to +Inf after combining partial 3 of 4"; err.Error() != exp {
+		t.Errorf("wrong error. exp %q got %q", exp, err)
+	}
+
+	// without overflow the result is unchanged
+	if got := reduceFunc(values[:2]); got != 1e308 {
+		t.Errorf("wrong sum. exp 1e308 got %v", got)
+	}
+
+	// the partials are reduced once, and again only to find the partial that overflowed
+	var calls int
+	counted := ReduceFinite(func(values []interface{}) interface{} {
+		calls++
+		return ReduceSum(values)
+	})
+	many := make([]interface{}, 1000)
+	for i := range many {
+		many[i] = 1.0
+	}
+	many[700], many[800] = math.MaxFloat64, math.MaxFloat64
+	if got := counted(many[:500]); got != 500.0 || calls != 1 {
+		t.Errorf("exp 500 in a single reduce, got %v in %d", got, calls)
+	}
+	calls = 0
+	if err, ok := counted(many).(error); !ok || err.Error() != "result overflowed to +Inf after combining partial 801 of 1000" {
+		t.Errorf("wrong error: %v", err)
+	} else if calls > 20 {
+		t.Errorf("expected a binary search for the partial, reduced %d times", calls)
+	}
+}
+
+func TestReduceTopBottomTieBreak(t *testing.T) {
+	fields := func(a, b float64) map[string]interface{} { return map[string]interface{}{"a": a, "b": b} }
+	m1 := []point{{0, 1, fields(5, 1)}, {0, 2, fields(4, 9)}, {0, 3, fields(2, 7)}}
+	m2 := []point{{0, 4, fields(5, 3)}, {0, 5, fields(2, 1)}, {0, 6, map[string]interface{}{"a": 9.0}}}
+
+	tests := []struct {
+		call string
+		exp  []topBottomPair
+	}{
+		{call: "top(a, b, 2)", exp: []topBottomPair{{5, 3}, {5, 1}}},
+		{call: "top(a, b, 1)", exp: []topBottomPair{{5, 3}}},
+		{call: "bottom(a, b, 2)", exp: []topBottomPair{{2, 1}, {2, 7}}},
+		{call: "bottom(a, b, 3, 'distinct')", exp: []topBottomPair{{2, 1}, {2, 7}, {4, 9}}},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		if !MultiFieldCall(c) {
+			t.Errorf("%s: expected a multi field call", c)
+		}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		got := reduceFunc([]interface{}{mapFunc(&testIterator{values: m1}), mapFunc(&testIterator{values: m2})})
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: exp %v got %v", c, test.exp, got)
+		}
+	}
+
+	if MultiFieldCall(&Call{Name: "top", Args: []Expr{&VarRef{Val: "a"}, &NumberLiteral{Val: 2}}}) {
+		t.Error("expected top(a, 2) to read a single field")
+	}
+}
+
+// Ensure points at the Unix epoch don't end iteration early.
+func TestMapEpochTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   MapFunc
+		exp  interface{}
+	}{
+		{name: "MapCount", fn: MapCount, exp: int64(3)},
+		{name: "MapSum", fn: MapSum, exp: 6.0},
+		{name: "MapMean", fn: MapMean, exp: &MeanMapOutput{Count: 3, Mean: 2, Version: PartialVersion}},
+		{name: "MapMin", fn: MapMin, exp: 1.0},
+		{name: "MapMax", fn: MapMax, exp: 3.0},
+		{name: "MapSpread", fn: MapSpread, exp: spreadMapOutput{Min: 1, Max: 3, Version: PartialVersion}},
+		{name: "MapStddev", fn: MapStddev, exp: []float64{1, 2, 3}},
+		{name: "MapFirst", fn: MapFirst, exp: firstLastMapOutput{Time: -5, Val: 1.0}},
+		{name: "MapLast", fn: MapLast, exp: firstLastMapOutput{Time: 5, Val: 3.0}},
+		{name: "MapEcho", fn: MapEcho, exp: []interface{}{1.0, 2.0, 3.0}},
+		{name: "MapRawQuery", fn: MapRawQuery, exp: []*rawQueryMapOutput{{-5, 1.0}, {0, 2.0}, {5, 3.0}}},
+	}
+
+	for _, test := range tests {
+		// a point at the epoch in the middle of the interval
+		middle := []point{{0, -5, 1.0}, {0, 0, 2.0}, {0, 5, 3.0}}
+		if got := test.fn(&testIterator{values: middle}); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: epoch point in the middle: exp %v got %v", test.name, test.exp, got)
+		}
+	}
+
+	// a point at the epoch at the end of the interval
+	end := []point{{0, -10, 1.0}, {0, -5, 2.0}, {0, 0, 3.0}}
+	if got := MapCount(&testIterator{values: end}); got != int64(3) {
+		t.Errorf("MapCount: epoch point at the end: exp 3 got %v", got)
+	}
+	if got, exp := MapLast(&testIterator{values: end}), (firstLastMapOutput{Time: 0, Val: 3.0}); got != exp {
+		t.Errorf("MapLast: epoch point at the end: exp %v got %v", exp, got)
+	}
+	if got := MapFirst(&testIterator{values: []point{{0, 0, 1.0}}}); got != (firstLastMapOutput{Time: 0, Val: 1.0}) {
+		t.Errorf("MapFirst: single epoch point: got %v", got)
+	}
+	ordered := &orderedIterator{testIterator: testIterator{values: []point{{0, 0, 1.0}}}}
+	if got := MapLast(ordered); got != (firstLastMapOutput{Time: 0, Val: 1.0}) {
+		t.Errorf("MapLast: single epoch point on an ordered iterator: got %v", got)
+	}
+}
+
+func TestReduceByBucketExpr(t *testing.T) {
+	m1 := []point{{0, 1, 1.0}, {0, 2, 2.0}, {0, 3, 3.0}, {0, 4, 4.0}}
+	m2 := []point{{0, 5, 5.0}, {0, 6, 6.0}, {0, 7, 7.0}}
+
+	tests := []struct {
+		call string
+		exp  []*bucketOutput
+	}{
+		{call: "sum(value, value % 3)", exp: []*bucketOutput{{0, 9.0}, {1, 12.0}, {2, 7.0}}},
+		{call: "count(value, value % 3)", exp: []*bucketOutput{{0, 2.0}, {1, 3.0}, {2, 2.0}}},
+		{call: "mean(value, value % 3)", exp: []*bucketOutput{{0, 4.5}, {1, 4.0}, {2, 3.5}}},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		// the second mapper's output comes from a remote node
+		b, err := json.Marshal(mapFunc(&testIterator{values: m2}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := unmarshal(b)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		got, ok := reduceFunc([]interface{}{mapFunc(&testIterator{values: m1}), remote}).([]*bucketOutput)
+		if !ok || len(got) != len(test.exp) {
+			t.Fatalf("%s: exp %d buckets got %v", c, len(test.exp), got)
+		}
+		for i, o := range got {
+			v, _ := toFloat64(o.Value)
+			if exp := test.exp[i]; o.Bucket != exp.Bucket || math.Abs(v-exp.Value.(float64)) > 1e-9 {
+				t.Errorf("%s: exp bucket %d = %v got %d = %v", c, exp.Bucket, exp.Value, o.Bucket, o.Value)
+			}
+		}
+	}
+
+	expr, _ := ParseExpr("sum(value, value % 3, 'group_hour_of_day')")
+	if _, err := InitializeMapFunc(expr.(*Call)); err == nil {
+		t.Error("expected an error grouping by both a time component and a bucket expression")
+	}
+}
+
+func TestUnmarshalPercentile(t *testing.T) {
+	for _, args := range [][]Expr{
+		{&VarRef{Val: "value"}, &NumberLiteral{Val: 50}},
+		{&VarRef{Val: "value"}, &NumberLiteral{Val: 50}, &StringLiteral{Val: "linear"}},
+	} {
+		c := &Call{Name: "percentile", Args: args}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var values []interface{}
+		for _, points := range [][]point{{{0, 1, 3.0}, {0, 2, 1.0}}, {{0, 3, 2.0}}, nil} {
+			b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := unmarshal(b)
+			if err != nil {
+				t.Fatalf("%s: %s", c, err)
+			}
+			values = append(values, v)
+		}
+
+		if got := reduceFunc(values); got != 2.0 {
+			t.Errorf("%s: exp 2 got %v", c, got)
+		}
+	}
+}
+
+func TestReduceSelectPoint(t *testing.T) {
+	fields := func(value, other float64, host string) map[string]interface{} {
+		return map[string]interface{}{"value": value, "other": other, "host": host}
+	}
+	m1 := []point{{0, 2, fields(3, 30, "a")}, {0, 4, fields(9, 90, "b")}, {0, 5, map[string]interface{}{"other": 1.0}}}
+	m2 := []point{{0, 1, fields(5, 50, "c")}, {0, 3, fields(1, 10, "d")}, {0, 6, fields(9, 91, "e")}}
+
+	tests := []struct {
+		call string
+		exp  *Point
+	}{
+		{call: "first(value, 'point')", exp: &Point{Timestamp: 1, Values: fields(5, 50, "c")}},
+		{call: "last(value, 'point')", exp: &Point{Timestamp: 6, Values: fields(9, 91, "e")}},
+		{call: "min(value, 'point')", exp: &Point{Timestamp: 3, Values: fields(1, 10, "d")}},
+		{call: "max(value, 'point')", exp: &Point{Timestamp: 4, Values: fields(9, 90, "b")}},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		if !MultiFieldCall(c) {
+			t.Errorf("%s: expected a multi field call", c)
+		}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		outputs := []interface{}{mapFunc(&testIterator{values: m1}), mapFunc(&testIterator{values: m2}), mapFunc(&testIterator{})}
+		if got := reduceFunc(outputs); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: exp %v got %v", c, test.exp, got)
+		}
+
+		// partials from remote mappers keep the companion fields
+		for i, o := range outputs {
+			b, err := json.Marshal(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outputs[i], err = unmarshal(b); err != nil {
+				t.Fatalf("%s: %s", c, err)
+			}
+		}
+		if got := reduceFunc(outputs); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: unmarshalled: exp %v got %v", c, test.exp, got)
+		}
+	}
+
+	// integer fields are compared like floats
+	ints := []point{
+		{0, 1, map[string]interface{}{"value": int64(4), "host": "a"}},
+		{0, 2, map[string]interface{}{"value": int64(7), "host": "b"}},
+		{0, 3, map[string]interface{}{"value": int64(2), "host": "c"}},
+	}
+	for name, exp := range map[string]int64{"min": 3, "max": 2} {
+		c := &Call{Name: name, Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "point"}}}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := reduceFunc([]interface{}{mapFunc(&testIterator{values: ints[:2]}), mapFunc(&testIterator{values: ints[2:]})}).(*Point)
+		if !ok || got.Timestamp != exp {
+			t.Errorf("%s of integers: exp point at %d got %v", c, exp, got)
+		}
+	}
+
+	for _, call := range []string{"first(value, 'foo')", "last(value, 'point', 'point')", "max(value, 'point', 2)", "min(value, 'point', 'series')", "sum(value, 'point')"} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeMapFunc(expr.(*Call)); err == nil {
+			t.Errorf("%s: expected an error", call)
+		}
+	}
+	if MultiFieldCall(&Call{Name: "max", Args: []Expr{&VarRef{Val: "value"}}}) {
+		t.Error("expected max(value) to read a single field")
+	}
+}
+
+// Ensure numeric aggregates accept integer fields and skip values that aren't numeric.
+func TestMapMixedNumeric(t *testing.T) {
+	points := func() *testIterator {
+		return &testIterator{values: []point{
+			{0, 1, int64(4)}, {0, 2, 2.0}, {0, 3, "foo"}, {0, 4, int64(-2)}, {0, 5, true}, {0, 6, 8.0},
+		}}
+	}
+
+	tests := []struct {
+		name string
+		fn   func(Iterator) interface{}
+		exp  interface{}
+	}{
+		{name: "sum", fn: MapSum, exp: 12.0},
+		{name: "mean", fn: func(itr Iterator) interface{} { return ReduceMean([]interface{}{MapMean(itr)}) }, exp: 3.0},
+		{name: "min", fn: MapMin, exp: -2.0},
+		{name: "max", fn: MapMax, exp: 8.0},
+		{name: "spread", fn: func(itr Iterator) interface{} { return ReduceSpread([]interface{}{MapSpread(itr)}) }, exp: 10.0},
+		{name: "stddev", fn: MapStddev, exp: []float64{4, 2, -2, 8}},
+		{name: "stddev one pass", fn: func(itr Iterator) interface{} { return MapStddevOnePass(itr).(*stddevOnePassMapOutput).Mean }, exp: 3.0},
+		{name: "log_stddev", fn: MapLogStddev, exp: []float64{math.Log(4), math.Log(2), math.Log(8)}},
+		{name: "percentile", fn: func(itr Iterator) interface{} { return ReducePercentile(50)([]interface{}{MapEcho(itr)}) }, exp: 2.0},
+		{name: "all_max", fn: func(itr Iterator) interface{} { return len(MapAllMax(itr).([]*rawQueryMapOutput)) }, exp: 1},
+	}
+
+	for _, test := range tests {
+		if got := test.fn(points()); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: exp %v got %v", test.name, test.exp, got)
+		}
+	}
+
+	if got := MapSum(&testIterator{values: []point{{0, 1, "foo"}}}); got != nil {
+		t.Errorf("sum of no numeric values: exp nil got %v", got)
+	}
+}
+
+// Ensure combining many partials of varying magnitude stays close to the exact result.
+func TestReducePairwise(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const n = 20000
+	sums := make([]interface{}, n)
+	means := make([]interface{}, n)
+	variances := make([]interface{}, n)
+	exactSum, exactTotal := new(big.Float).SetPrec(512), new(big.Float).SetPrec(512)
+	var count int64
+	for i := 0; i < n; i++ {
+		v := (rng.Float64() + 1) * math.Pow(10, float64(rng.Intn(16)))
+		c := rng.Intn(100) + 1
+		sums[i] = v
+		means[i] = &MeanMapOutput{Count: c, Mean: v}
+		variances[i] = &stddevOnePassMapOutput{Count: c, Mean: v}
+		exactSum.Add(exactSum, big.NewFloat(v))
+		exactTotal.Add(exactTotal, new(big.Float).Mul(big.NewFloat(v), big.NewFloat(float64(c))))
+		count += int64(c)
+	}
+
+	relErr := func(got float64, exp *big.Float) float64 {
+		diff := new(big.Float).Sub(big.NewFloat(got), exp)
+		d, _ := new(big.Float).Quo(diff, exp).Float64()
+		return math.Abs(d)
+	}
+
+	if e := relErr(ReduceSum(sums).(float64), exactSum); e > 1e-15 {
+		t.Errorf("sum: relative error %g", e)
+	}
+
+	expMean := new(big.Float).SetPrec(512).Quo(exactTotal, new(big.Float).SetInt64(count))
+	if e := relErr(ReduceMean(means).(float64), expMean); e > 1e-14 {
+		t.Errorf("mean: relative error %g", e)
+	}
+	if e := relErr(mergeVariances(toVariances(variances)).Mean, expMean); e > 1e-14 {
+		t.Errorf("variance mean: relative error %g", e)
+	}
+
+	// the variance of the partials around the mean, each contributing Count points at its mean
+	exactM2 := new(big.Float).SetPrec(512)
+	for _, v := range variances {
+		p := v.(*stddevOnePassMapOutput)
+		d := new(big.Float).SetPrec(512).Sub(big.NewFloat(p.Mean), expMean)
+		d.Mul(d, d)
+		exactM2.Add(exactM2, d.Mul(d, big.NewFloat(float64(p.Count))))
+	}
+	if e := relErr(mergeVariances(toVariances(variances)).M2, exactM2); e > 1e-12 {
+		t.Errorf("variance: relative error %g", e)
+	}
+}
+
+func toVariances(values []interface{}) []*stddevOnePassMapOutput {
+	partials := make([]*stddevOnePassMapOutput, len(values))
+	for i, v := range values {
+		partials[i] = v.(*stddevOnePassMapOutput)
+	}
+	return partials
+}
+
+func TestReduceSeriesCount(t *testing.T) {
+	c := &Call{Name: "series_count", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mappers [][]point
+		exp     interface{}
+	}{
+		{
+			name:    "three series",
+			mappers: [][]point{{{1, 1, 1.0}, {2, 2, 1.0}, {1, 3, 2.0}}, {{3, 4, 1.0}}},
+			exp:     3.0,
+		},
+		{
+			name:    "series read by two mappers",
+			mappers: [][]point{{{1, 1, 1.0}, {2, 2, 1.0}}, {{2, 3, 1.0}, {1, 4, 1.0}, {4, 5, 1.0}}},
+			exp:     3.0,
+		},
+		{name: "empty interval", mappers: [][]point{nil, nil}, exp: nil},
+	}
+
+	for _, test := range tests {
+		var outputs []interface{}
+		for _, points := range test.mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, v)
+		}
+		if got := reduceFunc(outputs); got != test.exp {
+			t.Errorf("%s: exp %v got %v", test.name, test.exp, got)
+		}
+	}
+
+	if got := MapSeriesCount(&testIterator{values: []point{{7, 1, 1.0}, {3, 2, 1.0}, {7, 3, 1.0}}}); !reflect.DeepEqual(got, []uint64{3, 7}) {
+		t.Errorf("MapSeriesCount: exp [3 7] got %v", got)
+	}
+}
+
+// Ensure 'coverage' reports the time range of the points an aggregate was computed from, which for a partially
+// filled interval is narrower than the interval.
+func TestReduceWithCoverage(t *testing.T) {
+	s := int64(time.Second)
+	// an interval from 0s to 60s with points only between 10s and 40s
+	mappers := [][]point{{{0, 20 * s, 4.0}, {0, 10 * s, 2.0}}, nil, {{0, 40 * s, 6.0}}}
+
+	tests := []struct {
+		call string
+		exp  interface{}
+	}{
+		{call: "sum(value, 'coverage')", exp: 12.0},
+		{call: "mean(value, 'coverage')", exp: 4.0},
+		{call: "mean(value, 2, 'coverage')", exp: 8.0},
+		{call: "percentile(value, 50, 'coverage')", exp: 4.0},
+		{call: "percentile(value, 100, 'linear', 'coverage')", exp: 6.0},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		var outputs []interface{}
+		for _, points := range mappers {
+			v := mapFunc(&testIterator{values: points})
+			if v == nil {
+				outputs = append(outputs, nil)
+				continue
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, err = unmarshal(b); err != nil {
+				t.Fatalf("%s: %s", c, err)
+			}
+			outputs = append(outputs, v)
+		}
+
+		exp := &coverageOutput{Value: test.exp, MinTime: 10 * s, MaxTime: 40 * s}
+		if got := reduceFunc(outputs); !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: exp %+v got %+v", c, exp, got)
+		}
+		if got := reduceFunc([]interface{}{nil, nil}); got != nil {
+			t.Errorf("%s: expected nil for an empty interval, got %v", c, got)
+		}
+	}
+
+	for _, call := range []string{"min(value, 'coverage')", "mean(value, 'coverage', 'coverage')", "percentile(value, 'coverage')"} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeMapFunc(expr.(*Call)); err == nil {
+			t.Errorf("%s: expected an error", call)
+		}
+	}
+}
+
+func TestReduceDistinct(t *testing.T) {
+	c := &Call{Name: "distinct", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two shards with overlapping values, one of them remote
+	local := mapFunc(&testIterator{values: []point{{0, 1, 3.0}, {0, 2, 1.0}, {0, 3, 3.0}, {0, 4, 2.5}}})
+	if n := len(local.([]interface{})); n != 3 {
+		t.Errorf("expected the mapper to emit 3 unique values, got %d", n)
+	}
+	b, err := json.Marshal(mapFunc(&testIterator{values: []point{{0, 5, 2.5}, {0, 6, 7.0}, {0, 7, 1.0}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []interface{}{1.0, 2.5, 3.0, 7.0}
+	for _, outputs := range [][]interface{}{{local, remote}, {remote, nil, local}} {
+		if got := reduceFunc(outputs); !reflect.DeepEqual(got, exp) {
+			t.Errorf("exp %v got %v", exp, got)
+		}
+	}
+	if got := reduceFunc([]interface{}{nil}); got != nil {
+		t.Errorf("expected nil for an empty interval, got %v", got)
+	}
+}
+
+func TestReducePercentileVerbose(t *testing.T) {
+	values := []interface{}{[]interface{}{4.0, 1.0, 10.0}, nil, []interface{}{2.0, 8.0}}
+
+	tests := []struct {
+		percentile float64
+		exp        *percentileInterpolation
+	}{
+		{percentile: 50, exp: &percentileInterpolation{Value: 4, Lower: 4, Upper: 8}},
+		{percentile: 30, exp: &percentileInterpolation{Value: 2.4, Lower: 2, Upper: 4, Weight: 0.2}},
+		{percentile: 90, exp: &percentileInterpolation{Value: 9.2, Lower: 8, Upper: 10, Weight: 0.6}},
+		{percentile: 100, exp: &percentileInterpolation{Value: 10, Lower: 10, Upper: 10}},
+	}
+
+	for _, test := range tests {
+		c := &Call{Name: "percentile", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: test.percentile}, &StringLiteral{Val: "verbose"}}}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		got, ok := reduceFunc(values).(*percentileInterpolation)
+		if !ok {
+			t.Fatalf("%s: unexpected output %v", c, reduceFunc(values))
+		}
+
+		// the bracketing values and weight reproduce the result, which matches the 'linear' percentile
+		linear := ReducePercentileInterpolated(test.percentile)(values).(float64)
+		if math.Abs(got.Lower+got.Weight*(got.Upper-got.Lower)-got.Value) > 1e-9 || got.Value != linear {
+			t.Errorf("%s: %+v doesn't reproduce %v", c, got, linear)
+		}
+		if math.Abs(got.Value-test.exp.Value) > 1e-9 || got.Lower != test.exp.Lower || got.Upper != test.exp.Upper || math.Abs(got.Weight-test.exp.Weight) > 1e-9 {
+			t.Errorf("%s: exp %+v got %+v", c, test.exp, got)
+		}
+	}
+
+	if got := ReducePercentileVerbose(50)([]interface{}{nil}); got != nil {
+		t.Errorf("expected nil for an empty interval, got %v", got)
+	}
+}
+
+func TestReduceVariance(t *testing.T) {
+	variance := &Call{Name: "variance", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(variance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(variance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(variance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(mapFunc(&testIterator{values: []point{{0, 1, 2.0}, {0, 2, 4.0}, {0, 3, 4.0}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []interface{}{remote, mapFunc(&testIterator{values: []point{{0, 4, 4.0}, {0, 5, 5.0}, {0, 6, 5.0}, {0, 7, 7.0}, {0, 8, 9.0}}})}
+
+	// the sample variance of 2, 4, 4, 4, 5, 5, 7, 9 is 32/7
+	got, ok := reduceFunc(values).(float64)
+	if !ok || math.Abs(got-32.0/7) > 1e-12 {
+		t.Fatalf("exp %v got %v", 32.0/7, reduceFunc(values))
+	}
+	stddev := ReduceStddev(values).(float64)
+	if math.Abs(got-stddev*stddev) > 1e-12 {
+		t.Errorf("variance %v isn't the square of stddev %v", got, stddev)
+	}
+
+	single := []interface{}{mapFunc(&testIterator{values: []point{{0, 1, 2.0}}})}
+	if got := reduceFunc(single); got != nil {
+		t.Errorf("expected nil for a single point, got %v", got)
+	}
+	if got := reduceFunc([]interface{}{nil}); got != nil {
+		t.Errorf("expected nil for an empty interval, got %v", got)
+	}
+}
+
+// Ensure reducing the output of a single mapper gives the same result as reducing it along with empty outputs.
+func TestReduceSingleMapper(t *testing.T) {
+	points := []point{{0, 1, 3.0}, {0, 2, -1.0}, {0, 3, 4.0}}
+	for _, test := range []struct {
+		name     string
+		mapFn    MapFunc
+		reduceFn ReduceFunc
+	}{
+		{"sum", MapSum, ReduceSum},
+		{"sum partial", MapPartial, ReduceSum},
+		{"mean", MapMean, ReduceMean},
+		{"mean partial", MapPartial, ReduceMean},
+		{"min", MapMin, ReduceMin},
+		{"max", MapMax, ReduceMax},
+	} {
+		single := test.reduceFn([]interface{}{test.mapFn(&testIterator{values: points})})
+		exp := test.reduceFn([]interface{}{test.mapFn(&testIterator{values: points}), nil})
+		if single != exp {
+			t.Errorf("%s: exp %v got %v", test.name, exp, single)
+		}
+		if got := test.reduceFn([]interface{}{nil}); got != nil {
+			t.Errorf("%s: expected nil for an empty interval, got %v", test.name, got)
+		}
+	}
+}
+
+func TestReducePopulationStddev(t *testing.T) {
+	// 2, 4, 4, 4, 5, 5, 7, 9 have a mean of 5 and a sum of squared differences of 32
+	values := []interface{}{[]float64{2, 4, 4, 4}, nil, []float64{5, 5, 7, 9}}
+
+	tests := []struct {
+		name   string
+		fn     ReduceFunc
+		exp    float64
+		single interface{}
+	}{
+		{"stddev", ReduceStddev, math.Sqrt(32.0 / 7), nil},
+		{"variance", ReduceVariance, 32.0 / 7, nil},
+		{"stddev_pop", ReducePopulationStddev, 2, 0.0},
+		{"variance_pop", ReducePopulationVariance, 4, 0.0},
+	}
+
+	for _, test := range tests {
+		c := &Call{Name: test.name, Args: []Expr{&VarRef{Val: "value"}}}
+		if _, err := InitializeMapFunc(c); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if _, err := InitializeUnmarshaller(c); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if _, err := InitializeReduceFunc(c); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		if got, ok := test.fn(values).(float64); !ok || math.Abs(got-test.exp) > 1e-12 {
+			t.Errorf("%s: exp %v got %v", test.name, test.exp, test.fn(values))
+		}
+		if got := test.fn([]interface{}{[]float64{3}}); got != test.single {
+			t.Errorf("%s: single point: exp %v got %v", test.name, test.single, got)
+		}
+		if got := test.fn([]interface{}{nil}); got != nil {
+			t.Errorf("%s: expected nil for an empty interval, got %v", test.name, got)
+		}
+	}
+}
+
+// Ensure null values are excluded from distinct(), count_distinct() and mode() unless they're passed 'nulls'.
+func TestNullPolicy(t *testing.T) {
+	mappers := [][]point{
+		{{0, 1, 2.0}, {0, 2, nil}, {0, 3, 1.0}, {0, 4, nil}},
+		{{0, 5, nil}, {0, 6, 2.0}},
+		{{0, 7, nil}},
+	}
+
+	tests := []struct {
+		call string
+		exp  interface{}
+	}{
+		{call: "distinct(value)", exp: []interface{}{1.0, 2.0}},
+		{call: "distinct(value, 'nulls')", exp: []interface{}{1.0, 2.0, nil}},
+		{call: "count_distinct(value)", exp: 2.0},
+		{call: "count_distinct(value, 'nulls')", exp: 3.0},
+		{call: "count_distinct(value, 'values', 'nulls')", exp: &countDistinctOutput{Count: 3, Values: []interface{}{1.0, 2.0, nil}}},
+		{call: "mode(value)", exp: 2.0},
+		{call: "mode(value, 'count')", exp: &modeOutput{Value: 2, Count: 2}},
+		{call: "mode(value, 'nulls')", exp: nil},
+		{call: "mode(value, 'count', 'nulls')", exp: &modeOutput{Count: 4, Null: true}},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		var outputs []interface{}
+		for _, points := range mappers {
+			v := mapFunc(&testIterator{values: points})
+			if v == nil {
+				outputs = append(outputs, nil)
+				continue
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, err = unmarshal(b); err != nil {
+				t.Fatalf("%s: %s", c, err)
+			}
+			outputs = append(outputs, v)
+		}
+		if got := reduceFunc(outputs); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: exp %v got %v", c, test.exp, got)
+		}
+	}
+
+	// an interval of only null values has no result unless nulls are counted
+	onlyNulls := &testIterator{values: []point{{0, 1, nil}}}
+	if got := ReduceDistinct([]interface{}{MapExcludeNulls(MapDistinct)(onlyNulls)}); got != nil {
+		t.Errorf("distinct of only nulls: exp nil got %v", got)
+	}
+	if got := ReduceMode(true)([]interface{}{MapModeWithNulls(&testIterator{values: []point{{0, 1, nil}, {0, 2, 3.0}}})}); !reflect.DeepEqual(got, &modeOutput{Value: 3, Count: 1}) {
+		t.Errorf("mode tied with null: exp the value got %v", got)
+	}
+}
+
+func TestReduceMinMaxWithTime(t *testing.T) {
+	m1 := []point{{0, 1, 4.0}, {0, 2, 9.0}, {0, 3, int64(1)}}
+	m2 := []point{{0, 4, 1.0}, {0, 5, 7.0}, {0, 6, "foo"}}
+	m3 := []point{{0, 0, 9.0}}
+
+	tests := []struct {
+		call    string
+		mappers [][]point
+		exp     *minMaxMapOutput
+	}{
+		{call: "min(value, 'time')", mappers: [][]point{m2, nil}, exp: &minMaxMapOutput{Time: 4, Val: 1}},
+		{call: "max(value, 'time')", mappers: [][]point{m1, m2}, exp: &minMaxMapOutput{Time: 2, Val: 9}},
+		// ties keep the earliest point, whichever mapper it came from
+		{call: "min(value, 'time')", mappers: [][]point{m2, m1}, exp: &minMaxMapOutput{Time: 3, Val: 1}},
+		{call: "max(value, 'time')", mappers: [][]point{m1, m3}, exp: &minMaxMapOutput{Time: 0, Val: 9}},
+		{call: "min(value, 'time')", mappers: [][]point{nil, nil}, exp: nil},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		var outputs []interface{}
+		for _, points := range test.mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := unmarshal(b)
+			if err != nil {
+				t.Fatalf("%s: %s", c, err)
+			}
+			outputs = append(outputs, v)
+		}
+
+		got := reduceFunc(outputs)
+		if test.exp == nil {
+			if got != nil {
+				t.Errorf("%s: exp nil got %v", c, got)
+			}
+		} else if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: exp %v got %v", c, test.exp, got)
+		}
+	}
+
+	if _, err := InitializeMapFunc(&Call{Name: "max", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 2}, &StringLiteral{Val: "time"}}}); err == nil {
+		t.Error("expected an error scaling max() with 'time'")
+	}
+}
+
+func TestReduceBatched(t *testing.T) {
+	defer func(size int, yield func()) { reduceBatchSize, reduceYield = size, yield }(reduceBatchSize, reduceYield)
+
+	rng := rand.New(rand.NewSource(763))
+	newValues := func(n int) []interface{} {
+		var values []interface{}
+		for len(values) < 3 {
+			data := make([]float64, n/3)
+			for i := range data {
+				data[i] = rng.NormFloat64() * 100
+			}
+			values = append(values, data)
+		}
+		return values
+	}
+	clone := func(values []interface{}) []interface{} {
+		var out []interface{}
+		for _, v := range values {
+			out = append(out, append([]float64(nil), v.([]float64)...))
+		}
+		return out
+	}
+	echoes := func(values []interface{}) []interface{} {
+		var out []interface{}
+		for _, v := range values {
+			var echo []interface{}
+			for _, f := range v.([]float64) {
+				echo = append(echo, f)
+			}
+			out = append(out, echo)
+		}
+		return out
+	}
+
+	for _, n := range []int{3000, 3003} {
+		values := newValues(n)
+
+		reduceBatchSize = 1 << 16
+		percentile := ReducePercentile(90)(echoes(values))
+		lowest := ReducePercentile(-10)(echoes(values))
+		median := ReduceMedian(clone(values))
+		stddev := ReduceStddev(clone(values))
+
+		reduceBatchSize = 100
+		var yields int
+		reduceYield = func() { yields++ }
+		check := func(name string, exp, got interface{}) {
+			if !reflect.DeepEqual(exp, got) {
+				t.Errorf("%d values: %s: exp %v, got %v", n, name, exp, got)
+			}
+			if yields < n/batchSize() {
+				t.Errorf("%d values: %s: exp at least %d yields, got %d", n, name, n/batchSize(), yields)
+			}
+			yields = 0
+		}
+
+		check("percentile", percentile, ReducePercentile(90)(echoes(values)))
+		check("negative percentile", lowest, ReducePercentile(-10)(echoes(values)))
+		check("median", median, ReduceMedian(clone(values)))
+		check("stddev", stddev, ReduceStddev(clone(values)))
+
+		// a batch size below 1 yields after every value rather than dividing by zero or looping forever
+		reduceBatchSize = 0
+		check("median in batches of 0", median, ReduceMedian(clone(values)))
+		check("percentile in batches of 0", percentile, ReducePercentile(90)(echoes(values)))
+	}
+}
+
+func TestReduceDifference(t *testing.T) {
+	c := &Call{Name: "difference", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduce := func(mappers ...[]point) interface{} {
+		var outputs []interface{}
+		for _, values := range mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+		return reduceFunc(outputs)
+	}
+
+	var sorted []point
+	for i, v := range []float64{1, 4, 9, 16, 10, 10, 3} {
+		sorted = append(sorted, point{0, int64(i+1) * 10, v})
+	}
+	exp := reduce(sorted)
+	results, ok := exp.([]*rawQueryMapOutput)
+	if !ok || len(results) != len(sorted)-1 {
+		t.Fatalf("expected %d differences. got %v", len(sorted)-1, exp)
+	}
+	for i, diff := range []float64{3, 5, 7, -6, 0, -7} {
+		if r := results[i]; r.Timestamp != sorted[i+1].timestamp || r.Values != diff {
+			t.Errorf("difference %d: exp %v at %d, got %v at %d", i, diff, sorted[i+1].timestamp, r.Values, r.Timestamp)
+		}
+	}
+
+	// shuffled points split across mappers, as from different shards, give the same differences
+	rng := rand.New(rand.NewSource(763))
+	for i := 0; i < 10; i++ {
+		shuffled := make([]point, len(sorted))
+		for j, k := range rng.Perm(len(sorted)) {
+			shuffled[j] = sorted[k]
+		}
+		split := rng.Intn(len(shuffled) + 1)
+		if got := reduce(shuffled[:split], shuffled[split:]); !reflect.DeepEqual(exp, got) {
+			t.Errorf("shuffle %d: exp %v, got %v", i, exp, got)
+		}
+	}
+
+	if got := reduce([]point{{0, 10, 1.0}}); got != nil {
+		t.Errorf("single point: exp nil, got %v", got)
+	}
+	if got := reduce(nil, nil); got != nil {
+		t.Errorf("no points: exp nil, got %v", got)
+	}
+}
+
+func TestMergePartials(t *testing.T) {
+	means := []MeanMapOutput{{Count: 3, Mean: 2}, {}, {Count: 1, Mean: 10}, {Count: 4, Mean: -1.5}}
+	values := []float64{3.5, -2, 11.25, 0}
+
+	var meanValues, floatValues []interface{}
+	for i := range means {
+		meanValues = append(meanValues, &means[i])
+	}
+	for _, v := range values {
+		floatValues = append(floatValues, v)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		typed  func() (float64, bool)
+		reduce interface{}
+	}{
+		{"mean", func() (float64, bool) { return MergeMeanPartials(means) }, ReduceMean(meanValues)},
+		{"sum", func() (float64, bool) { return MergeSumPartials(values) }, ReduceSum(floatValues)},
+		{"min", func() (float64, bool) { return MergeMinPartials(values) }, ReduceMin(floatValues)},
+		{"max", func() (float64, bool) { return MergeMaxPartials(values) }, ReduceMax(floatValues)},
+	} {
+		if got, ok := tt.typed(); !ok || got != tt.reduce {
+			t.Errorf("%s: exp %v, got %v (ok %v)", tt.name, tt.reduce, got, ok)
+		}
+	}
+
+	// without any points there's no result
+	if _, ok := MergeMeanPartials([]MeanMapOutput{{}}); ok {
+		t.Error("mean of empty partials: exp no result")
+	}
+	for name, merge := range map[string]func([]float64) (float64, bool){
+		"sum": MergeSumPartials, "min": MergeMinPartials, "max": MergeMaxPartials,
+	} {
+		if _, ok := merge(nil); ok {
+			t.Errorf("%s of no partials: exp no result", name)
+		}
+	}
+
+	// counts are merged as int64s, so they stay exact beyond 2^53
+	if got, ok := MergeCountPartials([]int64{MaxExactFloat64, 1, 2}); !ok || got != MaxExactFloat64+3 {
+		t.Errorf("count: exp %d, got %d (ok %v)", int64(MaxExactFloat64+3), got, ok)
+	}
+	if _, ok := MergeCountPartials(nil); ok {
+		t.Error("count of no partials: exp no result")
+	}
+}
+
+func TestOrderedReduce(t *testing.T) {
+	s := int64(time.Second)
+	rng := rand.New(rand.NewSource(765))
+
+	// points at distinct, irregular times split across mappers in a random order
+	var sorted []*rawQueryMapOutput
+	var ts int64
+	for i := 0; i < 50; i++ {
+		ts += int64(rng.Intn(5)+1) * s
+		sorted = append(sorted, &rawQueryMapOutput{ts, float64(rng.Intn(1000))})
+	}
+	var values []interface{}
+	for _, i := range rng.Perm(len(sorted)) {
+		if len(values) == 0 || rng.Intn(10) == 0 {
+			values = append(values, []*rawQueryMapOutput(nil))
+		}
+		values[len(values)-1] = append(values[len(values)-1].([]*rawQueryMapOutput), sorted[i])
+	}
+
+	naiveMovingAverage := func(n int) []*rawQueryMapOutput {
+		var out []*rawQueryMapOutput
+		for i := n - 1; i < len(sorted); i++ {
+			var sum float64
+			for _, p := range sorted[i-n+1 : i+1] {
+				sum += p.Values.(float64)
+			}
+			out = append(out, &rawQueryMapOutput{sorted[i].Timestamp, sum / float64(n)})
+		}
+		return out
+	}
+	var derivative, difference, cumulativeSum []*rawQueryMapOutput
+	var sum float64
+	for _, p := range sorted {
+		sum += p.Values.(float64)
+		cumulativeSum = append(cumulativeSum, &rawQueryMapOutput{p.Timestamp, sum})
+	}
+	for i := 1; i < len(sorted); i++ {
+		prev, cur := sorted[i-1], sorted[i]
+		delta := cur.Values.(float64) - prev.Values.(float64)
+		derivative = append(derivative, &rawQueryMapOutput{cur.Timestamp, delta / (float64(cur.Timestamp-prev.Timestamp) / float64(time.Second))})
+		difference = append(difference, &rawQueryMapOutput{cur.Timestamp, delta})
+	}
+
+	tests := []struct {
+		name string
+		fn   ReduceFunc
+		exp  []*rawQueryMapOutput
+	}{
+		{"derivative", ReduceDerivative(LaterTimestamp, 0), derivative},
+		{"derivative or zero", ReduceDerivativeOrZero(LaterTimestamp, 0), derivative},
+		{"difference", ReduceDifference, difference},
+		{"cumulative sum", ReduceCumulativeSum, cumulativeSum},
+		{"moving average", ReduceMovingAverage(MovingWindow{Points: 4}), naiveMovingAverage(4)},
+	}
+	for _, tt := range tests {
+		got, _ := tt.fn(values).([]*rawQueryMapOutput)
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: exp %v, got %v", tt.name, tt.exp, got)
+		}
+		if got := tt.fn(nil); got != nil {
+			t.Errorf("%s: no points: exp nil, got %v", tt.name, got)
+		}
+	}
+}
+
+func TestReduceCumulativeSum(t *testing.T) {
+	c := &Call{Name: "cumulative_sum", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a monotonic input split across two shards, each holding every other point
+	var shards [2][]point
+	for i := 1; i <= 10; i++ {
+		shards[i%2] = append(shards[i%2], point{0, int64(i) * 10, float64(i)})
+	}
+	var outputs []interface{}
+	for _, values := range shards {
+		b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, o)
+	}
+
+	got, ok := reduceFunc(outputs).([]*rawQueryMapOutput)
+	if !ok || len(got) != 10 {
+		t.Fatalf("expected 10 running totals. got %v", reduceFunc(outputs))
+	}
+	for i, r := range got {
+		n := i + 1
+		if exp := float64(n * (n + 1) / 2); r.Timestamp != int64(n)*10 || r.Values != exp {
+			t.Errorf("total %d: exp %v at %d, got %v at %d", i, exp, n*10, r.Values, r.Timestamp)
+		}
+	}
+
+	if got := reduceFunc([]interface{}{nil, nil}); got != nil {
+		t.Errorf("no points: exp nil, got %v", got)
+	}
+	c.Args = append(c.Args, &NumberLiteral{Val: 2})
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected one argument for cumulative_sum()" {
+		t.Errorf("InitializeMapFunc(%v) expected argument error. got %v", c, err)
+	}
+}
+
+func TestReduceIntegral(t *testing.T) {
+	s := int64(time.Second)
+	// a constant 5 over 10 seconds, split across mappers out of order with a duplicated point
+	values := []interface{}{
+		[]*rawQueryMapOutput{{10 * s, 5.0}, {0, 5.0}, {4 * s, 5.0}},
+		[]*rawQueryMapOutput{{4 * s, 5.0}, {7 * s, int64(5)}},
+	}
+
+	for _, tt := range []struct {
+		call string
+		exp  interface{}
+	}{
+		{"integral(value)", 50.0},
+		{"integral(value, 1ms)", 50000.0},
+		{"integral(value, 5s)", 10.0},
+	} {
+		expr, err := ParseExpr(tt.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		if _, err := InitializeMapFunc(c); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if got := reduceFunc(values); got != tt.exp {
+			t.Errorf("%s: exp %v, got %v", c, tt.exp, got)
+		}
+	}
+
+	// a line rising from 0 to 10 over 10 seconds
+	line := []interface{}{[]*rawQueryMapOutput{{0, 0.0}, {5 * s, 5.0}, {10 * s, 10.0}}}
+	if got := ReduceIntegral(time.Second)(line); got != 50.0 {
+		t.Errorf("line: exp 50, got %v", got)
+	}
+	single := []interface{}{[]*rawQueryMapOutput{{s, 5.0}}}
+	if got := ReduceIntegral(time.Second)(single); got != nil {
+		t.Errorf("single point: exp nil, got %v", got)
+	}
+
+	for _, call := range []string{"integral(value, 'seconds')", "integral(value, 0s)", "integral(value, 1s, 2s)"} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeMapFunc(expr.(*Call)); err == nil {
+			t.Errorf("InitializeMapFunc(%s) expected error. got nil", call)
+		}
+	}
+}
+
+func TestReduceElapsed(t *testing.T) {
+	ms := int64(time.Millisecond)
+	// irregular samples from two shards, each out of order
+	values := []interface{}{
+		[]*rawQueryMapOutput{{7500 * ms, 3.0}, {1000 * ms, 0.0}, {4000 * ms, 2.0}},
+		[]*rawQueryMapOutput{{9000 * ms, 4.0}, {2000 * ms, 1.0}},
+	}
+
+	for _, tt := range []struct {
+		call string
+		exp  []*rawQueryMapOutput
+	}{
+		{"elapsed(value)", []*rawQueryMapOutput{{2000 * ms, 1000 * ms}, {4000 * ms, 2000 * ms}, {7500 * ms, 3500 * ms}, {9000 * ms, 1500 * ms}}},
+		{"elapsed(value, 1ms)", []*rawQueryMapOutput{{2000 * ms, int64(1000)}, {4000 * ms, int64(2000)}, {7500 * ms, int64(3500)}, {9000 * ms, int64(1500)}}},
+		{"elapsed(value, 1s)", []*rawQueryMapOutput{{2000 * ms, int64(1)}, {4000 * ms, int64(2)}, {7500 * ms, int64(3)}, {9000 * ms, int64(1)}}},
+	} {
+		expr, err := ParseExpr(tt.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		if _, err := InitializeMapFunc(c); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		if got, _ := reduceFunc(values).([]*rawQueryMapOutput); !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: exp %v, got %v", c, tt.exp, got)
+		}
+	}
+
+	single := []interface{}{[]*rawQueryMapOutput{{ms, 1.0}}, nil}
+	if got := ReduceElapsed(time.Nanosecond)(single); got != nil {
+		t.Errorf("single point: exp nil, got %v", got)
+	}
+	expr, err := ParseExpr("elapsed(value, 10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitializeMapFunc(expr.(*Call)); err == nil || err.Error() != "expected duration unit in elapsed()" {
+		t.Errorf("expected unit error. got %v", err)
+	}
+}
+
+func TestSample(t *testing.T) {
+	c := &Call{Name: "sample", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 4}}}
+	if _, err := InitializeMapFunc(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitializeReduceFunc(c); err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 30 points split unevenly across three mappers
+	var mappers [][]point
+	var total int
+	for _, size := range []int{20, 7, 3} {
+		var values []point
+		for i := 0; i < size; i++ {
+			values = append(values, point{0, int64(total), float64(total)})
+			total++
+		}
+		mappers = append(mappers, values)
+	}
+
+	const n, iterations = 4, 30000
+	rng := rand.New(rand.NewSource(769))
+	mapFunc, reduceFunc := MapSample(n, rng.Intn), ReduceSample(n, rng.Intn)
+	included := make([]int, total)
+	for i := 0; i < iterations; i++ {
+		var outputs []interface{}
+		for _, values := range mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+
+		sample, ok := reduceFunc(outputs).([]*rawQueryMapOutput)
+		if !ok || len(sample) != n {
+			t.Fatalf("expected %d points. got %v", n, reduceFunc(outputs))
+		}
+		for j, p := range sample {
+			if j > 0 && p.Timestamp <= sample[j-1].Timestamp {
+				t.Fatalf("sample not sorted by time: %v", sample)
+			}
+			included[p.Timestamp]++
+		}
+	}
+
+	// every point is included with probability n/total
+	exp := float64(iterations) * n / float64(total)
+	for ts, count := range included {
+		if math.Abs(float64(count)-exp) > 0.1*exp {
+			t.Errorf("point %d: included %d times, exp about %.0f", ts, count, exp)
+		}
+	}
+
+	// a sample larger than the data holds every point
+	all, _ := ReduceSample(100, rng.Intn)([]interface{}{
+		MapSample(100, rng.Intn)(&testIterator{values: mappers[1]}),
+		MapSample(100, rng.Intn)(&testIterator{values: mappers[2]}),
+		nil,
+	}).([]*rawQueryMapOutput)
+	if len(all) != 10 {
+		t.Errorf("expected all 10 points. got %v", all)
+	}
+
+	for _, arg := range []Expr{&NumberLiteral{Val: 0}, &NumberLiteral{Val: 1.5}, &StringLiteral{Val: "4"}} {
+		c := &Call{Name: "sample", Args: []Expr{&VarRef{Val: "value"}, arg}}
+		if _, err := InitializeMapFunc(c); err == nil {
+			t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+		}
+	}
+}
+
+func TestStreamingReducer(t *testing.T) {
+	rng := rand.New(rand.NewSource(772))
+	for _, name := range []string{"sum", "count", "mean", "min", "max", "spread"} {
+		c := &Call{Name: name, Args: []Expr{&VarRef{Val: "value"}}}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newReducer := InitializeStreamingReducer(c)
+		if newReducer == nil {
+			t.Fatalf("%s: expected a streaming reducer", name)
+		}
+
+		for iter := 0; iter < 50; iter++ {
+			// mappers with random points, some with none
+			var outputs []interface{}
+			for m := rng.Intn(20); m >= 0; m-- {
+				var values []point
+				for i := rng.Intn(5); i > 0; i-- {
+					values = append(values, point{0, int64(i), rng.NormFloat64() * 1e6})
+				}
+				outputs = append(outputs, mapFunc(&testIterator{values: values}))
+			}
+
+			r := newReducer()
+			for _, o := range outputs {
+				r.Push(o)
+			}
+			if exp, got := reduceFunc(outputs), r.Result(); exp != got {
+				t.Fatalf("%s: buffered %v, streaming %v", name, exp, got)
+			}
+		}
+
+		if exp, got := reduceFunc(nil), newReducer().Result(); exp != got {
+			t.Errorf("%s: nothing pushed: buffered %v, streaming %v", name, exp, got)
+		}
+	}
+
+	// partials summarizing mapper points reduce the same way too
+	partials := []interface{}{&Partial{Count: 2, Sum: 3}, &Partial{}, 1.5, nil}
+	for _, name := range []string{"sum", "mean"} {
+		c := &Call{Name: name, Args: []Expr{&VarRef{Val: "value"}}}
+		reduceFunc, _ := InitializeReduceFunc(c)
+		r := InitializeStreamingReducer(c)()
+		for _, p := range partials {
+			r.Push(p)
+		}
+		if exp, got := reduceFunc(partials), r.Result(); exp != got {
+			t.Errorf("%s of partials: buffered %v, streaming %v", name, exp, got)
+		}
+	}
+
+	for _, q := range []string{"percentile(value, 90)", "median(value)", "stddev(value)", "sum(value, 'strict')", "max(derivative(value))"} {
+		expr, err := ParseExpr(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if InitializeStreamingReducer(expr.(*Call)) != nil {
+			t.Errorf("%s: expected no streaming reducer", q)
+		}
+	}
+}
+
+func TestReducePercentileApprox(t *testing.T) {
+	// the values 1 to 100000 shuffled across four mappers
+	const n = 100000
+	rng := rand.New(rand.NewSource(773))
+	mappers := make([][]point, 4)
+	for i, v := range rng.Perm(n) {
+		m := rng.Intn(len(mappers))
+		mappers[m] = append(mappers[m], point{0, int64(i), float64(v + 1)})
+	}
+
+	for _, p := range []float64{1, 10, 25, 50, 75, 90, 99, 99.9} {
+		c := &Call{Name: "percentile_approx", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: p}}}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var outputs []interface{}
+		for _, values := range mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+
+		// the values are uniform, so the error relative to their range is the error in rank
+		got, ok := reduceFunc(outputs).(float64)
+		exp := p / 100 * n
+		if !ok || math.Abs(got-exp)/n > 0.002 {
+			t.Errorf("percentile %v: exp about %v, got %v", p, exp, reduceFunc(outputs))
+		}
+	}
+
+	d := NewTDigest(DefaultTDigestCompression)
+	for _, v := range []float64{3, 1, 2} {
+		d.Add(v)
+	}
+	if min, max := d.Quantile(0), d.Quantile(1); min != 1 || max != 3 {
+		t.Errorf("exp extremes 1 and 3, got %v and %v", min, max)
+	}
+	if got := ReducePercentileApprox(50)([]interface{}{nil}); got != nil {
+		t.Errorf("no values: exp nil, got %v", got)
+	}
+	for _, arg := range []Expr{&NumberLiteral{Val: 101}, &NumberLiteral{Val: -1}, &StringLiteral{Val: "50"}} {
+		c := &Call{Name: "percentile_approx", Args: []Expr{&VarRef{Val: "value"}, arg}}
+		if _, err := InitializeMapFunc(c); err == nil {
+			t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+		}
+	}
+}
+
+func benchmarkPercentile(b *testing.B, mapFunc MapFunc, reduceFunc ReduceFunc) {
+	values := make([]point, 1000000)
+	rng := rand.New(rand.NewSource(773))
+	for i := range values {
+		values[i] = point{0, int64(i), rng.NormFloat64()}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reduceFunc([]interface{}{mapFunc(&testIterator{values: values})})
+	}
+}
+
+func BenchmarkPercentileExact(b *testing.B) {
+	benchmarkPercentile(b, MapEcho, ReducePercentile(99))
+}
+
+func BenchmarkPercentileApprox(b *testing.B) {
+	benchmarkPercentile(b, MapTDigest, ReducePercentileApprox(99))
+}
+
+// BenchmarkPercentilesSeparate computes four percentiles the way four percentile() calls would, sorting the
+// values each time, for comparison with BenchmarkPercentiles.
+func BenchmarkPercentilesSeparate(b *testing.B) {
+	reduceFuncs := []ReduceFunc{ReducePercentile(50), ReducePercentile(90), ReducePercentile(95), ReducePercentile(99)}
+	benchmarkPercentile(b, MapEcho, func(values []interface{}) interface{} {
+		for _, fn := range reduceFuncs {
+			fn(values)
+		}
+		return nil
+	})
+}
+
+func BenchmarkPercentiles(b *testing.B) {
+	benchmarkPercentile(b, MapEcho, ReducePercentiles([]float64{50, 90, 95, 99}))
+}
+
+// Ensure stddev() sends fixed size partials by default and keeps its precision for values with a large mean,
+// where the sum of squares would lose it.
+func TestStddevPartials(t *testing.T) {
+	c := &Call{Name: "stddev", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4, 7, 13 and 16 shifted by 1e9 have a sample stddev of sqrt(30)
+	const offset = 1e9
+	mappers := [][]point{
+		{{0, 1, offset + 4}, {0, 2, offset + 7}},
+		{{0, 3, offset + 13}},
+		{{0, 4, offset + 16}},
+	}
+	var outputs []interface{}
+	var sum, sumSq float64
+	for _, values := range mappers {
+		b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(b), "{") {
+			t.Fatalf("expected a partial rather than the values. got %s", b)
+		}
+		o, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, o)
+		for _, p := range values {
+			sum += p.value.(float64)
+			sumSq += p.value.(float64) * p.value.(float64)
+		}
+	}
+
+	exp := math.Sqrt(30)
+	if got, ok := reduceFunc(outputs).(float64); !ok || math.Abs(got-exp) > 1e-9 {
+		t.Errorf("exp %v, got %v", exp, reduceFunc(outputs))
+	}
+	// whereas the variance from the sum of squares is far off
+	if naive := math.Sqrt(math.Abs(sumSq-sum*sum/4) / 3); math.Abs(naive-exp) < 1 {
+		t.Errorf("sum of squares stddev %v is close to %v, so the values don't test precision", naive, exp)
+	}
+
+	// values sent by nodes that still map stddev() with two passes are reduced as partials
+	o, err := unmarshal([]byte(`[1e9, 1000000004, 1000000008]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reduceFunc([]interface{}{o, outputs[0]}); got == nil {
+		t.Error("expected a stddev of values mixed with partials")
+	}
+	if o, err := unmarshal([]byte(`[]`)); err != nil || o != nil {
+		t.Errorf("no values: exp nil, got %v (%v)", o, err)
+	}
+
+	// 'two_pass' still sends every value
+	c.Args = append(c.Args, &StringLiteral{Val: "two_pass"})
+	if mapFunc, err = InitializeMapFunc(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mapFunc(&testIterator{values: mappers[0]}).([]float64); !ok {
+		t.Error("expected 'two_pass' to map the values")
+	}
+}
+
+func TestCountAll(t *testing.T) {
+	expr, err := ParseExpr("count(*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := expr.(*Call)
+	if !MultiFieldCall(c) {
+		t.Fatal("expected count(*) to read every field")
+	}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// points with fields of every type, mapped as the fields of each point
+	m1 := mapFunc(&testIterator{values: []point{
+		{0, 1, map[string]interface{}{"value": 1.0}},
+		{0, 2, map[string]interface{}{"host": "a"}},
+		{0, 3, map[string]interface{}{"up": true, "value": int64(2)}},
+	}})
+	m2 := mapFunc(&testIterator{values: []point{
+		{0, 4, map[string]interface{}{"up": false}},
+		{0, 5, map[string]interface{}{"host": "b", "value": 3.5}},
+	}})
+	if got := reduceFunc([]interface{}{m1, m2, nil}); got != int64(5) {
+		t.Errorf("exp 5 points, got %v", got)
+	}
+
+	for _, q := range []string{"sum(*)", "mean(*)", "count(*, 'group_hour_of_day')"} {
+		expr, err := ParseExpr(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeMapFunc(expr.(*Call)); err == nil {
+			t.Errorf("%s: expected error", q)
+		}
+	}
+	if expr, _ := ParseExpr("count(value)"); MultiFieldCall(expr.(*Call)) {
+		t.Error("expected count(value) to read a single field")
+	}
+}
+
+func TestReduceCount(t *testing.T) {
+	c := &Call{Name: "count", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduce := func(mappers ...[]point) interface{} {
+		var outputs []interface{}
+		for _, values := range mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+		return reduceFunc(outputs)
+	}
+
+	tests := []struct {
+		name    string
+		mappers [][]point
+		exp     interface{}
+	}{
+		// empty intervals reduce to nil, which the engine reports as 0 unless they're filled
+		{"no mappers", nil, nil},
+		{"empty interval", [][]point{nil}, nil},
+		{"single point", [][]point{{{0, 1, 1.0}}}, int64(1)},
+		{"some empty shards", [][]point{nil, {{0, 1, 1.0}, {0, 2, 2.0}}, nil, {{0, 3, 3.0}}}, int64(3)},
+	}
+	for _, tt := range tests {
+		if got := reduce(tt.mappers...); got != tt.exp {
+			t.Errorf("%s: exp %v, got %v", tt.name, tt.exp, got)
+		}
+	}
+
+	if got := EmptyResult(c); got != int64(0) {
+		t.Errorf("count of an empty interval: exp 0, got %v", got)
+	}
+	floatCount := &Call{Name: "count", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "float"}}}
+	if got := EmptyResult(floatCount); got != float64(0) {
+		t.Errorf("float count of an empty interval: exp 0, got %v", got)
+	}
+
+	// the sum of no points is still undefined
+	sum, err := InitializeReduceFunc(&Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sum([]interface{}{nil}); got != nil {
+		t.Errorf("sum of no points: exp nil, got %v", got)
+	}
+	if got := EmptyResult(&Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}}}); got != nil {
+		t.Errorf("sum of an empty interval: exp nil, got %v", got)
+	}
+}
+
+// Ensure first() and last() of string and boolean fields survive being sent between nodes.
+func TestFirstLastNonNumeric(t *testing.T) {
+	tests := []struct {
+		name    string
+		mappers [][]point
+		first   interface{}
+		last    interface{}
+	}{
+		{
+			name: "strings",
+			mappers: [][]point{
+				{{0, 20, "starting"}, {0, 30, "running"}},
+				{{0, 10, "stopped"}, {0, 40, "stopping"}},
+			},
+			first: "stopped",
+			last:  "stopping",
+		},
+		{
+			name: "booleans",
+			mappers: [][]point{
+				{{0, 10, true}, {0, 30, true}},
+				nil,
+				{{0, 20, false}, {0, 40, false}},
+			},
+			first: true,
+			last:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		for name, exp := range map[string]interface{}{"first": tt.first, "last": tt.last} {
+			c := &Call{Name: name, Args: []Expr{&VarRef{Val: "state"}}}
+			mapFunc, err := InitializeMapFunc(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reduceFunc, err := InitializeReduceFunc(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unmarshal, err := InitializeUnmarshaller(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var outputs []interface{}
+			for _, values := range tt.mappers {
+				out := mapFunc(&testIterator{values: values})
+				if out == nil {
+					outputs = append(outputs, nil)
+					continue
+				}
+				b, err := json.Marshal(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				o, err := unmarshal(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs = append(outputs, o)
+			}
+			if got := reduceFunc(outputs); got != exp {
+				t.Errorf("%s: %s: exp %v, got %v", tt.name, name, exp, got)
+			}
+		}
+	}
+}
+
+func TestReduceWeightedMean(t *testing.T) {
+	expr, err := ParseExpr("mean_weighted(temp, confidence)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := expr.(*Call)
+	if !MultiFieldCall(c) {
+		t.Fatal("expected mean_weighted() to read every field")
+	}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduce := func(mappers ...[]point) interface{} {
+		var outputs []interface{}
+		for _, values := range mappers {
+			out := mapFunc(&testIterator{values: values})
+			if out == nil {
+				outputs = append(outputs, nil)
+				continue
+			}
+			b, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+		return reduceFunc(outputs)
+	}
+	reading := func(temp, confidence interface{}) map[string]interface{} {
+		return map[string]interface{}{"temp": temp, "confidence": confidence}
+	}
+
+	// (20*1 + 30*3 + 10*0.5 + 25*0.5) / 5 = 25.5, skipping the readings without a numeric value or weight
+	got := reduce(
+		[]point{{0, 1, reading(20.0, 1.0)}, {0, 2, reading(30.0, int64(3))}, {0, 3, map[string]interface{}{"temp": 99.0}}},
+		[]point{{0, 4, reading(10.0, 0.5)}, {0, 5, reading(int64(25), 0.5)}, {0, 6, reading("n/a", 4.0)}},
+		nil,
+	)
+	if got != 25.5 {
+		t.Errorf("exp 25.5, got %v", got)
+	}
+
+	if got := reduce([]point{{0, 1, reading(20.0, 0.0)}}, []point{{0, 2, reading(30.0, 0.0)}}); got != nil {
+		t.Errorf("zero total weight: exp nil, got %v", got)
+	}
+	if got := reduce(nil); got != nil {
+		t.Errorf("no points: exp nil, got %v", got)
+	}
+
+	for _, q := range []string{"mean_weighted(temp)", "mean_weighted(temp, 2)", "mean_weighted(temp, confidence, other)"} {
+		expr, err := ParseExpr(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeMapFunc(expr.(*Call)); err == nil || err.Error() != "expected value and weight fields for mean_weighted()" {
+			t.Errorf("%s: expected fields error. got %v", q, err)
+		}
+	}
+}
+
+func TestReduceGeometricHarmonicMean(t *testing.T) {
+	tests := []struct {
+		name    string
+		mappers [][]point
+		exp     interface{}
+	}{
+		{"geometric_mean", [][]point{{{0, 1, 2.0}}, {{0, 2, int64(8)}}}, 4.0},
+		{"geometric_mean", [][]point{{{0, 1, 1.0}, {0, 2, 3.0}}, nil, {{0, 3, 9.0}}}, 3.0},
+		{"geometric_mean", [][]point{{{0, 1, 1e300}, {0, 2, 1e300}}}, 1e300},
+		{"geometric_mean", [][]point{{{0, 1, 2.0}}, {{0, 2, 0.0}}}, nil},
+		{"geometric_mean", [][]point{{{0, 1, -2.0}, {0, 2, 8.0}}}, nil},
+		{"geometric_mean", nil, nil},
+		{"harmonic_mean", [][]point{{{0, 1, 1.0}}, {{0, 2, 4.0}, {0, 3, int64(4)}}}, 2.0},
+		{"harmonic_mean", [][]point{{{0, 1, 40.0}, {0, 2, 60.0}}}, 48.0},
+		{"harmonic_mean", [][]point{{{0, 1, 1.0}}, {{0, 2, 0.0}}}, nil},
+		{"harmonic_mean", [][]point{{{0, 1, 2.0}, {0, 2, -2.0}}}, nil},
+		{"harmonic_mean", nil, nil},
+	}
+
+	for i, tt := range tests {
+		c := &Call{Name: tt.name, Args: []Expr{&VarRef{Val: "value"}}}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var outputs []interface{}
+		for _, values := range tt.mappers {
+			out := mapFunc(&testIterator{values: values})
+			if out == nil {
+				outputs = append(outputs, nil)
+				continue
+			}
+			b, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+
+		got := reduceFunc(outputs)
+		if exp, ok := tt.exp.(float64); ok {
+			if v, ok := got.(float64); !ok || math.Abs(v-exp) > 1e-9*exp {
+				t.Errorf("%d. %s: exp %v, got %v", i, tt.name, exp, got)
+			}
+		} else if got != nil {
+			t.Errorf("%d. %s: exp nil, got %v", i, tt.name, got)
+		}
+	}
+
+	c := &Call{Name: "harmonic_mean", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 2}}}
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected one argument for harmonic_mean()" {
+		t.Errorf("expected argument error. got %v", err)
+	}
+}
+
+func TestReduceSkewnessKurtosis(t *testing.T) {
+	// values 1, 2, 3 and 10 have a mean of 4, so their central moment sums are M2 = 50, M3 = 180 and M4 = 1394
+	values := []float64{1, 2, 3, 10}
+	expSkewness := 2 * 180 / math.Pow(50, 1.5) // 1.0182...
+	expKurtosis := 4*1394/2500.0 - 3           // -0.7696
+
+	tests := []struct {
+		name  string
+		split []int // number of values per mapper
+		exp   interface{}
+	}{
+		{"skewness", []int{4}, expSkewness},
+		{"skewness", []int{1, 3}, expSkewness},
+		{"skewness", []int{2, 0, 1, 1}, expSkewness},
+		{"kurtosis", []int{4}, expKurtosis},
+		{"kurtosis", []int{3, 1}, expKurtosis},
+		{"kurtosis", []int{1, 1, 1, 1}, expKurtosis},
+	}
+
+	for i, tt := range tests {
+		c := &Call{Name: tt.name, Args: []Expr{&VarRef{Val: "value"}}}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var outputs []interface{}
+		var j int
+		for _, n := range tt.split {
+			var points []point
+			for _, v := range values[j : j+n] {
+				points = append(points, point{0, int64(j), v})
+				j++
+			}
+			out := MapMoments(&testIterator{values: points})
+			if out == nil {
+				outputs = append(outputs, nil)
+				continue
+			}
+			b, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+
+		if got, ok := reduceFunc(outputs).(float64); !ok || math.Abs(got-tt.exp.(float64)) > 1e-12 {
+			t.Errorf("%d. %s: exp %v, got %v", i, tt.name, tt.exp, reduceFunc(outputs))
+		}
+	}
+
+	// too few values or zero variance are undefined
+	for i, tt := range []struct {
+		reduce func([]interface{}) interface{}
+		values []float64
+	}{
+		{ReduceSkewness, nil},
+		{ReduceSkewness, []float64{1}},
+		{ReduceSkewness, []float64{1e9, 1e9, 1e9}},
+		{ReduceKurtosis, []float64{1, 2}},
+		{ReduceKurtosis, []float64{3, 3, 3, 3}},
+	} {
+		var points []point
+		for j, v := range tt.values {
+			points = append(points, point{0, int64(j), v})
+		}
+		if got := tt.reduce([]interface{}{MapMoments(&testIterator{values: points})}); got != nil {
+			t.Errorf("%d. exp nil, got %v", i, got)
+		}
+	}
+
+	// the moments of a single mapper match those of merged mappers
+	a, b := &momentsMapOutput{}, &momentsMapOutput{}
+	all := &momentsMapOutput{}
+	for i := 0; i < 100; i++ {
+		v := math.Exp(float64(i%17) / 4)
+		if i < 30 {
+			a.add(v)
+		} else {
+			b.add(v)
+		}
+		all.add(v)
+	}
+	m := mergeMoments([]*momentsMapOutput{a, b})
+	if math.Abs(m.M3-all.M3) > 1e-12*math.Abs(all.M3) || math.Abs(m.M4-all.M4) > 1e-12*all.M4 {
+		t.Errorf("merged moments %v differ from %v", m, all)
+	}
+}
+
+// Ensure percentiles() matches separate percentile() calls.
+func TestReducePercentiles(t *testing.T) {
+	c := &Call{Name: "percentiles", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 50}, &NumberLiteral{Val: 90},
+		&NumberLiteral{Val: 95}, &NumberLiteral{Val: 99.9}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(781))
+	var outputs []interface{}
+	for i := 0; i < 3; i++ {
+		var values []point
+		for j := 0; j < 1000; j++ {
+			values = append(values, point{0, int64(j), rng.Float64() * 100})
+		}
+		b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, o)
+	}
+
+	got, ok := reduceFunc(outputs).(map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected result %v", reduceFunc(outputs))
+	}
+	exp := map[string]interface{}{
+		"50":   ReducePercentile(50)(outputs),
+		"90":   ReducePercentile(90)(outputs),
+		"95":   ReducePercentile(95)(outputs),
+		"99.9": ReducePercentile(99.9)(outputs),
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp %v, got %v", exp, got)
+	}
+
+	if got := reduceFunc(nil); got != nil {
+		t.Errorf("exp nil for no values, got %v", got)
+	}
+	if got := ReducePercentiles([]float64{0, 100})([]interface{}{[]interface{}{1.0, 2.0}}); !reflect.DeepEqual(got,
+		map[string]interface{}{"0": nil, "100": 2.0}) {
+		t.Errorf("unexpected extreme percentiles %v", got)
+	}
+
+	for _, tt := range []struct {
+		args []Expr
+		err  string
+	}{
+		{[]Expr{&VarRef{Val: "value"}}, "expected field and percentiles for percentiles()"},
+		{[]Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 50}, &NumberLiteral{Val: 101}},
+			"expected percentile between 0 and 100 in percentiles()"},
+		{[]Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "50"}}, "expected percentile between 0 and 100 in percentiles()"},
+	} {
+		if _, err := InitializeMapFunc(&Call{Name: "percentiles", Args: tt.args}); err == nil || err.Error() != tt.err {
+			t.Errorf("exp error %q, got %v", tt.err, err)
+		}
+	}
+}
+
+// Ensure a registered aggregate runs through the Initialize functions like a built-in one.
+func TestRegisterAggregate(t *testing.T) {
+	mapRange := func(itr Iterator) interface{} {
+		var out []float64 // min and max
+		for _, _, v, ok := itr.Next(); ok; _, _, v, ok = itr.Next() {
+			val, ok := toFloat64(v)
+			if !ok {
+				continue
+			}
+			if out == nil {
+				out = []float64{val, val}
+			}
+			out[0], out[1] = math.Min(out[0], val), math.Max(out[1], val)
+		}
+		if out == nil {
+			return nil
+		}
+		return out
+	}
+	reduceRange := func(values []interface{}) interface{} {
+		var min, max float64
+		var found bool
+		for _, v := range values {
+			v, ok := v.([]float64)
+			if !ok {
+				continue
+			}
+			if !found {
+				min, max, found = v[0], v[1], true
+			}
+			min, max = math.Min(min, v[0]), math.Max(max, v[1])
+		}
+		if !found {
+			return nil
+		}
+		return max - min
+	}
+	unmarshalRange := func(b []byte) (interface{}, error) {
+		var a []float64
+		err := json.Unmarshal(b, &a)
+		return a, err
+	}
+
+	if err := RegisterAggregate("peak_to_peak", mapRange, reduceRange, unmarshalRange); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		aggregatesMu.Lock()
+		delete(aggregates, "peak_to_peak")
+		aggregatesMu.Unlock()
+	}()
+
+	stmt, err := NewParser(strings.NewReader(`SELECT peak_to_peak(value) FROM cpu`)).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := stmt.(*SelectStatement).Fields[0].Expr.(*Call)
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var outputs []interface{}
+	for _, values := range [][]point{{{0, 1, 3.0}, {0, 2, 7.0}}, {{0, 3, int64(-2)}}, nil} {
+		out := mapFunc(&testIterator{values: values})
+		if out == nil {
+			outputs = append(outputs, nil)
+			continue
+		}
+		b, err := json.Marshal(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, o)
+	}
+	if got := reduceFunc(outputs); got != 9.0 {
+		t.Errorf("exp 9, got %v", got)
+	}
+
+	// registered aggregates take a single field like the built-in ones
+	if _, err := InitializeMapFunc(&Call{Name: "peak_to_peak", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 1}}}); err == nil {
+		t.Error("expected argument error")
+	}
+
+	for _, tt := range []struct {
+		name string
+		err  string
+	}{
+		{"peak_to_peak", `aggregate already registered: "peak_to_peak"`},
+		{"mean", `can't register built-in function: "mean"`},
+		{"range", `can't register built-in function: "range"`},
+		{"percentile", `can't register built-in function: "percentile"`},
+	} {
+		if err := RegisterAggregate(tt.name, mapRange, reduceRange, nil); err == nil || err.Error() != tt.err {
+			t.Errorf("exp error %q, got %v", tt.err, err)
+		}
+	}
+
+	// every built-in function is known to the mappers, whatever arguments it expects
+	for name := range builtinFunctions {
+		_, err := InitializeMapFunc(&Call{Name: name, Args: []Expr{&VarRef{Val: "value"}}})
+		if err != nil && err.Error() == fmt.Sprintf("function not found: %q", name) {
+			t.Errorf("built-in function %s not found", name)
+		}
+	}
+
+	// a nil unmarshaller decodes generic JSON values
+	if err := RegisterAggregate("peak_to_peak_generic", mapRange, reduceRange, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		aggregatesMu.Lock()
+		delete(aggregates, "peak_to_peak_generic")
+		aggregatesMu.Unlock()
+	}()
+	unmarshal, err = InitializeUnmarshaller(&Call{Name: "peak_to_peak_generic", Args: []Expr{&VarRef{Val: "value"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := unmarshal([]byte(`[1,2]`)); err != nil || !reflect.DeepEqual(v, []interface{}{1.0, 2.0}) {
+		t.Errorf("unexpected generic value %v, %v", v, err)
+	}
+}
+
+// Ensure numeric aggregates of string and boolean fields are rejected rather than silently empty.
+func TestCheckFieldType(t *testing.T) {
+	for i, tt := range []struct {
+		call string
+		typ  DataType
+		err  string
+	}{
+		{`sum(value)`, String, `sum() can't be applied to string field value`},
+		{`mean(value)`, Boolean, `mean() can't be applied to boolean field value`},
+		{`percentile(value, 90)`, String, `percentile() can't be applied to string field value`},
+		{`max(value)`, Float, ``},
+		{`min(value)`, Integer, ``},
+		{`count(value)`, String, ``},
+		{`first(value)`, Boolean, ``},
+		{`distinct(value)`, String, ``},
+	} {
+		expr, err := ParseExpr(tt.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckFieldType(expr.(*Call), "value", tt.typ)
+		if tt.err == "" && err != nil {
+			t.Errorf("%d. %s: unexpected error %s", i, tt.call, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%d. %s: exp error %q, got %v", i, tt.call, tt.err, err)
+		}
+	}
+
+	if err := CheckFieldType(nil, "value", String); err != nil {
+		t.Errorf("unexpected error for raw query: %s", err)
+	}
+}
+
+// Ensure numeric aggregates skip NaN and infinite values only if SkipNonFinite is set.
+func TestSkipNonFinite(t *testing.T) {
+	points := func() *testIterator {
+		return &testIterator{values: []point{
+			{0, 1, 2.0}, {0, 2, math.NaN()}, {0, 3, int64(4)}, {0, 4, math.Inf(1)}, {0, 5, 6.0}, {0, 6, math.Inf(-1)},
+		}}
+	}
+
+	tests := []struct {
+		name string
+		fn   func(Iterator) interface{}
+		exp  float64
+	}{
+		{name: "sum", fn: MapSum, exp: 12},
+		{name: "sum strict", fn: MapSumStrict, exp: 12},
+		{name: "mean", fn: func(itr Iterator) interface{} { return ReduceMean([]interface{}{MapMean(itr)}) }, exp: 4},
+		{name: "mean strict", fn: func(itr Iterator) interface{} { return ReduceMean([]interface{}{MapMeanStrict(itr)}) }, exp: 4},
+		{name: "min", fn: MapMin, exp: 2},
+		{name: "max", fn: MapMax, exp: 6},
+		{name: "stddev", fn: func(itr Iterator) interface{} { return ReduceStddev([]interface{}{MapStddev(itr)}) }, exp: 2},
+		{name: "stddev one pass", fn: func(itr Iterator) interface{} {
+			return ReduceStddevOnePass([]interface{}{MapStddevOnePass(itr)})
+		}, exp: 2},
+	}
+
+	// strict by default: NaN poisons the result
+	for _, test := range tests[:3] {
+		if got, ok := test.fn(points()).(float64); !ok || !math.IsNaN(got) {
+			t.Errorf("%s: exp NaN by default, got %v", test.name, got)
+		}
+	}
+
+	SkipNonFinite = true
+	defer func() { SkipNonFinite = false }()
+	for _, test := range tests {
+		if got := test.fn(points()); got != test.exp {
+			t.Errorf("%s: exp %v got %v", test.name, test.exp, got)
+		}
+	}
+
+	// an interval of only non-finite values is empty
+	if got := MapSum(&testIterator{values: []point{{0, 1, math.NaN()}, {0, 2, math.Inf(1)}}}); got != nil {
+		t.Errorf("sum of no finite values: exp nil got %v", got)
+	}
+}
+
+// Ensure range() keeps both the min and max of every shard.
+func TestReduceRange(t *testing.T) {
+	c := &Call{Name: "range", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a local mapper's output is reduced along with those unmarshalled from other nodes
+	outputs := []interface{}{mapFunc(&testIterator{values: []point{{0, 1, 3.0}, {0, 2, int64(5)}}})}
+	for _, values := range [][]point{{{0, 3, -2.5}, {0, 4, 1.0}}, {{0, 5, 9.0}}, nil} {
+		out := mapFunc(&testIterator{values: values})
+		if out == nil {
+			outputs = append(outputs, nil)
+			continue
+		}
+		b, err := json.Marshal(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, o)
+	}
+
+	if got, exp := reduceFunc(outputs), (&rangeOutput{Min: -2.5, Max: 9}); !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp %v, got %v", exp, got)
+	}
+	if got := ReduceSpread(outputs); got != 11.5 {
+		t.Errorf("spread: exp 11.5, got %v", got)
+	}
+	if got := reduceFunc([]interface{}{mapFunc(&testIterator{}), nil}); got != nil {
+		t.Errorf("exp nil for an empty interval, got %v", got)
+	}
+
+	if _, err := InitializeMapFunc(&Call{Name: "range", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 1}}}); err == nil {
+		t.Error("expected argument error")
+	}
+}
+
+// Ensure the median of values split across shards matches sorting all the values and indexing the middle.
+func TestReduceMedian_Shards(t *testing.T) {
+	bruteForce := func(values []interface{}) interface{} {
+		var data []float64
+		for _, v := range values {
+			if v != nil {
+				data = append(data, v.([]float64)...)
+			}
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		sort.Float64s(data)
+		if n := len(data); n%2 == 0 {
+			return data[n/2-1] + (data[n/2]-data[n/2-1])/2
+		}
+		return data[len(data)/2]
+	}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{"no values", []interface{}{nil, []float64{}}, nil},
+		{"one value", []interface{}{nil, []float64{4}}, 4.0},
+		{"odd", []interface{}{[]float64{9, 1}, []float64{5}, []float64{7, 3}}, 5.0},
+		{"even", []interface{}{[]float64{8, 2}, []float64{6, 4}}, 5.0},
+		// the two middle values are in different shards and on either side of the selected window's boundary
+		{"even straddling shards", []interface{}{[]float64{1, 2, 3, 10}, []float64{4, 20, 30, 40}}, 7.0},
+		{"even equal middle values in different shards", []interface{}{[]float64{1, 5, 9}, []float64{5, 0, 7}}, 5.0},
+		{"even all equal", []interface{}{[]float64{2, 2}, []float64{2, 2}}, 2.0},
+		{"odd equal middle values", []interface{}{[]float64{3, 3}, []float64{1, 3, 8}}, 3.0},
+		{"NaN dropped", []interface{}{[]float64{math.NaN(), 1}, []float64{3}}, 2.0},
+	}
+	for _, tt := range tests {
+		if got := ReduceMedian(tt.values); !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: exp %v, got %v", tt.name, tt.exp, got)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(786))
+	for iter := 0; iter < 100; iter++ {
+		var values []interface{}
+		for i := rng.Intn(5); i >= 0; i-- {
+			data := make([]float64, rng.Intn(2000))
+			for j := range data {
+				// few distinct values, so the middle values are often equal
+				data[j] = float64(rng.Intn(50))
+				if iter%2 == 0 {
+					data[j] = rng.NormFloat64()
+				}
+			}
+			values = append(values, data)
+		}
+		exp := bruteForce(values)
+		if got := ReduceMedian(values); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("iteration %d: exp %v, got %v", iter, exp, got)
+		}
+	}
+
+	// input isn't modified
+	data := []float64{3, 1, 2}
+	ReduceMedian([]interface{}{data})
+	if !reflect.DeepEqual(data, []float64{3, 1, 2}) {
+		t.Errorf("input was modified: %v", data)
+	}
+}
+
+// Ensure count(distinct(field)) counts the distinct values and count_distinct_approx(field) estimates the count
+// within the error of its sketch.
+func TestCountDistinctCalls(t *testing.T) {
+	// three mappers with overlapping values
+	var mappers [][]point
+	exact := make(map[string]struct{})
+	for m := 0; m < 3; m++ {
+		var values []point
+		for i := 0; i < 20000; i++ {
+			v := fmt.Sprintf("host%d", m*5000+i)
+			values = append(values, point{0, int64(i), v})
+			exact[v] = struct{}{}
+		}
+		mappers = append(mappers, values)
+	}
+
+	run := func(call string) interface{} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var outputs []interface{}
+		for _, values := range mappers {
+			b, err := json.Marshal(mapFunc(&testIterator{values: values}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+		return reduceFunc(outputs)
+	}
+
+	if got, exp := run(`count(distinct(host))`), float64(len(exact)); got != exp {
+		t.Errorf("count(distinct(host)): exp %v, got %v", exp, got)
+	}
+	if got, exp := run(`count(distinct(host))`), run(`count_distinct(host)`); got != exp {
+		t.Errorf("count(distinct(host)) differs from count_distinct(host): %v, %v", got, exp)
+	}
+
+	// the standard error of the default precision is about 0.8%, so allow three times that
+	got, ok := run(`count_distinct_approx(host)`).(float64)
+	if exp := float64(len(exact)); !ok || math.Abs(got-exp)/exp > 0.025 {
+		t.Errorf("count_distinct_approx(host): exp about %v, got %v", exp, got)
+	}
+	if exp := run(`count_distinct(host, 'approx')`); got != exp {
+		t.Errorf("count_distinct_approx(host) differs from count_distinct(host, 'approx'): %v, %v", got, exp)
+	}
+
+	for _, call := range []string{`count(distinct(host), 1)`, `count_distinct_approx(host, 'values')`, `count(distinct())`} {
+		expr, err := ParseExpr(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitializeMapFunc(expr.(*Call)); err == nil {
+			t.Errorf("%s: expected an error", call)
+		}
+	}
+}
+
+// Ensure first() and last() select the same value of points sharing a time whatever order they're read and
+// merged in.
+func TestFirstLastTies(t *testing.T) {
+	points := []point{{0, 5, 3.0}, {0, 2, 7.0}, {0, 2, 4.0}, {0, 9, 8.0}, {0, 9, 1.0}, {0, 2, 6.0}, {0, 9, 2.0}}
+
+	rng := rand.New(rand.NewSource(788))
+	for iter := 0; iter < 50; iter++ {
+		shuffled := append([]point(nil), points...)
+		for i := range shuffled {
+			j := rng.Intn(i + 1)
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		}
+		split := rng.Intn(len(shuffled) + 1)
+
+		for _, tt := range []struct {
+			name   string
+			mapFn  MapFunc
+			reduce ReduceFunc
+			exp    interface{}
+		}{
+			{"first", MapFirst, ReduceFirst, 4.0},
+			{"last", MapLast, ReduceLast, 8.0},
+		} {
+			// as one mapper, and as two whose outputs are merged in either order
+			if got := tt.reduce([]interface{}{tt.mapFn(&testIterator{values: shuffled})}); got != tt.exp {
+				t.Fatalf("%s of %v: exp %v, got %v", tt.name, shuffled, tt.exp, got)
+			}
+			a := tt.mapFn(&testIterator{values: shuffled[:split]})
+			b := tt.mapFn(&testIterator{values: shuffled[split:]})
+			if got := tt.reduce([]interface{}{a, b}); got != tt.exp {
+				t.Fatalf("%s of %v and %v: exp %v, got %v", tt.name, shuffled[:split], shuffled[split:], tt.exp, got)
+			}
+			if got := tt.reduce([]interface{}{b, a}); got != tt.exp {
+				t.Fatalf("%s of %v and %v: exp %v, got %v", tt.name, shuffled[split:], shuffled[:split], tt.exp, got)
+			}
+		}
+	}
+
+	// time ordered input still breaks ties
+	ordered := []point{{0, 1, "b"}, {0, 1, "a"}, {0, 2, "z"}, {0, 2, "c"}}
+	if got := MapFirst(&orderedIterator{testIterator: testIterator{values: ordered}}); got != (firstLastMapOutput{Time: 1, Val: "a"}) {
+		t.Errorf("wrong first of ordered ties: %v", got)
+	}
+	if got := MapLast(&orderedIterator{testIterator: testIterator{values: ordered}}); got != (firstLastMapOutput{Time: 2, Val: "z"}) {
+		t.Errorf("wrong last of ordered ties: %v", got)
+	}
+
+	// so does selecting the whole point
+	fields := func(v float64, host string) map[string]interface{} {
+		return map[string]interface{}{"value": v, "host": host}
+	}
+	a := MapSelectPoint("first", "value")(&testIterator{values: []point{{0, 1, fields(2, "a")}, {0, 3, fields(0, "b")}}})
+	b := MapSelectPoint("first", "value")(&testIterator{values: []point{{0, 1, fields(1, "c")}}})
+	for _, values := range [][]interface{}{{a, b}, {b, a}} {
+		got, ok := ReduceSelectPoint("first", "value")(values).(*Point)
+		if !ok || got.Values.(map[string]interface{})["host"] != "c" {
+			t.Errorf("wrong first point of ties: %v", got)
+		}
+	}
+}
+
+// Ensure combined map functions read the iterator once and output what each would separately.
+func TestCombineMapFuncs(t *testing.T) {
+	points := []point{{1, 5, 3.0}, {2, 1, int64(7)}, {1, 9, -2.0}, {2, 3, 4.5}, {1, 2, 4.0}}
+	// the series of each point in the order they're read
+	series := func(itr Iterator) interface{} {
+		var ids []uint64
+		for id, _, _, ok := itr.Next(); ok; id, _, _, ok = itr.Next() {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	fns := []MapFunc{MapMin, MapMax, MapMean, MapCount, MapFirst, MapStddev, series}
+
+	itr := &orderedIterator{testIterator: testIterator{values: points}}
+	got, ok := CombineMapFuncs(fns)(itr).([]interface{})
+	if !ok || len(got) != len(fns) {
+		t.Fatalf("unexpected outputs %v", got)
+	}
+	if itr.nexts != len(points)+1 {
+		t.Errorf("expected a single pass over %d points, read %d", len(points), itr.nexts)
+	}
+	for i, fn := range fns {
+		if exp := fn(&testIterator{values: points}); !reflect.DeepEqual(got[i], exp) {
+			t.Errorf("%d. exp %v, got %v", i, exp, got[i])
+		}
+	}
+
+	// the order and error of the iterator are passed on
+	ordered := func(itr Iterator) interface{} { return isOrdered(itr) }
+	if got := CombineMapFuncs([]MapFunc{ordered})(&orderedIterator{}); !reflect.DeepEqual(got, []interface{}{true}) {
+		t.Errorf("expected ordered iterator, got %v", got)
+	}
+	errItr := &errIterator{testIterator: testIterator{values: points}, err: errors.New("read failed")}
+	if got, ok := CombineMapFuncs(fns)(errItr).(error); !ok || got.Error() != "read failed" {
+		t.Errorf("expected iterator error, got %v", got)
+	}
+	if got, ok := CombineMapFuncs([]MapFunc{MapSum, MapSumStrict})(&testIterator{values: []point{{0, 1, int64(MaxExactFloat64 + 1)}}}).(error); !ok {
+		t.Errorf("expected map function error, got %v", got)
+	}
+}
+
+// decodingIterator decodes the values of points as it iterates over them, like the mappers reading stored
+// points, where each pass over the interval decodes every point again.
+type decodingIterator struct {
+	data [][]byte
+	k    int64
+}
+
+func (d *decodingIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	if len(d.data) == 0 {
+		return 0, 0, nil, false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(d.data[0], &fields); err != nil {
+		panic(err)
+	}
+	d.data = d.data[1:]
+	d.k++
+	return 0, d.k, fields["value"], true
+}
+
+func benchmarkMapFuncs(b *testing.B, combined bool) {
+	data := make([][]byte, 10000)
+	rng := rand.New(rand.NewSource(789))
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf(`{"value":%v}`, rng.Float64()))
+	}
+	fns := []MapFunc{MapMin, MapMax, MapMean, MapCount}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if combined {
+			CombineMapFuncs(fns)(&decodingIterator{data: data})
+			continue
+		}
+		for _, fn := range fns {
+			fn(&decodingIterator{data: data})
+		}
+	}
+}
+
+func BenchmarkMapFuncsSeparate(b *testing.B) { benchmarkMapFuncs(b, false) }
+
+func BenchmarkMapFuncsCombined(b *testing.B) { benchmarkMapFuncs(b, true) }
+
+// Ensure WithFill fills intervals the reducer returns nil for.
+func TestWithFill(t *testing.T) {
+	// the sums of a sequence of intervals, some without points
+	intervals := [][]interface{}{nil, {2.0}, {}, {nil}, {3.0, 4.0}, nil}
+
+	tests := []struct {
+		name string
+		fill interface{}
+		exp  []interface{}
+	}{
+		{"fill(0)", 0.0, []interface{}{0.0, 2.0, 0.0, 0.0, 7.0, 0.0}},
+		{"fill(null)", nil, []interface{}{nil, 2.0, nil, nil, 7.0, nil}},
+		{"fill(previous)", PreviousFill, []interface{}{nil, 2.0, 2.0, 2.0, 7.0, 7.0}},
+	}
+	for _, tt := range tests {
+		fn := WithFill(ReduceSum, tt.fill)
+		var got []interface{}
+		for _, values := range intervals {
+			got = append(got, fn(values))
+		}
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: exp %v, got %v", tt.name, tt.exp, got)
+		}
+	}
+
+	// errors aren't filled or carried forward
+	fail := errors.New("failed")
+	results := []interface{}{1.0, fail, nil}
+	fn := WithFill(func([]interface{}) interface{} {
+		v := results[0]
+		results = results[1:]
+		return v
+	}, PreviousFill)
+	for i, exp := range []interface{}{1.0, fail, 1.0} {
+		if got := fn(nil); got != exp {
+			t.Errorf("%d. exp %v, got %v", i, exp, got)
+		}
+	}
+}
+
+// repeatIterator yields n points with the same value.
+type repeatIterator struct {
+	n     int
+	value interface{}
+}
+
+func (r *repeatIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	if r.n == 0 {
+		return 0, 0, nil, false
+	}
+	r.n--
+	return 0, int64(r.n), r.value, true
+}
+
+// Ensure sum(value, 'compensated') of many large integers matches the exact sum, which a plain float64 sum
+// drifts from.
+func TestCompensatedSum(t *testing.T) {
+	c := &Call{Name: "sum", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "compensated"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 million values of 9e15 across four mappers
+	const n, value = 10000000, int64(9e15)
+	var outputs []interface{}
+	for _, count := range []int{n / 2, n / 4, n/4 - 1, 1} {
+		b, err := json.Marshal(mapFunc(&repeatIterator{n: count, value: value}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, o)
+	}
+
+	exact, _ := new(big.Float).SetInt(new(big.Int).Mul(big.NewInt(n), big.NewInt(value))).Float64()
+	got, ok := reduceFunc(outputs).(float64)
+	if !ok || math.Abs(got-exact)/exact > 1e-15 {
+		t.Errorf("exp %v, got %v", exact, got)
+	}
+
+	// values of very different magnitude that cancel out
+	values := []point{{0, 1, 1e100}, {0, 2, 1.0}, {0, 3, -1e100}, {0, 4, 1.0}}
+	if got := reduceFunc([]interface{}{mapFunc(&testIterator{values: values})}); got != 2.0 {
+		t.Errorf("exp 2, got %v", got)
+	}
+	if got := reduceFunc([]interface{}{mapFunc(&testIterator{}), nil}); got != nil {
+		t.Errorf("exp nil for no values, got %v", got)
+	}
+
+	for _, args := range [][]Expr{
+		{&VarRef{Val: "value"}, &StringLiteral{Val: "compensated"}, &StringLiteral{Val: "exact"}},
+		{&VarRef{Val: "value"}, &StringLiteral{Val: "strict"}, &StringLiteral{Val: "compensated"}},
+	} {
+		if _, err := InitializeMapFunc(&Call{Name: "sum", Args: args}); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+	if _, err := InitializeMapFunc(&Call{Name: "mean", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "compensated"}}}); err == nil {
+		t.Error("expected an error for mean(value, 'compensated')")
+	}
+}
+
+// Ensure MapReduceFuncs returns the functions of each Initialize function together.
+func TestMapReduceFuncs(t *testing.T) {
+	c := &Call{Name: "mean", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, reduceFunc, unmarshal, err := MapReduceFuncs(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(mapFunc(&testIterator{values: []point{{0, 1, 2.0}, {0, 2, 4.0}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reduceFunc([]interface{}{o, mapFunc(&testIterator{values: []point{{0, 3, 9.0}}})}); got != 5.0 {
+		t.Errorf("exp 5, got %v", got)
+	}
+
+	// raw data queries are mapped and unmarshalled but not reduced
+	mapFunc, reduceFunc, unmarshal, err = MapReduceFuncs(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if mapFunc == nil || unmarshal == nil || reduceFunc != nil {
+		t.Errorf("unexpected functions for a raw data query")
+	}
+
+	for _, c := range []*Call{
+		{Name: "foo", Args: []Expr{&VarRef{Val: "value"}}},
+		{Name: "percentile", Args: []Expr{&VarRef{Val: "value"}}},
+	} {
+		if _, _, _, err := MapReduceFuncs(c); err == nil {
+			t.Errorf("%s: expected an error", c)
+		}
+	}
+	if _, _, _, err := MapReduceFuncs(&Call{Name: "foo", Args: []Expr{&VarRef{Val: "value"}}}); err == nil || err.Error() != `function not found: "foo"` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReduceHoltWinters(t *testing.T) {
+	const season = 12
+	wave := func(i int) float64 { return 10 + 0.5*float64(i) + 3*math.Sin(2*math.Pi*float64(i)/season) }
+
+	// Spread noisy points over two mappers with a sampling interval of 10s that every fifth point is late for.
+	rnd := rand.New(rand.NewSource(1))
+	var a, b []*rawQueryMapOutput
+	var last int64
+	for i := 0; i < 4*season; i++ {
+		p := &rawQueryMapOutput{int64(i) * 10, wave(i) + 0.2*rnd.NormFloat64()}
+		if i%5 == 4 {
+			p.Timestamp += 3
+		}
+		if i%2 == 0 {
+			a = append(a, p)
+		} else {
+			b = append(b, p)
+		}
+		last = p.Timestamp
+	}
+
+	out, ok := ReduceHoltWinters(season, season)([]interface{}{b, nil, a}).([]*rawQueryMapOutput)
+	if !ok || len(out) != 5*season {
+		t.Fatalf("unexpected output: %v", out)
+	}
+	for i, p := range out[4*season:] {
+		if exp := last + int64(i+1)*10; p.Timestamp != exp {
+			t.Errorf("forecast %d: timestamp mismatch: exp %d got %d", i, exp, p.Timestamp)
+		}
+		if exp, got := wave(4*season+i), p.Values.(float64); math.Abs(got-exp) > 0.5 {
+			t.Errorf("forecast %d: value mismatch: exp %v got %v", i, exp, got)
+		}
+	}
+
+	// Two full seasons are needed to fit the model.
+	if got := ReduceHoltWinters(1, season)([]interface{}{a[:2*season-1]}); got != nil {
+		t.Errorf("expected nil for too few points. got %v", got)
+	}
+
+	for _, args := range [][]Expr{
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 10}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0}, &NumberLiteral{Val: 12}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 10}, &NumberLiteral{Val: 1.5}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 10}, &StringLiteral{Val: "12"}},
+	} {
+		c := &Call{Name: "holt_winters", Args: args}
+		if _, err := InitializeMapFunc(c); err == nil {
+			t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+		}
+	}
+}
+
+func TestReduceMedianWithTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []point
+		exp    interface{}
+	}{
+		{
+			name:   "odd",
+			points: []point{{0, 10, 3.0}, {0, 20, 1.0}, {0, 30, 2.0}, {0, 40, math.NaN()}, {0, 50, 5.0}, {0, 60, 4.0}},
+			exp:    &medianMapOutput{Time: 10, Val: 3},
+		},
+		{
+			name:   "even uses the later central point",
+			points: []point{{0, 10, 1.0}, {0, 20, 4.0}, {0, 30, 3.0}, {0, 40, 2.0}},
+			exp:    &medianMapOutput{Time: 40, Val: 2.5},
+		},
+		{
+			name:   "even with equal central values",
+			points: []point{{0, 30, 2.0}, {0, 10, 2.0}},
+			exp:    &medianMapOutput{Time: 30, Val: 2},
+		},
+		{
+			name: "empty",
+			exp:  nil,
+		},
+	}
+
+	c := &Call{Name: "median", Args: []Expr{&VarRef{Val: "field1"}, &StringLiteral{Val: "time"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		// Split the points over two mappers to exercise the merge in the reducer.
+		var outputs []interface{}
+		half := len(tt.points) / 2
+		for _, points := range [][]point{tt.points[:half], tt.points[half:]} {
+			b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, v)
+		}
+
+		got := reduceFunc(outputs)
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: output mismatch: exp %v got %v", tt.name, tt.exp, got)
+			continue
+		}
+
+		// The timestamp must belong to an input point.
+		if got, ok := got.(*medianMapOutput); ok {
+			found := false
+			for _, p := range tt.points {
+				found = found || p.timestamp == got.Time
+			}
+			if !found {
+				t.Errorf("%s: timestamp %d isn't the timestamp of any point", tt.name, got.Time)
+			}
+		}
+	}
+
+	c = &Call{Name: "median", Args: []Expr{&VarRef{Val: "field1"}, &StringLiteral{Val: "point"}}}
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != "unexpected argument 'point' in median()" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReducePercentileRank(t *testing.T) {
+	// 1 through 100 spread over two mappers and a NaN value that is left out.
+	var a, b []interface{}
+	for i := 1; i <= 100; i++ {
+		if i%2 == 0 {
+			a = append(a, float64(i))
+		} else {
+			b = append(b, float64(i))
+		}
+	}
+	input := []interface{}{a, nil, append(b, math.NaN())}
+
+	tests := []struct {
+		threshold float64
+		exp       interface{}
+	}{
+		{1, 1.0},
+		{50, 50.0},
+		{50.5, 50.0},
+		{100, 100.0},
+		{1000, 100.0},
+		{0, 0.0},
+	}
+	for _, tt := range tests {
+		if got := ReducePercentileRank(tt.threshold)(input); got != tt.exp {
+			t.Errorf("percentile_rank(%v): output mismatch: exp %v got %v", tt.threshold, tt.exp, got)
+		}
+	}
+
+	if got := ReducePercentileRank(50)([]interface{}{nil, []interface{}{}}); got != nil {
+		t.Errorf("expected nil for no values. got %v", got)
+	}
+
+	c := &Call{Name: "percentile_rank", Args: []Expr{&VarRef{Val: "field1"}, &StringLiteral{Val: "50"}}}
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected numeric value in percentile_rank()" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReduceVarianceBoundaries(t *testing.T) {
+	data := map[string][]float64{
+		"zero": nil,
+		"one":  {3},
+		"two":  {1, 3},
+		"many": {2, 4, 4, 4, 5, 5, 7, 9},
+	}
+
+	tests := []struct {
+		name string
+		fn   ReduceFunc
+		exp  map[string]interface{}
+	}{
+		{"stddev", ReduceStddev, map[string]interface{}{"zero": nil, "one": nil, "two": math.Sqrt2, "many": math.Sqrt(32.0 / 7)}},
+		{"stddev one pass", nil, map[string]interface{}{"zero": nil, "one": nil, "two": math.Sqrt2, "many": math.Sqrt(32.0 / 7)}},
+		{"variance", ReduceVariance, map[string]interface{}{"zero": nil, "one": nil, "two": 2.0, "many": 32.0 / 7}},
+		{"stddev_pop", ReducePopulationStddev, map[string]interface{}{"zero": nil, "one": 0.0, "two": 1.0, "many": 2.0}},
+		{"variance_pop", ReducePopulationVariance, map[string]interface{}{"zero": nil, "one": 0.0, "two": 1.0, "many": 4.0}},
+	}
+
+	for _, tt := range tests {
+		for size, values := range data {
+			var got interface{}
+			if tt.fn == nil {
+				var points []point
+				for i, v := range values {
+					points = append(points, point{0, int64(i), v})
+				}
+				got = ReduceStddevOnePass([]interface{}{MapStddevOnePass(&testIterator{values: points})})
+			} else {
+				got = tt.fn([]interface{}{values})
+			}
+
+			exp := tt.exp[size]
+			if exp == nil || got == nil {
+				if got != exp {
+					t.Errorf("%s of %s points: exp %v got %v", tt.name, size, exp, got)
+				}
+			} else if math.Abs(got.(float64)-exp.(float64)) > 1e-12 {
+				t.Errorf("%s of %s points: exp %v got %v", tt.name, size, exp, got)
+			}
+		}
+	}
+}
+
+type sortedIterator struct {
+	testIterator
+	nexts int
+}
+
+func (s *sortedIterator) Sorted() bool { return true }
+
+func (s *sortedIterator) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
+	s.nexts++
+	return s.testIterator.Next()
+}
+
+func TestMapSortedIterator(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []point
+	}{
+		{"empty", nil},
+		{"single", []point{{0, 1, 5.0}}},
+		{"sorted", []point{{0, 3, -2.0}, {0, 1, "a"}, {0, 2, int64(1)}, {0, 5, 4.5}, {0, 4, 9.0}, {0, 6, true}}},
+	}
+
+	for _, tt := range tests {
+		for _, fn := range []struct {
+			name string
+			fn   MapFunc
+		}{{"min", MapMin}, {"max", MapMax}, {"spread", MapSpread}} {
+			exp := fn.fn(&testIterator{values: tt.points})
+			if got := fn.fn(&sortedIterator{testIterator: testIterator{values: tt.points}}); !reflect.DeepEqual(got, exp) {
+				t.Errorf("%s of %s points: exp %v got %v", fn.name, tt.name, exp, got)
+			}
+		}
+	}
+
+	// min stops at the first numeric value
+	itr := &sortedIterator{testIterator: testIterator{values: []point{{0, 1, "a"}, {0, 2, 1.0}, {0, 3, 2.0}, {0, 4, 3.0}}}}
+	if got := MapMin(itr); got != 1.0 || itr.nexts != 2 {
+		t.Errorf("exp min 1 after 2 points. got %v after %d", got, itr.nexts)
+	}
+}
+
+func TestReduceTopFrequent(t *testing.T) {
+	c := &Call{Name: "top_frequent", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 3}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two shards with overlapping values, and one with no points.
+	shards := [][]point{
+		{{0, 1, 1.5}, {0, 2, 2.0}, {0, 3, 2.0}, {0, 4, 7.0}, {0, 5, "a"}, {0, 6, math.NaN()}},
+		{{0, 7, 1.5}, {0, 8, 1.5}, {0, 9, int64(2)}, {0, 10, 5.0}, {0, 11, 5.0}, {0, 12, 7.0}},
+		nil,
+	}
+	var outputs []interface{}
+	for _, points := range shards {
+		b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, v)
+	}
+
+	// 2 and 1.5 occur three times each, and 5 and 7 twice each, so 5 wins the tie.
+	exp := []frequentValue{{Value: 1.5, Count: 3}, {Value: 2, Count: 3}, {Value: 5, Count: 2}}
+	if got := reduceFunc(outputs); !reflect.DeepEqual(got, exp) {
+		t.Errorf("output mismatch: exp %v got %v", exp, got)
+	}
+
+	// Fewer distinct values than requested returns them all.
+	if got := ReduceTopFrequent(10)(outputs).([]frequentValue); len(got) != 4 {
+		t.Errorf("expected 4 values. got %v", got)
+	}
+	if got := reduceFunc([]interface{}{outputs[2]}); got != nil {
+		t.Errorf("expected nil for no values. got %v", got)
+	}
+
+	for _, args := range [][]Expr{
+		{&VarRef{Val: "field1"}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0}},
+		{&VarRef{Val: "field1"}, &NumberLiteral{Val: 2.5}},
+	} {
+		c := &Call{Name: "top_frequent", Args: args}
+		if _, err := InitializeMapFunc(c); err == nil {
+			t.Errorf("InitializeMapFunc(%v) expected error. got nil", c)
+		}
+	}
+}
+
+func TestReduceRawQueryOrder(t *testing.T) {
+	// Shuffle points with some equal timestamps over three mappers. Points with equal timestamps are told apart
+	// by their values, which increase in the order of the mappers.
+	var points []*rawQueryMapOutput
+	for i := 0; i < 30; i++ {
+		points = append(points, &rawQueryMapOutput{int64(i / 3), float64(i)})
+	}
+	rnd := rand.New(rand.NewSource(1))
+	outputs := make([]interface{}, 3)
+	for _, i := range rnd.Perm(len(points)) {
+		p := points[i]
+		j := int(p.Values.(float64)) % 3
+		if outputs[j] == nil {
+			outputs[j] = []*rawQueryMapOutput{}
+		}
+		outputs[j] = append(outputs[j].([]*rawQueryMapOutput), p)
+	}
+
+	for _, q := range []string{`SELECT value FROM cpu`, `SELECT value FROM cpu ORDER BY ASC`, `SELECT value FROM cpu ORDER BY DESC`} {
+		stmt, err := NewParser(strings.NewReader(q)).ParseStatement()
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+		reduceFunc, err := InitializeRawReduceFunc(stmt.(*SelectStatement))
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+		got := reduceFunc(outputs).([]*rawQueryMapOutput)
+		if len(got) != len(points) {
+			t.Fatalf("%s: expected %d points. got %d", q, len(points), len(got))
+		}
+		for i := 1; i < len(got); i++ {
+			prev, p := got[i-1], got[i]
+			if p.Timestamp == prev.Timestamp {
+				if p.Values.(float64) < prev.Values.(float64) {
+					t.Errorf("%s: points with time %d out of mapper order: %v before %v", q, p.Timestamp, prev.Values, p.Values)
+				}
+			} else if (p.Timestamp < prev.Timestamp) != stmt.(*SelectStatement).IsTimeDescending() {
+				t.Errorf("%s: point at %d out of order after %d", q, p.Timestamp, prev.Timestamp)
+			}
+		}
+	}
+}
+
+func TestLimitRawQuery(t *testing.T) {
+	input := []interface{}{
+		[]*rawQueryMapOutput{{30, 3.0}, {10, 1.0}},
+		nil,
+		[]*rawQueryMapOutput{{20, 2.0}, {40, 4.0}},
+	}
+
+	tests := []struct {
+		offset, limit int
+		exp           []int64
+	}{
+		{0, 10, []int64{10, 20, 30, 40}},
+		{1, 2, []int64{20, 30}},
+		{3, 2, []int64{40}},
+		{4, 2, nil},
+		{10, 2, nil},
+		{0, 0, nil},
+	}
+	for _, tt := range tests {
+		fn, err := LimitRawQuery(ReduceRawQuery(false), tt.offset, tt.limit)
+		if err != nil {
+			t.Fatalf("offset %d limit %d: %s", tt.offset, tt.limit, err)
+		}
+		got, ok := fn(input).([]*rawQueryMapOutput)
+		if !ok {
+			t.Fatalf("offset %d limit %d: unexpected output %v", tt.offset, tt.limit, fn(input))
+		}
+		var times []int64
+		for _, p := range got {
+			times = append(times, p.Timestamp)
+		}
+		if !reflect.DeepEqual(times, tt.exp) {
+			t.Errorf("offset %d limit %d: exp %v got %v", tt.offset, tt.limit, tt.exp, times)
+		}
+	}
+
+	if _, err := LimitRawQuery(ReduceRawQuery(false), -1, 2); err == nil || err.Error() != "invalid offset -1: must be >= 0" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := LimitRawQuery(ReduceRawQuery(false), 0, -2); err == nil || err.Error() != "invalid limit -2: must be >= 0" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// A statement limit of 0 is no limit.
+	stmt, err := NewParser(strings.NewReader(`SELECT value FROM cpu ORDER BY DESC OFFSET 1`)).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, err := InitializeRawReduceFunc(stmt.(*SelectStatement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fn(input).([]*rawQueryMapOutput); len(got) != 3 || got[0].Timestamp != 30 {
+		t.Errorf("unexpected output %v", got)
+	}
+}
+
+func TestSumOfSquares(t *testing.T) {
+	c := &Call{Name: "sum_of_squares", Args: []Expr{&VarRef{Val: "field1"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := [][]point{
+		{{0, 1, 1.0}, {0, 2, -2.0}, {0, 3, nil}, {0, 4, "a"}},
+		{{0, 5, int64(3)}, {0, 6, 0.5}},
+		nil,
+	}
+	var outputs []interface{}
+	for _, points := range shards {
+		b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, v)
+	}
+
+	// 1 + 4 + 9 + 0.25
+	if got := reduceFunc(outputs); got != 14.25 {
+		t.Errorf("output mismatch: exp 14.25 got %v", got)
+	}
+	if got := reduceFunc([]interface{}{mapFunc(&testIterator{})}); got != nil {
+		t.Errorf("expected nil for no values. got %v", got)
+	}
+}
+
+func TestReduceRMS(t *testing.T) {
+	c := &Call{Name: "rms", Args: []Expr{&VarRef{Val: "field1"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reduce := func(shards ...[]point) interface{} {
+		var outputs []interface{}
+		for _, points := range shards {
+			b, err := json.Marshal(mapFunc(&testIterator{values: points}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, v)
+		}
+		return reduceFunc(outputs)
+	}
+
+	// an alternating signal of amplitude 1
+	var signal []point
+	for i := 0; i < 100; i++ {
+		signal = append(signal, point{0, int64(i), float64(1 - 2*(i%2))})
+	}
+	if got := reduce(signal); got != 1.0 {
+		t.Errorf("alternating signal: exp 1 got %v", got)
+	}
+
+	// sqrt((9 + 16 + 1 + 1 + 4 + 1) / 8) = 2 over shards of different sizes, one of them empty
+	got := reduce([]point{{0, 1, 3.0}, {0, 2, -4.0}}, nil, []point{{0, 3, 1.0}, {0, 4, -1.0}, {0, 5, int64(2)}, {0, 6, 1.0}, {0, 7, 0.0}, {0, 8, 0.0}})
+	if got != 2.0 {
+		t.Errorf("shards: exp 2 got %v", got)
+	}
+
+	if got := reduce(nil, nil); got != nil {
+		t.Errorf("expected nil for no values. got %v", got)
+	}
+	if _, err := InitializeMapFunc(&Call{Name: "rms", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 2}}}); err == nil {
+		t.Errorf("expected error for two arguments")
+	}
+}
+
+func TestReduceCountGaps(t *testing.T) {
+	s := int64(time.Second)
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{
+			name:   "regular",
+			values: []interface{}{[]*rawQueryMapOutput{{0, 1.0}, {10 * s, 1.0}, {20 * s, 1.0}, {30 * s, 1.0}}},
+			exp:    0.0,
+		},
+		{
+			// gaps of 10s, 25s, 10s, 11s and 40s over two mappers
+			name: "irregular",
+			values: []interface{}{
+				[]*rawQueryMapOutput{{45 * s, 1.0}, {0, 1.0}, {96 * s, 1.0}},
+				nil,
+				[]*rawQueryMapOutput{{10 * s, 1.0}, {35 * s, 1.0}, {56 * s, 1.0}},
+			},
+			exp: 3.0,
+		},
+		{
+			name:   "single point",
+			values: []interface{}{[]*rawQueryMapOutput{{0, 1.0}}},
+			exp:    0.0,
+		},
+		{
+			name:   "no points",
+			values: []interface{}{nil},
+			exp:    0.0,
+		},
+	}
+
+	c := &Call{Name: "count_gaps", Args: []Expr{&VarRef{Val: "field1"}, &DurationLiteral{Val: 10 * time.Second}}}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := reduceFunc(tt.values); got != tt.exp {
+			t.Errorf("%s: output mismatch: exp %v got %v", tt.name, tt.exp, got)
+		}
+	}
+
+	// an interval in nanoseconds
+	c.Args[1] = &NumberLiteral{Val: float64(20 * s)}
+	if reduceFunc, err = InitializeReduceFunc(c); err != nil {
+		t.Fatal(err)
+	} else if got := reduceFunc(tests[1].values); got != 2.0 {
+		t.Errorf("nanosecond interval: exp 2 got %v", got)
+	}
+
+	for _, arg := range []Expr{&DurationLiteral{Val: 0}, &NumberLiteral{Val: -1}, &StringLiteral{Val: "10s"}} {
+		c := &Call{Name: "count_gaps", Args: []Expr{&VarRef{Val: "field1"}, arg}}
+		if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected positive duration interval in count_gaps()" {
+			t.Errorf("%s: unexpected error: %v", c, err)
+		}
+	}
+}
+
+func TestReduceRatio(t *testing.T) {
+	reduce := func(q string, mappers ...[]point) interface{} {
+		expr, err := ParseExpr(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		if !MultiFieldCall(c) {
+			t.Fatalf("expected %s to read every field", q)
+		}
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var outputs []interface{}
+		for _, values := range mappers {
+			out := mapFunc(&testIterator{values: values})
+			if out == nil {
+				outputs = append(outputs, nil)
+				continue
+			}
+			b, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, err := unmarshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, o)
+		}
+		return reduceFunc(outputs)
+	}
+	requests := func(errors, total interface{}) map[string]interface{} {
+		return map[string]interface{}{"errors": errors, "total": total}
+	}
+
+	// (1 + 2 + 2) / (10 + 20 + 20), skipping the points without a numeric value for both fields
+	mappers := [][]point{
+		{{0, 1, requests(1.0, 10.0)}, {0, 2, requests(nil, 50.0)}, {0, 3, map[string]interface{}{"errors": 7.0}}},
+		{{0, 4, requests(int64(2), 20.0)}, {0, 5, requests(2.0, int64(20))}, {0, 6, requests(3.0, "n/a")}},
+		nil,
+	}
+	if got := reduce("ratio(errors, total)", mappers...); got != 0.1 {
+		t.Errorf("ratio: exp 0.1, got %v", got)
+	}
+	if got := reduce("percentage(errors, total)", mappers...); got != 10.0 {
+		t.Errorf("percentage: exp 10, got %v", got)
+	}
+
+	if got := reduce("ratio(errors, total)", []point{{0, 1, requests(1.0, 0.0)}}, []point{{0, 2, requests(2.0, nil)}}); got != nil {
+		t.Errorf("zero denominator: exp nil, got %v", got)
+	}
+	if got := reduce("percentage(errors, total)", nil); got != nil {
+		t.Errorf("no points: exp nil, got %v", got)
+	}
+
+	for _, q := range []string{"ratio(errors)", "ratio(errors, 2)", "percentage(errors, total, other)"} {
+		expr, err := ParseExpr(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		if _, err := InitializeMapFunc(c); err == nil || err.Error() != fmt.Sprintf("expected numerator and denominator fields for %s()", c.Name) {
+			t.Errorf("%s: expected fields error. got %v", q, err)
+		}
+	}
+}
+
+func TestReducePercentileDedupe(t *testing.T) {
+	c := &Call{Name: "percentile", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 50}, &StringLiteral{Val: "dedupe"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replicas overlap on the points at 3 and 4, which would make 9 the median if counted twice. The point at 5
+	// has the same value as the one at 4 but a different time, so it isn't a duplicate.
+	replicas := [][]point{
+		{{0, 1, 1.0}, {0, 2, 2.0}, {0, 3, 9.0}, {0, 4, 9.0}},
+		{{0, 3, 9.0}, {0, 4, int64(9)}, {0, 5, 9.0}, {0, 6, 3.0}},
+		nil,
+	}
+	var outputs []interface{}
+	for i, points := range replicas {
+		out := mapFunc(&testIterator{values: points})
+		// the first replica is local and the others are remote
+		if i > 0 {
+			b, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err = unmarshal(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		outputs = append(outputs, out)
+	}
+
+	// the deduplicated values are 1, 2, 3, 9, 9 and 9
+	if got := reduceFunc(outputs); got != 3.0 {
+		t.Errorf("exp 3 got %v", got)
+	}
+	if got := ReducePercentile(50)([]interface{}{[]interface{}{1.0, 2.0, 9.0, 9.0}, []interface{}{9.0, 9.0, 9.0, 3.0}}); got != 9.0 {
+		t.Errorf("without dedupe: exp 9 got %v", got)
+	}
+	if got := reduceFunc([]interface{}{nil}); got != nil {
+		t.Errorf("expected nil for no values. got %v", got)
+	}
+}
+
+// naiveMovingExtremeOf scans every window for its extreme, to check movingExtremeOf against.
+func naiveMovingExtremeOf(points []*rawQueryMapOutput, w MovingWindow, max bool) []*rawQueryMapOutput {
+	var results []*rawQueryMapOutput
+	w.each(points, func(timestamp int64, window []float64) {
+		extreme := window[0]
+		for _, v := range window[1:] {
+			if (max && v > extreme) || (!max && v < extreme) {
+				extreme = v
+			}
+		}
+		results = append(results, &rawQueryMapOutput{timestamp, extreme})
+	})
+	return results
+}
+
+// randomWalk returns n points a second apart, some missing, whose values are a random walk with repeats.
+func randomWalk(n int) []*rawQueryMapOutput {
+	rnd := rand.New(rand.NewSource(1))
+	points := make([]*rawQueryMapOutput, 0, n)
+	var v float64
+	for i := 0; len(points) < n; i++ {
+		if rnd.Intn(10) == 0 {
+			continue
+		}
+		v += float64(rnd.Intn(5) - 2)
+		points = append(points, &rawQueryMapOutput{int64(i) * int64(time.Second), v})
+	}
+	return points
+}
+
+func TestReduceMovingExtreme(t *testing.T) {
+	points := randomWalk(1000)
+	windows := []MovingWindow{{Points: 1}, {Points: 2}, {Points: 7}, {Points: 100}, {Duration: 10 * time.Second}, {Duration: 5 * time.Minute}}
+	for _, w := range windows {
+		for _, max := range []bool{false, true} {
+			exp := naiveMovingExtremeOf(points, w, max)
+			// split the points over two mappers in reverse order
+			var a, b []*rawQueryMapOutput
+			for i := len(points) - 1; i >= 0; i-- {
+				if i%3 == 0 {
+					a = append(a, points[i])
+				} else {
+					b = append(b, points[i])
+				}
+			}
+			got, _ := ReduceMovingExtreme(w, max)([]interface{}{a, nil, b}).([]*rawQueryMapOutput)
+			if !reflect.DeepEqual(got, exp) {
+				t.Errorf("window %+v max %v: output mismatch", w, max)
+			}
+		}
+	}
+
+	if got := ReduceMovingExtreme(MovingWindow{Points: 3}, false)([]interface{}{points[:2]}); got != nil {
+		t.Errorf("window larger than data: exp nil got %v", got)
+	}
+
+	// integer values are compared like floats and returned as integers, non-numeric values are skipped
+	s := int64(time.Second)
+	mixed := []interface{}{[]*rawQueryMapOutput{{1 * s, int64(3)}, {2 * s, "a"}, {3 * s, int64(1)}, {4 * s, false}, {5 * s, 2.5}}}
+	for _, tt := range []struct {
+		max bool
+		exp []*rawQueryMapOutput
+	}{
+		{false, []*rawQueryMapOutput{{3 * s, int64(1)}, {5 * s, int64(1)}}},
+		{true, []*rawQueryMapOutput{{3 * s, int64(3)}, {5 * s, 2.5}}},
+	} {
+		if got, _ := ReduceMovingExtreme(MovingWindow{Points: 2}, tt.max)(mixed).([]*rawQueryMapOutput); !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("mixed values max %v: exp %v got %v", tt.max, tt.exp, got)
+		}
+	}
+	if got := ReduceMovingExtreme(MovingWindow{Points: 1}, true)([]interface{}{[]*rawQueryMapOutput{{s, "a"}}}); got != nil {
+		t.Errorf("non-numeric values: exp nil got %v", got)
+	}
+
+	c := &Call{Name: "moving_max", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 0}}}
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected field and window size for moving_max()" {
+		t.Errorf("InitializeMapFunc(%v) expected window size error. got %v", c, err)
+	}
+}
+
+func BenchmarkMovingMaxNaive(b *testing.B) {
+	points := randomWalk(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		naiveMovingExtremeOf(points, MovingWindow{Points: 1000}, true)
+	}
+}
+
+func BenchmarkMovingMax(b *testing.B) {
+	points := randomWalk(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		movingExtremeOf(points, MovingWindow{Points: 1000}, true)
+	}
+}
+
+func TestReduceTimeWeightedMean(t *testing.T) {
+	s := int64(time.Second)
+	tests := []struct {
+		name   string
+		values []interface{}
+		exp    interface{}
+	}{
+		{
+			name: "constant with irregular spacing",
+			values: []interface{}{
+				[]*rawQueryMapOutput{{0, 5.0}, {1 * s, 5.0}, {2 * s, int64(5)}},
+				nil,
+				[]*rawQueryMapOutput{{90 * s, 5.0}, {3 * s, 5.0}, {100 * s, 5.0}},
+			},
+			exp: 5.0,
+		},
+		{
+			// 0 holds for 50s, then ten samples of 10 a second apart and 0 again for the remaining 40s. The
+			// arithmetic mean is 10*10/12, but 10 only held for 10 of the 100s.
+			name: "clustered samples",
+			values: []interface{}{
+				[]*rawQueryMapOutput{{0, 0.0}, {50 * s, 10.0}, {51 * s, 10.0}, {52 * s, 10.0}, {53 * s, 10.0}, {54 * s, 10.0}},
+				[]*rawQueryMapOutput{{55 * s, 10.0}, {56 * s, 10.0}, {57 * s, 10.0}, {58 * s, 10.0}, {59 * s, 10.0}},
+				[]*rawQueryMapOutput{{60 * s, 0.0}, {100 * s, 0.0}},
+			},
+			exp: 1.0,
+		},
+		{
+			name:   "single point",
+			values: []interface{}{[]*rawQueryMapOutput{{10 * s, 3.0}, {20 * s, "a"}}},
+			exp:    3.0,
+		},
+		{
+			name:   "no duration",
+			values: []interface{}{[]*rawQueryMapOutput{{10 * s, 3.0}}, []*rawQueryMapOutput{{10 * s, 4.0}}},
+			exp:    nil,
+		},
+		{
+			name:   "no points",
+			values: []interface{}{nil},
+			exp:    nil,
+		},
+	}
+
+	c := &Call{Name: "time_weighted_mean", Args: []Expr{&VarRef{Val: "field1"}}}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := reduceFunc(tt.values); got != tt.exp {
+			t.Errorf("%s: output mismatch: exp %v got %v", tt.name, tt.exp, got)
+		}
+	}
+}
+
+func TestReduceMeanOverTime(t *testing.T) {
+	s := int64(time.Second)
+	// 2 for 10s and then 4 until the series ends at 15s, before the 30s boundary
+	input := []interface{}{
+		[]*rawQueryMapOutput{{10 * s, 4.0}},
+		nil,
+		[]*rawQueryMapOutput{{0, 2.0}, {15 * s, 4.0}},
+	}
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		end      int64
+		exp      interface{}
+	}{
+		// the last value is carried forward to the boundary at 30s: (2*10 + 4*20) / 30
+		{"carried to the boundary", 30 * time.Second, 60 * s, 100.0 / 30},
+		// the boundary at 20s is before the end of the interval: (2*10 + 4*10) / 20
+		{"carried to a shorter boundary", 20 * time.Second, 60 * s, 3.0},
+		// the interval ends at 25s, before the boundary: (2*10 + 4*15) / 25
+		{"carried to the end of the interval", 30 * time.Second, 25 * s, 3.2},
+		// the interval ends before the last point, so nothing is carried forward: (2*10 + 4*5) / 15
+		{"end before the last point", 30 * time.Second, 12 * s, 40.0 / 15},
+	}
+	for _, tt := range tests {
+		got := ReduceMeanOverTime(tt.interval)(input, 0, tt.end)
+		if f, ok := got.(float64); !ok || math.Abs(f-tt.exp.(float64)) > 1e-12 {
+			t.Errorf("%s: exp %v got %v", tt.name, tt.exp, got)
+		}
+	}
+
+	// a single point holds its value to the boundary
+	if got := ReduceMeanOverTime(time.Minute)([]interface{}{[]*rawQueryMapOutput{{10 * s, 7.0}}}, 0, 60*s); got != 7.0 {
+		t.Errorf("single point: exp 7 got %v", got)
+	}
+	// a point at the end of the interval spans no time
+	if got := ReduceMeanOverTime(time.Minute)([]interface{}{[]*rawQueryMapOutput{{60 * s, 7.0}}}, 0, 60*s); got != nil {
+		t.Errorf("no duration: exp nil got %v", got)
+	}
+	if got := ReduceMeanOverTime(time.Minute)([]interface{}{nil}, 0, 60*s); got != nil {
+		t.Errorf("no points: exp nil got %v", got)
+	}
+
+	// without bounds, the last value is carried to the boundary
+	c := &Call{Name: "mean_over_time", Args: []Expr{&VarRef{Val: "field1"}, &DurationLiteral{Val: 30 * time.Second}}}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reduceFunc(input); got != 100.0/30 {
+		t.Errorf("unbounded: exp %v got %v", 100.0/30, got)
+	}
+	if InitializeBoundedReduceFunc(c) == nil {
+		t.Error("expected a bounded reducer for mean_over_time()")
+	}
+
+	c = &Call{Name: "mean_over_time", Args: []Expr{&VarRef{Val: "field1"}, &NumberLiteral{Val: 30}}}
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected positive duration interval in mean_over_time()" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMinMaxNonFinite(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	tests := []struct {
+		name             string
+		points           []point
+		min, max         interface{}
+		minTime, maxTime int64
+	}{
+		{"first", []point{{0, 1, nan}, {0, 2, 3.0}, {0, 3, 1.0}}, 1.0, 3.0, 3, 2},
+		{"only", []point{{0, 1, nan}}, nil, nil, 0, 0},
+		{"interspersed", []point{{0, 1, 2.0}, {0, 2, nan}, {0, 3, -inf}, {0, 4, 5.0}, {0, 5, inf}, {0, 6, nan}}, 2.0, 5.0, 1, 4},
+	}
+
+	for _, tt := range tests {
+		if got := MapMin(&testIterator{values: tt.points}); got != tt.min {
+			t.Errorf("MapMin of %s: exp %v got %v", tt.name, tt.min, got)
+		}
+		if got := MapMax(&testIterator{values: tt.points}); got != tt.max {
+			t.Errorf("MapMax of %s: exp %v got %v", tt.name, tt.max, got)
+		}
+
+		var values []interface{}
+		for _, p := range tt.points {
+			values = append(values, p.value)
+		}
+		if got := ReduceMin(values); got != tt.min {
+			t.Errorf("ReduceMin of %s: exp %v got %v", tt.name, tt.min, got)
+		}
+		if got := ReduceMax(values); got != tt.max {
+			t.Errorf("ReduceMax of %s: exp %v got %v", tt.name, tt.max, got)
+		}
+
+		// min() and max() with 'time' or 'point', and all_min() and all_max(), skip them too
+		var fields []point
+		for _, p := range tt.points {
+			fields = append(fields, point{p.seriesID, p.timestamp, map[string]interface{}{"value": p.value}})
+		}
+		for _, selector := range []struct {
+			name string
+			exp  interface{}
+			ts   int64
+			fn   func() interface{}
+		}{
+			{"MapMinWithTime", tt.min, tt.minTime, func() interface{} { return MapMinWithTime(&testIterator{values: tt.points}) }},
+			{"MapMaxWithTime", tt.max, tt.maxTime, func() interface{} { return MapMaxWithTime(&testIterator{values: tt.points}) }},
+			{"MapAllMin", tt.min, tt.minTime, func() interface{} { return MapAllMin(&testIterator{values: tt.points}) }},
+			{"MapAllMax", tt.max, tt.maxTime, func() interface{} { return MapAllMax(&testIterator{values: tt.points}) }},
+			{"min point", tt.min, tt.minTime, func() interface{} { return MapSelectPoint("min", "value")(&testIterator{values: fields}) }},
+			{"max point", tt.max, tt.maxTime, func() interface{} { return MapSelectPoint("max", "value")(&testIterator{values: fields}) }},
+		} {
+			var val interface{}
+			var ts int64
+			switch o := selector.fn().(type) {
+			case *minMaxMapOutput:
+				val, ts = o.Val, o.Time
+			case []*rawQueryMapOutput:
+				if len(o) != 1 {
+					t.Errorf("%s of %s: exp a single point got %v", selector.name, tt.name, o)
+					continue
+				}
+				val, ts = o[0].Values, o[0].Timestamp
+			case *Point:
+				val, ts = o.Values.(map[string]interface{})["value"], o.Timestamp
+			}
+			if val != selector.exp || ts != selector.ts {
+				t.Errorf("%s of %s: exp %v at %d got %v at %d", selector.name, tt.name, selector.exp, selector.ts, val, ts)
+			}
+		}
+	}
+
+	// the sorted fast path skips them too
+	points := []point{{0, 1, -inf}, {0, 2, 1.0}, {0, 3, 4.0}, {0, 4, inf}}
+	if got := MapMin(&sortedIterator{testIterator: testIterator{values: points}}); got != 1.0 {
+		t.Errorf("sorted MapMin: exp 1 got %v", got)
+	}
+	if got := MapMax(&sortedIterator{testIterator: testIterator{values: points}}); got != 4.0 {
+		t.Errorf("sorted MapMax: exp 4 got %v", got)
+	}
+}
+
+func TestReduceDistinctChanges(t *testing.T) {
+	c := &Call{Name: "distinct_changes", Args: []Expr{&VarRef{Val: "value"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intervals := []struct {
+		name   string
+		points []point
+		exp    interface{}
+	}{
+		{"first", []point{{0, 1, "a"}, {0, 2, "b"}, {0, 3, "a"}}, 2.0},
+		{"same", []point{{0, 4, "b"}, {0, 5, "a"}}, nil},
+		{"grows", []point{{0, 6, "a"}, {0, 7, "c"}, {0, 8, "b"}}, 3.0},
+		{"same values, different points", []point{{0, 9, "c"}, {0, 10, "b"}, {0, 11, "a"}, {0, 12, "c"}}, nil},
+		{"shrinks", []point{{0, 13, "c"}}, 1.0},
+		{"replaced", []point{{0, 14, "d"}}, 1.0},
+		{"empty", nil, 0.0},
+		{"still empty", nil, nil},
+	}
+
+	for _, tt := range intervals {
+		// half of the points come from a remote shard
+		n := len(tt.points) / 2
+		b, err := json.Marshal(mapFunc(&testIterator{values: tt.points[n:]}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local := mapFunc(&testIterator{values: tt.points[:n]})
+		if got := reduceFunc([]interface{}{local, remote}); got != tt.exp {
+			t.Errorf("%s: exp %v got %v", tt.name, tt.exp, got)
+		}
+	}
+
+	// every call starts over
+	reduceFunc, err = InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reduceFunc([]interface{}{mapFunc(&testIterator{values: []point{{0, 1, "a"}, {0, 2, "b"}}})}); got != 2.0 {
+		t.Errorf("new reducer: exp 2 got %v", got)
+	}
+}
+
+func TestReduceMedianWithOptions(t *testing.T) {
+	even := []interface{}{[]float64{4, 1, math.NaN()}, nil, []float64{3, 2}}
+	odd := []interface{}{[]float64{5, 1, 4}, []float64{2, 3}}
+
+	tests := []struct {
+		name string
+		mode MedianEvenMode
+		exp  float64
+	}{
+		{"average", MedianAverage, 2.5},
+		{"lower", MedianLower, 2},
+		{"upper", MedianUpper, 3},
+	}
+	for _, tt := range tests {
+		fn := ReduceMedianWithOptions(MedianOptions{EvenMode: tt.mode})
+		if got := fn(even); got != tt.exp {
+			t.Errorf("%s of even values: exp %v got %v", tt.name, tt.exp, got)
+		}
+		if got := fn(odd); got != 3.0 {
+			t.Errorf("%s of odd values: exp 3 got %v", tt.name, got)
+		}
+
+		// the flags are passed on by median()
+		c := &Call{Name: "median", Args: []Expr{&VarRef{Val: "value"}}}
+		if tt.mode != MedianAverage {
+			c.Args = append(c.Args, &StringLiteral{Val: tt.name})
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reduceFunc(even); got != tt.exp {
+			t.Errorf("%s: exp %v got %v", c, tt.exp, got)
+		}
+	}
+
+	if got := ReduceMedian(even); got != 2.5 {
+		t.Errorf("ReduceMedian: exp 2.5 got %v", got)
+	}
+	c := &Call{Name: "median", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "middle"}}}
+	if _, err := InitializeMapFunc(c); err == nil || err.Error() != `unexpected argument 'middle' in median()` {
+		t.Errorf("exp error for unknown flag. got %v", err)
+	}
+}
+
+func TestReduceLTTB(t *testing.T) {
+	c := &Call{Name: "lttb", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 5}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a flat line with a peak and a trough, split between a local and a remote shard
+	var local, remote []point
+	for i := int64(0); i < 30; i++ {
+		v := 1.0
+		switch i {
+		case 8:
+			v = 10
+		case 21:
+			v = -8
+		}
+		if i%2 == 0 {
+			local = append(local, point{0, i * 10, v})
+		} else {
+			remote = append(remote, point{0, i * 10, v})
+		}
+	}
+	b, err := json.Marshal(mapFunc(&testIterator{values: remote}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := reduceFunc([]interface{}{mapFunc(&testIterator{values: local}), r}).([]*rawQueryMapOutput)
+	if !ok || len(got) != 5 {
+		t.Fatalf("exp 5 points. got %v", got)
+	}
+	if got[0].Timestamp != 0 || got[4].Timestamp != 290 {
+		t.Errorf("exp the first and last points to be kept. got %d and %d", got[0].Timestamp, got[4].Timestamp)
+	}
+	var peak, trough bool
+	for i, p := range got {
+		if i > 0 && p.Timestamp <= got[i-1].Timestamp {
+			t.Errorf("points out of order: %d after %d", p.Timestamp, got[i-1].Timestamp)
+		}
+		peak = peak || p.Values == 10.0
+		trough = trough || p.Values == -8.0
+	}
+	if !peak || !trough {
+		t.Errorf("exp the peak and the trough to be kept. got %v", got)
+	}
+
+	// fewer points than N are returned unchanged, non-numeric values are skipped
+	few := []point{{0, 3, 2.0}, {0, 1, 1.0}, {0, 2, "a"}, {0, 4, int64(3)}}
+	got, _ = reduceFunc([]interface{}{mapFunc(&testIterator{values: few})}).([]*rawQueryMapOutput)
+	exp := []*rawQueryMapOutput{{1, 1.0}, {3, 2.0}, {4, int64(3)}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp %v got %v", exp, got)
+	}
+	if got := reduceFunc([]interface{}{nil}); got != nil {
+		t.Errorf("exp nil got %v", got)
+	}
+
+	for _, n := range []Expr{&NumberLiteral{Val: 2}, &NumberLiteral{Val: 4.5}, &StringLiteral{Val: "5"}} {
+		c := &Call{Name: "lttb", Args: []Expr{&VarRef{Val: "value"}, n}}
+		if _, err := InitializeMapFunc(c); err == nil || err.Error() != "expected integer number of points of at least 3 in lttb()" {
+			t.Errorf("%s: unexpected error %v", c, err)
+		}
+	}
+}
+
+func TestReducePercentileWithTime(t *testing.T) {
+	c := &Call{Name: "percentile", Args: []Expr{&VarRef{Val: "value"}, &NumberLiteral{Val: 90}, &StringLiteral{Val: "time"}}}
+	mapFunc, err := InitializeMapFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the values 1 to 20 at shuffled times, 18 being the p90
+	var local, remote []point
+	for i := 1; i <= 20; i++ {
+		p := point{0, int64((i * 7) % 20), float64(i)}
+		if i%2 == 0 {
+			local = append(local, p)
+		} else {
+			remote = append(remote, p)
+		}
+	}
+	b, err := json.Marshal(mapFunc(&testIterator{values: remote}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []interface{}{mapFunc(&testIterator{values: local}), r}
+
+	exp := &medianMapOutput{Time: (18 * 7) % 20, Val: 18}
+	if got := reduceFunc(values); !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp %v got %v", exp, got)
+	}
+	// the value agrees with percentile() without the flag
+	if got := ReducePercentile(90)([]interface{}{[]interface{}{1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0, 11.0, 12.0,
+		13.0, 14.0, 15.0, 16.0, 17.0, 18.0, 19.0, 20.0}}); got != exp.Val {
+		t.Errorf("ReducePercentile: exp %v got %v", exp.Val, got)
+	}
+
+	tests := []struct {
+		name       string
+		percentile float64
+		points     []point
+		exp        interface{}
+	}{
+		{"ties return the earliest point", 50, []point{{0, 5, 1.0}, {0, 9, 2.0}, {0, 3, 2.0}, {0, 7, 2.0}, {0, 1, 3.0}}, &medianMapOutput{3, 2}},
+		{"negative percentile", -20, []point{{0, 1, 1.0}, {0, 2, 5.0}, {0, 3, 4.0}, {0, 4, 5.0}, {0, 5, 2.0}}, &medianMapOutput{2, 5}},
+		{"NaN values skipped", 100, []point{{0, 1, math.NaN()}, {0, 2, 4.0}}, &medianMapOutput{2, 4}},
+		{"no points", 50, nil, nil},
+		{"no rank", 0, []point{{0, 1, 1.0}}, nil},
+	}
+	for _, tt := range tests {
+		fn := ReducePercentileWithTime(tt.percentile)
+		if got := fn([]interface{}{MapMedianWithTime(&testIterator{values: tt.points})}); !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: exp %v got %v", tt.name, tt.exp, got)
+		}
+	}
+}
+
+func TestReduceCountBeyondFloatPrecision(t *testing.T) {
+	c := &Call{Name: "count", Args: []Expr{&VarRef{Val: "value"}}}
+	reduceFunc, err := InitializeReduceFunc(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshal, err := InitializeUnmarshaller(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shards reporting counts through partials, a remote one, and one more point, for 2^53+3 points in total
+	b, err := json.Marshal(MapCount(&testIterator{values: []point{{0, 1, 1.0}, {0, 2, 2.0}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []interface{}{&Partial{Count: MaxExactFloat64 / 2}, &Partial{Count: MaxExactFloat64 / 2}, remote, int64(1)}
+
+	exp := int64(MaxExactFloat64 + 3)
+	if got := reduceFunc(values); got != exp {
+		t.Errorf("exp %d got %v", exp, got)
+	}
+	r := InitializeStreamingReducer(c)()
+	for _, v := range values {
+		r.Push(v)
+	}
+	if got := r.Result(); got != exp {
+		t.Errorf("streaming: exp %d got %v", exp, got)
+	}
+
+	// the float64 counts queries can opt into round
+	floatFunc, err := InitializeReduceFunc(&Call{Name: "count", Args: []Expr{&VarRef{Val: "value"}, &StringLiteral{Val: "float"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := floatFunc(values); got != float64(MaxExactFloat64+4) {
+		t.Errorf("float counts: exp %v got %v", float64(MaxExactFloat64+4), got)
+	}
+
+	// counts from servers predating int64 counts are floats, encoded with an exponent when large
+	for _, tt := range []struct {
+		b   string
+		exp interface{}
+	}{{"3", int64(3)}, {"1e+06", 1e6}, {"null", nil}} {
+		if got, err := unmarshal([]byte(tt.b)); err != nil || got != tt.exp {
+			t.Errorf("unmarshal %s: exp %v got %v (%v)", tt.b, tt.exp, got, err)
+		}
+	}
+}
@@ -61,6 +61,8 @@ func (s *Scanner) Scan() (tok Token, pos Pos, lit string) {
 		return MUL, pos, ""
 	case '/':
 		return DIV, pos, ""
+	case '%':
+		return MOD, pos, ""
 	case '=':
 		if ch1, _ := s.r.read(); ch1 == '~' {
 			return EQREGEX, pos, ""
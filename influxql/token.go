@@ -33,6 +33,7 @@ const (
 	SUB // -
 	MUL // *
 	DIV // /
+	MOD // %
 
 	AND // AND
 	OR  // OR
@@ -141,6 +142,7 @@ var tokens = [...]string{
 	SUB: "-",
 	MUL: "*",
 	DIV: "/",
+	MOD: "%",
 
 	AND: "AND",
 	OR:  "OR",
@@ -259,7 +261,7 @@ func (tok Token) Precedence() int {
 		return 3
 	case ADD, SUB:
 		return 4
-	case MUL, DIV:
+	case MUL, DIV, MOD:
 		return 5
 	}
 	return 0
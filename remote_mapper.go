@@ -61,7 +61,7 @@ func (m *RemoteMapper) Close() {
 // Begin sends a request to the remote server to start streaming map results
 func (m *RemoteMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int) error {
 	// get the function for unmarshaling results
-	f, err := influxql.InitializeUnmarshaller(c)
+	_, _, f, err := influxql.MapReduceFuncs(c)
 	if err != nil {
 		return err
 	}
@@ -121,6 +121,9 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 			interval = d.Nanoseconds()
 		}
 
+		// the number of points each mapper of a raw query reads
+		limit := stmt.MapperLimit()
+
 		// get the sorted unique tag sets for this query.
 		tagSets, err := m.tagSets(stmt, tagKeys)
 		if err != nil {
@@ -172,8 +175,7 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 							WhereFields:     whereFields,
 							SelectFields:    selectFields,
 							SelectTags:      selectTags,
-							Limit:           stmt.Limit,
-							Offset:          stmt.Offset,
+							Limit:           limit,
 							Interval:        interval,
 						}
 						mapper.(*RemoteMapper).SetFilters(t.Filters)
@@ -190,10 +192,8 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 							tmin:         tmin.UnixNano(),
 							tmax:         tmax.UnixNano(),
 							interval:     interval,
-							// multiple mappers may need to be merged together to get the results
-							// for a raw query. So each mapper will have to read at least the
-							// limit plus the offset in data points to ensure we've hit our mark
-							limit: uint64(stmt.Limit) + uint64(stmt.Offset),
+							limit:        uint64(limit),
+							rawMapFunc:   influxql.InitializeRawMapFunc(stmt),
 						}
 					}
 
@@ -261,6 +261,7 @@ type LocalMapper struct {
 	txn              *bolt.Tx               // read transactions by shard id
 	job              *influxql.MapReduceJob // the MRJob this mapper belongs to
 	mapFunc          influxql.MapFunc       // the map func
+	rawMapFunc       influxql.MapFunc       // the map func for raw queries, if not MapRawQuery
 	fieldID          uint8                  // the field ID associated with the mapFunc curently being run
 	fieldName        string                 // the field name associated with the mapFunc currently being run
 	keyBuffer        []int64                // the current timestamp key for each cursor
@@ -272,6 +273,7 @@ type LocalMapper struct {
 	selectFields     []*Field               // field names that occur in the select clause
 	selectTags       []string               // tag keys that occur in the select clause
 	isRaw            bool                   // if the query is a non-aggregate query
+	decodeAll        bool                   // if the map function needs all the fields of each point
 	interval         int64                  // the group by interval of the query, if any
 	limit            uint64                 // used for raw queries for LIMIT
 	perIntervalLimit int                    // used for raw queries to determine how far into a chunk we are
@@ -310,11 +312,15 @@ func (l *LocalMapper) Close() {
 // Begin will set up the mapper to run the map function for a given aggregate call starting at the passed in time
 func (l *LocalMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int) error {
 	// set up the buffers. These ensure that we return data in time order
-	mapFunc, err := influxql.InitializeMapFunc(c)
+	mapFunc, _, _, err := influxql.MapReduceFuncs(c)
 	if err != nil {
 		return err
 	}
+	if c == nil && l.rawMapFunc != nil {
+		mapFunc = l.rawMapFunc
+	}
 	l.mapFunc = mapFunc
+	l.decodeAll = influxql.MultiFieldCall(c)
 	l.keyBuffer = make([]int64, len(l.cursors))
 	l.valueBuffer = make([][]byte, len(l.cursors))
 	l.chunkSize = chunkSize
@@ -322,6 +328,7 @@ func (l *LocalMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int)
 
 	// determine if this is a raw data query with a single field, multiple fields, or an aggregate
 	var fieldName string
+	var fc *influxql.Call
 	if c == nil { // its a raw data query
 		l.isRaw = true
 		if len(l.selectFields) == 1 {
@@ -333,11 +340,21 @@ func (l *LocalMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int)
 			l.limit = math.MaxUint64
 		}
 	} else {
-		lit, ok := c.Args[0].(*influxql.VarRef)
-		if !ok {
-			return fmt.Errorf("aggregate call didn't contain a field %s", c.String())
+		// aggregates of a transform, such as max(derivative(value)), read the field of the transform, as does
+		// count(distinct(value))
+		fc = c
+		if t := influxql.Transform(c); t != nil {
+			fc = t
+		} else if d := influxql.CountDistinct(c); d != nil {
+			fc = d
+		}
+		if !influxql.CountsAll(fc) {
+			lit, ok := fc.Args[0].(*influxql.VarRef)
+			if !ok {
+				return fmt.Errorf("aggregate call didn't contain a field %s", c.String())
+			}
+			fieldName = lit.Val
 		}
-		fieldName = lit.Val
 	}
 
 	// set up the field info if a specific field was set for this mapper
@@ -346,6 +363,9 @@ func (l *LocalMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int)
 		if f == nil {
 			return fmt.Errorf("%s isn't a field on measurement %s", fieldName, l.job.MeasurementName)
 		}
+		if err := influxql.CheckFieldType(fc, f.Name, f.Type); err != nil {
+			return err
+		}
 		l.fieldID = f.ID
 		l.fieldName = f.Name
 	}
@@ -400,10 +420,15 @@ func (l *LocalMapper) NextInterval() (interface{}, error) {
 	// Execute the map function. This local mapper acts as the iterator
 	val := l.mapFunc(l)
 
-	// see if all the cursors are empty
+	// map functions that can fail return their error as the output
+	if err, ok := val.(error); ok {
+		return nil, err
+	}
+
+	// see if all the cursors are empty. An exhausted cursor has no buffered value, since a timestamp of 0 is valid
 	l.cursorsEmpty = true
-	for _, k := range l.keyBuffer {
-		if k != 0 {
+	for _, v := range l.valueBuffer {
+		if v != nil {
 			l.cursorsEmpty = false
 			break
 		}
@@ -418,19 +443,19 @@ func (l *LocalMapper) NextInterval() (interface{}, error) {
 }
 
 // Next returns the next matching timestamped value for the LocalMapper.
-func (l *LocalMapper) Next() (seriesID uint64, timestamp int64, value interface{}) {
+func (l *LocalMapper) Next() (seriesID uint64, timestamp int64, value interface{}, ok bool) {
 	for {
 		// if it's a raw query and we've hit the limit of the number of points to read in
 		// for either this chunk or for the absolute query, bail
 		if l.isRaw && (l.limit == 0 || l.perIntervalLimit == 0) {
-			return uint64(0), int64(0), nil
+			return 0, 0, nil, false
 		}
 
 		// find the minimum timestamp
 		min := -1
 		minKey := int64(math.MaxInt64)
 		for i, k := range l.keyBuffer {
-			if k != 0 && k <= l.tmax && k < minKey && k >= l.tmin {
+			if l.valueBuffer[i] != nil && k <= l.tmax && k < minKey && k >= l.tmin {
 				min = i
 				minKey = k
 			}
@@ -438,7 +463,7 @@ func (l *LocalMapper) Next() (seriesID uint64, timestamp int64, value interface{
 
 		// return if there is no more data in this group by interval
 		if min == -1 {
-			return 0, 0, nil
+			return 0, 0, nil, false
 		}
 
 		// set the current timestamp and seriesID
@@ -448,7 +473,7 @@ func (l *LocalMapper) Next() (seriesID uint64, timestamp int64, value interface{
 		// decode either the value, or values we need. Also filter if necessary
 		var value interface{}
 		var err error
-		if l.isRaw && len(l.selectFields) > 1 {
+		if (l.isRaw && len(l.selectFields) > 1) || l.decodeAll {
 			if fieldsWithNames, err := l.decoder.DecodeFieldsWithNames(l.valueBuffer[min]); err == nil {
 				value = fieldsWithNames
 
@@ -498,10 +523,13 @@ func (l *LocalMapper) Next() (seriesID uint64, timestamp int64, value interface{
 			l.perIntervalLimit--
 		}
 
-		return seriesID, timestamp, value
+		return seriesID, timestamp, value, true
 	}
 }
 
+// Ordered returns true since the LocalMapper always yields points in time order.
+func (l *LocalMapper) Ordered() bool { return true }
+
 // IsEmpty returns true if either all cursors are nil or all cursors are past the passed in max time
 func (l *LocalMapper) IsEmpty(tmax int64) bool {
 	if l.cursorsEmpty || l.limit == 0 {
@@ -509,9 +537,9 @@ func (l *LocalMapper) IsEmpty(tmax int64) bool {
 	}
 
 	// look at the next time for each cursor
-	for _, t := range l.keyBuffer {
+	for i, t := range l.keyBuffer {
 		// if the time is less than the max, we haven't emptied this mapper yet
-		if t != 0 && t <= tmax {
+		if l.valueBuffer[i] != nil && t <= tmax {
 			return false
 		}
 	}